@@ -0,0 +1,63 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+var checkConfig string
+
+// CheckCmd validates the configured tasks and their endpoints without syncing them.
+var CheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the sync tasks and their endpoints before running",
+	Long: `Load the configuration, validate the definition of each task, build both its endpoints and check
+that they are reachable. Nothing is synced. A summary is printed for each task, and the command exits
+with an error if any task failed.
+
+Use --config to check another file than the current configuration.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if checkConfig != "" {
+			g, e := config.LoadFromPath(checkConfig)
+			if e != nil {
+				exit(e)
+			}
+			config.SetDefault(g)
+		}
+		report := endpoint.NewPreflightReport(context.Background(), config.Default().Tasks)
+		report.WriteText(cmd.OutOrStdout())
+		if n := report.Failures(); n > 0 {
+			exit(fmt.Errorf("%d tasks failed the checks", n))
+		}
+	},
+}
+
+func init() {
+	CheckCmd.Flags().StringVar(&checkConfig, "config", "", "Path to a JSON configuration file, defaults to the current configuration")
+	RootCmd.AddCommand(CheckCmd)
+}
@@ -48,8 +48,9 @@ var AddCmd = &cobra.Command{
 
 Endpoint URI support the following schemes: 
  - router: Direct connexion to Cells server running on the same machine
- - fs:     Path to a local folder
- - s3:     S3 compliant
+ - fs:     Path to a local folder, add ?symlinks=follow|skip|preserve to choose how links are synced
+ - s3:     S3 compliant, write the secret as keyring:id to read it from the OS keyring
+ - cells:  Remote Cells server (same as https), using an account logged in from the UI
  - memdb:  In-memory DB for testing purposes
 
 Direction can be:
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+var (
+	dumpOffset int
+	dumpLimit  int
+)
+
+// namedEndpoint is an offline endpoint only reporting the URI of a task endpoint.
+type namedEndpoint struct {
+	*memory.DBEndpoint
+	uri string
+}
+
+func (n *namedEndpoint) GetEndpointInfo() model.EndpointInfo {
+	info := n.DBEndpoint.GetEndpointInfo()
+	info.URI = n.uri
+	return info
+}
+
+// storeEndpoints provides endpoints for opening the patch store of a task folder without connecting to the real
+// endpoints. If the folder belongs to a configured task, they report its URIs so that directions are preserved.
+func storeEndpoints(folderPath string) (left, right model.Endpoint) {
+	for _, t := range config.Default().Tasks {
+		if t.Uuid == filepath.Base(folderPath) {
+			return &namedEndpoint{DBEndpoint: memory.NewMemDB(), uri: t.LeftURI}, &namedEndpoint{DBEndpoint: memory.NewMemDB(), uri: t.RightURI}
+		}
+	}
+	return memory.NewMemDB(), memory.NewMemDB()
+}
+
+// DumpCmd prints the content of a PatchStore as JSON.
+var DumpCmd = &cobra.Command{
+	Use:   "dump <folderPath>",
+	Short: "Print the patches stored in a task folder as JSON",
+	Long: `Open the patch store found in the given task folder in read-only mode and print its patches
+and their operations as JSON, newest first. The store is not modified, which makes it safe to run
+while the sync is stopped for attaching sync history to a bug report.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		left, right := storeEndpoints(args[0])
+		store, e := endpoint.NewPatchStoreWithOptions(args[0], left, right, endpoint.PatchStoreOptions{ReadOnly: true})
+		if e != nil {
+			exit(e)
+		}
+		defer store.Stop()
+		if e := endpoint.DumpPatches(cmd.OutOrStdout(), store, dumpOffset, dumpLimit); e != nil {
+			exit(e)
+		}
+	},
+}
+
+func init() {
+	DumpCmd.Flags().IntVar(&dumpOffset, "offset", 0, "Number of most recent patches to skip")
+	DumpCmd.Flags().IntVar(&dumpLimit, "limit", -1, "Maximum number of patches to print, all if negative")
+	RootCmd.AddCommand(DumpCmd)
+}
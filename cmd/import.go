@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+// ImportCmd restores patches exported by the dump command into a PatchStore.
+var ImportCmd = &cobra.Command{
+	Use:   "import <folderPath> <file>",
+	Short: "Restore patches exported by dump into a task folder",
+	Long: `Read patches previously exported with the dump command and write them to the patch store of the
+given task folder, preserving their UUIDs and stamps. Use "-" as file to read from the standard input.
+The sync must be stopped, as the store cannot be opened while it is running.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var reader io.Reader = os.Stdin
+		if args[1] != "-" {
+			f, e := os.Open(args[1])
+			if e != nil {
+				exit(e)
+			}
+			defer f.Close()
+			reader = f
+		}
+		left, right := storeEndpoints(args[0])
+		store, e := endpoint.NewPatchStore(args[0], left, right)
+		if e != nil {
+			exit(e)
+		}
+		defer store.Stop()
+		count, e := store.Import(reader)
+		if e != nil {
+			exit(e)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Imported %d patches\n", count)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(ImportCmd)
+}
@@ -26,10 +26,14 @@ import (
 	"runtime"
 
 	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
 
+	"github.com/pydio/cells-sync/endpoint"
 	"github.com/pydio/cells/common/log"
 )
 
+var logFormat string
+
 // RootCmd is the Cobra root command
 var RootCmd = &cobra.Command{
 	Use:   os.Args[0],
@@ -49,6 +53,13 @@ Launching without command is the same as './cells-sync start' on Mac and Windows
 		log.RegisterConsoleNamedColor("sync-task", log.ConsoleColorGrpc)
 		log.SetSkipServerSync()
 		log.Init()
+		if logFormat != "" {
+			storeLogger, e := endpoint.NewStoreLogger(logFormat, zapcore.AddSync(os.Stdout))
+			if e != nil {
+				exit(e)
+			}
+			endpoint.SetStoreLogger(storeLogger)
+		}
 
 		handleSignals()
 	},
@@ -61,3 +72,7 @@ Launching without command is the same as './cells-sync start' on Mac and Windows
 		}
 	},
 }
+
+func init() {
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "", "Write patch store logs with discrete fields to stdout, using console or json format")
+}
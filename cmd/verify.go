@@ -0,0 +1,81 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+var verifyJSON bool
+
+// VerifyCmd compares two endpoints without syncing them.
+var VerifyCmd = &cobra.Command{
+	Use:   "verify <leftUri> <rightUri>",
+	Short: "Compare two endpoints without syncing them",
+	Long: `Walk both endpoints, compute the same diff as a sync would and report the files found on one
+side only, as well as the files whose size, content hash or modification time differ. No change is
+made to any of the endpoints, which makes it safe for checking that a completed sync converged.
+
+The command exits with an error if any difference is found.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var sources []model.PathSyncSource
+		for i, uri := range args {
+			ep, e := endpoint.EndpointFromURI(uri, args[1-i])
+			if e != nil {
+				exit(e)
+			}
+			src, ok := ep.(model.PathSyncSource)
+			if !ok {
+				exit(fmt.Errorf("endpoint %s cannot be walked", uri))
+			}
+			sources = append(sources, src)
+		}
+		report, e := endpoint.Verify(context.Background(), sources[0], sources[1])
+		if e != nil {
+			exit(e)
+		}
+		if verifyJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			if e := enc.Encode(report); e != nil {
+				exit(e)
+			}
+		} else {
+			report.WriteText(cmd.OutOrStdout())
+		}
+		if !report.Converged() {
+			exit(fmt.Errorf("%d differences found", len(report.Differences)))
+		}
+	},
+}
+
+func init() {
+	VerifyCmd.Flags().BoolVar(&verifyJSON, "json", false, "Print the report as JSON")
+	RootCmd.AddCommand(VerifyCmd)
+}
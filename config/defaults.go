@@ -24,6 +24,7 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/pydio/cells/common/log"
 )
@@ -59,12 +60,52 @@ type Task struct {
 	RightURI       string
 	Direction      string
 	SelectiveRoots []string
+	// ConflictStrategy is the name of the resolver proposing resolutions for stored conflicts, see endpoint.ResolverFromName.
+	ConflictStrategy string
+	// Parallelism is the number of operations applied concurrently, for computed and replayed patches alike.
+	// When <= 1, patches are applied serially.
+	Parallelism int
+	// MinFileSize and MaxFileSize skip files out of these sizes in bytes, a zero MaxFileSize meaning no limit.
+	MinFileSize int64
+	MaxFileSize int64
+	// OversizePolicy handles files that went out of the size limits after being synced, see endpoint.ParseSizePolicy.
+	OversizePolicy string
+	// RetryMax is the number of retries of the endpoint operations failing with a transient error, zero disabling
+	// retries, see endpoint.NewRetryTarget. RetryDelay is the wait before the first retry, doubled at each attempt,
+	// as a duration string, 500ms if empty.
+	RetryMax   int
+	RetryDelay string
+	// ListingCacheSize is the number of folder listings cached per endpoint, zero disabling the cache.
+	// ListingCacheTTL expires the cached listings, as a duration string, never when empty.
+	ListingCacheSize int
+	ListingCacheTTL  string
+	// DeletionPolicy tells how deletions are applied to the endpoints, see endpoint.ParseDeletionPolicy.
+	// TrashRetention is the age after which trashed nodes are purged, as a duration string, never when empty.
+	DeletionPolicy string
+	TrashRetention string
+	// VerifyChecksums reads each transferred file back from its target, failing the transfer if its sha256
+	// checksum differs from the sent data, see endpoint.NewVerifiedTarget.
+	VerifyChecksums bool
+	// SyncSystemFiles disables endpoint.DefaultIgnorePatterns, so that files created by operating systems and
+	// desktop applications are synced too. Patterns of the .syncignore files of the endpoints still apply.
+	SyncSystemFiles bool
 
 	Realtime       bool
 	RealtimePaused bool
 
 	LoopInterval string
 	HardInterval string
+	// SyncWindows restricts the times when the task is running, see control.WindowSchedule. Empty means always.
+	SyncWindows []*SyncWindow
+}
+
+// SyncWindow is a daily time range in local time, formatted as "15:04". If End is before Start,
+// the window crosses midnight and ends on the next day. Days lists the week days when the window
+// starts, all days if empty.
+type SyncWindow struct {
+	Days  []time.Weekday
+	Start string
+	End   string
 }
 
 // Logs represents the logs configuration.
@@ -264,7 +305,7 @@ func (g *Global) Items() (items []string) {
 		} else if t.Direction == "Right" {
 			dir = "<="
 		}
-		items = append(items, t.LeftURI+" "+dir+" "+t.RightURI)
+		items = append(items, RedactURI(t.LeftURI)+" "+dir+" "+RedactURI(t.RightURI))
 	}
 	return
 }
@@ -302,6 +343,14 @@ func Default() *Global {
 	return def
 }
 
+// SetDefault replaces the config returned by Default, e.g. with one read by LoadFromPath.
+func SetDefault(g *Global) {
+	for _, a := range g.Authorities {
+		a.AfterLoad()
+	}
+	def = g
+}
+
 // Save writes the config to the JSON file.
 func Save() error {
 	// Copy def and update Authorities before saving
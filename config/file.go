@@ -31,7 +31,12 @@ func getPath() string {
 
 // LoadFromFile loads a Global config from a JSON file.
 func LoadFromFile() (*Global, error) {
-	data, err := ioutil.ReadFile(getPath())
+	return LoadFromPath(getPath())
+}
+
+// LoadFromPath loads a Global config from the JSON file at path.
+func LoadFromPath(path string) (*Global, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -21,6 +21,7 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/zalando/go-keyring"
@@ -31,6 +32,8 @@ import (
 var (
 	keyringService = "com.pydio.CellsSync"
 	tokenSeparator = "__//__"
+	// keyringPrefixes mark a password of an endpoint URI as a reference to a credential stored in the keyring.
+	keyringPrefixes = []string{"keyring://", "keyring:"}
 )
 
 // AuthToKeyring tries to store tokens in local keychain and remove them from the conf
@@ -78,3 +81,68 @@ func ClearKeyring(a *Authority) error {
 	}
 	return err
 }
+
+// CredentialToKeyring stores an endpoint secret in local keychain, to be referenced as keyring:id in the
+// password of the endpoint URI.
+func CredentialToKeyring(id, secret string) error {
+	return keyring.Set(keyringService, id+"::Credential", secret)
+}
+
+// CredentialFromKeyring loads an endpoint secret stored by CredentialToKeyring.
+func CredentialFromKeyring(id string) (string, error) {
+	secret, e := keyring.Get(keyringService, id+"::Credential")
+	if e != nil {
+		return "", fmt.Errorf("cannot find credential %s in keyring: %v", id, e)
+	}
+	return secret, nil
+}
+
+// keyringReference returns the credential id referenced by password, if any.
+func keyringReference(password string) (string, bool) {
+	for _, prefix := range keyringPrefixes {
+		if strings.HasPrefix(password, prefix) {
+			return strings.TrimPrefix(password, prefix), true
+		}
+	}
+	return "", false
+}
+
+// ResolveURICredentials returns a copy of u where a password like keyring:id (or keyring://id once escaped) is
+// replaced by the secret stored in the keyring under id. Other URIs are returned as is.
+func ResolveURICredentials(u *url.URL) (*url.URL, error) {
+	if u.User == nil {
+		return u, nil
+	}
+	password, _ := u.User.Password()
+	id, ok := keyringReference(password)
+	if !ok {
+		return u, nil
+	}
+	secret, e := CredentialFromKeyring(id)
+	if e != nil {
+		return nil, e
+	}
+	resolved := *u
+	resolved.User = url.UserPassword(u.User.Username(), secret)
+	return &resolved, nil
+}
+
+// RedactURI hides the password of uri, unless it is a keyring reference, so that it can be logged or displayed.
+func RedactURI(uri string) string {
+	u, e := url.Parse(uri)
+	if e != nil {
+		if i := strings.Index(uri, "://"); i > 0 {
+			return uri[:i] + "://[redacted]"
+		}
+		return "[redacted]"
+	}
+	if u.User == nil {
+		return uri
+	}
+	if password, ok := u.User.Password(); ok {
+		if _, ref := keyringReference(password); !ref {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	return u.String()
+}
@@ -44,6 +44,8 @@ func init() {
 
 var (
 	oidcContext = servicecontext.WithServiceName(context.Background(), "oidc")
+	// refreshLock serializes token refreshes, as a refresh token can only be used once
+	refreshLock sync.Mutex
 )
 
 // Authority represent an active account where user has logged in using the OpenID Connect workflow.
@@ -96,7 +98,10 @@ func (a *Authority) RefreshRequired() (in time.Duration, now bool) {
 }
 
 // Refresh uses the RefreshToken to ask for a new IdToken/AccessToken/RefreshToken truple.
+// Concurrent calls are serialized, so that each one uses the RefreshToken renewed by the previous one.
 func (a *Authority) Refresh() error {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
 
 	log.Logger(oidcContext).Info("Refreshing token for " + a.URI)
 	data := url.Values{}
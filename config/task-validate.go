@@ -0,0 +1,74 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Validate checks the fields of a task definition, without building nor contacting its endpoints.
+func (t *Task) Validate() error {
+	for i, uri := range []string{t.LeftURI, t.RightURI} {
+		side := [2]string{"left", "right"}[i]
+		if uri == "" {
+			return fmt.Errorf("missing %s endpoint URI", side)
+		}
+		if u, e := url.Parse(uri); e != nil || u.Scheme == "" {
+			return fmt.Errorf("invalid %s endpoint URI %s", side, RedactURI(uri))
+		}
+	}
+	switch t.Direction {
+	case "Bi", "Left", "Right":
+	default:
+		return fmt.Errorf("unsupported direction type %s, please use one of Bi, Left, Right", t.Direction)
+	}
+	if t.MinFileSize < 0 || t.MaxFileSize < 0 {
+		return fmt.Errorf("file size limits cannot be negative")
+	}
+	if t.MaxFileSize > 0 && t.MaxFileSize < t.MinFileSize {
+		return fmt.Errorf("maximum file size %d is lower than minimum file size %d", t.MaxFileSize, t.MinFileSize)
+	}
+	if t.ListingCacheSize < 0 {
+		return fmt.Errorf("listing cache size cannot be negative")
+	}
+	if t.ListingCacheTTL != "" {
+		if _, e := time.ParseDuration(t.ListingCacheTTL); e != nil {
+			return fmt.Errorf("invalid listing cache TTL %s", t.ListingCacheTTL)
+		}
+	}
+	if t.RetryMax < 0 {
+		return fmt.Errorf("number of retries cannot be negative")
+	}
+	if t.RetryDelay != "" {
+		if _, e := time.ParseDuration(t.RetryDelay); e != nil {
+			return fmt.Errorf("invalid retry delay %s", t.RetryDelay)
+		}
+	}
+	for _, w := range t.SyncWindows {
+		for _, value := range []string{w.Start, w.End} {
+			if _, e := time.Parse("15:04", value); e != nil {
+				return fmt.Errorf("invalid sync window time %s, please use the 15:04 format", value)
+			}
+		}
+	}
+	return nil
+}
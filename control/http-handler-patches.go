@@ -74,7 +74,7 @@ func (h *HttpServer) parsePatchRequest(c *gin.Context) (*PatchesRequest, error)
 }
 
 // reqRespStore uses a Pub/Sub model to synchronously retrieve a pointer to the PatchStore of a sync.
-func (h *HttpServer) reqRespStore(syncUUID string) (store *endpoint.PatchStore, err error) {
+func (h *HttpServer) reqRespStore(syncUUID string) (store endpoint.PatchStore, err error) {
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -87,7 +87,7 @@ func (h *HttpServer) reqRespStore(syncUUID string) (store *endpoint.PatchStore,
 		for {
 			select {
 			case s := <-ch:
-				if data, ok := s.(*endpoint.PatchStore); ok {
+				if data, ok := s.(endpoint.PatchStore); ok {
 					store = data
 				} else if er, ok := s.(error); ok {
 					err = er
@@ -119,7 +119,7 @@ func (h *HttpServer) listPatches(c *gin.Context) {
 		h.writeError(c, e)
 		return
 	}
-	patches, err := store.Load(request.Offset, request.Limit)
+	patches, err := store.LoadContext(c.Request.Context(), request.Offset, request.Limit)
 	if err != nil {
 		h.writeError(c, err)
 		return
@@ -134,3 +134,18 @@ func (h *HttpServer) listPatches(c *gin.Context) {
 	c.JSON(http.StatusOK, data)
 
 }
+
+// serveStore forwards requests under /sync/:uuid to the JSON API of the sync PatchStore (see endpoint.NewPatchStoreHandler).
+func (h *HttpServer) serveStore(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	store, e := h.reqRespStore(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	http.StripPrefix("/sync/"+request.SyncUUID, endpoint.NewPatchStoreHandler(store)).ServeHTTP(c.Writer, c.Request)
+}
@@ -47,6 +47,7 @@ import (
 type HttpServer struct {
 	WebSocket          *melody.Melody
 	LogSocket          *melody.Melody
+	ProgressSocket     *ProgressSocket
 	logSocketConnected bool
 
 	done          chan bool
@@ -115,6 +116,8 @@ func (h *HttpServer) InitHandlers() {
 		}
 	})
 
+	h.ProgressSocket = NewProgressSocket()
+
 	h.WebSocket = melody.New()
 	h.WebSocket.Config.MaxMessageSize = 2048
 
@@ -318,10 +321,13 @@ func (h *HttpServer) Serve() {
 	Server.GET("/logs", func(c *gin.Context) {
 		h.LogSocket.HandleRequest(c.Writer, c.Request)
 	})
+	Server.GET("/progress", func(c *gin.Context) {
+		h.ProgressSocket.ServeHTTP(c.Writer, c.Request)
+	})
 	// Simple RestAPI for browsing/creating nodes inside Endpoints
 	Server.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"PUT", "POST"},
+		AllowMethods:     []string{"PUT", "POST", "DELETE"},
 		AllowHeaders:     []string{"*"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -334,6 +340,8 @@ func (h *HttpServer) Serve() {
 
 	// Load Patch contents
 	Server.GET("/patches/:uuid/:offset/:limit", h.listPatches)
+	// Patch store API and health check of a sync
+	Server.Any("/sync/:uuid/*path", h.serveStore)
 
 	// Manage global config
 	Server.GET("/config", h.loadConf)
@@ -348,4 +356,7 @@ func (h *HttpServer) Serve() {
 // Stop implements supervisor service interface.
 func (h *HttpServer) Stop() {
 	h.done <- true
+	if h.ProgressSocket != nil {
+		h.ProgressSocket.Close()
+	}
 }
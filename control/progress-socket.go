@@ -0,0 +1,228 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/olahol/melody.v1"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// JobStatus describes the progress of the patch currently applied by a sync task.
+type JobStatus struct {
+	Processed        int
+	Total            int
+	BytesTransferred int64
+	TotalBytes       int64
+	// Throughput is the average transfer rate since the patch started, in bytes per second.
+	Throughput float64
+	// ETA is the estimated remaining time, based on transferred bytes when the patch size is known,
+	// on processed operations otherwise.
+	ETA time.Duration
+	// Elapsed is the time spent applying the patch so far.
+	Elapsed time.Duration
+}
+
+// ProgressMessage is sent to progress WebSocket clients while a patch is applied.
+type ProgressMessage struct {
+	JobStatus
+	SyncUUID    string
+	Progress    float32
+	CurrentFile string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+	Done        bool
+}
+
+// ProgressTracker converts the processing statuses of a sync task into ProgressMessages published on the bus.
+// Patches applied by the syncer processor call Start when they begin and Transferred for each written chunk, so
+// that throughput and ETA are computed from bytes.
+type ProgressTracker struct {
+	sync.Mutex
+	syncUUID string
+	status   JobStatus
+	started  time.Time
+	// Now gives the current time, time.Now if nil.
+	Now func() time.Time
+}
+
+// NewProgressTracker creates a ProgressTracker for a given sync task.
+func NewProgressTracker(syncUUID string) *ProgressTracker {
+	return &ProgressTracker{syncUUID: syncUUID}
+}
+
+func (t *ProgressTracker) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Start resets the counters for a new patch of totalOps operations and totalBytes bytes (zero when unknown).
+func (t *ProgressTracker) Start(totalOps int, totalBytes int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.status = JobStatus{Total: totalOps, TotalBytes: totalBytes}
+	t.started = t.now()
+}
+
+// Transferred records bytes written to an endpoint for the current patch.
+func (t *ProgressTracker) Transferred(bytes int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.started.IsZero() {
+		t.started = t.now()
+	}
+	t.status.BytesTransferred += bytes
+}
+
+// JobStatus computes the current status, including throughput and ETA.
+func (t *ProgressTracker) JobStatus() JobStatus {
+	t.Lock()
+	defer t.Unlock()
+	return t.computeStatus()
+}
+
+// computeStatus must be called with the lock held.
+func (t *ProgressTracker) computeStatus() JobStatus {
+	status := t.status
+	if t.started.IsZero() {
+		return status
+	}
+	elapsed := t.now().Sub(t.started)
+	if elapsed <= 0 {
+		return status
+	}
+	status.Elapsed = elapsed
+	status.Throughput = float64(status.BytesTransferred) / elapsed.Seconds()
+	if status.TotalBytes > 0 && status.BytesTransferred > 0 {
+		// Content transfers dominate: use bytes
+		remaining := status.TotalBytes - status.BytesTransferred
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.ETA = time.Duration(float64(remaining) / status.Throughput * float64(time.Second))
+	} else if status.Total > 0 && status.Processed > 0 {
+		// Mostly structural patch: use operations count
+		remaining := status.Total - status.Processed
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.ETA = time.Duration(float64(elapsed) * float64(remaining) / float64(status.Processed))
+	}
+	return status
+}
+
+// Status publishes a progress message for a processing status. Statuses carrying a node are counted as processed
+// operations. If the total was not set by Start, it is estimated from the overall progress.
+func (t *ProgressTracker) Status(status model.Status) {
+	t.Lock()
+	if t.started.IsZero() {
+		t.started = t.now()
+	}
+	msg := ProgressMessage{
+		SyncUUID: t.syncUUID,
+		Progress: status.Progress(),
+	}
+	if n := status.Node(); n != nil {
+		t.status.Processed++
+		msg.CurrentFile = n.Path
+	}
+	msg.JobStatus = t.computeStatus()
+	if msg.Total == 0 && msg.Progress > 0 {
+		msg.Total = int(float32(msg.Processed)/msg.Progress + 0.5)
+	}
+	if status.IsError() && status.Error() != nil {
+		msg.Error = status.Error().Error()
+	}
+	t.Unlock()
+	GetBus().Pub(msg, TopicProgress)
+}
+
+// Done publishes the completion message of a patch, resets the counters and returns the time spent applying it.
+func (t *ProgressTracker) Done(patch merger.Patch) time.Duration {
+	t.Lock()
+	status := t.computeStatus()
+	t.status = JobStatus{}
+	t.started = time.Time{}
+	t.Unlock()
+	status.Processed = patch.Size()
+	status.Total = patch.Size()
+	status.ETA = 0
+	msg := ProgressMessage{
+		JobStatus: status,
+		SyncUUID:  t.syncUUID,
+		Progress:  1,
+		Done:      true,
+	}
+	if errs, ok := patch.HasErrors(); ok {
+		msg.Error = errs[0].Error()
+	}
+	GetBus().Pub(msg, TopicProgress)
+	return status.Elapsed
+}
+
+// ProgressSocket broadcasts ProgressMessages published on the bus to all connected WebSocket clients.
+// Slow or disconnected clients are dropped by melody and never block the sync.
+type ProgressSocket struct {
+	socket *melody.Melody
+	sub    chan interface{}
+}
+
+// NewProgressSocket creates a ProgressSocket and starts listening to the bus.
+func NewProgressSocket() *ProgressSocket {
+	p := &ProgressSocket{
+		socket: melody.New(),
+		sub:    GetBus().Sub(TopicProgress),
+	}
+	p.socket.Config.MaxMessageSize = 2048
+	p.socket.HandleClose(func(session *melody.Session, i int, i2 string) error {
+		session.Close()
+		return nil
+	})
+	go p.listen()
+	return p
+}
+
+func (p *ProgressSocket) listen() {
+	for m := range p.sub {
+		if msg, ok := m.(ProgressMessage); ok {
+			if data, e := json.Marshal(msg); e == nil {
+				p.socket.Broadcast(data)
+			}
+		}
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection.
+func (p *ProgressSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.socket.HandleRequest(w, r)
+}
+
+// Close unsubscribes from the bus and closes all client connections.
+func (p *ProgressSocket) Close() {
+	GetBus().Unsub(p.sub)
+	p.socket.Close()
+}
@@ -30,12 +30,13 @@ var (
 )
 
 const (
-	TopicGlobal  = "cmd"
-	TopicSyncAll = "sync"
-	TopicSync_   = "sync-"
-	TopicState   = "state"
-	TopicStore_  = "store"
-	TopicUpdate  = "update"
+	TopicGlobal   = "cmd"
+	TopicSyncAll  = "sync"
+	TopicSync_    = "sync-"
+	TopicState    = "state"
+	TopicStore_   = "store"
+	TopicUpdate   = "update"
+	TopicProgress = "progress"
 )
 
 type CommandMessage int
@@ -55,6 +56,8 @@ const (
 	MessagePublishStore
 	MessageRestartClean // Restart an clean snapshots
 	MessageHaltClean    // Halt task and remove all configs
+	MessageResyncClean  // Clear snapshots and reconcile endpoints from scratch
+	MessageSyncWindow   // Sync windows of the task opened or closed
 )
 
 func init() {
@@ -76,6 +79,9 @@ func MessageFromString(text string) (int, error) {
 	case "resync":
 		// Full resync
 		return MessageResync, nil
+	case "rebuild":
+		// Resync from scratch, clearing snapshots
+		return MessageResyncClean, nil
 	case "dry":
 		// Full resync with dry run
 		return MessageResyncDry, nil
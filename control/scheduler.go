@@ -21,8 +21,10 @@ package control
 
 import (
 	"context"
+	"time"
 
 	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
 	"github.com/pydio/cells/common/log"
 	servicecontext "github.com/pydio/cells/common/service/context"
 	"github.com/pydio/cells/common/utils/schedule"
@@ -34,6 +36,10 @@ type Scheduler struct {
 	tickers []*schedule.Ticker
 	logCtx  context.Context
 	stop    chan bool
+
+	// Clock and After drive the sync windows, they default to time.Now and time.After.
+	Clock endpoint.Clock
+	After func(d time.Duration) <-chan time.Time
 }
 
 // NewScheduler creates a scheduler and register the schedules from the tasks configs.
@@ -44,6 +50,8 @@ func NewScheduler(tasks []*config.Task) *Scheduler {
 		tasks:  tasks,
 		logCtx: ctx,
 		stop:   make(chan bool, 1),
+		Clock:  endpoint.RealClock{},
+		After:  time.After,
 	}
 }
 
@@ -78,10 +86,38 @@ func (s *Scheduler) Serve() {
 				log.Logger(s.logCtx).Error("Cannot parse interval as duration :" + e.Error())
 			}
 		}
+		if len(t.SyncWindows) > 0 {
+			if w, e := NewWindowSchedule(t.SyncWindows); e == nil {
+				log.Logger(s.logCtx).Info("Starting sync windows for task - " + t.Label)
+				go s.watchWindows(t.Uuid, w)
+			} else {
+				log.Logger(s.logCtx).Error("Cannot parse sync windows :" + e.Error())
+			}
+		}
 	}
 	<-s.stop
 }
 
+// watchWindows notifies the task each time its windows open or close. The syncer checks the windows itself
+// when it starts and before each run, so that a notification published before it subscribed is not missed.
+func (s *Scheduler) watchWindows(taskUuid string, windows *WindowSchedule) {
+	for {
+		now := s.Clock.Now()
+		next := windows.NextChange(now)
+		if next.IsZero() {
+			<-s.stop
+			return
+		}
+		select {
+		case <-s.After(next.Sub(now)):
+		case <-s.stop:
+			return
+		}
+		log.Logger(s.logCtx).Info("Sync windows changed for task " + taskUuid)
+		GetBus().Pub(MessageSyncWindow, TopicSync_+taskUuid)
+	}
+}
+
 // Stop implements supervisor service interface.
 func (s *Scheduler) Stop() {
 	log.Logger(s.logCtx).Info("Stopping all tickers")
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+type syncWindow struct {
+	days       map[time.Weekday]bool
+	start, end time.Duration
+}
+
+// WindowSchedule tells whether a task is allowed to run at a given time, based on a set of daily windows.
+type WindowSchedule struct {
+	// Location is the timezone used to read the windows, time.Local by default.
+	Location *time.Location
+	windows  []syncWindow
+}
+
+// NewWindowSchedule parses the windows of a task configuration.
+func NewWindowSchedule(windows []*config.SyncWindow) (*WindowSchedule, error) {
+	s := &WindowSchedule{Location: time.Local}
+	for _, w := range windows {
+		start, e := parseClock(w.Start)
+		if e != nil {
+			return nil, e
+		}
+		end, e := parseClock(w.End)
+		if e != nil {
+			return nil, e
+		}
+		if end <= start {
+			end += 24 * time.Hour
+		}
+		sw := syncWindow{start: start, end: end}
+		if len(w.Days) > 0 {
+			sw.days = make(map[time.Weekday]bool, len(w.Days))
+			for _, d := range w.Days {
+				sw.days[d] = true
+			}
+		}
+		s.windows = append(s.windows, sw)
+	}
+	return s, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	t, e := time.Parse("15:04", value)
+	if e != nil {
+		return 0, fmt.Errorf("invalid window time %q, please use HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active tells whether t falls inside one of the windows. A schedule without windows is always active.
+func (s *WindowSchedule) Active(t time.Time) bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+	t = t.In(s.Location)
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.Location)
+	for _, w := range s.windows {
+		// Check windows started today and yesterday, as they may cross midnight
+		for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+			if w.days != nil && !w.days[day.Weekday()] {
+				continue
+			}
+			if !t.Before(clockOn(day, w.start)) && t.Before(clockOn(day, w.end)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clockOn returns the wall clock time d on day, so that DST changes do not shift windows.
+func clockOn(day time.Time, d time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// NextChange returns the first minute after t when Active changes value, or a zero time if it
+// does not change within a week.
+func (s *WindowSchedule) NextChange(t time.Time) time.Time {
+	current := s.Active(t)
+	next := t.Truncate(time.Minute)
+	for i := 0; i <= 7*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.Active(next) != current {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -52,11 +53,21 @@ type Syncer struct {
 	serviceCtx   context.Context
 	configPath   string
 	stateStore   StateStore
-	patchStore   *endpoint.PatchStore
+	patchStore   endpoint.PatchStore
+	progress     *ProgressTracker
 	snapFactory  model.SnapshotFactory
 	taskPaused   bool
+	windows      *WindowSchedule
+	windowClosed bool
+	clock        endpoint.Clock
 	lastPatch    merger.Patch
 	dirtyStopped bool
+	direction    model.DirectionType
+
+	// processor applies the patches computed by the task, see run
+	processor    *endpoint.ParallelProcessor
+	applyLock    sync.Mutex
+	applyPending bool
 
 	cleanSnapsAfterStop bool
 	cleanAllAfterStop   bool
@@ -120,8 +131,111 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 		return
 	}
 
+	if conf.RetryMax > 0 {
+		retryOptions := endpoint.RetryOptions{MaxRetries: conf.RetryMax}
+		if conf.RetryDelay != "" {
+			if retryOptions.InitialDelay, err = time.ParseDuration(conf.RetryDelay); err != nil {
+				startError = errors.Wrap(err, "invalid retry delay")
+				return
+			}
+		}
+		if left, ok := leftEndpoint.(model.PathSyncTarget); ok {
+			leftEndpoint = endpoint.NewRetryTarget(left, retryOptions)
+		}
+		if right, ok := rightEndpoint.(model.PathSyncTarget); ok {
+			rightEndpoint = endpoint.NewRetryTarget(right, retryOptions)
+		}
+	}
+
+	leftEndpoint, rightEndpoint, ignores, err := endpoint.ApplyIgnorePatterns(ctx, leftEndpoint, rightEndpoint, !conf.SyncSystemFiles)
+	if err != nil {
+		log.Logger(ctx).Warn("Cannot read ignore patterns: " + err.Error())
+	}
+
+	if conf.DeletionPolicy != "" {
+		policy, err := endpoint.ParseDeletionPolicy(conf.DeletionPolicy)
+		if err != nil {
+			startError = err
+			return
+		}
+		trashOptions := endpoint.TrashOptions{}
+		if conf.TrashRetention != "" {
+			if trashOptions.Retention, err = time.ParseDuration(conf.TrashRetention); err != nil {
+				startError = errors.Wrap(err, "invalid trash retention")
+				return
+			}
+		}
+		if left, ok := leftEndpoint.(model.PathSyncTarget); ok {
+			if leftEndpoint, err = endpoint.NewTrashTarget(left, policy, trashOptions); err != nil {
+				startError = errors.Wrap(err, "cannot apply deletion policy to left endpoint")
+				return
+			}
+		}
+		if right, ok := rightEndpoint.(model.PathSyncTarget); ok {
+			if rightEndpoint, err = endpoint.NewTrashTarget(right, policy, trashOptions); err != nil {
+				startError = errors.Wrap(err, "cannot apply deletion policy to right endpoint")
+				return
+			}
+		}
+	}
+
+	if conf.VerifyChecksums {
+		if left, ok := leftEndpoint.(model.PathSyncTarget); ok {
+			if leftEndpoint, err = endpoint.NewVerifiedTarget(left, "sha256"); err != nil {
+				startError = errors.Wrap(err, "cannot verify checksums on left endpoint")
+				return
+			}
+		}
+		if right, ok := rightEndpoint.(model.PathSyncTarget); ok {
+			if rightEndpoint, err = endpoint.NewVerifiedTarget(right, "sha256"); err != nil {
+				startError = errors.Wrap(err, "cannot verify checksums on right endpoint")
+				return
+			}
+		}
+	}
+
+	if conf.MinFileSize > 0 || conf.MaxFileSize > 0 {
+		policy, err := endpoint.ParseSizePolicy(conf.OversizePolicy)
+		if err != nil {
+			startError = err
+			return
+		}
+		limits := endpoint.SizeLimits{Min: conf.MinFileSize, Max: conf.MaxFileSize, Policy: policy}
+		leftSource, _ := leftEndpoint.(model.PathSyncSource)
+		rightSource, _ := rightEndpoint.(model.PathSyncSource)
+		left, err := endpoint.NewSizeFilteredEndpoint(leftEndpoint, rightSource, limits)
+		if err != nil {
+			startError = errors.Wrap(err, "cannot apply size limits to left endpoint")
+			return
+		}
+		right, err := endpoint.NewSizeFilteredEndpoint(rightEndpoint, leftSource, limits)
+		if err != nil {
+			startError = errors.Wrap(err, "cannot apply size limits to right endpoint")
+			return
+		}
+		leftEndpoint, rightEndpoint = left, right
+	}
+
+	if conf.ListingCacheSize > 0 {
+		cacheOptions := endpoint.ListingCacheOptions{Size: conf.ListingCacheSize}
+		if conf.ListingCacheTTL != "" {
+			if cacheOptions.TTL, err = time.ParseDuration(conf.ListingCacheTTL); err != nil {
+				startError = errors.Wrap(err, "invalid listing cache TTL")
+				return
+			}
+		}
+		if leftEndpoint, err = endpoint.NewListingCache(leftEndpoint, cacheOptions); err != nil {
+			startError = errors.Wrap(err, "cannot cache left endpoint listings")
+			return
+		}
+		if rightEndpoint, err = endpoint.NewListingCache(rightEndpoint, cacheOptions); err != nil {
+			startError = errors.Wrap(err, "cannot cache right endpoint listings")
+			return
+		}
+	}
+
 	syncTask := task.NewSync(leftEndpoint, rightEndpoint, direction)
-	syncTask.SetFilters(conf.SelectiveRoots, []string{"**/.git**", "**/.pydio"})
+	syncTask.SetFilters(conf.SelectiveRoots, append([]string{"**/.git**", "**/.pydio"}, ignores...))
 
 	if _, er := os.Stat(configPath); er != nil && os.IsNotExist(er) {
 		if er := os.MkdirAll(configPath, 0755); er != nil {
@@ -131,16 +245,45 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 	}
 
 	syncer.task = syncTask
+	syncer.direction = direction
 	syncer.watches = conf.Realtime
 	if conf.RealtimePaused {
 		syncer.taskPaused = true
 	}
+	syncer.clock = endpoint.RealClock{}
+	if len(conf.SyncWindows) > 0 {
+		if windows, err := NewWindowSchedule(conf.SyncWindows); err == nil {
+			syncer.windows = windows
+		} else {
+			log.Logger(ctx).Error("Cannot parse sync windows: " + err.Error())
+		}
+	}
 	syncer.eventsChan = make(chan interface{})
 	syncer.patchStatus = make(chan model.Status)
 	syncer.patchDone = make(chan interface{})
 	syncer.cmd = model.NewCommand()
+	syncer.progress = NewProgressTracker(conf.Uuid)
 
-	if patchStore, err := endpoint.NewPatchStore(configPath, leftEndpoint, rightEndpoint); err == nil {
+	storeOptions := endpoint.PatchStoreOptions{}
+	if resolver, err := endpoint.ResolverFromName(conf.ConflictStrategy); err == nil {
+		storeOptions.Resolver = resolver
+	} else {
+		log.Logger(ctx).Error("Cannot use conflict strategy: " + err.Error())
+	}
+	// Patches are always applied by the syncer processor, serially by default, so that the reasons of their
+	// operations are explained before they modify the endpoints
+	parallelism := conf.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	syncer.processor = endpoint.NewParallelProcessor(parallelism)
+	syncer.processor.OnStatus = func(status model.Status) {
+		syncer.patchStatus <- status
+	}
+	syncer.processor.OnTransferred = syncer.progress.Transferred
+	storeOptions.Processor = syncer.processor
+	storeOptions.Events, storeOptions.EventsTask = endpoint.DefaultEventBus(), conf.Uuid
+	if patchStore, err := endpoint.NewPatchStoreWithOptions(configPath, leftEndpoint, rightEndpoint, storeOptions); err == nil {
 		syncer.patchStore = patchStore
 		syncTask.SetPatchListener(syncer.patchStore)
 
@@ -152,6 +295,149 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 
 }
 
+// JobStatus returns the progress of the patch currently applied, if any.
+func (s *Syncer) JobStatus() JobStatus {
+	if s.progress == nil {
+		return JobStatus{}
+	}
+	return s.progress.JobStatus()
+}
+
+// CheckConnection probes both endpoints of the task and returns an error for each unreachable one. An
+// EndpointUnreachable event is published for each of them.
+func (s *Syncer) CheckConnection(ctx context.Context) []error {
+	if s.task == nil {
+		return nil
+	}
+	errs := endpoint.CheckEndpoints(ctx, s.task.Source, s.task.Target)
+	for _, e := range errs {
+		if unreachable, ok := e.(*endpoint.UnreachableError); ok {
+			endpoint.DefaultEventBus().Publish(endpoint.EndpointUnreachable{Task: s.uuid, Err: unreachable})
+		}
+	}
+	return errs
+}
+
+// run publishes a SyncStarted event and runs the task. The task only computes the patch, which is applied by the
+// processor once received by dispatchStatus.
+func (s *Syncer) run(ctx context.Context, dryRun bool, force bool) {
+	s.updateWindow(ctx)
+	if s.windowClosed && !dryRun {
+		log.Logger(ctx).Info("Outside of the sync windows, not running task")
+		GetBus().Pub(s.stateStore.UpdateSyncStatus(model.TaskStatusPaused), TopicState)
+		return
+	}
+	endpoint.DefaultEventBus().Publish(endpoint.SyncStarted{Task: s.uuid, Resync: force, DryRun: dryRun})
+	if s.processor != nil && !dryRun {
+		s.setApplyPending(true)
+		dryRun = true
+	}
+	s.task.Run(ctx, dryRun, force)
+}
+
+// updateWindow checks whether the task is inside its sync windows, pausing it when they close and resuming it
+// when they open. The window pause is kept apart from taskPaused: it is not saved in the configuration, and a
+// manually paused task stays paused when its windows open. It returns true if the windows just opened.
+func (s *Syncer) updateWindow(ctx context.Context) (opened bool) {
+	if s.windows == nil {
+		return false
+	}
+	closed := !s.windows.Active(s.clock.Now())
+	if closed == s.windowClosed {
+		return false
+	}
+	s.windowClosed = closed
+	if s.taskPaused {
+		return false
+	}
+	if closed {
+		log.Logger(ctx).Info("Sync window closed, pausing task")
+		s.task.Pause(ctx)
+		GetBus().Pub(s.stateStore.UpdateSyncStatus(model.TaskStatusPaused), TopicState)
+		return false
+	}
+	log.Logger(ctx).Info("Sync window opened, resuming task")
+	if s.watches {
+		s.task.Resume(ctx)
+	}
+	GetBus().Pub(s.stateStore.UpdateSyncStatus(model.TaskStatusIdle), TopicState)
+	return true
+}
+
+func (s *Syncer) setApplyPending(pending bool) {
+	s.applyLock.Lock()
+	s.applyPending = pending
+	s.applyLock.Unlock()
+}
+
+// takeApplyPending tells whether the next patch received from the task must be applied, and resets the flag.
+func (s *Syncer) takeApplyPending() bool {
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+	pending := s.applyPending
+	s.applyPending = false
+	return pending
+}
+
+// apply processes a patch computed by the task, then hands it back to dispatchStatus as if the task had applied
+// it. Target files that differ from versions raise conflicts instead of being overwritten. The snapshots of
+// bidirectional tasks are captured again, as the task does after processing.
+func (s *Syncer) apply(ctx context.Context, patch merger.Patch, versions *endpoint.TargetVersions) {
+	if patch.Size() > 0 {
+		summary := endpoint.SummarizePatch(patch)
+		s.progress.Start(summary.Total(), summary.Bytes)
+		s.processor.ProcessWithVersions(patch, s.cmd, versions)
+		if s.direction == model.DirectionBi && s.snapFactory != nil {
+			for _, side := range []model.Endpoint{s.task.Source, s.task.Target} {
+				source, ok := side.(model.PathSyncSource)
+				if !ok {
+					continue
+				}
+				if snap, e := s.snapFactory.Load(source); e != nil {
+					log.Logger(ctx).Error("Cannot load snapshot: " + e.Error())
+				} else if e := snap.Capture(ctx, source); e != nil {
+					log.Logger(ctx).Error("Cannot capture snapshot: " + e.Error())
+				}
+			}
+		}
+	}
+	s.patchDone <- patch
+}
+
+// purgeTrash removes the expired trash folders of the endpoints applying a deletion policy.
+func (s *Syncer) purgeTrash(ctx context.Context) {
+	for _, ep := range []model.Endpoint{s.task.Source, s.task.Target} {
+		trash := endpoint.FindTrashTarget(ep)
+		if trash == nil {
+			continue
+		}
+		if purged, e := trash.PurgeTrash(ctx); e != nil {
+			log.Logger(ctx).Error("Cannot purge trash: " + e.Error())
+		} else if purged > 0 {
+			log.Logger(ctx).Info(fmt.Sprintf("Purged %d expired trash folders", purged))
+		}
+	}
+}
+
+// reApply replays the last patch that had errors, through the patch store when it supports retries.
+func (s *Syncer) reApply(ctx context.Context) {
+	retrier, ok := s.patchStore.(interface {
+		Retry(uuid string) (merger.Patch, error)
+	})
+	if s.processor == nil || !ok {
+		s.task.ReApplyPatch(ctx, s.lastPatch)
+		return
+	}
+	go func() {
+		retried, e := retrier.Retry(s.lastPatch.GetUUID())
+		if e != nil {
+			log.Logger(ctx).Error("Cannot re-apply last patch: " + e.Error())
+			return
+		}
+		s.patchDone <- retried
+	}()
+}
+
 func (s *Syncer) dispatchStatus(ctx context.Context) {
 
 	for {
@@ -172,22 +458,31 @@ func (s *Syncer) dispatchStatus(ctx context.Context) {
 				log.Logger(ctx).Debug(msg)
 			}
 			s.stateStore.UpdateProcessStatus(l, status)
+			s.progress.Status(l)
 
 		case data, ok := <-s.patchDone:
 			if !ok {
 				return
 			}
 			var idleStatus = model.TaskStatusIdle
-			if s.taskPaused {
+			if s.taskPaused || s.windowClosed {
 				idleStatus = model.TaskStatusPaused
 			}
 			deferIdle := true
 			stateStore := s.stateStore
+			if patch, ok := data.(merger.Patch); ok && s.takeApplyPending() {
+				// Versions and reasons are captured before the patch modifies the endpoints
+				go func() {
+					s.apply(ctx, endpoint.ExplainPatch(ctx, patch), endpoint.CaptureTargetVersions(ctx, patch))
+				}()
+				continue
+			}
 			if patch, ok := data.(merger.Patch); ok {
 				stats := patch.Stats()
 				if patch.Size() > 0 {
 					s.lastPatch = patch
 					s.stateStore.TouchLastOpsTime()
+					go s.purgeTrash(ctx)
 					// Update Stats from snapshots
 					if snapStats, err := s.task.RootStats(ctx, true); err == nil {
 						log.Logger(ctx).Info("Stats after running patch")
@@ -219,8 +514,10 @@ func (s *Syncer) dispatchStatus(ctx context.Context) {
 					stateStore.UpdateProcessStatus(model.NewProcessingStatus("Idle"), idleStatus)
 					deferIdle = false
 				}
+				duration := s.progress.Done(patch)
+				endpoint.DefaultEventBus().Publish(endpoint.PatchComputed{Task: s.uuid, Patch: patch})
 				if s.patchStore != nil {
-					s.patchStore.Store(patch)
+					s.patchStore.Store(endpoint.WithDuration(patch, duration))
 				}
 			}
 			if deferIdle {
@@ -264,6 +561,35 @@ func (s *Syncer) dispatchPublishBus(ctx context.Context, done chan bool) {
 
 }
 
+// resyncClean clears the snapshots, reconciles both endpoints from scratch and stores the resulting patches.
+// A full resync then rebuilds the snapshots.
+func (s *Syncer) resyncClean(ctx context.Context) {
+	if s.snapFactory != nil {
+		log.Logger(ctx).Info("Clearing snapshots before resyncing from scratch")
+		if e := s.snapFactory.Reset(ctx); e != nil {
+			log.Logger(ctx).Error("Cannot clear snapshots: " + e.Error())
+		}
+	}
+	right, ok := s.task.Target.(model.PathSyncSource)
+	if !ok {
+		e := fmt.Errorf("right endpoint cannot be walked")
+		s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Cannot resync from scratch: "+e.Error()).SetError(e), model.TaskStatusError)
+		return
+	}
+	result, e := endpoint.Resync(ctx, s.task.Source, right, s.direction, nil)
+	if e != nil {
+		s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Cannot resync from scratch: "+e.Error()).SetError(e), model.TaskStatusError)
+		return
+	}
+	for _, patch := range result.Patches {
+		log.Logger(ctx).Info("Resync from scratch applied " + endpoint.SummarizePatch(patch).String())
+		if s.patchStore != nil {
+			s.patchStore.Store(patch)
+		}
+	}
+	s.run(ctx, false, true)
+}
+
 func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 
 	bus := GetBus()
@@ -339,22 +665,26 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 					}
 				}
 				s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Starting full resync"), model.TaskStatusProcessing)
-				s.task.Run(ctx, false, true)
+				s.run(ctx, false, true)
+			case MessageResyncClean:
+				// Rebuild the sync state from scratch
+				s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Rebuilding sync state from scratch"), model.TaskStatusProcessing)
+				s.resyncClean(ctx)
 			case MessageResyncDry:
 				// Trigger a dry-run
 				s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Dry-running sync"), model.TaskStatusProcessing)
-				s.task.Run(ctx, true, true)
+				s.run(ctx, true, true)
 			case MessageSyncLoop:
 				if s.lastPatch != nil {
 					if _, b := s.lastPatch.HasErrors(); b {
 						// Trigger the loop
 						s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Re-applying last patch that had errors"), model.TaskStatusProcessing)
-						s.task.ReApplyPatch(ctx, s.lastPatch)
+						s.reApply(ctx)
 						break
 					}
 				}
 				s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Starting sync loop"), model.TaskStatusProcessing)
-				s.task.Run(ctx, false, false)
+				s.run(ctx, false, false)
 			case MessagePublishState:
 				// Broadcast current state
 				bus.Pub(s.stateStore.LastState(), TopicState)
@@ -374,15 +704,24 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 				config.Default().UpdateTaskPaused(s.uuid, true)
 				bus.Pub(state, TopicState)
 			case MessageResume:
-				// Start watching for events
+				// Start watching for events, unless the sync windows are closed
+				s.taskPaused = false
+				config.Default().UpdateTaskPaused(s.uuid, false)
+				if s.windowClosed {
+					bus.Pub(s.stateStore.UpdateSyncStatus(model.TaskStatusPaused), TopicState)
+					break
+				}
 				if s.watches {
 					s.task.Resume(ctx)
 				}
-				s.taskPaused = false
 				state := s.stateStore.UpdateSyncStatus(model.TaskStatusIdle)
-				config.Default().UpdateTaskPaused(s.uuid, false)
 				bus.Pub(state, TopicState)
-				s.task.Run(ctx, false, false)
+				s.run(ctx, false, false)
+			case MessageSyncWindow:
+				// Sync windows opened or closed
+				if s.updateWindow(ctx) {
+					s.run(ctx, false, false)
+				}
 			case MessageDisable:
 				// Disable Task
 				s.task.Shutdown()
@@ -419,10 +758,10 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 							if s.dirtyStopped {
 								s.dirtyStopped = false
 								log.Logger(ctx).Info("Both sides are connected, now launching a full resync")
-								s.task.Run(ctx, false, true)
+								s.run(ctx, false, true)
 							} else {
 								log.Logger(ctx).Info("Both sides are connected, now launching a sync loop")
-								s.task.Run(ctx, false, false)
+								s.run(ctx, false, false)
 							}
 						}
 						bus.Pub(state, TopicState)
@@ -462,6 +801,8 @@ func (s *Syncer) Serve() {
 		s.snapFactory = endpoint.NewSnapshotFactory(s.configPath, s.task.Source, s.task.Target)
 		s.task.SetSnapshotFactory(s.snapFactory)
 
+		// The task starts paused outside of its sync windows
+		s.windowClosed = s.windows != nil && !s.windows.Active(s.clock.Now())
 		if s.patchStore != nil {
 			if lasts, err := s.patchStore.Load(0, 1); err == nil && len(lasts) > 0 {
 				s.lastPatch = lasts[0]
@@ -476,7 +817,14 @@ func (s *Syncer) Serve() {
 			}
 		}
 
-		s.task.Start(ctx, s.watches && !s.taskPaused)
+		if s.windowClosed && s.stateStore.LastState().Status == model.TaskStatusIdle {
+			s.stateStore.UpdateSyncStatus(model.TaskStatusPaused)
+		}
+
+		for _, e := range s.CheckConnection(ctx) {
+			log.Logger(ctx).Warn(e.Error())
+		}
+		s.task.Start(ctx, s.watches && !s.taskPaused && !s.windowClosed)
 
 	} else {
 
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// AuditEntry is one line of the audit log written by an AuditTarget.
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	From  string    `json:"from,omitempty"`
+	Size  int64     `json:"size,omitempty"`
+	Actor string    `json:"actor"`
+	// Prev is the hash of the previous entry, empty for the first one.
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of Prev and of the entry serialized without Hash.
+	Hash string `json:"hash"`
+}
+
+func (a AuditEntry) computeHash() string {
+	a.Hash = ""
+	data, _ := json.Marshal(a)
+	sum := sha256.Sum256(append([]byte(a.Prev+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditChainError reports the first entry of an audit log that does not match the chain.
+type AuditChainError struct {
+	Line   int
+	Reason string
+}
+
+// Error implements the error interface.
+func (a *AuditChainError) Error() string {
+	return fmt.Sprintf("audit log broken at line %d: %s", a.Line, a.Reason)
+}
+
+// AuditTarget wraps a PathSyncTarget to append an entry to a log file for each node operation and content
+// transfer it successfully forwards. Each entry is chained to the previous one by its hash, so that modifying,
+// removing or reordering lines is detected by VerifyAuditLog. The other interfaces of the wrapped endpoint
+// are forwarded.
+type AuditTarget struct {
+	wrapped
+	// Actor is recorded in each entry, the current OS user name by default.
+	Actor string
+
+	logPath  string
+	lock     sync.Mutex
+	lastHash string
+	loaded   bool
+}
+
+// NewAuditTarget wraps target and appends audit entries to logPath. An existing log is continued, operations
+// return an error if it is found broken.
+func NewAuditTarget(target model.PathSyncTarget, logPath string) model.PathSyncTarget {
+	a := &AuditTarget{wrapped: wrapped{inner: target}, logPath: logPath, Actor: "cells-sync"}
+	if u, e := user.Current(); e == nil {
+		a.Actor = u.Username
+	}
+	return expose(a, target).(model.PathSyncTarget)
+}
+
+// CreateNode forwards to the underlying CreateNode and logs a "create" entry.
+func (a *AuditTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	if e := a.wrapped.CreateNode(ctx, node, updateIfExists); e != nil {
+		return e
+	}
+	return a.append(AuditEntry{Op: "create", Path: node.Path, Size: node.Size})
+}
+
+// DeleteNode forwards to the underlying DeleteNode and logs a "delete" entry.
+func (a *AuditTarget) DeleteNode(ctx context.Context, path string) error {
+	if e := a.wrapped.DeleteNode(ctx, path); e != nil {
+		return e
+	}
+	return a.append(AuditEntry{Op: "delete", Path: path})
+}
+
+// MoveNode forwards to the underlying MoveNode and logs a "move" entry.
+func (a *AuditTarget) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	if e := a.wrapped.MoveNode(ctx, oldPath, newPath); e != nil {
+		return e
+	}
+	return a.append(AuditEntry{Op: "move", Path: newPath, From: oldPath})
+}
+
+// GetWriterOn forwards to the underlying GetWriterOn and logs a "create" entry, or an "update" entry if the
+// file already existed, with the number of bytes written once the write completes.
+func (a *AuditTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	return a.auditWrite(cancel, p, 0, func() (io.WriteCloser, chan bool, chan error, error) {
+		return a.wrapped.GetWriterOn(cancel, p, targetSize)
+	})
+}
+
+// GetWriterAt forwards to the underlying GetWriterAt and logs the entry of the whole file like GetWriterOn,
+// counting the offset bytes written by previous attempts.
+func (a *AuditTarget) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error) {
+	return a.auditWrite(ctx, p, offset, func() (io.WriteCloser, chan bool, chan error, error) {
+		return a.wrapped.GetWriterAt(ctx, p, targetSize, offset)
+	})
+}
+
+// auditWrite wraps the writer returned by open to log the write of p, preceded by offset bytes, once complete.
+func (a *AuditTarget) auditWrite(cancel context.Context, p string, offset int64, open func() (io.WriteCloser, chan bool, chan error, error)) (io.WriteCloser, chan bool, chan error, error) {
+	op := "create"
+	if _, e := a.wrapped.LoadNode(cancel, p); e == nil {
+		op = "update"
+	}
+	w, writeDone, writeErr, err := open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aw := &auditWriter{WriteCloser: w, written: offset}
+	logWrite := func() error {
+		return a.append(AuditEntry{Op: op, Path: p, Size: aw.written})
+	}
+	if writeDone == nil && writeErr == nil {
+		// The write completes when the writer is closed
+		aw.closed = logWrite
+		return aw, nil, nil, nil
+	}
+	done, errs := make(chan bool, 1), make(chan error, 1)
+	go func() {
+		select {
+		case <-writeDone:
+		case e := <-writeErr:
+			if e != nil {
+				errs <- e
+				return
+			}
+		}
+		if e := logWrite(); e != nil {
+			errs <- e
+			return
+		}
+		done <- true
+	}()
+	return aw, done, errs, nil
+}
+
+// auditWriter counts the bytes written to a file, starting from written, and calls closed, if set, once it is successfully closed.
+type auditWriter struct {
+	io.WriteCloser
+	written int64
+	closed  func() error
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *auditWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if w.closed != nil {
+		return w.closed()
+	}
+	return nil
+}
+
+func (a *AuditTarget) append(entry AuditEntry) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.loaded {
+		last, _, err := readAuditLog(a.logPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		a.lastHash, a.loaded = last, true
+	}
+	entry.Time = time.Now()
+	entry.Actor = a.Actor
+	entry.Prev = a.lastHash
+	entry.Hash = entry.computeHash()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.lastHash = entry.Hash
+	return nil
+}
+
+// VerifyAuditLog walks an audit log and checks the hash chain. It returns the number of valid
+// entries, and an *AuditChainError for the first broken link.
+func VerifyAuditLog(logPath string) (entries int, err error) {
+	_, entries, err = readAuditLog(logPath)
+	return
+}
+
+// readAuditLog verifies the log and returns the hash of its last entry.
+func readAuditLog(logPath string) (lastHash string, entries int, err error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if e := json.Unmarshal(scanner.Bytes(), &entry); e != nil {
+			return lastHash, entries, &AuditChainError{Line: line, Reason: e.Error()}
+		}
+		if entry.Prev != lastHash {
+			return lastHash, entries, &AuditChainError{Line: line, Reason: "previous hash does not match"}
+		}
+		if entry.computeHash() != entry.Hash {
+			return lastHash, entries, &AuditChainError{Line: line, Reason: "hash does not match content"}
+		}
+		lastHash = entry.Hash
+		entries++
+	}
+	return lastHash, entries, scanner.Err()
+}
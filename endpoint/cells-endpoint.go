@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pydio/minio-go"
+	"github.com/pydio/minio-go/pkg/credentials"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells-sync/config"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/cells"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// cellsServerURL strips the workspace path of a Cells endpoint URL, and replaces the cells:// alias by https://.
+func cellsServerURL(u *url.URL) url.URL {
+	server := *u
+	if server.Scheme == "cells" {
+		server.Scheme = "https"
+	}
+	server.Path = ""
+	server.RawQuery = ""
+	return server
+}
+
+// cellsAuthority finds the Authority created by logging in to a server as a user.
+func cellsAuthority(server url.URL) (*config.Authority, error) {
+	for _, a := range config.Default().Authorities {
+		if a.Id == server.String() {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find authority for %s, please log in to the server first", server.String())
+}
+
+func cellsRemoteConfig(server url.URL, auth *config.Authority) cells.RemoteConfig {
+	// Warning, we use the ACCESSS TOKEN as IdToken
+	return cells.RemoteConfig{
+		Url:           fmt.Sprintf("%s://%s", server.Scheme, server.Host),
+		IdToken:       auth.AccessToken,
+		RefreshToken:  auth.RefreshToken,
+		ExpiresAt:     auth.ExpiresAt,
+		SkipVerify:    auth.InsecureSkipVerify,
+		CustomHeaders: map[string]string{"User-Agent": "cells-sync/" + common.Version},
+	}
+}
+
+// cellsGateway is the bucket of the S3 gateway of Cells servers, and cellsGatewaySecret the secret paired with
+// the access token used as access key.
+const (
+	cellsGateway       = "io"
+	cellsGatewaySecret = "gatewaysecret"
+)
+
+// cellsEndpoint adds the resumable uploads of RangeSyncTarget to the remote Cells endpoint of the sync library,
+// with multipart uploads on the S3 gateway of the server. Node operations and transfers refused with a 401 answer
+// are replayed once the tokens are renewed, as RefreshingTarget does. The other methods of the remote endpoint,
+// such as checksums, UUIDs or sessions, are promoted as is.
+type cellsEndpoint struct {
+	*cells.Remote
+	multipartUploads
+	*refresher
+
+	lock  sync.Mutex
+	token string
+}
+
+// RefreshRemoteConfig keeps the renewed token for multipart uploads and forwards to the remote endpoint.
+func (c *cellsEndpoint) RefreshRemoteConfig(conf cells.RemoteConfig) {
+	c.lock.Lock()
+	c.token = conf.IdToken
+	c.lock.Unlock()
+	c.Remote.RefreshRemoteConfig(conf)
+}
+
+// LoadNode retries the remote LoadNode after a refresh.
+func (c *cellsEndpoint) LoadNode(ctx context.Context, path string, extendedStats ...bool) (node *tree.Node, err error) {
+	err = c.retry(ctx, func() (e error) {
+		node, e = c.Remote.LoadNode(ctx, path, extendedStats...)
+		return
+	})
+	return
+}
+
+// CreateNode retries the remote CreateNode after a refresh.
+func (c *cellsEndpoint) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	return c.retry(ctx, func() error {
+		return c.Remote.CreateNode(ctx, node, updateIfExists)
+	})
+}
+
+// DeleteNode retries the remote DeleteNode after a refresh.
+func (c *cellsEndpoint) DeleteNode(ctx context.Context, path string) error {
+	return c.retry(ctx, func() error {
+		return c.Remote.DeleteNode(ctx, path)
+	})
+}
+
+// MoveNode retries the remote MoveNode after a refresh.
+func (c *cellsEndpoint) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	return c.retry(ctx, func() error {
+		return c.Remote.MoveNode(ctx, oldPath, newPath)
+	})
+}
+
+// GetReaderOn retries opening the remote reader after a refresh.
+func (c *cellsEndpoint) GetReaderOn(p string) (out io.ReadCloser, err error) {
+	err = c.retry(context.Background(), func() (e error) {
+		out, e = c.Remote.GetReaderOn(p)
+		return
+	})
+	return
+}
+
+// GetWriterOn retries opening the remote writer after a refresh.
+func (c *cellsEndpoint) GetWriterOn(cancel context.Context, p string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = c.retry(cancel, func() (e error) {
+		out, writeDone, writeErr, e = c.Remote.GetWriterOn(cancel, p, targetSize)
+		return
+	})
+	return
+}
+
+// GetWriterAt retries opening the resumed multipart upload after a refresh.
+func (c *cellsEndpoint) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = c.retry(ctx, func() (e error) {
+		out, writeDone, writeErr, e = c.multipartUploads.GetWriterAt(ctx, p, targetSize, offset)
+		return
+	})
+	return
+}
+
+// CommittedOffset retries listing the parts of a multipart upload after a refresh.
+func (c *cellsEndpoint) CommittedOffset(ctx context.Context, p string) (offset int64, err error) {
+	err = c.retry(ctx, func() (e error) {
+		offset, e = c.multipartUploads.CommittedOffset(ctx, p)
+		return
+	})
+	return
+}
+
+// gatewayCore returns a client of the S3 gateway of server authenticated with the current token.
+func (c *cellsEndpoint) gatewayCore(server url.URL, skipVerify bool) (*minio.Core, error) {
+	c.lock.Lock()
+	token := c.token
+	c.lock.Unlock()
+	mc, err := minio.NewWithOptions(server.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(token, cellsGatewaySecret, ""),
+		Secure:       server.Scheme == "https",
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skipVerify {
+		mc.SetCustomTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}})
+	}
+	return &minio.Core{Client: mc}, nil
+}
+
+// NewCellsEndpoint creates an endpoint on a remote Cells server from an URL like
+// https://user@host[:port]/workspace/path. The cells:// scheme is an alias of https://. Tokens are read from the
+// config Authority of this user and server, which must have been created by logging in. Unless opts.BrowseOnly
+// is set, tokens renewed by the Authority refresh are passed to the endpoint. Operations refused with a 401
+// answer are replayed once the tokens are renewed, see NewCellsTokenRefresher. Uploads are resumable with
+// multipart uploads on the S3 gateway of the server.
+func NewCellsEndpoint(u *url.URL, opts model.EndpointOptions) (model.Endpoint, error) {
+	server := cellsServerURL(u)
+	auth, e := cellsAuthority(server)
+	if e != nil {
+		return nil, e
+	}
+	conf := cellsRemoteConfig(server, auth)
+	options := cells.Options{
+		EndpointOptions: opts,
+	}
+	root := strings.TrimLeft(u.Path, "/")
+	ep := &cellsEndpoint{Remote: cells.NewRemote(conf, root, options), token: conf.IdToken}
+	ep.multipartUploads = multipartUploads{
+		core: func() (*minio.Core, error) {
+			return ep.gatewayCore(server, auth.InsecureSkipVerify)
+		},
+		bucket: cellsGateway,
+		root:   root,
+	}
+	if !opts.BrowseOnly {
+		watcher := config.Watch()
+		go func() {
+			for change := range watcher {
+				if aC, ok := change.(*config.AuthChange); ok {
+					acUrl, _ := url.Parse(aC.Authority.URI)
+					if acUrl.Scheme == server.Scheme && acUrl.Host == server.Host && aC.Authority.Username == server.User.Username() {
+						if aC.Type == "delete" {
+							return
+						} else {
+							conf.IdToken = aC.Authority.AccessToken
+							conf.RefreshToken = aC.Authority.RefreshToken
+							conf.ExpiresAt = aC.Authority.ExpiresAt
+							ep.RefreshRemoteConfig(conf)
+						}
+					}
+				}
+			}
+		}()
+	}
+	ep.refresher = &refresher{refresh: NewCellsTokenRefresher(u, ep)}
+	return ep, nil
+}
+
+// remoteConfigRefresher is implemented by remote Cells endpoints.
+type remoteConfigRefresher interface {
+	RefreshRemoteConfig(conf cells.RemoteConfig)
+}
+
+// NewCellsTokenRefresher returns a function renewing the tokens of the Authority used by an endpoint created with
+// NewCellsEndpoint from u, and passing them to the endpoint right away. Renewed tokens are also saved to the
+// config, so that they survive a restart. It is used by the Cells endpoint and meant for NewRefreshingTarget, to
+// recover from 401 answers received before the periodic refresh of the Authority.
+func NewCellsTokenRefresher(u *url.URL, ep model.Endpoint) func(ctx context.Context) error {
+	server := cellsServerURL(u)
+	return func(ctx context.Context) error {
+		auth, e := cellsAuthority(server)
+		if e != nil {
+			return e
+		}
+		if e := auth.Refresh(); e != nil {
+			return e
+		}
+		if r := findEndpoint(ep, func(e model.Endpoint) bool {
+			_, ok := e.(remoteConfigRefresher)
+			return ok
+		}); r != nil {
+			r.(remoteConfigRefresher).RefreshRemoteConfig(cellsRemoteConfig(server, auth))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import "time"
+
+// Clock provides the current time to time-dependent logic, so that it can be faked in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the default Clock, based on time.Now.
+type RealClock struct{}
+
+// Now implements Clock.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// ClockFunc adapts a function to the Clock interface, e.g. the Now options of TrashOptions or ProgressTracker.
+type ClockFunc func() time.Time
+
+// Now implements Clock.
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ConflictResolver turns a conflict operation into a concrete operation.
+type ConflictResolver interface {
+	Resolve(conflict merger.Operation) (merger.Operation, error)
+}
+
+// MultiConflictResolver is a ConflictResolver that may replace a conflict by more than one operation.
+type MultiConflictResolver interface {
+	ConflictResolver
+	ResolveAll(conflict merger.Operation) ([]merger.Operation, error)
+}
+
+// ResolutionChoice is the side chosen by a user for resolving a stored conflict.
+type ResolutionChoice int
+
+const (
+	// ResolveLeft keeps the left (source) side of the conflict.
+	ResolveLeft ResolutionChoice = iota
+	// ResolveRight keeps the right (target) side of the conflict.
+	ResolveRight
+	// ResolveKeepBoth keeps both sides, the right one being renamed as a conflicted copy.
+	ResolveKeepBoth
+	// ResolveProposed applies the resolution proposed by the store resolver when the conflict was stored.
+	ResolveProposed
+)
+
+// ResolverFromName finds a built-in resolver by its name: prefer-source, prefer-target, most-recent, server-mtime or
+// keep-both. An empty name returns a nil resolver, meaning conflicts are kept unresolved. The server-mtime tolerance
+// may be set with a duration suffix, e.g. "server-mtime:5s".
+func ResolverFromName(name string) (ConflictResolver, error) {
+	if strings.HasPrefix(name, "server-mtime") {
+		resolver := AuthoritativeMTimeResolver{Authority: ResolveLeft, Tolerance: defaultMTimeTolerance}
+		if tolerance := strings.TrimPrefix(name, "server-mtime"); tolerance != "" {
+			d, e := time.ParseDuration(strings.TrimPrefix(tolerance, ":"))
+			if e != nil || !strings.HasPrefix(tolerance, ":") || d < 0 {
+				return nil, fmt.Errorf("invalid tolerance in conflict strategy %s, please use a duration like server-mtime:5s", name)
+			}
+			resolver.Tolerance = d
+		}
+		return resolver, nil
+	}
+	switch name {
+	case "":
+		return nil, nil
+	case "prefer-source":
+		return PreferSourceResolver{}, nil
+	case "prefer-target":
+		return PreferTargetResolver{}, nil
+	case "most-recent":
+		return MostRecentResolver{}, nil
+	case "keep-both":
+		return KeepBothResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported conflict strategy %s, please use one of prefer-source, prefer-target, most-recent, server-mtime, keep-both", name)
+	}
+}
+
+// resolveConflicts returns the operations replacing op using resolver. Non-conflict operations,
+// or conflicts that cannot be resolved, are returned as is.
+func resolveConflicts(resolver ConflictResolver, op merger.Operation) []merger.Operation {
+	if resolver == nil || op.Type() != merger.OpConflict {
+		return []merger.Operation{op}
+	}
+	if multi, ok := resolver.(MultiConflictResolver); ok {
+		if ops, e := multi.ResolveAll(op); e == nil && len(ops) > 0 {
+			return ops
+		}
+		return []merger.Operation{op}
+	}
+	if resolved, e := resolver.Resolve(op); e == nil && resolved != nil {
+		return []merger.Operation{resolved}
+	}
+	return []merger.Operation{op}
+}
+
+// PreferSourceResolver always keeps the left (source) side of a conflict.
+type PreferSourceResolver struct{}
+
+// Resolve implements ConflictResolver.
+func (PreferSourceResolver) Resolve(conflict merger.Operation) (merger.Operation, error) {
+	_, left, _, e := ConflictInfo(conflict)
+	return left, e
+}
+
+// PreferTargetResolver always keeps the right (target) side of a conflict.
+type PreferTargetResolver struct{}
+
+// Resolve implements ConflictResolver.
+func (PreferTargetResolver) Resolve(conflict merger.Operation) (merger.Operation, error) {
+	_, _, right, e := ConflictInfo(conflict)
+	return right, e
+}
+
+// MostRecentResolver keeps the side whose node has the most recent modification time, or the source side if equal.
+type MostRecentResolver struct{}
+
+// Resolve implements ConflictResolver.
+func (MostRecentResolver) Resolve(conflict merger.Operation) (merger.Operation, error) {
+	_, left, right, e := ConflictInfo(conflict)
+	if e != nil {
+		return nil, e
+	}
+	if left.GetNode() == nil || right.GetNode() == nil {
+		return nil, fmt.Errorf("cannot compare modification times without nodes")
+	}
+	if right.GetNode().MTime > left.GetNode().MTime {
+		return right, nil
+	}
+	return left, nil
+}
+
+// defaultMTimeTolerance is the tolerance of the server-mtime resolver, covering the one second precision of mtimes.
+const defaultMTimeTolerance = 2 * time.Second
+
+// AuthoritativeMTimeResolver keeps the side whose node has the most recent modification time, as seen by the clock
+// of the Authority side. MTimes of the other side are corrected by the known clock Skew before comparing them.
+// Sides modified within Tolerance of each other are considered simultaneous, and the Tiebreak side is kept, so
+// that small clock drifts give a stable result.
+type AuthoritativeMTimeResolver struct {
+	// Authority is the side whose clock is trusted, ResolveLeft (the source) or ResolveRight.
+	Authority ResolutionChoice
+	// Skew is how far the clock of the other side is ahead of the Authority one, negative if behind.
+	Skew time.Duration
+	// Tolerance is the mtime difference under which both sides are considered modified at the same time.
+	Tolerance time.Duration
+	// Tiebreak is the side kept within Tolerance, ResolveLeft (the source) or ResolveRight.
+	Tiebreak ResolutionChoice
+}
+
+// Resolve implements ConflictResolver.
+func (a AuthoritativeMTimeResolver) Resolve(conflict merger.Operation) (merger.Operation, error) {
+	_, left, right, e := ConflictInfo(conflict)
+	if e != nil {
+		return nil, e
+	}
+	if left.GetNode() == nil || right.GetNode() == nil {
+		return nil, fmt.Errorf("cannot compare modification times without nodes")
+	}
+	leftTime, rightTime := time.Unix(left.GetNode().MTime, 0), time.Unix(right.GetNode().MTime, 0)
+	if a.Authority == ResolveRight {
+		leftTime = leftTime.Add(-a.Skew)
+	} else {
+		rightTime = rightTime.Add(-a.Skew)
+	}
+	diff := rightTime.Sub(leftTime)
+	switch {
+	case diff > a.Tolerance:
+		return right, nil
+	case diff < -a.Tolerance:
+		return left, nil
+	case a.Tiebreak == ResolveRight:
+		return right, nil
+	default:
+		return left, nil
+	}
+}
+
+// KeepBothResolver keeps both sides of a conflict, the target side being created under a
+// "name (conflicted copy YYYY-MM-DD).ext" path.
+type KeepBothResolver struct {
+	// Exists tells whether a path is already used, in which case a counter is appended to the suffix.
+	Exists func(p string) bool
+	// Now gives the date used in the suffix, time.Now if nil.
+	Now func() time.Time
+}
+
+// Resolve implements ConflictResolver by returning the source side, see ResolveAll for the full resolution.
+func (k KeepBothResolver) Resolve(conflict merger.Operation) (merger.Operation, error) {
+	ops, e := k.ResolveAll(conflict)
+	if e != nil {
+		return nil, e
+	}
+	return ops[0], nil
+}
+
+// ResolveAll returns the source side operation and a move of the target file to a conflicted copy path, applied
+// on the target before the source side is written there. The right node is kept aside by the move, so that the
+// next sync propagates the copy to the source.
+func (k KeepBothResolver) ResolveAll(conflict merger.Operation) ([]merger.Operation, error) {
+	cType, left, right, e := ConflictInfo(conflict)
+	if e != nil {
+		return nil, e
+	}
+	if cType != merger.ConflictFileContent {
+		return nil, fmt.Errorf("keep-both only applies to file content conflicts")
+	}
+	if right.GetNode() == nil {
+		return nil, fmt.Errorf("cannot rename target side without node")
+	}
+	now := time.Now
+	if k.Now != nil {
+		now = k.Now
+	}
+	copyPath := ConflictedCopyPath(right.GetRefPath(), now(), k.Exists)
+	// Moves are described by their origin node and their destination path
+	node := right.GetNode().Clone()
+	node.Path = right.GetRefPath()
+	renamed := merger.NewOperation(merger.OpMoveFile, model.EventInfo{Path: copyPath}, node)
+	return []merger.Operation{left, renamed}, nil
+}
+
+// ConflictedCopyPath inserts a " (conflicted copy YYYY-MM-DD)" suffix before the extension of p. Only the last
+// extension is kept aside, and dot files are considered as having no extension. If exists reports the
+// generated path as used, a counter is added until a free path is found.
+func ConflictedCopyPath(p string, date time.Time, exists func(p string) bool) string {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	name := strings.TrimSuffix(base, ext)
+	suffix := "conflicted copy " + date.Format("2006-01-02")
+	candidate := fmt.Sprintf("%s%s (%s)%s", dir, name, suffix, ext)
+	for i := 2; exists != nil && exists(candidate); i++ {
+		candidate = fmt.Sprintf("%s%s (%s %d)%s", dir, name, suffix, i, ext)
+	}
+	return candidate
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ConnectionChecker is implemented by endpoints providing their own liveness probe.
+type ConnectionChecker interface {
+	CheckConnection(ctx context.Context) error
+}
+
+// UnreachableError is returned when an endpoint does not answer its liveness probe.
+type UnreachableError struct {
+	URI string
+	Err error
+}
+
+// Error implements the error interface.
+func (u *UnreachableError) Error() string {
+	return "endpoint " + u.URI + " is unreachable: " + u.Err.Error()
+}
+
+// Cause returns the error returned by the probe.
+func (u *UnreachableError) Cause() error {
+	return u.Err
+}
+
+// CheckConnection runs a cheap liveness probe on ep, to detect unreachable endpoints before starting
+// a sync. Endpoints implementing ConnectionChecker are asked directly, others are probed by loading
+// their root node: a stat of the root folder for a filesystem, a lookup of the root for S3 or Cells.
+func CheckConnection(ctx context.Context, ep model.Endpoint) error {
+	var err error
+	if checker, ok := ep.(ConnectionChecker); ok {
+		err = checker.CheckConnection(ctx)
+	} else {
+		_, err = ep.LoadNode(ctx, "/")
+	}
+	if err != nil {
+		return &UnreachableError{URI: ep.GetEndpointInfo().URI, Err: err}
+	}
+	return nil
+}
+
+// CheckEndpoints probes all endpoints and returns one UnreachableError per failing endpoint.
+func CheckEndpoints(ctx context.Context, endpoints ...model.Endpoint) (errs []error) {
+	for _, ep := range endpoints {
+		if e := CheckConnection(ctx, ep); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return
+}
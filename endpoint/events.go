@@ -0,0 +1,211 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// SyncEvent is a lifecycle event of a sync task, published on an EventBus. Task is the task UUID when known.
+type SyncEvent interface {
+	TaskUUID() string
+}
+
+// SyncStarted is published when a task starts a sync loop or a resync.
+type SyncStarted struct {
+	Task   string
+	Resync bool
+	DryRun bool
+}
+
+// PatchComputed is published when a task computed a patch and is done processing it, before it is stored.
+type PatchComputed struct {
+	Task  string
+	Patch merger.Patch
+}
+
+// PatchApplied is published once a patch without errors is stored.
+type PatchApplied struct {
+	Task  string
+	Patch merger.Patch
+}
+
+// PatchFailed is published once a patch with errors is stored.
+type PatchFailed struct {
+	Task   string
+	Patch  merger.Patch
+	Errors []error
+}
+
+// ConflictDetected is published for each conflict of a stored patch that was not resolved automatically.
+type ConflictDetected struct {
+	Task      string
+	PatchUUID string
+	Path      string
+	Type      merger.ConflictType
+}
+
+// EndpointUnreachable is published when an endpoint of a task does not answer its liveness probe.
+type EndpointUnreachable struct {
+	Task string
+	Err  *UnreachableError
+}
+
+// TaskUUID implements SyncEvent.
+func (e SyncStarted) TaskUUID() string { return e.Task }
+
+// TaskUUID implements SyncEvent.
+func (e PatchComputed) TaskUUID() string { return e.Task }
+
+// TaskUUID implements SyncEvent.
+func (e PatchApplied) TaskUUID() string { return e.Task }
+
+// TaskUUID implements SyncEvent.
+func (e PatchFailed) TaskUUID() string { return e.Task }
+
+// TaskUUID implements SyncEvent.
+func (e ConflictDetected) TaskUUID() string { return e.Task }
+
+// TaskUUID implements SyncEvent.
+func (e EndpointUnreachable) TaskUUID() string { return e.Task }
+
+// EventHandlers are the typed callbacks of a subscriber. Nil handlers ignore their events.
+type EventHandlers struct {
+	SyncStarted         func(SyncStarted)
+	PatchComputed       func(PatchComputed)
+	PatchApplied        func(PatchApplied)
+	PatchFailed         func(PatchFailed)
+	ConflictDetected    func(ConflictDetected)
+	EndpointUnreachable func(EndpointUnreachable)
+}
+
+func (h EventHandlers) handle(e SyncEvent) {
+	switch ev := e.(type) {
+	case SyncStarted:
+		if h.SyncStarted != nil {
+			h.SyncStarted(ev)
+		}
+	case PatchComputed:
+		if h.PatchComputed != nil {
+			h.PatchComputed(ev)
+		}
+	case PatchApplied:
+		if h.PatchApplied != nil {
+			h.PatchApplied(ev)
+		}
+	case PatchFailed:
+		if h.PatchFailed != nil {
+			h.PatchFailed(ev)
+		}
+	case ConflictDetected:
+		if h.ConflictDetected != nil {
+			h.ConflictDetected(ev)
+		}
+	case EndpointUnreachable:
+		if h.EndpointUnreachable != nil {
+			h.EndpointUnreachable(ev)
+		}
+	}
+}
+
+// eventBufferSize is the number of events queued for a subscriber before new ones are dropped.
+const eventBufferSize = 256
+
+// EventBus dispatches SyncEvents to subscribers. Each subscriber receives events in publication order on its
+// own goroutine: Publish never blocks, and events are dropped for subscribers whose queue is full.
+type EventBus struct {
+	lock        sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+	dropped     uint64
+}
+
+type eventSubscriber struct {
+	handlers EventHandlers
+	events   chan SyncEvent
+	done     chan struct{}
+}
+
+// NewEventBus creates an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+var defaultEventBus = NewEventBus()
+
+// DefaultEventBus returns the bus receiving the events of all sync tasks.
+func DefaultEventBus() *EventBus {
+	return defaultEventBus
+}
+
+// Subscribe registers handlers, called one at a time in publication order. The returned function unsubscribes
+// them: events still queued are discarded.
+func (b *EventBus) Subscribe(handlers EventHandlers) (unsubscribe func()) {
+	s := &eventSubscriber{
+		handlers: handlers,
+		events:   make(chan SyncEvent, eventBufferSize),
+		done:     make(chan struct{}),
+	}
+	b.lock.Lock()
+	b.subscribers[s] = struct{}{}
+	b.lock.Unlock()
+	go func() {
+		for {
+			select {
+			case e := <-s.events:
+				s.handlers.handle(e)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, s)
+			b.lock.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// Publish queues e for all subscribers. It is a no-op on a nil bus.
+func (b *EventBus) Publish(e SyncEvent) {
+	if b == nil {
+		return
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Dropped counts the events that were not delivered because a subscriber queue was full.
+func (b *EventBus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
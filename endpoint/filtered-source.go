@@ -0,0 +1,336 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// SyncIgnoreFile is the name of the file read at the root of a source to find ignore patterns.
+const SyncIgnoreFile = ".syncignore"
+
+// DefaultIgnorePatterns lists the files created by operating systems and desktop applications that are
+// usually not worth syncing.
+var DefaultIgnorePatterns = []string{
+	// macOS
+	".DS_Store",
+	"._*",
+	".Spotlight-V100/",
+	".Trashes/",
+	".fseventsd/",
+	// Windows
+	"Thumbs.db",
+	"ehthumbs.db",
+	"desktop.ini",
+	"$RECYCLE.BIN/",
+	// Office and LibreOffice lock files
+	"~$*",
+	".~lock.*#",
+}
+
+// WithDefaultIgnores returns DefaultIgnorePatterns followed by patterns. As the last matching pattern
+// wins, a negated pattern such as "!desktop.ini" force-includes a name ignored by default.
+func WithDefaultIgnores(patterns []string) []string {
+	return append(append([]string{}, DefaultIgnorePatterns...), patterns...)
+}
+
+// DefaultIgnoreGlobs converts DefaultIgnorePatterns to the ignore globs of the sync task filters, which apply to
+// both endpoints without wrapping them.
+func DefaultIgnoreGlobs() []string {
+	var globs []string
+	for _, p := range DefaultIgnorePatterns {
+		name := strings.TrimSuffix(p, "/")
+		globs = append(globs, "**/"+name)
+		if name != p {
+			globs = append(globs, "**/"+name+"/**")
+		}
+	}
+	return globs
+}
+
+// ApplyIgnorePatterns sets up the ignore rules of a sync between left and right. When none of them has a
+// SyncIgnoreFile, the endpoints are returned as is, keeping all their optional interfaces, along with the
+// DefaultIgnoreGlobs to pass to the task filters. Otherwise, the sources are wrapped in a FilteredSource applying
+// the defaults followed by the patterns of their own file, so that a negated pattern overrides the defaults.
+// Defaults are left out when defaults is false. A file that cannot be read is skipped and its error returned.
+func ApplyIgnorePatterns(ctx context.Context, left, right model.Endpoint, defaults bool) (model.Endpoint, model.Endpoint, []string, error) {
+	var err error
+	var found bool
+	endpoints := []model.Endpoint{left, right}
+	patterns := make([][]string, len(endpoints))
+	for i, ep := range endpoints {
+		src, ok := ep.(model.PathSyncSource)
+		if !ok {
+			continue
+		}
+		p, e := LoadIgnorePatterns(ctx, src)
+		if e != nil {
+			err = e
+			continue
+		}
+		found = found || len(p) > 0
+		patterns[i] = p
+	}
+	if !found {
+		if defaults {
+			return left, right, DefaultIgnoreGlobs(), err
+		}
+		return left, right, nil, err
+	}
+	for i, ep := range endpoints {
+		src, ok := ep.(model.PathSyncSource)
+		if !ok {
+			continue
+		}
+		p := patterns[i]
+		if defaults {
+			p = WithDefaultIgnores(p)
+		}
+		if len(p) > 0 {
+			endpoints[i] = NewFilteredSource(src, p)
+		}
+	}
+	return endpoints[0], endpoints[1], nil, err
+}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher matches paths against a list of gitignore-style patterns: "!" negates a pattern,
+// a trailing "/" only matches folders, a leading or inner "/" anchors the pattern to the root,
+// "*" and "?" do not cross folders while "**" does. The last matching pattern wins.
+type IgnoreMatcher struct {
+	rules []ignoreRule
+}
+
+// NewIgnoreMatcher parses patterns. Empty lines and lines starting with "#" are skipped.
+func NewIgnoreMatcher(patterns []string) *IgnoreMatcher {
+	m := &IgnoreMatcher{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(p, "!") {
+			rule.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			rule.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimLeft(p, "/")
+		expr := globToRegexp(p)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "^(?:.*/)?" + expr + "$"
+		}
+		re, e := regexp.Compile(expr)
+		if e != nil {
+			continue
+		}
+		rule.re = re
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+// Match tells whether a path is ignored, either directly or because one of its parent folders is.
+func (m *IgnoreMatcher) Match(p string, isDir bool) bool {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matchOne(p, isDir)
+}
+
+func (m *IgnoreMatcher) matchOne(p string, isDir bool) bool {
+	var ignored bool
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(p) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// globToRegexp converts a glob pattern to a regular expression (without anchors).
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			if end := strings.IndexByte(pattern[i:], ']'); end > 1 {
+				class := pattern[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += end
+			} else {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// FilteredSource wraps a PathSyncSource to hide ignored paths from its listings, nodes and events, so that
+// they are never part of a diff and thus never enqueued into a patch. The target and content interfaces of
+// the wrapped endpoint are forwarded.
+type FilteredSource struct {
+	wrapped
+	matcher *IgnoreMatcher
+}
+
+// NewFilteredSource wraps src and ignores all paths matching the gitignore-style patterns.
+func NewFilteredSource(src model.PathSyncSource, patterns []string) model.PathSyncSource {
+	f := &FilteredSource{
+		wrapped: wrapped{inner: src},
+		matcher: NewIgnoreMatcher(patterns),
+	}
+	return expose(f, src).(model.PathSyncSource)
+}
+
+// Ignored tells whether a path is filtered out by this source.
+func (f *FilteredSource) Ignored(p string, isDir bool) bool {
+	return f.matcher.Match(p, isDir)
+}
+
+// Walk wraps the underlying Walk and skips ignored nodes.
+func (f *FilteredSource) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	return f.wrapped.Walk(func(p string, node *tree.Node, err error) {
+		if err == nil && node != nil && f.Ignored(p, !node.IsLeaf()) {
+			return
+		}
+		walknFc(p, node, err)
+	}, root, recursive)
+}
+
+// LoadNode reports ignored nodes as not found.
+func (f *FilteredSource) LoadNode(ctx context.Context, p string, extendedStats ...bool) (*tree.Node, error) {
+	node, err := f.wrapped.LoadNode(ctx, p, extendedStats...)
+	if err != nil {
+		return nil, err
+	}
+	if f.Ignored(p, !node.IsLeaf()) {
+		return nil, &os.PathError{Op: "load", Path: p, Err: os.ErrNotExist}
+	}
+	return node, nil
+}
+
+// Watch wraps the underlying Watch and drops the events on ignored paths.
+func (f *FilteredSource) Watch(recursivePath string) (*model.WatchObject, error) {
+	w, err := f.wrapped.Watch(recursivePath)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan model.EventInfo)
+	filtered := &model.WatchObject{
+		EventInfoChan:  events,
+		ErrorChan:      w.ErrorChan,
+		DoneChan:       w.DoneChan,
+		ConnectionInfo: w.ConnectionInfo,
+	}
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case event, ok := <-w.EventInfoChan:
+				if !ok {
+					return
+				}
+				if f.Ignored(event.Path, event.Folder) {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-w.DoneChan:
+					return
+				}
+			case <-w.DoneChan:
+				return
+			}
+		}
+	}()
+	return filtered, nil
+}
+
+// LoadIgnorePatterns reads the SyncIgnoreFile at the root of src, if src can provide contents.
+// It returns no patterns if the file does not exist.
+func LoadIgnorePatterns(ctx context.Context, src model.PathSyncSource) ([]string, error) {
+	ds, ok := src.(model.DataSyncSource)
+	if !ok {
+		return nil, nil
+	}
+	if _, e := src.LoadNode(ctx, SyncIgnoreFile); e != nil {
+		return nil, nil
+	}
+	reader, e := ds.GetReaderOn(SyncIgnoreFile)
+	if e != nil {
+		return nil, e
+	}
+	defer reader.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// wrapped is embedded by endpoint wrappers to forward all model interfaces to the inner endpoint. Calls
+// to an interface the inner endpoint does not implement fail: wrappers are returned through expose, so
+// that they never advertise such interfaces.
+type wrapped struct {
+	inner model.Endpoint
+}
+
+// Unwrap returns the inner endpoint.
+func (w wrapped) Unwrap() model.Endpoint {
+	return w.inner
+}
+
+// LoadNode forwards to the inner endpoint.
+func (w wrapped) LoadNode(ctx context.Context, p string, extendedStats ...bool) (*tree.Node, error) {
+	return w.inner.LoadNode(ctx, p, extendedStats...)
+}
+
+// GetEndpointInfo forwards to the inner endpoint.
+func (w wrapped) GetEndpointInfo() model.EndpointInfo {
+	return w.inner.GetEndpointInfo()
+}
+
+// Walk forwards to the inner endpoint.
+func (w wrapped) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	src, ok := w.inner.(model.PathSyncSource)
+	if !ok {
+		return fmt.Errorf("endpoint cannot be walked")
+	}
+	return src.Walk(walknFc, root, recursive)
+}
+
+// Watch forwards to the inner endpoint.
+func (w wrapped) Watch(recursivePath string) (*model.WatchObject, error) {
+	src, ok := w.inner.(model.PathSyncSource)
+	if !ok {
+		return nil, fmt.Errorf("endpoint cannot be watched")
+	}
+	return src.Watch(recursivePath)
+}
+
+// CreateNode forwards to the inner endpoint.
+func (w wrapped) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	target, ok := w.inner.(model.PathSyncTarget)
+	if !ok {
+		return fmt.Errorf("endpoint cannot be written")
+	}
+	return target.CreateNode(ctx, node, updateIfExists)
+}
+
+// DeleteNode forwards to the inner endpoint.
+func (w wrapped) DeleteNode(ctx context.Context, p string) error {
+	target, ok := w.inner.(model.PathSyncTarget)
+	if !ok {
+		return fmt.Errorf("endpoint cannot be written")
+	}
+	return target.DeleteNode(ctx, p)
+}
+
+// MoveNode forwards to the inner endpoint.
+func (w wrapped) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	target, ok := w.inner.(model.PathSyncTarget)
+	if !ok {
+		return fmt.Errorf("endpoint cannot be written")
+	}
+	return target.MoveNode(ctx, oldPath, newPath)
+}
+
+// GetReaderOn forwards to the inner endpoint.
+func (w wrapped) GetReaderOn(p string) (io.ReadCloser, error) {
+	ds, ok := w.inner.(model.DataSyncSource)
+	if !ok {
+		return nil, fmt.Errorf("endpoint cannot provide contents")
+	}
+	return ds.GetReaderOn(p)
+}
+
+// GetWriterOn forwards to the inner endpoint.
+func (w wrapped) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	dt, ok := w.inner.(model.DataSyncTarget)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("endpoint cannot receive contents")
+	}
+	return dt.GetWriterOn(cancel, p, targetSize)
+}
+
+// GetWriterAt forwards to the inner endpoint.
+func (w wrapped) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error) {
+	rt, ok := w.inner.(RangeSyncTarget)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("endpoint cannot resume uploads")
+	}
+	return rt.GetWriterAt(ctx, p, targetSize, offset)
+}
+
+// CommittedOffset forwards to the inner endpoint.
+func (w wrapped) CommittedOffset(ctx context.Context, p string) (int64, error) {
+	rt, ok := w.inner.(RangeSyncTarget)
+	if !ok {
+		return 0, fmt.Errorf("endpoint cannot resume uploads")
+	}
+	return rt.CommittedOffset(ctx, p)
+}
+
+// fullEndpoint is implemented by the wrappers embedding wrapped.
+type fullEndpoint interface {
+	model.DataSyncSource
+	RangeSyncTarget
+}
+
+// Views narrowing a wrapper to the interfaces of the endpoint it wraps. Each view unwraps to the wrapper.
+type (
+	sourceView           struct{ model.PathSyncSource }
+	dataSourceView       struct{ model.DataSyncSource }
+	targetView           struct{ model.PathSyncTarget }
+	dataTargetView       struct{ model.DataSyncTarget }
+	syncEndpointView     struct{ syncEndpoint }
+	dataSourceTargetView struct{ dataSourceTarget }
+	sourceDataTargetView struct{ sourceDataTarget }
+	dataEndpointView     struct{ dataEndpoint }
+	rangeTargetView      struct{ RangeSyncTarget }
+	sourceRangeView      struct{ sourceRangeTarget }
+)
+
+type dataEndpoint interface {
+	model.DataSyncSource
+	model.DataSyncTarget
+}
+
+type sourceRangeTarget interface {
+	model.PathSyncSource
+	RangeSyncTarget
+}
+
+type dataSourceTarget interface {
+	model.DataSyncSource
+	model.PathSyncTarget
+}
+
+type sourceDataTarget interface {
+	model.PathSyncSource
+	model.DataSyncTarget
+}
+
+func (v sourceView) Unwrap() model.Endpoint           { return v.PathSyncSource }
+func (v dataSourceView) Unwrap() model.Endpoint       { return v.DataSyncSource }
+func (v targetView) Unwrap() model.Endpoint           { return v.PathSyncTarget }
+func (v dataTargetView) Unwrap() model.Endpoint       { return v.DataSyncTarget }
+func (v syncEndpointView) Unwrap() model.Endpoint     { return v.syncEndpoint }
+func (v dataSourceTargetView) Unwrap() model.Endpoint { return v.dataSourceTarget }
+func (v sourceDataTargetView) Unwrap() model.Endpoint { return v.sourceDataTarget }
+func (v dataEndpointView) Unwrap() model.Endpoint     { return v.dataEndpoint }
+func (v rangeTargetView) Unwrap() model.Endpoint      { return v.RangeSyncTarget }
+func (v sourceRangeView) Unwrap() model.Endpoint      { return v.sourceRangeTarget }
+
+// expose returns w, a wrapper of inner, narrowed to the source, target, content and resumable upload interfaces
+// that inner implements. Wrappers of full endpoints are returned as is.
+func expose(w fullEndpoint, inner model.Endpoint) model.Endpoint {
+	_, source := inner.(model.PathSyncSource)
+	_, reads := inner.(model.DataSyncSource)
+	_, target := inner.(model.PathSyncTarget)
+	_, writes := inner.(model.DataSyncTarget)
+	_, ranges := inner.(RangeSyncTarget)
+	switch {
+	case reads && ranges:
+		return w
+	case reads && writes:
+		return dataEndpointView{w}
+	case reads && target:
+		return dataSourceTargetView{w}
+	case reads:
+		return dataSourceView{w}
+	case source && ranges:
+		return sourceRangeView{w}
+	case source && writes:
+		return sourceDataTargetView{w}
+	case source && target:
+		return syncEndpointView{w}
+	case source:
+		return sourceView{w}
+	case ranges:
+		return rangeTargetView{w}
+	case writes:
+		return dataTargetView{w}
+	default:
+		return targetView{w}
+	}
+}
+
+// findEndpoint walks down the wrappers of ep and returns the first endpoint accepted by match, or nil.
+func findEndpoint(ep model.Endpoint, match func(model.Endpoint) bool) model.Endpoint {
+	for ep != nil {
+		if match(ep) {
+			return ep
+		}
+		u, ok := ep.(interface{ Unwrap() model.Endpoint })
+		if !ok {
+			return nil
+		}
+		ep = u.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ListingCacheOptions configures a ListingCache. A zero Size disables the cache.
+type ListingCacheOptions struct {
+	// Size is the maximum number of folder listings kept, the least recently used being evicted first.
+	Size int
+	// TTL expires the listings older than this duration. Zero keeps them until evicted or invalidated.
+	TTL time.Duration
+}
+
+// ListingCache wraps an endpoint to serve repeated listings of a same folder from memory. Only non-recursive
+// walks are cached, keyed by their root. Any write going through the cache invalidates the listings of the
+// written path, of its parent and of its children. Changes not made through the cache are only seen once
+// the TTL expires. The content and resumable upload interfaces of the wrapped endpoint are forwarded.
+type ListingCache struct {
+	wrapped
+	options ListingCacheOptions
+
+	sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    int
+	misses  int
+}
+
+type listedNode struct {
+	path string
+	node *tree.Node
+}
+
+type listingEntry struct {
+	root    string
+	nodes   []listedNode
+	expires time.Time
+}
+
+// NewListingCache wraps ep. It returns ep unchanged if the options disable the cache.
+func NewListingCache(ep model.Endpoint, options ListingCacheOptions) (model.Endpoint, error) {
+	if options.Size <= 0 {
+		return ep, nil
+	}
+	if _, ok := ep.(syncEndpoint); !ok {
+		return nil, fmt.Errorf("endpoint cannot be used as both source and target")
+	}
+	c := &ListingCache{
+		wrapped: wrapped{inner: ep},
+		options: options,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	return expose(c, ep), nil
+}
+
+func listingKey(p string) string {
+	return "/" + strings.Trim(p, "/")
+}
+
+// Walk serves non-recursive walks from the cache when possible, and caches the listings that went without error.
+func (c *ListingCache) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	if recursive {
+		return c.wrapped.Walk(walknFc, root, recursive)
+	}
+	key := listingKey(root)
+	if nodes, ok := c.get(key); ok {
+		for _, n := range nodes {
+			walknFc(n.path, n.node.Clone(), nil)
+		}
+		return nil
+	}
+	var nodes []listedNode
+	failed := false
+	err := c.wrapped.Walk(func(p string, node *tree.Node, err error) {
+		if err != nil || node == nil {
+			failed = true
+		} else {
+			nodes = append(nodes, listedNode{path: p, node: node.Clone()})
+		}
+		walknFc(p, node, err)
+	}, root, recursive)
+	if err == nil && !failed {
+		c.put(key, nodes)
+	}
+	return err
+}
+
+// get returns the listing cached for key, if any and not expired.
+func (c *ListingCache) get(key string) ([]listedNode, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*listingEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return entry.nodes, true
+}
+
+// put stores a listing, evicting the least recently used ones past the cache size.
+func (c *ListingCache) put(key string, nodes []listedNode) {
+	c.Lock()
+	defer c.Unlock()
+	entry := &listingEntry{root: key, nodes: nodes}
+	if c.options.TTL > 0 {
+		entry.expires = time.Now().Add(c.options.TTL)
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.options.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*listingEntry).root)
+	}
+}
+
+// Invalidate drops the cached listings of p, of its parent folder and of all its children.
+func (c *ListingCache) Invalidate(p string) {
+	key := listingKey(p)
+	parent := path.Dir(key)
+	c.Lock()
+	defer c.Unlock()
+	for root, el := range c.entries {
+		if root == key || root == parent || strings.HasPrefix(root, strings.TrimRight(key, "/")+"/") {
+			c.lru.Remove(el)
+			delete(c.entries, root)
+		}
+	}
+}
+
+// Stats returns the number of listings served from the cache and from the wrapped endpoint.
+func (c *ListingCache) Stats() (hits, misses int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
+
+// CreateNode forwards to the wrapped endpoint and invalidates node path.
+func (c *ListingCache) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	defer c.Invalidate(node.Path)
+	return c.wrapped.CreateNode(ctx, node, updateIfExists)
+}
+
+// DeleteNode forwards to the wrapped endpoint and invalidates path.
+func (c *ListingCache) DeleteNode(ctx context.Context, path string) error {
+	defer c.Invalidate(path)
+	return c.wrapped.DeleteNode(ctx, path)
+}
+
+// MoveNode forwards to the wrapped endpoint and invalidates both paths.
+func (c *ListingCache) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	defer c.Invalidate(newPath)
+	defer c.Invalidate(oldPath)
+	return c.wrapped.MoveNode(ctx, oldPath, newPath)
+}
+
+// GetWriterOn forwards to the wrapped endpoint and invalidates p, as the written file changes its folder listing.
+func (c *ListingCache) GetWriterOn(cancel context.Context, p string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	c.Invalidate(p)
+	return c.wrapped.GetWriterOn(cancel, p, targetSize)
+}
+
+// GetWriterAt forwards to the wrapped endpoint and invalidates p, like GetWriterOn.
+func (c *ListingCache) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	c.Invalidate(p)
+	return c.wrapped.GetWriterAt(ctx, p, targetSize, offset)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/pydio/cells/common/log"
+)
+
+var (
+	storeLogger     *zap.Logger
+	storeLoggerLock sync.RWMutex
+)
+
+// SetStoreLogger replaces the logger used by the PatchStore. Passing nil restores the default application logger.
+func SetStoreLogger(logger *zap.Logger) {
+	storeLoggerLock.Lock()
+	defer storeLoggerLock.Unlock()
+	storeLogger = logger
+}
+
+// NewStoreLogger creates a logger writing to w, either in "json" or "console" (default) format.
+func NewStoreLogger(format string, w zapcore.WriteSyncer) (*zap.Logger, error) {
+	config := zap.NewProductionEncoderConfig()
+	config.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case "json":
+		encoder = zapcore.NewJSONEncoder(config)
+	case "", "console":
+		encoder = zapcore.NewConsoleEncoder(config)
+	default:
+		return nil, fmt.Errorf("unsupported log format %s, please use one of console, json", format)
+	}
+	return zap.New(zapcore.NewCore(encoder, w, zap.InfoLevel)), nil
+}
+
+// logger returns the logger used by the PatchStore.
+func (p *BoltPatchStore) logger() *zap.Logger {
+	storeLoggerLock.RLock()
+	defer storeLoggerLock.RUnlock()
+	if storeLogger != nil {
+		return storeLogger
+	}
+	return log.Logger(context.Background())
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// MemoryEndpoint keeps a whole tree in RAM, including file contents. It can be used on both sides of a
+// sync, which makes it handy for tests that need real transfers without touching the filesystem.
+type MemoryEndpoint struct {
+	*memory.DBEndpoint
+	sync.Mutex
+	contents map[string][]byte
+	// uploads holds the data committed by interrupted range uploads.
+	uploads map[string][]byte
+}
+
+// NewMemoryEndpoint creates an empty MemoryEndpoint.
+func NewMemoryEndpoint() *MemoryEndpoint {
+	return &MemoryEndpoint{
+		DBEndpoint: memory.NewMemDB(),
+		contents:   make(map[string][]byte),
+		uploads:    make(map[string][]byte),
+	}
+}
+
+// memoryWriter buffers the transferred data and stores it on Close.
+type memoryWriter struct {
+	bytes.Buffer
+	onClose func([]byte) error
+}
+
+func (w *memoryWriter) Close() error {
+	return w.onClose(w.Bytes())
+}
+
+// GetWriterOn returns a writer storing content at path once closed. The corresponding leaf is created
+// or updated with the md5 of the content as ETag.
+func (m *MemoryEndpoint) GetWriterOn(cancel context.Context, path string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	w := &memoryWriter{}
+	w.onClose = func(data []byte) error {
+		return m.storeContent(cancel, path, data)
+	}
+	return w, nil, nil, nil
+}
+
+// storeContent creates or updates the leaf at path with data as content.
+func (m *MemoryEndpoint) storeContent(ctx context.Context, path string, data []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	node := &tree.Node{
+		Path:  path,
+		Type:  tree.NodeType_LEAF,
+		Etag:  fmt.Sprintf("%x", md5.Sum(data)),
+		Size:  int64(len(data)),
+		MTime: time.Now().Unix(),
+	}
+	if existing, e := m.LoadNode(ctx, path); e == nil && existing != nil {
+		node.Uuid = existing.Uuid
+	}
+	if e := m.DBEndpoint.CreateNode(ctx, node, true); e != nil {
+		return e
+	}
+	m.Lock()
+	m.contents[memoryKey(path)] = append([]byte{}, data...)
+	m.Unlock()
+	return nil
+}
+
+// uploadWriter commits each write to the pending upload of a path, and stores the content on Close.
+type uploadWriter struct {
+	m    *MemoryEndpoint
+	ctx  context.Context
+	path string
+}
+
+func (u *uploadWriter) Write(p []byte) (int, error) {
+	if u.ctx.Err() != nil {
+		return 0, u.ctx.Err()
+	}
+	u.m.Lock()
+	defer u.m.Unlock()
+	key := memoryKey(u.path)
+	u.m.uploads[key] = append(u.m.uploads[key], p...)
+	return len(p), nil
+}
+
+func (u *uploadWriter) Close() error {
+	key := memoryKey(u.path)
+	u.m.Lock()
+	data := u.m.uploads[key]
+	u.m.Unlock()
+	if e := u.m.storeContent(u.ctx, u.path, data); e != nil {
+		return e
+	}
+	u.m.Lock()
+	delete(u.m.uploads, key)
+	u.m.Unlock()
+	return nil
+}
+
+// GetWriterAt implements RangeSyncTarget: data written is appended to the first offset bytes of the pending
+// upload of path, and committed as soon as it is written.
+func (m *MemoryEndpoint) GetWriterAt(ctx context.Context, path string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error) {
+	key := memoryKey(path)
+	m.Lock()
+	defer m.Unlock()
+	if committed := int64(len(m.uploads[key])); offset > committed {
+		return nil, nil, nil, fmt.Errorf("cannot resume upload of %s at %d, only %d bytes committed", path, offset, committed)
+	}
+	m.uploads[key] = m.uploads[key][:offset]
+	return &uploadWriter{m: m, ctx: ctx, path: path}, nil, nil, nil
+}
+
+// CommittedOffset implements RangeSyncTarget.
+func (m *MemoryEndpoint) CommittedOffset(ctx context.Context, path string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return int64(len(m.uploads[memoryKey(path)])), nil
+}
+
+// GetReaderOn returns a reader on the content stored at path.
+func (m *MemoryEndpoint) GetReaderOn(path string) (out io.ReadCloser, err error) {
+	m.Lock()
+	data, ok := m.contents[memoryKey(path)]
+	m.Unlock()
+	if !ok {
+		if _, e := m.LoadNode(context.Background(), path); e != nil {
+			return nil, e
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// DeleteNode removes the node and any content stored at or below path.
+func (m *MemoryEndpoint) DeleteNode(ctx context.Context, path string) error {
+	if err := m.DBEndpoint.DeleteNode(ctx, path); err != nil {
+		return err
+	}
+	key := memoryKey(path)
+	m.Lock()
+	defer m.Unlock()
+	for k := range m.contents {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.contents, k)
+		}
+	}
+	return nil
+}
+
+// MoveNode moves the node and any content stored at or below oldPath.
+func (m *MemoryEndpoint) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	if err := m.DBEndpoint.MoveNode(ctx, oldPath, newPath); err != nil {
+		return err
+	}
+	from, to := memoryKey(oldPath), memoryKey(newPath)
+	m.Lock()
+	defer m.Unlock()
+	moved := make(map[string][]byte)
+	for k, data := range m.contents {
+		if k == from || strings.HasPrefix(k, from+"/") {
+			delete(m.contents, k)
+			moved[to+strings.TrimPrefix(k, from)] = data
+		}
+	}
+	for k, data := range moved {
+		m.contents[k] = data
+	}
+	return nil
+}
+
+// Content returns a copy of the data stored at path, if any.
+func (m *MemoryEndpoint) Content(path string) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	data, ok := m.contents[memoryKey(path)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, data...), true
+}
+
+func memoryKey(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
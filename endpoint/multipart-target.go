@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pydio/minio-go"
+)
+
+// multipartPartSize is the size of the parts uploaded by multipartUploads, except the last one. S3 requires
+// at least 5MB.
+const multipartPartSize = 8 * 1024 * 1024
+
+// multipartUploads implements the resumable writes of RangeSyncTarget with the multipart uploads of an
+// S3-compatible API: uploaded parts stay on the server until the upload is completed or aborted.
+type multipartUploads struct {
+	// core returns the client used for each upload.
+	core   func() (*minio.Core, error)
+	bucket string
+	root   string
+}
+
+func (m multipartUploads) key(p string) string {
+	return path.Join(m.root, strings.TrimLeft(p, "/"))
+}
+
+// pendingUpload finds the most recent incomplete upload of key, and its parts numbered without gaps from 1.
+func (m multipartUploads) pendingUpload(core *minio.Core, key string) (uploadID string, parts []minio.ObjectPart, err error) {
+	uploads, err := core.ListMultipartUploads(m.bucket, key, "", "", "", 1000)
+	if err != nil {
+		return "", nil, err
+	}
+	var latest minio.ObjectMultipartInfo
+	for _, u := range uploads.Uploads {
+		if u.Key == key && (uploadID == "" || u.Initiated.After(latest.Initiated)) {
+			latest, uploadID = u, u.UploadID
+		}
+	}
+	if uploadID == "" {
+		return "", nil, nil
+	}
+	listed, err := core.ListObjectParts(m.bucket, key, uploadID, 0, 10000)
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Slice(listed.ObjectParts, func(i, j int) bool {
+		return listed.ObjectParts[i].PartNumber < listed.ObjectParts[j].PartNumber
+	})
+	for i, part := range listed.ObjectParts {
+		if part.PartNumber != i+1 {
+			break
+		}
+		parts = append(parts, part)
+	}
+	return uploadID, parts, nil
+}
+
+// CommittedOffset implements RangeSyncTarget: it is the size of the parts already uploaded for path.
+func (m multipartUploads) CommittedOffset(ctx context.Context, p string) (int64, error) {
+	core, err := m.core()
+	if err != nil {
+		return 0, err
+	}
+	_, parts, err := m.pendingUpload(core, m.key(p))
+	if err != nil {
+		return 0, err
+	}
+	var committed int64
+	for _, part := range parts {
+		committed += part.Size
+	}
+	return committed, nil
+}
+
+// GetWriterAt implements RangeSyncTarget. A zero offset starts a new upload, aborting the pending one. Other
+// offsets continue the pending upload and must fall at the end of one of its parts. The upload is completed
+// when the writer is closed after targetSize bytes, otherwise the uploaded parts are kept for the next attempt.
+func (m multipartUploads) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error) {
+	core, err := m.core()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key := m.key(p)
+	pendingID, parts, err := m.pendingUpload(core, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	w := &multipartWriter{core: core, bucket: m.bucket, key: key, size: targetSize, written: offset}
+	if offset == 0 {
+		if pendingID != "" {
+			core.AbortMultipartUpload(m.bucket, key, pendingID)
+		}
+		if w.uploadID, err = core.NewMultipartUpload(m.bucket, key, minio.PutObjectOptions{}); err != nil {
+			return nil, nil, nil, err
+		}
+		return w, nil, nil, nil
+	}
+	var committed int64
+	for _, part := range parts {
+		if committed >= offset {
+			break
+		}
+		committed += part.Size
+		w.parts = append(w.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if pendingID == "" || committed != offset {
+		return nil, nil, nil, fmt.Errorf("cannot resume upload of %s at %d, parts only end at %d", p, offset, committed)
+	}
+	w.uploadID = pendingID
+	return w, nil, nil, nil
+}
+
+// multipartWriter buffers the data written until a part is full, and uploads it.
+type multipartWriter struct {
+	core     *minio.Core
+	bucket   string
+	key      string
+	uploadID string
+	parts    []minio.CompletePart
+	buffer   bytes.Buffer
+	size     int64
+	written  int64
+	err      error
+}
+
+func (w *multipartWriter) upload(n int) error {
+	data := w.buffer.Next(n)
+	number := len(w.parts) + 1
+	part, err := w.core.PutObjectPart(w.bucket, w.key, w.uploadID, number, bytes.NewReader(data), int64(len(data)), "", "", nil)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	return nil
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buffer.Write(p)
+	w.written += int64(len(p))
+	for w.buffer.Len() >= multipartPartSize {
+		if w.err = w.upload(multipartPartSize); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// Close uploads the last part and completes the upload, unless the content is incomplete.
+func (w *multipartWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.size >= 0 && w.written != w.size {
+		return fmt.Errorf("upload of %s interrupted after %d bytes of %d", w.key, w.written, w.size)
+	}
+	if w.buffer.Len() > 0 || len(w.parts) == 0 {
+		if err := w.upload(w.buffer.Len()); err != nil {
+			return err
+		}
+	}
+	_, err := w.core.CompleteMultipartUpload(w.bucket, w.key, w.uploadID, w.parts)
+	return err
+}
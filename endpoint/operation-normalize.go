@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import "github.com/pydio/cells/common/sync/merger"
+
+// NormalizeOperations collapses the creation and the updates of a same file into their net effect, ops being
+// in the order of WalkOperationsSorted: the creation is kept, carrying the node of the last update. The order of
+// operations does not tell which of a creation and a deletion at the same path came first, so they are never
+// collapsed: the deletion may replace a previous node. Paths with a conflict or an operation in error are left as
+// they are. The order of the remaining operations is preserved, and ops is not modified.
+func NormalizeOperations(ops []merger.Operation) []merger.Operation {
+	return normalizeOperations(ops, nil)
+}
+
+// normalizeOperations is NormalizeOperations, calling merged with each original creation and the operation
+// replacing it.
+func normalizeOperations(ops []merger.Operation, merged func(original, replacement merger.Operation)) []merger.Operation {
+	kept := make(map[string]bool)
+	created := make(map[string]int)
+	updated := make(map[string][]int)
+	for i, op := range ops {
+		p := op.GetRefPath()
+		if keptAsIs(op) {
+			// Do not merge operations on a node in conflict or in error
+			kept[p] = true
+			continue
+		}
+		switch op.Type() {
+		case merger.OpCreateFile:
+			if _, ok := created[p]; ok {
+				kept[p] = true
+			}
+			created[p] = i
+		case merger.OpUpdateFile:
+			updated[p] = append(updated[p], i)
+		}
+	}
+	normalized := make([]merger.Operation, len(ops))
+	copy(normalized, ops)
+	dropped := make([]bool, len(ops))
+	for p, c := range created {
+		updates := updated[p]
+		if kept[p] || len(updates) == 0 {
+			continue
+		}
+		last := ops[updates[len(updates)-1]].GetNode()
+		if last == nil {
+			continue
+		}
+		replacement := ops[c].Clone()
+		replacement.SetNode(last)
+		if status := ops[c].GetStatus(); status != nil {
+			replacement.Status(status)
+		}
+		normalized[c] = replacement
+		if merged != nil {
+			merged(ops[c], replacement)
+		}
+		for _, u := range updates {
+			dropped[u] = true
+		}
+	}
+	result := normalized[:0]
+	for i, op := range normalized {
+		if !dropped[i] {
+			result = append(result, op)
+		}
+	}
+	return result
+}
+
+// keptAsIs tells whether an operation must not be collapsed: conflicts and operations with an error status.
+func keptAsIs(op merger.Operation) bool {
+	if op.Type() == merger.OpConflict {
+		return true
+	}
+	status := op.GetStatus()
+	return status != nil && status.IsError()
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// operationRanks orders operation types in a safe apply order: folders are created and moved before
+// files are transferred into them, and deletions come last.
+var operationRanks = map[merger.OperationType]int{
+	merger.OpCreateFolder: 0,
+	merger.OpMoveFolder:   1,
+	merger.OpMoveFile:     2,
+	merger.OpCreateFile:   3,
+	merger.OpUpdateFile:   3,
+	merger.OpRefreshUuid:  4,
+	merger.OpDelete:       6,
+}
+
+func operationRank(op merger.Operation) int {
+	if r, ok := operationRanks[op.Type()]; ok {
+		return r
+	}
+	return 5
+}
+
+func pathDepth(p string) int {
+	return strings.Count(strings.Trim(p, "/"), "/")
+}
+
+// SortOperations orders operations by type rank, then by path depth: parents come before their
+// children, except for deletions where children come first. Operations at the same depth are sorted
+// by path. The sort is stable.
+func SortOperations(ops []merger.Operation) {
+	sort.SliceStable(ops, func(i, j int) bool {
+		ri, rj := operationRank(ops[i]), operationRank(ops[j])
+		if ri != rj {
+			return ri < rj
+		}
+		pi, pj := ops[i].GetRefPath(), ops[j].GetRefPath()
+		if di, dj := pathDepth(pi), pathDepth(pj); di != dj {
+			if ops[i].Type() == merger.OpDelete {
+				return di > dj
+			}
+			return di < dj
+		}
+		return pi < pj
+	})
+}
+
+// WalkOperationsSorted is the same as patch.WalkOperations, but calls callback in the order of SortOperations.
+func WalkOperationsSorted(patch merger.Patch, opTypes []merger.OperationType, callback func(merger.Operation)) {
+	var ops []merger.Operation
+	patch.WalkOperations(opTypes, func(op merger.Operation) {
+		ops = append(ops, op)
+	})
+	SortOperations(ops)
+	for _, op := range ops {
+		callback(op)
+	}
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+	"github.com/pydio/cells/common/sync/proc"
+)
+
+// ErrInterrupted is set on the operations that were not applied because processing was interrupted.
+var ErrInterrupted = errors.New("patch processing was interrupted")
+
+// ParallelProcessor is a PatchProcessor applying independent operations concurrently. Operations are
+// grouped in stages following SortOperations: all operations of a stage share the same type rank and path
+// depth, so parents are always created before their children (and deleted after them). Moves are applied one
+// at a time, each after the moves leaving its target. Stages are applied one after the other, each by at most
+// Workers goroutines. Errors are set on each failed operation.
+// Pause, Resume and Interrupt commands published on the Process command are applied between operations.
+type ParallelProcessor struct {
+	// Workers is the number of operations applied at the same time. Values <= 1 apply operations serially.
+	Workers int
+	// Fallback applies the operation types that are not handled directly, like uuid refreshes.
+	Fallback PatchProcessor
+	// Versions, if set, is checked by Process before creating, updating or deleting each file: if the target file
+	// changed since it was captured, the operation fails with ErrTargetChanged and a conflict is added to the patch
+	// instead. Use ProcessWithVersions to check versions captured for a given patch.
+	Versions *TargetVersions
+	// Offsets, if set, records how much of an upload was committed when it fails, so that the next attempt
+	// resumes from there on targets implementing RangeSyncTarget. Other targets always upload whole files.
+	Offsets TransferOffsets
+	// OnStatus, if set, receives a processing status after each applied operation, with its node, its error
+	// and the overall progress of the patch. It is called from the workers goroutines.
+	OnStatus func(status model.Status)
+	// OnTransferred, if set, receives the number of bytes of each chunk written to the target while transferring
+	// contents. It is called from the workers goroutines.
+	OnTransferred func(bytes int64)
+}
+
+// NewParallelProcessor creates a ParallelProcessor using the sync library processor as fallback.
+func NewParallelProcessor(workers int) *ParallelProcessor {
+	return &ParallelProcessor{
+		Workers:  workers,
+		Fallback: proc.NewProcessor(context.Background()),
+	}
+}
+
+// Process implements PatchProcessor.
+func (pp *ParallelProcessor) Process(patch merger.Patch, cmd *model.Command) {
+	pp.ProcessWithVersions(patch, cmd, pp.Versions)
+}
+
+// ProcessWithVersions applies patch like Process, checking the target files against versions, usually captured
+// by CaptureTargetVersions right after patch was computed. A nil versions disables the checks.
+func (pp *ParallelProcessor) ProcessWithVersions(patch merger.Patch, cmd *model.Command, versions *TargetVersions) {
+	var ops []merger.Operation
+	var others []merger.Operation
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		switch op.Type() {
+		case merger.OpCreateFolder, merger.OpCreateFile, merger.OpUpdateFile, merger.OpMoveFolder, merger.OpMoveFile, merger.OpDelete:
+			ops = append(ops, op)
+		default:
+			others = append(others, op)
+		}
+	})
+	SortOperations(ops)
+	ctx, gate, stop := followCommands(context.Background(), cmd)
+	defer stop()
+	progress := &patchProgress{total: len(ops) + len(others)}
+	var conflicts []merger.Operation
+	for _, stage := range operationStages(ops) {
+		conflicts = append(conflicts, pp.applyStage(ctx, gate, progress, versions, stage)...)
+	}
+	for _, c := range conflicts {
+		patch.Enqueue(c)
+	}
+	if len(others) == 0 {
+		return
+	}
+	if ctx.Err() != nil {
+		for _, op := range others {
+			op.Error(ErrInterrupted)
+		}
+		return
+	}
+	if pp.Fallback == nil {
+		for _, op := range others {
+			op.Error(fmt.Errorf("unsupported operation type %s", op.Type().String()))
+		}
+		return
+	}
+	rest := merger.NewPatch(patch.Source(), patch.Target(), merger.PatchOptions{})
+	for _, op := range others {
+		rest.Enqueue(op)
+	}
+	pp.Fallback.Process(rest, cmd)
+}
+
+// operationStages splits sorted operations into consecutive groups sharing the same rank and depth. Moves are
+// applied one at a time in the order of orderMoves, as concurrent moves of a chain or a swap would race.
+func operationStages(ops []merger.Operation) (stages [][]merger.Operation) {
+	ops = orderMoves(ops)
+	for i, op := range ops {
+		if i == 0 || isMove(op) || isMove(ops[i-1]) || operationRank(op) != operationRank(ops[i-1]) || pathDepth(op.GetRefPath()) != pathDepth(ops[i-1].GetRefPath()) {
+			stages = append(stages, nil)
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], op)
+	}
+	return
+}
+
+func isMove(op merger.Operation) bool {
+	return op.Type() == merger.OpMoveFolder || op.Type() == merger.OpMoveFile
+}
+
+// orderMoves returns sorted operations where each run of moves of the same rank is reordered so that a move comes
+// after the moves leaving its target path, like b to c before a to b. Moves in a cycle keep their sorted order.
+func orderMoves(ops []merger.Operation) []merger.Operation {
+	ordered := make([]merger.Operation, 0, len(ops))
+	for i := 0; i < len(ops); {
+		j := i
+		for j < len(ops) && isMove(ops[j]) && operationRank(ops[j]) == operationRank(ops[i]) {
+			j++
+		}
+		if j == i {
+			ordered = append(ordered, ops[i])
+			i++
+			continue
+		}
+		pending := append([]merger.Operation{}, ops[i:j]...)
+		for len(pending) > 0 {
+			next := 0
+			for k, op := range pending {
+				if !leavesPath(pending, op.GetRefPath(), k) {
+					next = k
+					break
+				}
+			}
+			ordered = append(ordered, pending[next])
+			pending = append(pending[:next], pending[next+1:]...)
+		}
+		i = j
+	}
+	return ordered
+}
+
+// leavesPath tells whether a move of pending other than the one at index skip moves a node away from p.
+func leavesPath(pending []merger.Operation, p string, skip int) bool {
+	for k, op := range pending {
+		if k != skip && op.GetMoveOriginPath() == p {
+			return true
+		}
+	}
+	return false
+}
+
+// applyStage applies all operations of a stage and waits for them to finish. It returns the conflicts raised
+// by the version checks.
+func (pp *ParallelProcessor) applyStage(ctx context.Context, gate *commandGate, progress *patchProgress, versions *TargetVersions, stage []merger.Operation) (conflicts []merger.Operation) {
+	workers := pp.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan merger.Operation)
+	wg := &sync.WaitGroup{}
+	lock := &sync.Mutex{}
+	for i := 0; i < workers && i < len(stage); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range queue {
+				if gate.wait(ctx) != nil {
+					op.Error(ErrInterrupted)
+					continue
+				}
+				if versions != nil {
+					if current, changed := versions.Changed(ctx, op.Target(), op); changed {
+						op.Error(ErrTargetChanged)
+						lock.Lock()
+						conflicts = append(conflicts, versionConflict(op, current))
+						lock.Unlock()
+						pp.publish(op, progress, ErrTargetChanged)
+						continue
+					}
+				}
+				err := pp.applyOperation(ctx, op)
+				if err != nil {
+					op.Error(err)
+				}
+				pp.publish(op, progress, err)
+			}
+		}()
+	}
+	for _, op := range stage {
+		queue <- op
+	}
+	close(queue)
+	wg.Wait()
+	return
+}
+
+// applyOperation applies a single operation to its target, which is the patch target unless the operation goes
+// the other way in a bidirectional patch.
+func (pp *ParallelProcessor) applyOperation(ctx context.Context, op merger.Operation) error {
+	target := op.Target()
+	switch op.Type() {
+	case merger.OpCreateFolder:
+		return target.CreateNode(ctx, op.GetNode(), false)
+	case merger.OpCreateFile, merger.OpUpdateFile:
+		if SymlinkTarget(op.GetNode()) != "" {
+			// Preserved links have no content, the target recreates them from their metadata
+			link := op.GetNode().Clone()
+			link.Path = op.GetRefPath()
+			return target.CreateNode(ctx, link, true)
+		}
+		ds, ok := op.Source().(model.DataSyncSource)
+		if !ok {
+			return fmt.Errorf("cannot transfer %s: source cannot provide contents", op.GetRefPath())
+		}
+		dt, ok := target.(model.DataSyncTarget)
+		if !ok {
+			return fmt.Errorf("cannot transfer %s: target cannot receive contents", op.GetRefPath())
+		}
+		if rt, ok := target.(RangeSyncTarget); ok && pp.Offsets != nil {
+			return pp.resumeTransfer(ctx, ds, rt, op)
+		}
+		return transferContent(ctx, ds, dt, op.GetRefPath(), op.GetNode().GetSize(), pp.OnTransferred)
+	case merger.OpMoveFolder, merger.OpMoveFile:
+		return target.MoveNode(ctx, op.GetMoveOriginPath(), op.GetRefPath())
+	case merger.OpDelete:
+		return target.DeleteNode(ctx, op.GetRefPath())
+	}
+	return fmt.Errorf("unsupported operation type %s", op.Type().String())
+}
+
+// patchProgress counts the operations of a patch applied so far.
+type patchProgress struct {
+	sync.Mutex
+	done, total int
+}
+
+// publish sends the status of an applied operation to OnStatus.
+func (pp *ParallelProcessor) publish(op merger.Operation, progress *patchProgress, err error) {
+	if pp.OnStatus == nil {
+		return
+	}
+	progress.Lock()
+	progress.done++
+	ratio := float32(progress.done) / float32(progress.total)
+	progress.Unlock()
+	status := model.NewProcessingStatus(fmt.Sprintf("Applied %s on %s", op.Type().String(), op.GetRefPath()))
+	status.SetNode(op.GetNode())
+	status.SetProgress(ratio)
+	if err != nil {
+		status.SetError(err)
+	}
+	pp.OnStatus(status)
+}
+
+// commandGate blocks workers while processing is paused.
+type commandGate struct {
+	sync.Mutex
+	resumed chan struct{}
+}
+
+// followCommands applies the commands published on cmd while a patch is processed: Pause and Resume drive the
+// returned gate, Interrupt cancels the returned context. stop must be called once processing is over.
+func followCommands(parent context.Context, cmd *model.Command) (ctx context.Context, gate *commandGate, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+	gate = &commandGate{resumed: make(chan struct{})}
+	close(gate.resumed)
+	if cmd == nil {
+		return ctx, gate, cancel
+	}
+	commands, unsubscribe := cmd.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case c, ok := <-commands:
+				if !ok {
+					return
+				}
+				switch c {
+				case model.Pause:
+					gate.pause()
+				case model.Resume:
+					gate.resume()
+				case model.Interrupt:
+					cancel()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ctx, gate, func() {
+		close(done)
+		unsubscribe()
+		cancel()
+	}
+}
+
+func (g *commandGate) pause() {
+	g.Lock()
+	defer g.Unlock()
+	select {
+	case <-g.resumed:
+		g.resumed = make(chan struct{})
+	default:
+	}
+}
+
+func (g *commandGate) resume() {
+	g.Lock()
+	defer g.Unlock()
+	select {
+	case <-g.resumed:
+	default:
+		close(g.resumed)
+	}
+}
+
+// wait blocks while the gate is paused, and returns the context error once it is cancelled.
+func (g *commandGate) wait(ctx context.Context) error {
+	g.Lock()
+	resumed := g.resumed
+	g.Unlock()
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+	return ctx.Err()
+}
+
+// transferContent copies the content at path from source to target.
+func transferContent(ctx context.Context, source model.DataSyncSource, target model.DataSyncTarget, path string, size int64, written func(int64)) error {
+	return copyContent(ctx, source, path, 0, func() (io.WriteCloser, chan bool, chan error, error) {
+		return target.GetWriterOn(ctx, path, size)
+	}, written)
+}
+
+// countingWriter reports the size of each chunk written through it.
+type countingWriter struct {
+	io.Writer
+	written func(int64)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.written(int64(n))
+	return n, err
+}
+
+// copyContent copies the content at path from source, skipping its first offset bytes, to the writer
+// returned by open. written, if not nil, receives the size of each chunk copied.
+func copyContent(ctx context.Context, source model.DataSyncSource, path string, offset int64, open func() (io.WriteCloser, chan bool, chan error, error), written func(int64)) error {
+	reader, err := source.GetReaderOn(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if offset > 0 {
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, reader, offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	writer, done, errs, err := open()
+	if err != nil {
+		return err
+	}
+	var dest io.Writer = writer
+	if written != nil {
+		dest = countingWriter{Writer: writer, written: written}
+	}
+	if _, err := io.Copy(dest, reader); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if done == nil && errs == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
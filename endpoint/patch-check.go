@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/etcd-io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ErrCorruptStore is returned when the DB file cannot be read and the CorruptionPolicy is CorruptionFail.
+var ErrCorruptStore = errors.New("patch store file is corrupted")
+
+// CorruptionPolicy tells what to do when the DB file is found corrupted on open.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail returns ErrCorruptStore and leaves the file as is.
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionBackup renames the file with a ".corrupt" suffix and starts with an empty store.
+	CorruptionBackup
+)
+
+// corruptBackupSuffix is appended to the name of corrupted DB files kept aside.
+const corruptBackupSuffix = ".corrupt"
+
+// openDB opens the DB file and reads all its buckets, as a truncated or corrupted file may be opened
+// successfully by bbolt but panic on reads. Corruptions are reported as ErrCorruptStore.
+func (p *BoltPatchStore) openDB(dbPath string, options *bbolt.Options) (*bbolt.DB, error) {
+	db, err := openBolt(dbPath, options)
+	if err == bbolt.ErrInvalid || err == bbolt.ErrChecksum || err == bbolt.ErrVersionMismatch {
+		p.logger().Error("Cannot open patch store", zap.String("path", dbPath), zap.Error(err))
+		return nil, ErrCorruptStore
+	} else if err != nil {
+		return nil, err
+	}
+	if err := checkConsistency(db); err != nil {
+		p.logger().Error("Patch store failed consistency check", zap.String("path", dbPath), zap.Error(err))
+		db.Close()
+		return nil, ErrCorruptStore
+	}
+	return db, nil
+}
+
+// openDBWithPolicy opens the DB file and applies policy if it is corrupted.
+func (p *BoltPatchStore) openDBWithPolicy(dbPath string, options *bbolt.Options, policy CorruptionPolicy) (*bbolt.DB, error) {
+	db, err := p.openDB(dbPath, options)
+	if err != ErrCorruptStore || policy != CorruptionBackup || options.ReadOnly {
+		return db, err
+	}
+	backup := dbPath + corruptBackupSuffix
+	if e := os.Rename(dbPath, backup); e != nil {
+		return nil, e
+	}
+	p.logger().Warn("Patch store was corrupted, starting with an empty one", zap.String("backup", backup))
+	return p.openDB(dbPath, options)
+}
+
+func openBolt(dbPath string, options *bbolt.Options) (db *bbolt.DB, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			db, err = nil, bbolt.ErrInvalid
+		}
+	}()
+	return bbolt.Open(dbPath, 0644, options)
+}
+
+// checkConsistency walks all buckets and values of the DB, turning read panics into errors.
+func checkConsistency(db *bbolt.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while reading: %v", r)
+		}
+	}()
+	return db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			return walkBucket(b)
+		})
+	})
+}
+
+func walkBucket(b *bbolt.Bucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if nested := b.Bucket(k); nested != nil {
+				return walkBucket(nested)
+			}
+		}
+		return nil
+	})
+}
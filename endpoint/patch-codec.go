@@ -0,0 +1,252 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// opErrorKey is the JSON key used to store an operation error along with the serialized operation.
+const opErrorKey = "OpError"
+
+// conflictTypeNames are the stable names used to serialize merger.ConflictType values.
+var conflictTypeNames = map[merger.ConflictType]string{
+	merger.ConflictNodeType:       "node-type",
+	merger.ConflictFileContent:    "file-content",
+	merger.ConflictFolderUUID:     "folder-uuid",
+	merger.ConflictFileUUID:       "file-uuid",
+	merger.ConflictMoveSameSource: "move-same-source",
+	merger.ConflictMoveSameTarget: "move-same-target",
+}
+
+// ConflictTypeName returns a stable, human-readable name for a conflict type. Unknown types are
+// named after their integer value.
+func ConflictTypeName(t merger.ConflictType) string {
+	if name, ok := conflictTypeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// ParseConflictType is the reverse of ConflictTypeName.
+func ParseConflictType(name string) (merger.ConflictType, error) {
+	for t, n := range conflictTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	if i, e := strconv.Atoi(name); e == nil {
+		return merger.ConflictType(i), nil
+	}
+	return 0, fmt.Errorf("unknown conflict type %q", name)
+}
+
+// OperationCodec serializes operations for storing them inside the PatchStore.
+type OperationCodec interface {
+	Marshal(op merger.Operation) ([]byte, error)
+	Unmarshal(data []byte) (merger.Operation, error)
+}
+
+// JSONCodec is the default OperationCodec, storing operations as JSON.
+type JSONCodec struct{}
+
+// Marshal serializes an operation to JSON, adding its error (if any) under the opErrorKey.
+func (JSONCodec) Marshal(op merger.Operation) ([]byte, error) {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	status := op.GetStatus()
+	hasError := status != nil && status.IsError() && status.Error() != nil
+	if !hasError && op.Type() != merger.OpConflict {
+		return data, nil
+	}
+	var ii map[string]interface{}
+	if err := json.Unmarshal(data, &ii); err != nil {
+		return nil, err
+	}
+	if t, ok := ii["ConflictType"].(float64); ok {
+		ii["ConflictType"] = ConflictTypeName(merger.ConflictType(int(t)))
+	}
+	if hasError {
+		ii[opErrorKey] = status.Error().Error()
+	}
+	return json.Marshal(ii)
+}
+
+// Unmarshal rebuilds an operation from JSON, including conflicts and operation errors.
+func (JSONCodec) Unmarshal(data []byte) (merger.Operation, error) {
+	operation := merger.NewOpForUnmarshall()
+	if err := json.Unmarshal(data, &operation); err != nil {
+		return nil, err
+	}
+	operation, err := unmarshalConflict(data, operation)
+	if err != nil {
+		return nil, err
+	}
+	unmarshalOperationError(data, operation)
+	return operation, nil
+}
+
+// DTOCodec stores operations in the OperationDTO wire format, which does not depend on the merger internals.
+// Values written by JSONCodec, which carry no version, are still read transparently.
+type DTOCodec struct{}
+
+// storedOperation is an OperationDTO tagged with the format version.
+type storedOperation struct {
+	Version int `json:"version"`
+	OperationDTO
+}
+
+// Marshal serializes an operation to a versioned OperationDTO.
+func (DTOCodec) Marshal(op merger.Operation) ([]byte, error) {
+	return json.Marshal(storedOperation{Version: DTOVersion, OperationDTO: NewOperationDTO(op)})
+}
+
+// Unmarshal rebuilds an operation from an OperationDTO, or from legacy JSON.
+func (DTOCodec) Unmarshal(data []byte) (merger.Operation, error) {
+	var stored storedOperation
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Version == 0 {
+		return JSONCodec{}.Unmarshal(data)
+	}
+	if stored.Version > DTOVersion {
+		return nil, fmt.Errorf("operation format version %d is not supported", stored.Version)
+	}
+	return stored.OperationDTO.Operation()
+}
+
+// FlateCodec stores operations as deflate-compressed JSON, which is much more compact for
+// patches with large nodes. Legacy plain JSON values are still read transparently.
+type FlateCodec struct{}
+
+// Marshal serializes an operation to compressed JSON.
+func (FlateCodec) Marshal(op merger.Operation) ([]byte, error) {
+	data, err := JSONCodec{}.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal rebuilds an operation from compressed or plain JSON.
+func (FlateCodec) Unmarshal(data []byte) (merger.Operation, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return JSONCodec{}.Unmarshal(data)
+	}
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return JSONCodec{}.Unmarshal(raw)
+}
+
+func unmarshalConflict(data []byte, op merger.Operation) (merger.Operation, error) {
+	if op.Type() != merger.OpConflict {
+		return op, nil
+	}
+	cType, leftOp, rightOp, err := decodeConflictInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	// replace op now
+	conflict := merger.NewConflictOperation(op.GetNode(), cType, leftOp, rightOp)
+	return conflict, nil
+}
+
+// ConflictInfo extracts the conflict type and both sides operations from a conflict operation.
+func ConflictInfo(op merger.Operation) (cType merger.ConflictType, leftOp, rightOp merger.Operation, err error) {
+	if op.Type() != merger.OpConflict {
+		err = fmt.Errorf("operation is not a conflict")
+		return
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return
+	}
+	return decodeConflictInfo(data)
+}
+
+// decodeConflictInfo reads the ConflictType, LeftOp and RightOp keys of a JSON-serialized conflict.
+func decodeConflictInfo(data []byte) (cType merger.ConflictType, leftOp, rightOp merger.Operation, err error) {
+	var ii map[string]interface{}
+	if err = json.Unmarshal(data, &ii); err != nil {
+		return
+	}
+	switch t := ii["ConflictType"].(type) {
+	case float64:
+		// Legacy integer value
+		cType = merger.ConflictType(int(t))
+	case string:
+		if cType, err = ParseConflictType(t); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unmarshalling conflict: missing key ConflictType")
+		return
+	}
+	if left, o := ii["LeftOp"]; o {
+		remarsh, _ := json.Marshal(left)
+		leftOp = merger.NewOpForUnmarshall()
+		if err = json.Unmarshal(remarsh, &leftOp); err != nil {
+			return
+		}
+	} else {
+		err = fmt.Errorf("unmarshalling conflict: missing key LeftOp")
+		return
+	}
+	if right, o := ii["RightOp"]; o {
+		remarsh, _ := json.Marshal(right)
+		rightOp = merger.NewOpForUnmarshall()
+		if err = json.Unmarshal(remarsh, &rightOp); err != nil {
+			return
+		}
+	} else {
+		err = fmt.Errorf("unmarshalling conflict: missing key RightOp")
+		return
+	}
+	return
+}
+
+// unmarshalOperationError restores the error stored along with an operation, if any.
+func unmarshalOperationError(data []byte, op merger.Operation) {
+	var ii map[string]interface{}
+	if err := json.Unmarshal(data, &ii); err != nil {
+		return
+	}
+	if msg, ok := ii[opErrorKey].(string); ok && msg != "" {
+		op.Error(errors.New(msg))
+	}
+}
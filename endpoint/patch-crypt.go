@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+var (
+	metaBucket  = []byte("meta")
+	keyCheckKey = []byte("keyCheck")
+	keyCheck    = []byte("cells-sync-patch-store")
+)
+
+// ErrInvalidKey is returned when opening an encrypted PatchStore with a wrong key.
+var ErrInvalidKey = errors.New("invalid encryption key for patch store")
+
+// ErrEncryptedStore is returned when opening an encrypted PatchStore without key.
+var ErrEncryptedStore = errors.New("patch store is encrypted, please provide its encryption key")
+
+// valueCipher encrypts DB values with AES-GCM, prefixing them with a random nonce.
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+func newValueCipher(key []byte) (*valueCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCipher{aead: aead}, nil
+}
+
+func (c *valueCipher) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (c *valueCipher) open(data []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, ErrInvalidKey
+	}
+	plain, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return plain, nil
+}
+
+// encryptedCodec encrypts the output of another OperationCodec.
+type encryptedCodec struct {
+	codec  OperationCodec
+	cipher *valueCipher
+}
+
+func (e encryptedCodec) Marshal(op merger.Operation) ([]byte, error) {
+	data, err := e.codec.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	return e.cipher.seal(data)
+}
+
+func (e encryptedCodec) Unmarshal(data []byte) (merger.Operation, error) {
+	plain, err := e.cipher.open(data)
+	if err != nil {
+		return nil, err
+	}
+	return e.codec.Unmarshal(plain)
+}
+
+// checkEncryption verifies that the store key matches the one used to create the DB, recording a
+// key check value on first use.
+func (p *BoltPatchStore) checkEncryption() error {
+	var check []byte
+	p.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			check = b.Get(keyCheckKey)
+		}
+		return nil
+	})
+	if check != nil {
+		if p.cipher == nil {
+			return ErrEncryptedStore
+		}
+		if plain, err := p.cipher.open(check); err != nil || string(plain) != string(keyCheck) {
+			return ErrInvalidKey
+		}
+		return nil
+	}
+	if p.cipher == nil || p.readOnly {
+		return nil
+	}
+	sealed, err := p.cipher.seal(keyCheck)
+	if err != nil {
+		return err
+	}
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(keyCheckKey, sealed)
+	})
+}
+
+// sealValue encrypts a value before storing it, if the store is encrypted.
+func (p *BoltPatchStore) sealValue(v []byte) []byte {
+	if p.cipher == nil {
+		return v
+	}
+	sealed, err := p.cipher.seal(v)
+	if err != nil {
+		return nil
+	}
+	return sealed
+}
+
+// openValue decrypts a stored value, if the store is encrypted.
+func (p *BoltPatchStore) openValue(v []byte) ([]byte, error) {
+	if p.cipher == nil || v == nil {
+		return v, nil
+	}
+	return p.cipher.open(v)
+}
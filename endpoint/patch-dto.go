@@ -0,0 +1,228 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// DTOVersion is the version of the PatchDTO and OperationDTO formats. It is bumped on any incompatible change
+// of the documented keys.
+const DTOVersion = 1
+
+// PatchDTO is the stable wire format of a patch, decoupled from the merger internals. Its documented keys are
+// version, uuid, stamp, source, label, durationMs, errors and operations.
+type PatchDTO struct {
+	Version    int            `json:"version"`
+	UUID       string         `json:"uuid"`
+	Stamp      time.Time      `json:"stamp"`
+	Source     string         `json:"source,omitempty"`
+	Label      string         `json:"label,omitempty"`
+	DurationMs int64          `json:"durationMs,omitempty"`
+	Errors     []string       `json:"errors,omitempty"`
+	Operations []OperationDTO `json:"operations"`
+}
+
+// OperationDTO is the stable wire format of an operation. Its documented keys are type, path, from, nodeType,
+// uuid, etag, size, mtime, meta, error, conflict and reason.
+type OperationDTO struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// From is the origin path of move operations.
+	From     string            `json:"from,omitempty"`
+	NodeType string            `json:"nodeType,omitempty"`
+	UUID     string            `json:"uuid,omitempty"`
+	Etag     string            `json:"etag,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	MTime    int64             `json:"mtime,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	// Conflict is only set on conflict operations.
+	Conflict *ConflictDTO `json:"conflict,omitempty"`
+	// Reason explains why the operation exists, for patches loaded from the PatchStore.
+	Reason *OperationReason `json:"reason,omitempty"`
+}
+
+// ConflictDTO is the stable wire format of the details of a conflict operation. Its documented keys are
+// type, left and right.
+type ConflictDTO struct {
+	Type  string       `json:"type"`
+	Left  OperationDTO `json:"left"`
+	Right OperationDTO `json:"right"`
+}
+
+// OperationRefDTO is the wire format of an OperationRef.
+type OperationRefDTO struct {
+	PatchUUID string       `json:"patchUuid"`
+	Stamp     time.Time    `json:"stamp"`
+	Operation OperationDTO `json:"operation"`
+}
+
+// PatchJSON is the former name of PatchDTO.
+//
+// Deprecated: use PatchDTO.
+type PatchJSON = PatchDTO
+
+// OperationJSON is the former name of OperationDTO.
+//
+// Deprecated: use OperationDTO.
+type OperationJSON = OperationDTO
+
+// NewPatchJSON is the former name of NewPatchDTO.
+//
+// Deprecated: use NewPatchDTO.
+func NewPatchJSON(patch merger.Patch) PatchDTO {
+	return NewPatchDTO(patch)
+}
+
+// NewPatchDTO converts a patch to its wire format.
+func NewPatchDTO(patch merger.Patch) PatchDTO {
+	pj := PatchDTO{
+		Version:    DTOVersion,
+		UUID:       patch.GetUUID(),
+		Stamp:      patch.GetStamp(),
+		Label:      PatchLabel(patch),
+		DurationMs: int64(PatchDuration(patch) / time.Millisecond),
+		Operations: []OperationDTO{},
+	}
+	if src := patch.Source(); src != nil {
+		pj.Source = src.GetEndpointInfo().URI
+	}
+	for _, e := range ListPatchErrors(patch) {
+		pj.Errors = append(pj.Errors, e.Error())
+	}
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		oj := NewOperationDTO(op)
+		if reason, ok := OperationReasonOf(patch, op); ok {
+			oj.Reason = &reason
+		}
+		pj.Operations = append(pj.Operations, oj)
+	})
+	return pj
+}
+
+// NewOperationDTO converts an operation to its wire format.
+func NewOperationDTO(op merger.Operation) OperationDTO {
+	oj := OperationDTO{
+		Type: op.Type().String(),
+		Path: op.GetRefPath(),
+	}
+	if n := op.GetNode(); n != nil {
+		oj.UUID = n.Uuid
+		oj.Etag = n.Etag
+		oj.Size = n.Size
+		oj.MTime = n.MTime
+		oj.Meta = n.MetaStore
+		if n.Type == tree.NodeType_COLLECTION {
+			oj.NodeType = "folder"
+		} else {
+			oj.NodeType = "file"
+		}
+	}
+	if status := op.GetStatus(); status != nil && status.IsError() && status.Error() != nil {
+		oj.Error = status.Error().Error()
+	}
+	switch op.Type() {
+	case merger.OpMoveFile, merger.OpMoveFolder:
+		oj.From = op.GetMoveOriginPath()
+	case merger.OpConflict:
+		if cType, left, right, e := ConflictInfo(op); e == nil {
+			oj.Conflict = &ConflictDTO{
+				Type:  ConflictTypeName(cType),
+				Left:  NewOperationDTO(left),
+				Right: NewOperationDTO(right),
+			}
+		}
+	}
+	return oj
+}
+
+// operationTypes are the operation types known by the wire format, by their name.
+var operationTypes = map[string]merger.OperationType{}
+
+func init() {
+	for _, t := range []merger.OperationType{
+		merger.OpCreateFile,
+		merger.OpCreateFolder,
+		merger.OpMoveFile,
+		merger.OpMoveFolder,
+		merger.OpUpdateFile,
+		merger.OpDelete,
+		merger.OpRefreshUuid,
+		merger.OpConflict,
+	} {
+		operationTypes[t.String()] = t
+	}
+}
+
+// Operation rebuilds a merger.Operation from its wire format.
+func (oj OperationDTO) Operation() (merger.Operation, error) {
+	opType, ok := operationTypes[oj.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported operation type %q", oj.Type)
+	}
+	node := &tree.Node{
+		Path:      oj.Path,
+		Uuid:      oj.UUID,
+		Etag:      oj.Etag,
+		Size:      oj.Size,
+		MTime:     oj.MTime,
+		MetaStore: oj.Meta,
+		Type:      tree.NodeType_LEAF,
+	}
+	if oj.NodeType == "folder" {
+		node.Type = tree.NodeType_COLLECTION
+	}
+	var op merger.Operation
+	switch opType {
+	case merger.OpMoveFile, merger.OpMoveFolder:
+		node.Path = oj.From
+		op = merger.NewOperation(opType, model.EventInfo{Path: oj.Path}, node)
+	case merger.OpConflict:
+		if oj.Conflict == nil {
+			return nil, fmt.Errorf("conflict on %s misses its details", oj.Path)
+		}
+		cType, e := ParseConflictType(oj.Conflict.Type)
+		if e != nil {
+			return nil, e
+		}
+		left, e := oj.Conflict.Left.Operation()
+		if e != nil {
+			return nil, e
+		}
+		right, e := oj.Conflict.Right.Operation()
+		if e != nil {
+			return nil, e
+		}
+		op = merger.NewConflictOperation(node, cType, left, right)
+	default:
+		op = merger.NewOperation(opType, model.EventInfo{Path: oj.Path}, node)
+	}
+	if oj.Error != "" {
+		op.Error(errors.New(oj.Error))
+	}
+	return op, nil
+}
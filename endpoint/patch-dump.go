@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// DumpPatches writes the patches returned by store.Load(offset, limit) to w, as an indented JSON array of PatchDTO.
+// It does not write to the store: open it with PatchStoreOptions.ReadOnly to guarantee the DB is left untouched.
+func DumpPatches(w io.Writer, store PatchStore, offset, limit int) error {
+	patches, e := store.Load(offset, limit)
+	if e != nil {
+		return e
+	}
+	out := make([]PatchDTO, 0, len(patches))
+	for _, patch := range patches {
+		out = append(out, NewPatchDTO(patch))
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// Import reads patches exported by DumpPatches and writes them to the store in a single transaction,
+// preserving their UUIDs, stamps, errors and directions. Existing patches with the same UUIDs are
+// replaced. The whole input is validated first: nothing is written if a UUID is missing or
+// duplicated, or a stamp is missing.
+func (p *BoltPatchStore) Import(r io.Reader) (imported int, e error) {
+	if p.readOnly {
+		return 0, ErrReadOnlyStore
+	}
+	var pjs []PatchDTO
+	if e := json.NewDecoder(r).Decode(&pjs); e != nil {
+		return 0, e
+	}
+	seen := make(map[string]bool, len(pjs))
+	var patches []merger.Patch
+	for i, pj := range pjs {
+		if pj.UUID == "" {
+			return 0, fmt.Errorf("patch #%d has no uuid", i)
+		}
+		if seen[pj.UUID] {
+			return 0, fmt.Errorf("duplicate patch uuid %s", pj.UUID)
+		}
+		seen[pj.UUID] = true
+		if pj.Stamp.IsZero() {
+			return 0, fmt.Errorf("patch %s has no stamp", pj.UUID)
+		}
+		patch, e := p.patchFromDTO(pj)
+		if e != nil {
+			return 0, fmt.Errorf("patch %s: %v", pj.UUID, e)
+		}
+		patches = append(patches, patch)
+	}
+	e = p.update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(patchBucket)
+		if err != nil {
+			return err
+		}
+		for _, patch := range patches {
+			if _, err := p.writePatch(bucket, patch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		return 0, e
+	}
+	if _, err := p.Prune(); err != nil {
+		return len(patches), err
+	}
+	return len(patches), nil
+}
+
+// patchFromDTO rebuilds a patch from its exported representation.
+func (p *BoltPatchStore) patchFromDTO(pj PatchDTO) (merger.Patch, error) {
+	source, target := asSource(p.source), asTarget(p.target)
+	if pj.Source != "" && pj.Source != p.source.GetEndpointInfo().URI && pj.Source == p.target.GetEndpointInfo().URI {
+		source, target = asSource(p.target), asTarget(p.source)
+	}
+	patch := merger.NewPatch(source, target, merger.PatchOptions{})
+	patch.SetUUID(pj.UUID)
+	if len(pj.Errors) == 1 {
+		patch.SetPatchError(errors.New(pj.Errors[0]))
+	} else if len(pj.Errors) > 1 {
+		var pe PatchErrors
+		for _, m := range pj.Errors {
+			pe = append(pe, errors.New(m))
+		}
+		patch.SetPatchError(pe)
+	}
+	// Set stamp after errors, as SetPatchError resets it
+	patch.Stamp(pj.Stamp)
+	for _, oj := range pj.Operations {
+		op, e := oj.Operation()
+		if e != nil {
+			return nil, e
+		}
+		patch.Enqueue(op)
+	}
+	return WithDuration(patch, time.Duration(pj.DurationMs)*time.Millisecond), nil
+}
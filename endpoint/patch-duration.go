@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"time"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// durationKey stores the time spent applying a patch, in nanoseconds.
+var durationKey = []byte("duration")
+
+// TimedPatch adds the time it took to apply a patch to a merger.Patch.
+type TimedPatch struct {
+	merger.Patch
+	duration time.Duration
+}
+
+// Duration returns the time spent applying the patch.
+func (t *TimedPatch) Duration() time.Duration {
+	return t.duration
+}
+
+// WithDuration attaches the time spent applying patch, so that it is persisted by the PatchStore.
+func WithDuration(patch merger.Patch, d time.Duration) merger.Patch {
+	if t, ok := patch.(*TimedPatch); ok {
+		patch = t.Patch
+	}
+	if d <= 0 {
+		return patch
+	}
+	return &TimedPatch{Patch: patch, duration: d}
+}
+
+// PatchDuration returns the time spent applying patch, or zero if it is unknown, as for legacy records.
+func PatchDuration(patch merger.Patch) time.Duration {
+	if t, ok := patch.(interface{ Duration() time.Duration }); ok {
+		return t.Duration()
+	}
+	return 0
+}
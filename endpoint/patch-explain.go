@@ -0,0 +1,199 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// reasonsKey is the bucket storing the OperationReason of each operation of a patch, under the same
+// sequence key as the operation in the opsKey bucket.
+var reasonsKey = []byte("reasons")
+
+// Comparisons that trigger an operation.
+const (
+	// ComparisonExistence means the node exists on one side only.
+	ComparisonExistence = "existence"
+	// ComparisonHash means the file contents hashes differ.
+	ComparisonHash = "hash"
+	// ComparisonSize means the file sizes differ.
+	ComparisonSize = "size"
+	// ComparisonMTime means the modification times differ.
+	ComparisonMTime = "mtime"
+	// ComparisonPath means the same node was found at different paths.
+	ComparisonPath = "path"
+	// ComparisonUUID means the node identifiers differ.
+	ComparisonUUID = "uuid"
+	// ComparisonConflict means both sides changed the node.
+	ComparisonConflict = "conflict"
+)
+
+// OperationReason explains why an operation exists: the endpoint the change comes from and the comparison
+// of both sides that triggered it.
+type OperationReason struct {
+	Endpoint   string `json:"endpoint"`
+	Comparison string `json:"comparison"`
+	Detail     string `json:"detail"`
+}
+
+// String returns the human-readable detail.
+func (r OperationReason) String() string {
+	return r.Detail
+}
+
+// ExplainOperation compares the node of op with the current node on the other side, so it must be called
+// once the patch is computed and before it is applied. The endpoint is the source of op, which follows the
+// direction of the operation in bidirectional patches. It returns false when both sides look the same.
+func ExplainOperation(ctx context.Context, op merger.Operation) (OperationReason, bool) {
+	r := OperationReason{}
+	if src := op.Source(); src != nil {
+		r.Endpoint = src.GetEndpointInfo().URI
+	}
+	switch op.Type() {
+	case merger.OpConflict:
+		r.Comparison = ComparisonConflict
+		r.Detail = "conflict because the node changed on both sides"
+		if cType, _, _, e := ConflictInfo(op); e == nil {
+			r.Detail += " (" + ConflictTypeName(cType) + ")"
+		}
+		return r, true
+	case merger.OpMoveFile, merger.OpMoveFolder:
+		r.Comparison = ComparisonPath
+		r.Detail = fmt.Sprintf("moved because the node was found at a new path on source, from %s", op.GetMoveOriginPath())
+		return r, true
+	case merger.OpRefreshUuid:
+		r.Comparison = ComparisonUUID
+		r.Detail = "uuid refreshed because it differs on source"
+		return r, true
+	case merger.OpCreateFile, merger.OpCreateFolder, merger.OpUpdateFile, merger.OpDelete:
+	default:
+		return r, false
+	}
+	var source, target *tree.Node
+	if op.Type() != merger.OpDelete {
+		source = op.GetNode()
+	} else if src := op.Source(); src != nil {
+		if n, e := src.LoadNode(ctx, op.GetRefPath()); e == nil {
+			source = n
+		}
+	}
+	if t := op.Target(); t != nil {
+		if n, e := t.LoadNode(ctx, op.GetRefPath()); e == nil {
+			target = n
+		}
+	}
+	switch {
+	case source == nil && target == nil:
+		return r, false
+	case source == nil:
+		r.Comparison = ComparisonExistence
+		r.Detail = "deleted because the node no longer exists on source"
+	case target == nil:
+		r.Comparison = ComparisonExistence
+		r.Detail = "created because the node only exists on source"
+	case !source.IsLeaf() || !target.IsLeaf():
+		return r, false
+	case source.Etag != "" && target.Etag != "" && source.Etag != target.Etag:
+		r.Comparison = ComparisonHash
+		r.Detail = "updated because source hash differs"
+	case source.Size != target.Size:
+		r.Comparison = ComparisonSize
+		r.Detail = fmt.Sprintf("updated because source size differs (%d, was %d)", source.Size, target.Size)
+	case source.MTime != target.MTime:
+		r.Comparison = ComparisonMTime
+		r.Detail = "updated because source modification time differs"
+	default:
+		return r, false
+	}
+	return r, true
+}
+
+// ExplainedPatch is a patch along with the reasons of its operations, either computed by ExplainPatch or
+// loaded from the PatchStore.
+type ExplainedPatch struct {
+	merger.Patch
+	reasons map[merger.Operation]OperationReason
+}
+
+// ExplainPatch computes the reasons of the operations of patch with ExplainOperation, before it is applied.
+// The PatchStore saves them along with the operations.
+func ExplainPatch(ctx context.Context, patch merger.Patch) *ExplainedPatch {
+	e := &ExplainedPatch{Patch: patch, reasons: make(map[merger.Operation]OperationReason)}
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		if r, ok := ExplainOperation(ctx, op); ok {
+			e.reasons[op] = r
+		}
+	})
+	return e
+}
+
+// Duration forwards the duration of the wrapped patch, if any.
+func (e *ExplainedPatch) Duration() time.Duration {
+	return PatchDuration(e.Patch)
+}
+
+// Reason returns the reason of op, if any.
+func (e *ExplainedPatch) Reason(op merger.Operation) (OperationReason, bool) {
+	r, ok := e.reasons[op]
+	return r, ok
+}
+
+// patchReasons finds the ExplainedPatch below the wrappers of patch.
+func patchReasons(patch merger.Patch) *ExplainedPatch {
+	for patch != nil {
+		switch p := patch.(type) {
+		case *ExplainedPatch:
+			return p
+		case *LabeledPatch:
+			patch = p.Patch
+		case *TimedPatch:
+			patch = p.Patch
+		case *BatchedPatch:
+			patch = p.Patch
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// OperationReasonOf returns the reason of op, an operation of a patch explained by ExplainPatch or loaded
+// from the PatchStore. Records written before reasons were stored have none.
+func OperationReasonOf(patch merger.Patch, op merger.Operation) (OperationReason, bool) {
+	if e := patchReasons(patch); e != nil {
+		return e.Reason(op)
+	}
+	return OperationReason{}, false
+}
+
+// unmarshalReason decodes a stored reason, returning false for missing or corrupted values.
+func unmarshalReason(data []byte) (OperationReason, bool) {
+	var r OperationReason
+	if data == nil || json.Unmarshal(data, &r) != nil {
+		return r, false
+	}
+	return r, true
+}
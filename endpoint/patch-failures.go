@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// FailingNode aggregates the errors of a node that kept failing since the last successful patch.
+type FailingNode struct {
+	Path string `json:"path"`
+	// Since is the stamp of the oldest patch where the node failed.
+	Since time.Time `json:"since"`
+	// Last is the stamp of the most recent patch where the node failed.
+	Last time.Time `json:"last"`
+	// Failures counts the patches where the node failed.
+	Failures int `json:"failures"`
+	// LastError is the error of the most recent failure.
+	LastError string `json:"lastError"`
+	// Patches lists the UUIDs of the patches where the node failed, newest first.
+	Patches []string `json:"patches"`
+}
+
+// FailingSinceLastSuccess walks patches from newest to oldest until the last patch without errors, and returns
+// the nodes whose operations are still errored in between, oldest failure first. A node is not reported if a
+// more recent patch applied an operation on it successfully. Patch-level errors not attached to an operation
+// are not reported.
+func (p *BoltPatchStore) FailingSinceLastSuccess() ([]*FailingNode, error) {
+	patches, e := p.LoadSorted(0, -1, SortNewestFirst)
+	if e != nil {
+		return nil, e
+	}
+	nodes := make(map[string]*FailingNode)
+	succeeded := make(map[string]bool)
+	for _, patch := range patches {
+		if _, has := patch.HasErrors(); !has {
+			break
+		}
+		patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			path := op.GetRefPath()
+			status := op.GetStatus()
+			if status == nil || !status.IsError() {
+				succeeded[path] = true
+				return
+			}
+			if succeeded[path] {
+				return
+			}
+			node, ok := nodes[path]
+			if !ok {
+				node = &FailingNode{Path: path, Last: patch.GetStamp()}
+				if status.Error() != nil {
+					node.LastError = status.Error().Error()
+				}
+				nodes[path] = node
+			}
+			node.Since = patch.GetStamp()
+			node.Failures++
+			node.Patches = append(node.Patches, patch.GetUUID())
+		})
+	}
+	var failing []*FailingNode
+	for _, n := range nodes {
+		failing = append(failing, n)
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		if !failing[i].Since.Equal(failing[j].Since) {
+			return failing[i].Since.Before(failing[j].Since)
+		}
+		return failing[i].Path < failing[j].Path
+	})
+	return failing, nil
+}
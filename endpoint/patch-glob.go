@@ -0,0 +1,66 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// OperationRef is an operation found by LoadOperationsMatching, along with the patch that contains it.
+type OperationRef struct {
+	PatchUUID string
+	Stamp     time.Time
+	Operation merger.Operation
+}
+
+// matchPath tells if the operation path matches a glob pattern. Leading slashes are ignored on both sides, so
+// that "docs/**/*.pdf" matches "/docs/2019/report.pdf".
+func matchPath(pattern, path string) (bool, error) {
+	return doublestar.Match(strings.TrimLeft(pattern, "/"), strings.TrimLeft(path, "/"))
+}
+
+// LoadOperationsMatching lists the operations of all patches whose path matches pattern, newest patches first.
+// The pattern uses the doublestar syntax: "*" matches inside a path segment while "**" matches any number of
+// segments. Invalid patterns return doublestar.ErrBadPattern.
+func (p *BoltPatchStore) LoadOperationsMatching(pattern string) (refs []OperationRef, e error) {
+	if _, e := matchPath(pattern, ""); e != nil {
+		return nil, e
+	}
+	e = p.StreamPatches(context.Background(), func(patch merger.Patch) error {
+		var err error
+		patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			if err != nil {
+				return
+			}
+			var ok bool
+			if ok, err = matchPath(pattern, op.GetRefPath()); ok {
+				refs = append(refs, OperationRef{PatchUUID: patch.GetUUID(), Stamp: patch.GetStamp(), Operation: op})
+			}
+		})
+		return err
+	})
+	return
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// HealthReport summarizes the last sync status of a PatchStore, for external monitoring.
+type HealthReport struct {
+	// Healthy is false when the last patch had errors or when an endpoint is unreachable.
+	Healthy bool `json:"healthy"`
+	// LastSync is the stamp of the most recent stored patch, if any.
+	LastSync         *time.Time       `json:"lastSync,omitempty"`
+	LastHadErrors    bool             `json:"lastHadErrors"`
+	PendingConflicts int              `json:"pendingConflicts"`
+	Endpoints        []EndpointHealth `json:"endpoints"`
+}
+
+// EndpointHealth is the result of the connection check of an endpoint.
+type EndpointHealth struct {
+	URI       string `json:"uri"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Health checks the store endpoints with CheckConnection and reports the status of the last sync.
+func (p *BoltPatchStore) Health(ctx context.Context) (*HealthReport, error) {
+	report := &HealthReport{LastHadErrors: p.LastHadErrors(), Endpoints: []EndpointHealth{}}
+	if last, e := p.Load(0, 1); e != nil {
+		return nil, e
+	} else if len(last) > 0 {
+		stamp := last[0].GetStamp()
+		report.LastSync = &stamp
+	}
+	conflicts, e := p.PendingConflicts()
+	if e != nil {
+		return nil, e
+	}
+	report.PendingConflicts = len(conflicts)
+	report.Healthy = !report.LastHadErrors
+	for _, ep := range []model.Endpoint{p.source, p.target} {
+		if ep == nil {
+			continue
+		}
+		health := EndpointHealth{URI: ep.GetEndpointInfo().URI, Reachable: true}
+		if err := CheckConnection(ctx, ep); err != nil {
+			health.Reachable = false
+			health.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Endpoints = append(report.Endpoints, health)
+	}
+	return report, nil
+}
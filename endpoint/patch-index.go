@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// stampsBucket indexes patches by stamp. Keys are the stamp in nanoseconds (big-endian, so that they sort
+// chronologically) followed by the patch UUID, values are empty.
+var stampsBucket = []byte("stamps")
+
+// stampIndexKey builds the index key of a patch. Stamps before the Unix epoch are indexed as zero.
+func stampIndexKey(stamp time.Time, uuid []byte) []byte {
+	key := make([]byte, 8, 8+len(uuid))
+	if stamp.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(key, uint64(stamp.UnixNano()))
+	}
+	return append(key, uuid...)
+}
+
+// indexPatch adds a patch to the stamps index.
+func indexPatch(tx *bbolt.Tx, uuid []byte, stamp time.Time) error {
+	index, e := tx.CreateBucketIfNotExists(stampsBucket)
+	if e != nil {
+		return e
+	}
+	return index.Put(stampIndexKey(stamp, uuid), []byte{})
+}
+
+// unindexPatch removes a patch from the stamps index, using the stamp stored in its bucket.
+func unindexPatch(tx *bbolt.Tx, uuid []byte, patchBucket *bbolt.Bucket) error {
+	index := tx.Bucket(stampsBucket)
+	if index == nil || patchBucket == nil {
+		return nil
+	}
+	var stamp time.Time
+	stamp.UnmarshalJSON(patchBucket.Get(timeKey))
+	return index.Delete(stampIndexKey(stamp, uuid))
+}
+
+// migrateV2ToV3 builds the stamps index.
+func migrateV2ToV3(p *BoltPatchStore, patches *bbolt.Bucket) error {
+	c := patches.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+		var stamp time.Time
+		stamp.UnmarshalJSON(patches.Bucket(k).Get(timeKey))
+		if err := indexPatch(patches.Tx(), k, stamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndexed reads a page of patches in chronological or reverse chronological order by seeking the stamps
+// index, only rebuilding the patches of the page. The ok flag is false if the DB has no index yet.
+func (p *BoltPatchStore) loadIndexed(ctx context.Context, offset, limit int, order SortOrder) (patches []merger.Patch, total int, ok bool, e error) {
+	e = p.view(func(tx *bbolt.Tx) error {
+		index, bucket := tx.Bucket(stampsBucket), tx.Bucket(patchBucket)
+		if index == nil || bucket == nil {
+			return nil
+		}
+		ok = true
+		total = index.Stats().KeyN
+		c := index.Cursor()
+		first, next := c.Last, c.Prev
+		if order == SortOldestFirst {
+			first, next = c.First, c.Next
+		}
+		i := 0
+		for k, _ := first(); k != nil; k, _ = next() {
+			if limit >= 0 && i >= offset+limit {
+				break
+			}
+			if i >= offset {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				uuid := k[8:]
+				if patchBucket := bucket.Bucket(uuid); patchBucket != nil {
+					patches = append(patches, p.patchFromBucket(uuid, patchBucket))
+				}
+			}
+			i++
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// labelKey stores the label given to a patch by StoreLabeled.
+var labelKey = []byte("label")
+
+// LabeledPatch adds a user-defined label to a merger.Patch, like "nightly" or "before migration".
+type LabeledPatch struct {
+	merger.Patch
+	label string
+}
+
+// Label returns the label of the patch.
+func (l *LabeledPatch) Label() string {
+	return l.label
+}
+
+// Duration forwards the duration of the wrapped patch, if any.
+func (l *LabeledPatch) Duration() time.Duration {
+	return PatchDuration(l.Patch)
+}
+
+// WithLabel attaches label to patch, so that it is persisted by the PatchStore. An empty label removes it.
+func WithLabel(patch merger.Patch, label string) merger.Patch {
+	if l, ok := patch.(*LabeledPatch); ok {
+		patch = l.Patch
+	}
+	if label == "" {
+		return patch
+	}
+	return &LabeledPatch{Patch: patch, label: label}
+}
+
+// PatchLabel returns the label of patch, or an empty string if it has none.
+func PatchLabel(patch merger.Patch) string {
+	for patch != nil {
+		switch p := patch.(type) {
+		case *LabeledPatch:
+			return p.label
+		case *BatchedPatch:
+			patch = p.Patch
+		case *TimedPatch:
+			patch = p.Patch
+		case *ExplainedPatch:
+			patch = p.Patch
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// StoreLabeled queues patch for persistence along with a label. Labeled patches are stored even if they are
+// empty, so that a labeled run always shows in the history.
+func (p *BoltPatchStore) StoreLabeled(patch merger.Patch, label string) error {
+	return p.Store(WithLabel(patch, label))
+}
+
+// LoadByLabel lists the patches stored with label, newest first. An empty label lists unlabeled patches.
+func (p *BoltPatchStore) LoadByLabel(label string) (patches []merger.Patch, e error) {
+	patches, _, e = p.load(context.Background(), 0, -1, SortNewestFirst, func(patchBucket *bbolt.Bucket) bool {
+		return string(patchBucket.Get(labelKey)) == label
+	}, nil)
+	return
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCompactCheckInterval = 10 * time.Minute
+	defaultCompactMinInterval   = time.Hour
+)
+
+// SizeSource returns the size of the DB file and the size of the data it actually holds.
+type SizeSource func() (fileSize, liveSize int64, err error)
+
+// dbSizes is the default SizeSource, based on the BoltDB free pages.
+func (p *BoltPatchStore) dbSizes() (fileSize, liveSize int64, err error) {
+	err = p.view(func(tx *bbolt.Tx) error {
+		fileSize = tx.Size()
+		liveSize = fileSize - int64(p.db.Stats().FreeAlloc)
+		return nil
+	})
+	return
+}
+
+// startMaintenance runs MaintainOnce every check interval until the store is stopped.
+func (p *BoltPatchStore) startMaintenance(interval time.Duration) {
+	p.maintenanceWg.Add(1)
+	go func() {
+		defer p.maintenanceWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := p.MaintainOnce(); err != nil {
+					p.logger().Error("Cannot compact patch store", zap.Error(err))
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// MaintainOnce compacts the DB if its file is more than CompactThreshold times bigger than its live data,
+// and if the last compaction is older than the minimum interval. Pending writes are finished before
+// compacting, and new ones wait for it. It returns true if the DB was compacted.
+func (p *BoltPatchStore) MaintainOnce() (bool, error) {
+	if p.readOnly {
+		return false, ErrReadOnlyStore
+	}
+	if p.compactThreshold <= 0 {
+		return false, nil
+	}
+	p.Lock()
+	closed := p.closed
+	p.Unlock()
+	if closed {
+		return false, ErrStoreClosed
+	}
+	now := p.clock.Now()
+	if !p.lastCompact.IsZero() && now.Sub(p.lastCompact) < p.compactMinInterval {
+		return false, nil
+	}
+	fileSize, liveSize, err := p.sizes()
+	if err != nil {
+		return false, err
+	}
+	if liveSize <= 0 || float64(fileSize)/float64(liveSize) < p.compactThreshold {
+		return false, nil
+	}
+	p.persistLock.Lock()
+	defer p.persistLock.Unlock()
+	p.logger().Info("Compacting patch store", zap.Int64("file_size", fileSize), zap.Int64("live_size", liveSize))
+	if err := p.Compact(); err != nil {
+		return false, err
+	}
+	p.lastCompact = now
+	return true, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollector exposes the PatchStore activity as Prometheus metrics. Counters are updated when patches
+// are persisted, gauges are computed lazily at collection time.
+type MetricsCollector struct {
+	store *BoltPatchStore
+
+	patchesStored    prometheus.Counter
+	patchesErrors    prometheus.Counter
+	operations       *prometheus.CounterVec
+	pendingConflicts *prometheus.Desc
+	dbSize           *prometheus.Desc
+}
+
+func newMetricsCollector(store *BoltPatchStore) *MetricsCollector {
+	return &MetricsCollector{
+		store: store,
+		patchesStored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cells_sync",
+			Name:      "patches_stored_total",
+			Help:      "Number of patches persisted in the patch store.",
+		}),
+		patchesErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "cells_sync",
+			Name:      "patches_errors_total",
+			Help:      "Number of persisted patches that had errors.",
+		}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cells_sync",
+			Name:      "operations_total",
+			Help:      "Number of persisted operations, by type.",
+		}, []string{"type"}),
+		pendingConflicts: prometheus.NewDesc("cells_sync_pending_conflicts", "Number of unresolved conflicts in stored patches.", nil, nil),
+		dbSize:           prometheus.NewDesc("cells_sync_patch_store_bytes", "Size of the patch store DB file.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	m.patchesStored.Describe(ch)
+	m.patchesErrors.Describe(ch)
+	m.operations.Describe(ch)
+	ch <- m.pendingConflicts
+	ch <- m.dbSize
+}
+
+// Collect implements prometheus.Collector.
+func (m *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m.patchesStored.Collect(ch)
+	m.patchesErrors.Collect(ch)
+	m.operations.Collect(ch)
+	if conflicts, e := m.store.PendingConflicts(); e == nil {
+		ch <- prometheus.MustNewConstMetric(m.pendingConflicts, prometheus.GaugeValue, float64(len(conflicts)))
+	}
+	if info, e := os.Stat(filepath.Join(m.store.folderPath, "patches")); e == nil {
+		ch <- prometheus.MustNewConstMetric(m.dbSize, prometheus.GaugeValue, float64(info.Size()))
+	}
+}
+
+// Metrics returns the collector of this store, to be registered on a prometheus.Registry.
+func (p *BoltPatchStore) Metrics() *MetricsCollector {
+	return p.metrics
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+	"github.com/pydio/cells/common/sync/proc"
+)
+
+// resolutionsKey is the bucket storing the resolution proposed by the configured resolver for each conflict of a
+// patch, under the same key as the conflict in the opsKey bucket. Operations are encoded with the store codec,
+// which already encrypts them when a key is set.
+var resolutionsKey = []byte("resolutions")
+
+// ErrNoProposedResolution is returned when applying the proposed resolution of a conflict the resolver could not
+// resolve, or that was stored without resolver.
+var ErrNoProposedResolution = errors.New("no resolution was proposed for this conflict")
+
+// proposeResolution encodes the operations the configured resolver would replace conflict with. It returns nil
+// when there is no resolver or when it cannot resolve this conflict.
+func (p *BoltPatchStore) proposeResolution(conflict merger.Operation) []byte {
+	resolved := resolveConflicts(p.resolver, conflict)
+	if resolved[0].Type() == merger.OpConflict {
+		return nil
+	}
+	var encoded [][]byte
+	for _, op := range resolved {
+		data, e := p.codec.Marshal(op)
+		if e != nil {
+			return nil
+		}
+		encoded = append(encoded, data)
+	}
+	data, e := json.Marshal(encoded)
+	if e != nil {
+		return nil
+	}
+	return data
+}
+
+// proposedResolution decodes a resolution encoded by proposeResolution.
+func (p *BoltPatchStore) proposedResolution(data []byte) (ops []merger.Operation, e error) {
+	var encoded [][]byte
+	if e = json.Unmarshal(data, &encoded); e != nil {
+		return nil, e
+	}
+	for _, d := range encoded {
+		op, err := p.codec.Unmarshal(d)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// applyResolution applies the operations resolving a conflict of stored with the store processor, and returns them
+// with their status. Operations keeping the right side of the conflict describe the state of the patch target:
+// they are applied from the target back to the source. Others are applied from the source to the target.
+func (p *BoltPatchStore) applyResolution(stored merger.Patch, conflict merger.Operation, ops []merger.Operation) (applied []merger.Operation, e error) {
+	_, _, right, e := ConflictInfo(conflict)
+	if e != nil {
+		return nil, e
+	}
+	forward := merger.NewPatch(stored.Source(), stored.Target(), merger.PatchOptions{})
+	backward := merger.NewPatch(asSource(stored.Target()), asTarget(stored.Source()), merger.PatchOptions{})
+	var forwardOps, backwardOps int
+	for _, op := range ops {
+		// Rebuild operations to drop any previous status
+		rebuilt := merger.NewOperation(op.Type(), model.EventInfo{Path: op.GetRefPath()}, op.GetNode())
+		if sameOperation(op, right) {
+			backward.Enqueue(rebuilt)
+			backwardOps++
+		} else {
+			forward.Enqueue(rebuilt)
+			forwardOps++
+		}
+	}
+	if backwardOps > 0 && (backward.Source() == nil || backward.Target() == nil) {
+		return nil, errors.New("patch source cannot receive the target side of the conflict")
+	}
+	processor := p.processor
+	if processor == nil {
+		processor = proc.NewProcessor(context.Background())
+	}
+	cmd := model.NewCommand()
+	defer cmd.Stop()
+	var errs PatchErrors
+	for _, run := range []struct {
+		patch merger.Patch
+		size  int
+	}{{forward, forwardOps}, {backward, backwardOps}} {
+		if run.size == 0 {
+			continue
+		}
+		processor.Process(run.patch, cmd)
+		run.patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			applied = append(applied, op)
+			if status := op.GetStatus(); status != nil && status.IsError() && status.Error() != nil {
+				errs = append(errs, status.Error())
+			}
+		})
+	}
+	if len(errs) > 0 {
+		return applied, errs
+	}
+	return applied, nil
+}
+
+// sameOperation tells whether a and b apply the same change to the same node.
+func sameOperation(a, b merger.Operation) bool {
+	if a == nil || b == nil || a.Type() != b.Type() || a.GetRefPath() != b.GetRefPath() {
+		return false
+	}
+	an, bn := a.GetNode(), b.GetNode()
+	if an == nil || bn == nil {
+		return an == bn
+	}
+	return an.Etag == bn.Etag && an.Uuid == bn.Uuid && an.MTime == bn.MTime
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+	"github.com/pydio/cells/common/sync/proc"
+)
+
+// PatchProcessor applies the operations of a patch to its target.
+type PatchProcessor interface {
+	Process(patch merger.Patch, cmd *model.Command)
+}
+
+// Retry replays the errored operations of a stored patch against the current endpoints, and stores
+// the result under the same UUID. If no operation is individually marked as errored but the patch
+// has errors, all its operations are replayed. If the patch still contains conflicts,
+// ErrUnresolvedConflicts is returned and nothing is replayed: resolve them with ResolveConflict first.
+func (p *BoltPatchStore) Retry(uuid string) (merger.Patch, error) {
+	if p.readOnly {
+		return nil, ErrReadOnlyStore
+	}
+	stored, e := p.Get(uuid)
+	if e != nil {
+		return nil, e
+	}
+	var succeeded, errored []merger.Operation
+	var conflicts bool
+	stored.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		if op.Type() == merger.OpConflict {
+			conflicts = true
+		} else if status := op.GetStatus(); status != nil && status.IsError() {
+			errored = append(errored, op)
+		} else {
+			succeeded = append(succeeded, op)
+		}
+	})
+	if conflicts {
+		return nil, ErrUnresolvedConflicts
+	}
+	if len(errored) == 0 {
+		if _, has := stored.HasErrors(); !has {
+			return stored, nil
+		}
+		errored, succeeded = succeeded, nil
+	}
+
+	patch := merger.NewPatch(stored.Source(), stored.Target(), merger.PatchOptions{})
+	patch.SetUUID(uuid)
+	for _, op := range errored {
+		// Rebuild operations to drop their previous status
+		patch.Enqueue(merger.NewOperation(op.Type(), model.EventInfo{Path: op.GetRefPath()}, op.GetNode()))
+	}
+	processor := p.processor
+	if processor == nil {
+		processor = proc.NewProcessor(context.Background())
+	}
+	cmd := model.NewCommand()
+	defer cmd.Stop()
+	processor.Process(patch, cmd)
+
+	// Stored result keeps the operations that had already succeeded
+	result := merger.NewPatch(stored.Source(), stored.Target(), merger.PatchOptions{})
+	result.SetUUID(uuid)
+	for _, op := range succeeded {
+		result.Enqueue(op)
+	}
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		result.Enqueue(op)
+	})
+	if errs, has := patch.HasErrors(); has {
+		result.SetPatchError(PatchErrors(errs))
+	}
+	if e := p.enqueue(result); e != nil {
+		return result, e
+	}
+	return result, nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/etcd-io/bbolt"
+	"go.uber.org/zap"
+)
+
+var schemaVersionKey = []byte("schemaVersion")
+
+// currentSchemaVersion is the storage layout version written by this code. Version 1 is the legacy layout,
+// without version marker, direction flag nor errors list. Version 3 adds the stamps index.
+const currentSchemaVersion = 3
+
+// ErrSchemaTooNew is returned when opening a PatchStore written by a more recent version.
+var ErrSchemaTooNew = errors.New("patch store was created by a newer version, please upgrade to read it")
+
+// schemaMigrations upgrades the DB from version i+1 to version i+2.
+var schemaMigrations = []func(p *BoltPatchStore, patches *bbolt.Bucket) error{
+	migrateV1ToV2,
+	migrateV2ToV3,
+}
+
+// migrateSchema checks the stored schema version and runs the required migrations.
+func (p *BoltPatchStore) migrateSchema() error {
+	version := 0
+	var fresh bool
+	p.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			if v := b.Get(schemaVersionKey); len(v) == 8 {
+				version = int(binary.BigEndian.Uint64(v))
+			}
+		}
+		if version == 0 {
+			fresh = tx.Bucket(patchBucket) == nil
+			version = 1
+		}
+		return nil
+	})
+	if fresh {
+		version = currentSchemaVersion
+	}
+	if version > currentSchemaVersion {
+		return ErrSchemaTooNew
+	}
+	if p.readOnly {
+		// Legacy layouts are still readable as is
+		return nil
+	}
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(patchBucket); bucket != nil {
+			for v := version; v < currentSchemaVersion; v++ {
+				p.logger().Info("Migrating patch store", zap.Int("from", v), zap.Int("to", v+1))
+				if err := schemaMigrations[v-1](p, bucket); err != nil {
+					return fmt.Errorf("cannot migrate patch store from version %d: %v", v, err)
+				}
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(schemaVersionKey, itob(currentSchemaVersion))
+	})
+}
+
+// migrateV1ToV2 adds the direction flag, inferred from the source URI, and the errors list to legacy records.
+func migrateV1ToV2(p *BoltPatchStore, patches *bbolt.Bucket) error {
+	c := patches.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+		patchBucket := patches.Bucket(k)
+		if patchBucket.Get(invertedKey) == nil {
+			inverted := "false"
+			if src := patchBucket.Get(patchSourceKey); src != nil && string(src) != p.source.GetEndpointInfo().URI {
+				inverted = "true"
+			}
+			if err := patchBucket.Put(invertedKey, []byte(inverted)); err != nil {
+				return err
+			}
+		}
+		if errValue := patchBucket.Get(patchErrKey); errValue != nil && patchBucket.Get(patchErrorsKey) == nil {
+			data, _ := json.Marshal([]string{string(errValue)})
+			if err := patchBucket.Put(patchErrorsKey, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+var (
+	// batchKey stores the UUID of the patch a chunk was split from.
+	batchKey = []byte("batch")
+	// chunkKey stores the position of a chunk inside its batch.
+	chunkKey = []byte("chunk")
+)
+
+// BatchedPatch is one chunk of a patch split by SplitPatch.
+type BatchedPatch struct {
+	merger.Patch
+	batch string
+	index int
+}
+
+// BatchUUID returns the UUID of the patch this chunk was split from.
+func (b *BatchedPatch) BatchUUID() string {
+	return b.batch
+}
+
+// ChunkIndex returns the position of this chunk inside its batch, starting at zero.
+func (b *BatchedPatch) ChunkIndex() int {
+	return b.index
+}
+
+// Duration forwards the duration of the wrapped patch, if any.
+func (b *BatchedPatch) Duration() time.Duration {
+	return PatchDuration(b.Patch)
+}
+
+// PatchBatch returns the batch UUID of patch, or an empty string if it was not split.
+func PatchBatch(patch merger.Patch) string {
+	if b, ok := patch.(*BatchedPatch); ok {
+		return b.batch
+	}
+	return ""
+}
+
+// SplitPatch splits patch into chunks of at most max operations, in application order. Each chunk gets a
+// UUID derived from the patch UUID and its index (see ChunkUUID) and shares the patch UUID as batch UUID. Patch errors and duration are kept on the last chunk, the
+// label on all chunks.
+// The patch is returned as is if max <= 0 or if it is small enough.
+func SplitPatch(patch merger.Patch, max int) []merger.Patch {
+	if max <= 0 || patch.Size() <= max {
+		return []merger.Patch{patch}
+	}
+	var ops []merger.Operation
+	WalkOperationsSorted(patch, []merger.OperationType{}, func(operation merger.Operation) {
+		ops = append(ops, operation)
+	})
+	var chunks []merger.Patch
+	for i := 0; i < len(ops); i += max {
+		end := i + max
+		if end > len(ops) {
+			end = len(ops)
+		}
+		chunk := merger.NewPatch(patch.Source(), patch.Target(), merger.PatchOptions{})
+		chunk.SetUUID(ChunkUUID(patch.GetUUID(), len(chunks)))
+		for _, op := range ops[i:end] {
+			chunk.Enqueue(op)
+		}
+		var inner merger.Patch = chunk
+		if e := patchReasons(patch); e != nil {
+			inner = &ExplainedPatch{Patch: inner, reasons: e.reasons}
+		}
+		if end == len(ops) {
+			errs := ListPatchErrors(patch)
+			if len(errs) == 1 {
+				chunk.SetPatchError(errs[0])
+			} else if len(errs) > 1 {
+				chunk.SetPatchError(PatchErrors(errs))
+			}
+			inner = WithDuration(inner, PatchDuration(patch))
+		}
+		inner = WithLabel(inner, PatchLabel(patch))
+		// Set the stamp last, as setting an error overwrites it
+		chunk.Stamp(patch.GetStamp())
+		chunks = append(chunks, &BatchedPatch{Patch: inner, batch: patch.GetUUID(), index: len(chunks)})
+	}
+	return chunks
+}
+
+// ChunkUUID returns the UUID of the chunk at index inside batch. Splitting the same patch again yields the
+// same chunk UUIDs, so that re-storing it replaces its chunks.
+func ChunkUUID(batch string, index int) string {
+	return uuid.NewSHA1(uuid.NameSpace_OID, []byte(batch+"\x00"+strconv.Itoa(index))).String()
+}
+
+// groupBatches merges chunks sharing the same batch UUID back into a single patch, placed at the position of
+// the first chunk found. Other patches are left untouched.
+func groupBatches(patches []merger.Patch) (grouped []merger.Patch) {
+	chunks := make(map[string][]*BatchedPatch)
+	for _, patch := range patches {
+		b, ok := patch.(*BatchedPatch)
+		if !ok {
+			grouped = append(grouped, patch)
+			continue
+		}
+		if _, seen := chunks[b.batch]; !seen {
+			// Placeholder, replaced once all chunks are known
+			grouped = append(grouped, b)
+		}
+		chunks[b.batch] = append(chunks[b.batch], b)
+	}
+	for i, patch := range grouped {
+		if b, ok := patch.(*BatchedPatch); ok {
+			grouped[i] = mergeChunks(b.batch, chunks[b.batch])
+		}
+	}
+	return
+}
+
+// mergeChunks rebuilds the patch identified by batch from its chunks.
+func mergeChunks(batch string, chunks []*BatchedPatch) merger.Patch {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].index < chunks[j].index
+	})
+	first := chunks[0]
+	patch := merger.NewPatch(first.Source(), first.Target(), merger.PatchOptions{})
+	patch.SetUUID(batch)
+	var errs []error
+	var duration time.Duration
+	explained := &ExplainedPatch{Patch: patch, reasons: make(map[merger.Operation]OperationReason)}
+	for _, chunk := range chunks {
+		reasons := patchReasons(chunk.Patch)
+		chunk.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+			patch.Enqueue(operation)
+			if reasons != nil {
+				if r, ok := reasons.Reason(operation); ok {
+					explained.reasons[operation] = r
+				}
+			}
+		})
+		errs = append(errs, ListPatchErrors(chunk.Patch)...)
+		duration += chunk.Duration()
+	}
+	if len(errs) == 1 {
+		patch.SetPatchError(errs[0])
+	} else if len(errs) > 1 {
+		patch.SetPatchError(PatchErrors(errs))
+	}
+	patch.Stamp(first.GetStamp())
+	return WithLabel(WithDuration(explained, duration), PatchLabel(first))
+}
+
+// chunkIndex decodes a value stored under chunkKey.
+func chunkIndex(v []byte) int {
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/gin-gonic/gin"
+)
+
+// NewPatchStoreHandler exposes a PatchStore as a JSON API: GET /patches?offset=&limit= lists patches (newest first),
+// GET /patches/:uuid loads one patch and DELETE /patches/:uuid removes it. GET /operations?path= lists the operations
+// whose path matches a glob, see BoltPatchStore.LoadOperationsMatching. GET /health (or /status) returns the
+// HealthReport of stores implementing it, with a 503 status when unhealthy.
+func NewPatchStoreHandler(store PatchStore) http.Handler {
+	h := &patchStoreHandler{store: store}
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.GET("/patches", h.list)
+	router.GET("/patches/:uuid", h.get)
+	router.DELETE("/patches/:uuid", h.delete)
+	router.GET("/operations", h.operations)
+	router.GET("/health", h.health)
+	router.GET("/status", h.health)
+	return router
+}
+
+type patchStoreHandler struct {
+	store PatchStore
+}
+
+func (h *patchStoreHandler) writeError(c *gin.Context, e error) {
+	status := http.StatusInternalServerError
+	if e == ErrPatchNotFound {
+		status = http.StatusNotFound
+	} else if e == ErrReadOnlyStore {
+		status = http.StatusForbidden
+	}
+	c.JSON(status, map[string]string{"error": e.Error()})
+}
+
+func (h *patchStoreHandler) list(c *gin.Context) {
+	offset, limit := 0, 10
+	if o, e := strconv.Atoi(c.Query("offset")); e == nil && o >= 0 {
+		offset = o
+	}
+	if l, e := strconv.Atoi(c.Query("limit")); e == nil {
+		limit = l
+	}
+	patches, total, e := h.store.LoadWithTotal(offset, limit)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	data := make([]PatchDTO, 0, len(patches))
+	for _, p := range patches {
+		data = append(data, NewPatchDTO(p))
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"patches": data,
+	})
+}
+
+func (h *patchStoreHandler) get(c *gin.Context) {
+	patch, e := h.store.Get(c.Param("uuid"))
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.JSON(http.StatusOK, NewPatchDTO(patch))
+}
+
+func (h *patchStoreHandler) delete(c *gin.Context) {
+	if e := h.store.Delete(c.Param("uuid")); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// operationMatcher is implemented by stores able to query operations by path, like BoltPatchStore.
+type operationMatcher interface {
+	LoadOperationsMatching(pattern string) ([]OperationRef, error)
+}
+
+func (h *patchStoreHandler) operations(c *gin.Context) {
+	matcher, ok := h.store.(operationMatcher)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, map[string]string{"error": "store does not query operations"})
+		return
+	}
+	pattern := c.Query("path")
+	if pattern == "" {
+		c.JSON(http.StatusBadRequest, map[string]string{"error": "missing path parameter"})
+		return
+	}
+	refs, e := matcher.LoadOperationsMatching(pattern)
+	if e == doublestar.ErrBadPattern {
+		c.JSON(http.StatusBadRequest, map[string]string{"error": e.Error()})
+		return
+	} else if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	data := make([]OperationRefDTO, 0, len(refs))
+	for _, ref := range refs {
+		data = append(data, OperationRefDTO{PatchUUID: ref.PatchUUID, Stamp: ref.Stamp, Operation: NewOperationDTO(ref.Operation)})
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"operations": data,
+	})
+}
+
+// healthReporter is implemented by stores able to report their HealthReport, like BoltPatchStore.
+type healthReporter interface {
+	Health(ctx context.Context) (*HealthReport, error)
+}
+
+func (h *patchStoreHandler) health(c *gin.Context) {
+	reporter, ok := h.store.(healthReporter)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, map[string]string{"error": "store does not report its health"})
+		return
+	}
+	report, e := reporter.Health(c.Request.Context())
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.JSON(status, report)
+}
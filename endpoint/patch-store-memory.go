@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// MemoryPatchStore is a PatchStore keeping patches in memory only, for tests and ephemeral syncs.
+// Patches are stored synchronously and lost on Stop.
+type MemoryPatchStore struct {
+	sync.Mutex
+	patches       map[string]merger.Patch
+	closed        bool
+	lastHasErrors bool
+
+	// MaxStoredPatches is the number of patches to keep, -1 disables pruning.
+	MaxStoredPatches int
+}
+
+// NewMemoryPatchStore creates an empty MemoryPatchStore.
+func NewMemoryPatchStore() *MemoryPatchStore {
+	return &MemoryPatchStore{
+		patches:          make(map[string]merger.Patch),
+		MaxStoredPatches: defaultMaxStoredPatches,
+	}
+}
+
+// Store keeps the patch in memory, skipping empty patches without errors like BoltPatchStore.
+func (m *MemoryPatchStore) Store(patch merger.Patch) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	_, has := patch.HasErrors()
+	if patch.Size() == 0 && !has && !m.lastHasErrors {
+		return nil
+	}
+	m.lastHasErrors = has
+	m.patches[patch.GetUUID()] = patch
+	if m.MaxStoredPatches >= 0 && len(m.patches) > m.MaxStoredPatches {
+		for _, p := range m.sorted()[m.MaxStoredPatches:] {
+			delete(m.patches, p.GetUUID())
+		}
+	}
+	return nil
+}
+
+// LastHadErrors tells whether the last stored patch had errors.
+func (m *MemoryPatchStore) LastHadErrors() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.lastHasErrors
+}
+
+// PublishPatch implements the patch listener by calling Store.
+func (m *MemoryPatchStore) PublishPatch(patch merger.Patch) {
+	m.Store(patch)
+}
+
+// Load lists patches, newest first. A negative limit returns all patches, a zero limit none.
+func (m *MemoryPatchStore) Load(offset, limit int) ([]merger.Patch, error) {
+	return m.LoadContext(context.Background(), offset, limit)
+}
+
+// LoadContext lists patches, newest first.
+func (m *MemoryPatchStore) LoadContext(ctx context.Context, offset, limit int) ([]merger.Patch, error) {
+	patches, _, e := m.LoadWithTotal(offset, limit)
+	if e == nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return patches, e
+}
+
+// LoadWithTotal lists patches, newest first, along with the total number of patches.
+func (m *MemoryPatchStore) LoadWithTotal(offset, limit int) ([]merger.Patch, int, error) {
+	m.Lock()
+	defer m.Unlock()
+	all := m.sorted()
+	if offset >= len(all) {
+		return nil, len(all), nil
+	}
+	end := len(all)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return append([]merger.Patch{}, all[offset:end]...), len(all), nil
+}
+
+// Get finds a patch by its UUID.
+func (m *MemoryPatchStore) Get(uuid string) (merger.Patch, error) {
+	m.Lock()
+	defer m.Unlock()
+	if p, ok := m.patches[uuid]; ok {
+		return p, nil
+	}
+	return nil, ErrPatchNotFound
+}
+
+// Delete removes a patch by its UUID.
+func (m *MemoryPatchStore) Delete(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.patches[uuid]; !ok {
+		return ErrPatchNotFound
+	}
+	delete(m.patches, uuid)
+	return nil
+}
+
+// Clear removes all patches.
+func (m *MemoryPatchStore) Clear() error {
+	m.Lock()
+	defer m.Unlock()
+	m.patches = make(map[string]merger.Patch)
+	return nil
+}
+
+// Stop refuses further patches and drops stored ones.
+func (m *MemoryPatchStore) Stop() {
+	m.Lock()
+	defer m.Unlock()
+	m.closed = true
+	m.patches = make(map[string]merger.Patch)
+}
+
+// sorted returns all patches, newest first. It must be called with the lock held.
+func (m *MemoryPatchStore) sorted() []merger.Patch {
+	var all []merger.Patch
+	for _, p := range m.patches {
+		all = append(all, p)
+	}
+	sort.Sort(newPatchSorter(all, SortNewestFirst))
+	return all
+}
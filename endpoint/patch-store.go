@@ -24,14 +24,18 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/etcd-io/bbolt"
+	"go.uber.org/zap"
 
-	"github.com/pydio/cells/common/log"
 	"github.com/pydio/cells/common/sync/merger"
 	"github.com/pydio/cells/common/sync/model"
 )
@@ -41,250 +45,1429 @@ var (
 	timeKey        = []byte("stamp")
 	opsKey         = []byte("operations")
 	patchErrKey    = []byte("patchError")
+	patchErrorsKey = []byte("patchErrors")
 	patchSourceKey = []byte("source")
+	invertedKey    = []byte("inverted")
 )
 
-type patchSorter []merger.Patch
+// PatchErrors groups all errors of a patch restored from the store into one error, as a patch can only hold one
+// patch-level error.
+type PatchErrors []error
+
+// Error implements the error interface by joining all messages.
+func (pe PatchErrors) Error() string {
+	var msgs []string
+	for _, e := range pe {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// ListPatchErrors returns all errors of a patch, expanding PatchErrors if necessary.
+func ListPatchErrors(patch merger.Patch) []error {
+	errs, _ := patch.HasErrors()
+	return flattenErrors(errs)
+}
+
+func flattenErrors(errs []error) (flat []error) {
+	for _, e := range errs {
+		if pe, ok := e.(PatchErrors); ok {
+			flat = append(flat, flattenErrors(pe)...)
+		} else {
+			flat = append(flat, e)
+		}
+	}
+	return
+}
+
+// ErrPatchNotFound is returned when looking up a patch UUID that is not in the store.
+var ErrPatchNotFound = errors.New("patch not found")
+
+// ErrReadOnlyStore is returned when trying to store a patch in a store opened in read-only mode.
+var ErrReadOnlyStore = errors.New("patch store is opened in read-only mode")
+
+// ErrStoreClosed is returned when trying to store a patch after the store was stopped.
+var ErrStoreClosed = errors.New("patch store is closed")
+
+// ErrConflictNotFound is returned when no pending conflict matches a patch UUID and node path.
+var ErrConflictNotFound = errors.New("conflict not found")
+
+// ErrUnresolvedConflicts is returned when retrying a patch that still contains conflicts.
+var ErrUnresolvedConflicts = errors.New("patch contains unresolved conflicts, resolve them before retrying")
+
+const defaultMaxStoredPatches = 100
+
+// SortOrder defines the order of patches returned by LoadSorted.
+type SortOrder int
+
+const (
+	// SortNewestFirst is the default order, most recent patches first.
+	SortNewestFirst SortOrder = iota
+	// SortOldestFirst lists patches in chronological order.
+	SortOldestFirst
+	// SortErrorsFirst lists patches with errors first, each group being sorted newest first.
+	SortErrorsFirst
+)
+
+func newestFirst(a, b merger.Patch) bool {
+	return a.GetStamp().After(b.GetStamp())
+}
+
+func oldestFirst(a, b merger.Patch) bool {
+	return a.GetStamp().Before(b.GetStamp())
+}
+
+func errorsFirst(a, b merger.Patch) bool {
+	_, aErr := a.HasErrors()
+	_, bErr := b.HasErrors()
+	if aErr != bErr {
+		return aErr
+	}
+	return newestFirst(a, b)
+}
+
+// patchSorter sorts patches using a pluggable comparison, newest first by default.
+type patchSorter struct {
+	patches []merger.Patch
+	less    func(a, b merger.Patch) bool
+}
+
+func newPatchSorter(patches []merger.Patch, order SortOrder) patchSorter {
+	switch order {
+	case SortOldestFirst:
+		return patchSorter{patches: patches, less: oldestFirst}
+	case SortErrorsFirst:
+		return patchSorter{patches: patches, less: errorsFirst}
+	default:
+		return patchSorter{patches: patches, less: newestFirst}
+	}
+}
 
 func (p patchSorter) Len() int {
-	return len(p)
+	return len(p.patches)
 }
 func (p patchSorter) Less(i, j int) bool {
-	return p[i].GetStamp().After(p[j].GetStamp())
+	return p.less(p.patches[i], p.patches[j])
 }
 func (p patchSorter) Swap(i, j int) {
-	p[i], p[j] = p[j], p[i]
+	p.patches[i], p.patches[j] = p.patches[j], p.patches[i]
+}
+
+// patchStamp is a lightweight reference to a stored patch, used when operations are not required.
+type patchStamp struct {
+	uuid  string
+	stamp time.Time
+}
+
+type stampSorter []patchStamp
+
+func (s stampSorter) Len() int {
+	return len(s)
+}
+func (s stampSorter) Less(i, j int) bool {
+	return s[i].stamp.After(s[j].stamp)
+}
+func (s stampSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// PatchStore is a persistence layer for storing patches. See BoltPatchStore and MemoryPatchStore.
+type PatchStore interface {
+	// Store queues a patch for persistence.
+	Store(patch merger.Patch) error
+	// PublishPatch implements the sync task patch listener.
+	PublishPatch(patch merger.Patch)
+	// Load lists patches, newest first. A negative limit returns all patches, a zero limit none.
+	Load(offset, limit int) ([]merger.Patch, error)
+	// LoadContext is the same as Load but stops early if ctx is cancelled.
+	LoadContext(ctx context.Context, offset, limit int) ([]merger.Patch, error)
+	// LoadWithTotal is the same as Load and also returns the total number of stored patches.
+	LoadWithTotal(offset, limit int) ([]merger.Patch, int, error)
+	// Get loads a single patch, or returns ErrPatchNotFound.
+	Get(uuid string) (merger.Patch, error)
+	// Delete removes a single patch, or returns ErrPatchNotFound.
+	Delete(uuid string) error
+	// Clear removes all patches.
+	Clear() error
+	// LastHadErrors tells whether the last stored patch had errors. It is safe to call from any goroutine.
+	LastHadErrors() bool
+	// Stop flushes pending patches and releases resources. Patches stored after Stop are refused.
+	Stop()
 }
 
-// PatchStore is a persistence layer for storing patches. It is based on BoltDB
-type PatchStore struct {
-	patches  chan merger.Patch
-	done     chan bool
-	pipeDone chan bool
+// BoltPatchStore is a persistence layer for storing patches. It is based on BoltDB
+type BoltPatchStore struct {
+	sync.Mutex
+	patches   chan merger.Patch
+	persistWg sync.WaitGroup
+	// senders tracks the enqueue calls sending on patches, so that Stop closes it once they are done
+	senders sync.WaitGroup
+	// persistLock serializes persist calls from the store goroutine and StoreBatch
+	persistLock sync.Mutex
+	// queued and handled count the patches pushed to and handled by the persist goroutine, for Flush
+	flushCond       *sync.Cond
+	queued, handled int
+	done            chan bool
+	pipeDone        chan bool
+	// maintenanceWg tracks the compaction goroutine, which must exit before the DB is closed
+	maintenanceWg sync.WaitGroup
 
 	source model.Endpoint
 	target model.Endpoint
 
 	db            *bbolt.DB
+	dbLock        sync.RWMutex
+	dbOptions     *bbolt.Options
 	folderPath    string
+	codec         OperationCodec
+	resolver      ConflictResolver
+	cipher        *valueCipher
+	metrics       *MetricsCollector
+	processor     PatchProcessor
+	excludes      []string
+	maxOperations int
+	clock         Clock
+	sizes         SizeSource
+	batchWindow   time.Duration
+	batchSize     int
+	readOnly      bool
+	closed        bool
+	// lastHasErrors is written by persist and read from other goroutines, always under lastErrLock
+	lastErrLock   sync.Mutex
 	lastHasErrors bool
+	// deterministicUUIDs replaces the UUID of stored patches by their ContentUUID
+	deterministicUUIDs bool
+	// events and eventsTask publish the lifecycle of stored patches
+	events     *EventBus
+	eventsTask string
+
+	// compactThreshold, compactMinInterval and lastCompact drive automatic compaction
+	compactThreshold   float64
+	compactMinInterval time.Duration
+	lastCompact        time.Time
+
+	// MaxStoredPatches is the number of most recent patches kept in the DB, older ones are pruned. -1 disables pruning.
+	MaxStoredPatches int
+	// MaxPatchAge prunes patches stamped before now minus this duration, whatever their count. Disabled when zero.
+	MaxPatchAge time.Duration
+	// OnError is called when a patch with errors is persisted while the previous one had none.
+	OnError func(patch merger.Patch)
+	// OnCommit is called after each write transaction with the number of patches it contained.
+	OnCommit func(patches int)
+	// OnPatchStored is called after each successful write with every patch it contained, errors included.
+	// It runs on the persist goroutine: it must return quickly, or fan out the work itself.
+	//
+	// These callbacks must not re-enter the store: Store, Flush and Stop wait for the persist goroutine
+	// that runs them, and would block forever. Call them from another goroutine instead.
+	OnPatchStored func(patch merger.Patch)
+}
+
+// PatchStoreOptions provides additional configuration to a PatchStore.
+type PatchStoreOptions struct {
+	// MaxStoredPatches sets the number of patches to keep. Defaults to 100 when zero, -1 disables pruning.
+	MaxStoredPatches int
+	// MaxPatchAge prunes patches older than this duration, in addition to the count limit. Disabled when zero.
+	MaxPatchAge time.Duration
+	// OpenTimeout is the time to wait for a lock on the DB file. Defaults to 5 seconds when zero.
+	OpenTimeout time.Duration
+	// ReadOnly opens the DB in read-only mode, for inspection purposes. Storing patches is then refused.
+	ReadOnly bool
+	// Codec is used to serialize operations. Defaults to DTOCodec when nil.
+	Codec OperationCodec
+	// Resolver proposes a resolution for the conflicts of stored patches. Conflicts are stored unresolved, their
+	// proposal being saved next to them and applied by ResolveConflict with ResolveProposed.
+	Resolver ConflictResolver
+	// BatchWindow coalesces patches queued within this delay into a single write transaction. Disabled when zero.
+	BatchWindow time.Duration
+	// BatchSize caps the number of patches written in one transaction when batching. Defaults to 100 when zero.
+	BatchSize int
+	// EncryptionKey is an AES key (16, 24 or 32 bytes) used to encrypt operations and errors at rest.
+	EncryptionKey []byte
+	// Processor applies patches replayed by Retry. Defaults to the sync library processor when nil. A
+	// ParallelProcessor without Offsets records its interrupted uploads in the store, to resume them.
+	Processor PatchProcessor
+	// OnCorruption is applied when the DB file is found corrupted on open. Defaults to CorruptionFail.
+	OnCorruption CorruptionPolicy
+	// ExcludeFromHistory lists folders whose operations are applied but never written to the DB, for privacy.
+	// Patches keep their errors even if they only come from excluded operations.
+	ExcludeFromHistory []string
+	// NoSync skips the fsync after each write transaction. Writes are much faster on slow disks, but the most
+	// recent patches may be lost, or the file corrupted, if the machine crashes before the OS flushes them.
+	// Patches stay readable within the session. Only enable it when losing some history is acceptable.
+	NoSync bool
+	// MaxOperationsPerPatch splits larger patches into chunks of at most this many operations, each stored as
+	// its own patch sharing the original UUID as batch UUID. Use LoadGrouped to list them as single patches.
+	// Disabled when zero.
+	MaxOperationsPerPatch int
+	// MetadataOnly opens the store without endpoints, for inspection: source and target may be nil and
+	// patches are loaded with nil source and target. It implies ReadOnly.
+	MetadataOnly bool
+	// CompactThreshold enables automatic compaction when the DB file is this many times bigger than its live
+	// data, e.g. 2 for a file half empty. Disabled when zero.
+	CompactThreshold float64
+	// CompactCheckInterval is the delay between two size checks. Defaults to 10 minutes when zero.
+	CompactCheckInterval time.Duration
+	// CompactMinInterval is the minimum delay between two automatic compactions. Defaults to 1 hour when zero.
+	CompactMinInterval time.Duration
+	// SizeSource reports the DB sizes checked for automatic compaction. Defaults to the BoltDB statistics when nil.
+	SizeSource SizeSource
+	// Clock gives the time used for patches stored or loaded without a stamp. Defaults to RealClock when nil.
+	Clock Clock
+	// DeterministicUUIDs stores patches under their ContentUUID, so that storing the same operations twice
+	// replaces the first record instead of adding a duplicate. Retried patches keep their UUID.
+	DeterministicUUIDs bool
+	// Events receives a PatchApplied or PatchFailed event for each stored patch, and a ConflictDetected event
+	// for each of its unresolved conflicts. Events are not published when nil.
+	Events *EventBus
+	// EventsTask is the task UUID set on published events.
+	EventsTask string
 }
 
 // NewPatchStore opens a new PatchStore
-func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoint) (*PatchStore, error) {
-	p := &PatchStore{
-		patches: make(chan merger.Patch),
-		done:    make(chan bool, 1),
-		source:  source,
-		target:  target,
+func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoint) (*BoltPatchStore, error) {
+	return NewPatchStoreWithOptions(folderPath, source, target, PatchStoreOptions{})
+}
+
+// NewPatchStoreWithOptions opens a new PatchStore using the passed options.
+func NewPatchStoreWithOptions(folderPath string, source model.Endpoint, target model.Endpoint, opts PatchStoreOptions) (*BoltPatchStore, error) {
+	if opts.MetadataOnly {
+		opts.ReadOnly = true
+	} else {
+		if _, ok := source.(model.PathSyncSource); !ok {
+			return nil, fmt.Errorf("patch store source endpoint cannot be walked (got %T), open the store with MetadataOnly for inspection", source)
+		}
+		if _, ok := target.(model.PathSyncTarget); !ok {
+			return nil, fmt.Errorf("patch store target endpoint cannot be written (got %T), open the store with MetadataOnly for inspection", target)
+		}
+	}
+	p := &BoltPatchStore{
+		patches:          make(chan merger.Patch),
+		flushCond:        sync.NewCond(&sync.Mutex{}),
+		done:             make(chan bool, 1),
+		source:           source,
+		target:           target,
+		readOnly:         opts.ReadOnly,
+		codec:            opts.Codec,
+		resolver:         opts.Resolver,
+		processor:        opts.Processor,
+		MaxStoredPatches: opts.MaxStoredPatches,
+		MaxPatchAge:      opts.MaxPatchAge,
+		batchWindow:      opts.BatchWindow,
+		batchSize:        opts.BatchSize,
+		maxOperations:    opts.MaxOperationsPerPatch,
+		clock:            opts.Clock,
+		sizes:            opts.SizeSource,
+		compactThreshold: opts.CompactThreshold,
+	}
+	if p.clock == nil {
+		p.clock = RealClock{}
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = 100
+	}
+	for _, prefix := range opts.ExcludeFromHistory {
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			p.excludes = append(p.excludes, prefix)
+		}
+	}
+	p.metrics = newMetricsCollector(p)
+	if p.codec == nil {
+		p.codec = DTOCodec{}
+	}
+	if len(opts.EncryptionKey) > 0 {
+		c, err := newValueCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		p.cipher = c
+		p.codec = encryptedCodec{codec: p.codec, cipher: c}
+	}
+	if keepBoth, ok := p.resolver.(KeepBothResolver); ok && keepBoth.Exists == nil {
+		keepBoth.Exists = p.existsOnEndpoints
+		p.resolver = keepBoth
+	}
+	if pp, ok := p.processor.(*ParallelProcessor); ok && pp.Offsets == nil && !p.readOnly {
+		pp.Offsets = p
+	}
+	if p.MaxStoredPatches == 0 {
+		p.MaxStoredPatches = defaultMaxStoredPatches
 	}
 
-	options := bbolt.DefaultOptions
+	// Copy default options, as they are shared with other BoltDB users
+	options := *bbolt.DefaultOptions
 	options.Timeout = 5 * time.Second
+	if opts.OpenTimeout > 0 {
+		options.Timeout = opts.OpenTimeout
+	}
+	options.ReadOnly = opts.ReadOnly
+	if opts.NoSync {
+		options.NoSync = true
+		options.NoFreelistSync = true
+	}
 	p.folderPath = folderPath
 	dbPath := filepath.Join(p.folderPath, "patches")
-	db, err := bbolt.Open(dbPath, 0644, options)
+	db, err := p.openDBWithPolicy(dbPath, &options, opts.OnCorruption)
 	if err != nil {
 		return nil, err
 	}
 	p.db = db
+	p.dbOptions = &options
+	if err := p.checkEncryption(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := p.migrateSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Load last known patch status (error or not)
 	if last, e := p.Load(0, 1); e == nil && len(last) > 0 {
-		_, p.lastHasErrors = last[0].HasErrors()
+		_, has := last[0].HasErrors()
+		p.setLastHasErrors(has)
 	}
 
+	p.persistWg.Add(1)
 	go func() {
+		defer p.persistWg.Done()
 		for patch := range p.patches {
-			p.persist(patch)
+			batch := p.collectBatch(patch)
+			p.persist(batch...)
+			p.flushCond.L.Lock()
+			p.handled += len(batch)
+			p.flushCond.Broadcast()
+			p.flushCond.L.Unlock()
 		}
 	}()
+	if p.sizes == nil {
+		p.sizes = p.dbSizes
+	}
+	p.deterministicUUIDs = opts.DeterministicUUIDs
+	p.events, p.eventsTask = opts.Events, opts.EventsTask
+	p.compactMinInterval = opts.CompactMinInterval
+	if p.compactMinInterval <= 0 {
+		p.compactMinInterval = defaultCompactMinInterval
+	}
+	if p.compactThreshold > 0 && !p.readOnly {
+		interval := opts.CompactCheckInterval
+		if interval <= 0 {
+			interval = defaultCompactCheckInterval
+		}
+		p.startMaintenance(interval)
+	}
 	return p, nil
 }
 
-// Store pushes the patch to the DB.
-func (p *PatchStore) Store(patch merger.Patch) {
+// Store pushes the patch to the DB. With DeterministicUUIDs, the patch UUID is first replaced by its ContentUUID.
+func (p *BoltPatchStore) Store(patch merger.Patch) error {
+	if p.deterministicUUIDs {
+		patch.SetUUID(ContentUUID(patch))
+	}
+	return p.enqueue(patch)
+}
+
+// enqueue pushes the patch to the persist goroutine, keeping its UUID.
+func (p *BoltPatchStore) enqueue(patch merger.Patch) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return ErrStoreClosed
+	}
+	p.flushCond.L.Lock()
+	p.queued++
+	p.flushCond.L.Unlock()
+	// Send without holding the lock, Stop waits for senders before closing the channel
+	p.senders.Add(1)
+	p.Unlock()
+	defer p.senders.Done()
 	p.patches <- patch
+	return nil
 }
 
-func (p *PatchStore) unmarshalConflict(data []byte, op merger.Operation) (merger.Operation, error) {
-	if op.Type() != merger.OpConflict {
-		return op, nil
+// Flush waits until the patches queued by Store before the call are persisted, or skipped if empty.
+func (p *BoltPatchStore) Flush() {
+	p.flushCond.L.Lock()
+	defer p.flushCond.L.Unlock()
+	for queued := p.queued; p.handled < queued; {
+		p.flushCond.Wait()
 	}
-	n := op.GetNode()
-	var cType merger.ConflictType
-	var leftOp, rightOp merger.Operation
-	var ii map[string]interface{}
-	if err := json.Unmarshal(data, &ii); err != nil {
-		return nil, err
+}
+
+// StoreBatch synchronously writes patches in a single transaction, instead of one transaction per patch
+// when queued with Store. Empty patches without errors are skipped the same way, unless the previous one had errors.
+func (p *BoltPatchStore) StoreBatch(patches []merger.Patch) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
 	}
-	if t, o := ii["ConflictType"]; o {
-		cType = merger.ConflictType(int(t.(float64)))
-	} else {
-		return nil, fmt.Errorf("unmarshalling conflict: missing key ConflictType")
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return ErrStoreClosed
+	}
+	// Stop waits for this write before closing the DB
+	p.persistWg.Add(1)
+	p.Unlock()
+	defer p.persistWg.Done()
+	if p.deterministicUUIDs {
+		for _, patch := range patches {
+			patch.SetUUID(ContentUUID(patch))
+		}
+	}
+	return p.persist(patches...)
+}
+
+// patchFromBucket rebuilds a patch from its bucket, including its operations.
+func (p *BoltPatchStore) patchFromBucket(uuid []byte, patchBucket *bbolt.Bucket) merger.Patch {
+	patch := merger.NewPatch(asSource(p.source), asTarget(p.target), merger.PatchOptions{})
+	// Set the UUID of the patch
+	patch.SetUUID(string(uuid))
+	var errMessages []string
+	if errsValue, e := p.openValue(patchBucket.Get(patchErrorsKey)); e == nil && errsValue != nil {
+		json.Unmarshal(errsValue, &errMessages)
 	}
-	if left, o := ii["LeftOp"]; o {
-		remarsh, _ := json.Marshal(left)
-		leftOp = merger.NewOpForUnmarshall()
-		if e := json.Unmarshal(remarsh, &leftOp); e != nil {
-			return nil, e
+	if len(errMessages) == 0 {
+		if errValue, e := p.openValue(patchBucket.Get(patchErrKey)); e == nil && errValue != nil {
+			errMessages = append(errMessages, string(errValue))
+		}
+	}
+	if len(errMessages) == 1 {
+		// Do this before unmarshalling tStamp otherwise it overwrites internal mtime
+		patch.SetPatchError(errors.New(errMessages[0]))
+	} else if len(errMessages) > 1 {
+		var pe PatchErrors
+		for _, m := range errMessages {
+			pe = append(pe, errors.New(m))
+		}
+		patch.SetPatchError(pe)
+	}
+	var inverted bool
+	if inv := patchBucket.Get(invertedKey); inv != nil {
+		inverted = string(inv) == "true"
+	} else if src := patchBucket.Get(patchSourceKey); src != nil && p.source != nil && string(src) != p.source.GetEndpointInfo().URI {
+		// Legacy records: infer direction from source URI
+		inverted = true
+	}
+	if inverted {
+		// Invert target and source
+		patch.Source(asSource(p.target))
+		patch.Target(asTarget(p.source))
+	}
+	var t time.Time
+	if err := t.UnmarshalJSON(patchBucket.Get(timeKey)); err != nil {
+		t = p.clock.Now()
+	}
+	patch.Stamp(t)
+	explained := &ExplainedPatch{Patch: patch, reasons: make(map[merger.Operation]OperationReason)}
+	reasonsBucket := patchBucket.Bucket(reasonsKey)
+	if opsBucket := patchBucket.Bucket(opsKey); opsBucket != nil {
+		oc := opsBucket.Cursor()
+		for k, v := oc.First(); v != nil; k, v = oc.Next() {
+			if operation, err := p.codec.Unmarshal(v); err == nil {
+				var reason OperationReason
+				var hasReason bool
+				if reasonsBucket != nil {
+					if data, e := p.openValue(reasonsBucket.Get(k)); e == nil {
+						reason, hasReason = unmarshalReason(data)
+					}
+				}
+				patch.Enqueue(operation)
+				if hasReason {
+					explained.reasons[operation] = reason
+				}
+			} else {
+				p.logger().Error("Cannot unmarshall operation", zap.String("patch_uuid", string(uuid)), zap.Error(err))
+			}
 		}
 	} else {
-		return nil, fmt.Errorf("unmarshalling conflict: missing key LeftOp")
+		// Partially written record, e.g. by an interrupted write: load it without operations
+		p.logger().Warn("Patch has no operations bucket", zap.String("patch_uuid", string(uuid)))
+	}
+	var loaded merger.Patch = explained
+	if d := patchBucket.Get(durationKey); len(d) == 8 {
+		loaded = WithDuration(loaded, time.Duration(binary.BigEndian.Uint64(d)))
 	}
-	if right, o := ii["RightOp"]; o {
-		remarsh, _ := json.Marshal(right)
-		rightOp = merger.NewOpForUnmarshall()
-		if e := json.Unmarshal(remarsh, &rightOp); e != nil {
-			return nil, e
+	if label := patchBucket.Get(labelKey); label != nil {
+		loaded = WithLabel(loaded, string(label))
+	}
+	if batch := patchBucket.Get(batchKey); batch != nil {
+		loaded = &BatchedPatch{Patch: loaded, batch: string(batch), index: chunkIndex(patchBucket.Get(chunkKey))}
+	}
+	return loaded
+}
+
+// Get loads a single patch by its UUID. It returns ErrPatchNotFound if it does not exist.
+func (p *BoltPatchStore) Get(uuid string) (patch merger.Patch, e error) {
+	e = p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil {
+			return ErrPatchNotFound
+		}
+		patchBucket := bucket.Bucket([]byte(uuid))
+		if patchBucket == nil {
+			return ErrPatchNotFound
 		}
+		patch = p.patchFromBucket([]byte(uuid), patchBucket)
+		return nil
+	})
+	return
+}
+
+// Load lists patches, newest first. A negative limit returns all patches, a zero limit none.
+func (p *BoltPatchStore) Load(offset, limit int) (patches []merger.Patch, e error) {
+	return p.LoadContext(context.Background(), offset, limit)
+}
+
+// LoadContext lists patches like Load, but aborts with the context error if ctx is cancelled while reading.
+func (p *BoltPatchStore) LoadContext(ctx context.Context, offset, limit int) (patches []merger.Patch, e error) {
+	patches, _, e = p.load(ctx, offset, limit, SortNewestFirst, nil, nil)
+	return
+}
+
+// LoadGrouped lists patches like Load, but chunks created by MaxOperationsPerPatch are merged back into
+// a single patch carrying the batch UUID. Paging applies to the grouped patches.
+func (p *BoltPatchStore) LoadGrouped(offset, limit int) (patches []merger.Patch, e error) {
+	all, _, e := p.load(context.Background(), 0, -1, SortNewestFirst, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	for i, patch := range groupBatches(all) {
+		if i < offset {
+			continue
+		}
+		if limit >= 0 && i >= offset+limit {
+			break
+		}
+		patches = append(patches, patch)
+	}
+	return
+}
+
+// LoadWithTotal lists patches like Load, and also returns the total number of patches currently
+// stored in the DB, to be used for paging.
+func (p *BoltPatchStore) LoadWithTotal(offset, limit int) (patches []merger.Patch, total int, e error) {
+	return p.load(context.Background(), offset, limit, SortNewestFirst, nil, nil)
+}
+
+// LoadSorted is the same as Load, using the given order.
+func (p *BoltPatchStore) LoadSorted(offset, limit int, order SortOrder) (patches []merger.Patch, e error) {
+	patches, _, e = p.load(context.Background(), offset, limit, order, nil, nil)
+	return
+}
+
+// LoadFiltered lists patches like Load, but only the ones containing at least one operation of the given types.
+// If types is empty, it behaves like Load.
+func (p *BoltPatchStore) LoadFiltered(offset, limit int, types []merger.OperationType) (patches []merger.Patch, e error) {
+	if len(types) == 0 {
+		return p.Load(offset, limit)
+	}
+	patches, _, e = p.load(context.Background(), offset, limit, SortNewestFirst, nil, func(patch merger.Patch) bool {
+		var found bool
+		patch.WalkOperations(types, func(operation merger.Operation) {
+			found = true
+		})
+		return found
+	})
+	return
+}
+
+// publishStored publishes the events of a stored patch: its unresolved conflicts, then whether it failed.
+func (p *BoltPatchStore) publishStored(patch merger.Patch) {
+	patch.WalkOperations([]merger.OperationType{merger.OpConflict}, func(operation merger.Operation) {
+		cType, _, _, _ := ConflictInfo(operation)
+		p.events.Publish(ConflictDetected{Task: p.eventsTask, PatchUUID: patch.GetUUID(), Path: operation.GetRefPath(), Type: cType})
+	})
+	if errs := ListPatchErrors(patch); len(errs) > 0 {
+		p.events.Publish(PatchFailed{Task: p.eventsTask, Patch: patch, Errors: errs})
 	} else {
-		return nil, fmt.Errorf("unmarshalling conflict: missing key RightOp")
+		p.events.Publish(PatchApplied{Task: p.eventsTask, Patch: patch})
 	}
-	// replace op now
-	conflict := merger.NewConflictOperation(n, cType, leftOp, rightOp)
-	return conflict, nil
 }
 
-// Load list all patches
-func (p *PatchStore) Load(offset, limit int) (patches []merger.Patch, e error) {
-	var stamps patchSorter
+// LoadErrored lists patches like Load, but only the ones that failed. Patches are selected on the presence of
+// their stored error, so that operations are only read for the failed ones.
+func (p *BoltPatchStore) LoadErrored(offset, limit int) (patches []merger.Patch, e error) {
+	patches, _, e = p.load(context.Background(), offset, limit, SortNewestFirst, func(patchBucket *bbolt.Bucket) bool {
+		return patchBucket.Get(patchErrKey) != nil
+	}, nil)
+	return
+}
+
+// LoadBetween lists all patches whose stamp is inside the [from, to] range, newest first.
+// A zero from or to means no lower or upper bound.
+func (p *BoltPatchStore) LoadBetween(from, to time.Time) (patches []merger.Patch, e error) {
+	patches, _, e = p.load(context.Background(), 0, -1, SortNewestFirst, func(patchBucket *bbolt.Bucket) bool {
+		var t time.Time
+		if err := t.UnmarshalJSON(patchBucket.Get(timeKey)); err != nil {
+			return false
+		}
+		if !from.IsZero() && t.Before(from) {
+			return false
+		}
+		if !to.IsZero() && t.After(to) {
+			return false
+		}
+		return true
+	}, nil)
+	return
+}
 
-	e = p.db.View(func(tx *bbolt.Tx) error {
+// load reads all patches (checking ctx in between each), sorts them and returns the requested page (a negative limit returns all patches).
+// Unfiltered chronological pages are read from the stamps index instead, when the DB has one.
+// If bucketFilter is not nil, it is called on the raw bucket before the patch is rebuilt, and if filter is not nil
+// it is called on the rebuilt patch: only patches accepted by both are kept. Total is the number of patches found in the DB.
+func (p *BoltPatchStore) load(ctx context.Context, offset, limit int, order SortOrder, bucketFilter func(patchBucket *bbolt.Bucket) bool, filter func(patch merger.Patch) bool) (patches []merger.Patch, total int, e error) {
+	if bucketFilter == nil && filter == nil && (order == SortNewestFirst || order == SortOldestFirst) {
+		if patches, total, ok, e := p.loadIndexed(ctx, offset, limit, order); ok || e != nil {
+			return patches, total, e
+		}
+	}
+	var stamps []merger.Patch
+
+	e = p.view(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(patchBucket)
 		if bucket == nil {
 			return nil
 		}
 		c := bucket.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			patch := merger.NewPatch(p.source.(model.PathSyncSource), p.target.(model.PathSyncTarget), merger.PatchOptions{})
-			// Set the UUID of the patch
-			patch.SetUUID(string(k))
-			// v is a bucket containing all operations
-			patchBucket := bucket.Bucket(k)
-			if errValue := patchBucket.Get(patchErrKey); errValue != nil {
-				// Do this before unmarshalling tStamp otherwise it overwrites internal mtime
-				patch.SetPatchError(fmt.Errorf(string(errValue)))
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				// Not a bucket
+				continue
 			}
-			if src := patchBucket.Get(patchSourceKey); src != nil && string(src) != p.source.GetEndpointInfo().URI {
-				// Invert target and source
-				patch.Source(p.target.(model.PathSyncSource))
-				patch.Target(p.source.(model.PathSyncTarget))
+			if err := ctx.Err(); err != nil {
+				return err
 			}
-			stamp := patchBucket.Get(timeKey)
-			t := time.Now()
-			if err := t.UnmarshalJSON(stamp); err == nil {
-				patch.Stamp(t)
+			total++
+			if bucketFilter != nil && !bucketFilter(bucket.Bucket(k)) {
+				continue
 			}
-			opsBucket := patchBucket.Bucket(opsKey)
-			oc := opsBucket.Cursor()
-			for _, v := oc.First(); v != nil; _, v = oc.Next() {
-				operation := merger.NewOpForUnmarshall()
-				if err := json.Unmarshal(v, &operation); err == nil {
-					if operation, err = p.unmarshalConflict(v, operation); err != nil {
-						log.Logger(context.Background()).Error("Cannot unmarshall conflict operation:" + err.Error())
-					}
-					patch.Enqueue(operation)
-				} else {
-					log.Logger(context.Background()).Error("Cannot unmarshall operation:" + err.Error())
-				}
+			patch := p.patchFromBucket(k, bucket.Bucket(k))
+			if filter != nil && !filter(patch) {
+				continue
 			}
 			stamps = append(stamps, patch)
 		}
 		return nil
 	})
 	if e != nil {
-		return patches, e
-	}
-	// Order patches by timestamp
-	sort.Sort(stamps)
-	var prunes []string
-	if len(stamps) > 100 {
-		for _, pr := range stamps[100:] {
-			prunes = append(prunes, pr.GetUUID())
-		}
+		return patches, total, e
 	}
+	sort.Sort(newPatchSorter(stamps, order))
 	for i, patch := range stamps {
+		if limit >= 0 && i >= offset+limit {
+			break
+		}
 		if i < offset {
 			continue
 		}
 		patches = append(patches, patch)
-		if i >= offset+limit-1 {
-			break
-		}
 	}
 
-	if len(prunes) > 0 {
-		go func() {
-			log.Logger(context.Background()).Info("Pruning patch store")
-			p.db.Update(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket(patchBucket)
-				if bucket == nil {
-					return nil
+	return
+}
+
+// Prune removes the oldest patches from the DB to keep only the MaxStoredPatches most recent ones, as well
+// as the patches older than MaxPatchAge. A patch is removed as soon as it exceeds either limit.
+func (p *BoltPatchStore) Prune() (removed int, err error) {
+	if p.MaxStoredPatches < 0 && p.MaxPatchAge <= 0 {
+		return 0, nil
+	}
+	err = p.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil {
+			return nil
+		}
+		var stamps stampSorter
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			ps := patchStamp{uuid: string(k)}
+			ps.stamp.UnmarshalJSON(bucket.Bucket(k).Get(timeKey))
+			stamps = append(stamps, ps)
+		}
+		sort.Sort(stamps)
+		cutoff := p.clock.Now().Add(-p.MaxPatchAge)
+		var prune stampSorter
+		for i, ps := range stamps {
+			if p.MaxStoredPatches >= 0 && i >= p.MaxStoredPatches {
+				prune = append(prune, ps)
+			} else if p.MaxPatchAge > 0 && ps.stamp.Before(cutoff) {
+				prune = append(prune, ps)
+			}
+		}
+		if len(prune) == 0 {
+			return nil
+		}
+		p.logger().Info("Pruning patch store", zap.Int("patches", len(prune)))
+		for _, ps := range prune {
+			if e := unindexPatch(tx, []byte(ps.uuid), bucket.Bucket([]byte(ps.uuid))); e != nil {
+				return e
+			}
+			if e := bucket.DeleteBucket([]byte(ps.uuid)); e != nil {
+				p.logger().Error("Cannot delete bucket", zap.String("patch_uuid", ps.uuid), zap.Error(e))
+			} else {
+				removed++
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// PatchStats gathers aggregated figures about all patches in the store.
+type PatchStats struct {
+	Total      int
+	WithErrors int
+	Operations map[merger.OperationType]int
+	Oldest     time.Time
+	Newest     time.Time
+}
+
+// Stats computes aggregated statistics over all stored patches, without fully rebuilding them.
+func (p *BoltPatchStore) Stats() (stats PatchStats, e error) {
+	stats.Operations = make(map[merger.OperationType]int)
+	e = p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			patchBucket := bucket.Bucket(k)
+			stats.Total++
+			if patchBucket.Get(patchErrKey) != nil {
+				stats.WithErrors++
+			}
+			var t time.Time
+			if err := t.UnmarshalJSON(patchBucket.Get(timeKey)); err == nil {
+				if stats.Oldest.IsZero() || t.Before(stats.Oldest) {
+					stats.Oldest = t
+				}
+				if t.After(stats.Newest) {
+					stats.Newest = t
 				}
-				for _, uuid := range prunes {
-					if e := bucket.DeleteBucket([]byte(uuid)); e != nil {
-						log.Logger(context.Background()).Error("cannot delete bucket " + uuid + " - " + e.Error())
+			}
+			opsBucket := patchBucket.Bucket(opsKey)
+			if opsBucket == nil {
+				continue
+			}
+			oc := opsBucket.Cursor()
+			for _, ov := oc.First(); ov != nil; _, ov = oc.Next() {
+				if operation, err := p.codec.Unmarshal(ov); err == nil {
+					stats.Operations[operation.Type()]++
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ConflictItem describes a conflict operation kept unresolved in a stored patch.
+type ConflictItem struct {
+	PatchUUID string
+	NodePath  string
+	Type      merger.ConflictType
+	Left      merger.Operation
+	Right     merger.Operation
+	// Proposed lists the operations proposed by the configured resolver when the conflict was stored, if any.
+	Proposed []merger.Operation
+}
+
+// PendingConflicts scans all stored patches and lists their unresolved conflict operations, with the
+// resolution proposed for them.
+func (p *BoltPatchStore) PendingConflicts() (conflicts []ConflictItem, e error) {
+	e = p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			opsBucket := bucket.Bucket(k).Bucket(opsKey)
+			if opsBucket == nil {
+				continue
+			}
+			resolutionsBucket := bucket.Bucket(k).Bucket(resolutionsKey)
+			oc := opsBucket.Cursor()
+			for opKey, ov := oc.First(); ov != nil; opKey, ov = oc.Next() {
+				operation, err := p.codec.Unmarshal(ov)
+				if err != nil || operation.Type() != merger.OpConflict {
+					continue
+				}
+				cType, left, right, err := ConflictInfo(operation)
+				if err != nil {
+					return err
+				}
+				item := ConflictItem{
+					PatchUUID: string(k),
+					NodePath:  operation.GetRefPath(),
+					Type:      cType,
+					Left:      left,
+					Right:     right,
+				}
+				if resolutionsBucket != nil {
+					if data := resolutionsBucket.Get(opKey); data != nil {
+						item.Proposed, _ = p.proposedResolution(data)
 					}
 				}
-				return nil
-			})
-		}()
+				conflicts = append(conflicts, item)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ResolveConflict applies the operation(s) of the chosen side of a stored conflict of patch patchUUID on nodePath
+// with the store processor, then replaces the conflict by the applied operations so that it is not listed by
+// PendingConflicts anymore. If some operations fail, they are stored with their error, to be replayed by Retry,
+// and their errors are returned.
+func (p *BoltPatchStore) ResolveConflict(patchUUID, nodePath string, choice ResolutionChoice) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	var resolver ConflictResolver
+	switch choice {
+	case ResolveLeft:
+		resolver = PreferSourceResolver{}
+	case ResolveRight:
+		resolver = PreferTargetResolver{}
+	case ResolveKeepBoth:
+		resolver = KeepBothResolver{Exists: p.existsOnEndpoints}
+	case ResolveProposed:
+	default:
+		return fmt.Errorf("unsupported resolution choice %d", choice)
+	}
+	var conflictKey []byte
+	var conflict merger.Operation
+	var resolved []merger.Operation
+	e := p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil || bucket.Bucket([]byte(patchUUID)) == nil {
+			return ErrPatchNotFound
+		}
+		conflictKey, conflict = p.findConflict(bucket.Bucket([]byte(patchUUID)), nodePath)
+		if conflict == nil {
+			return ErrConflictNotFound
+		}
+		if resolver != nil {
+			return nil
+		}
+		resolutionsBucket := bucket.Bucket([]byte(patchUUID)).Bucket(resolutionsKey)
+		if resolutionsBucket == nil || resolutionsBucket.Get(conflictKey) == nil {
+			return ErrNoProposedResolution
+		}
+		var err error
+		resolved, err = p.proposedResolution(resolutionsBucket.Get(conflictKey))
+		return err
+	})
+	if e != nil {
+		return e
+	}
+	if resolver != nil {
+		if multi, ok := resolver.(MultiConflictResolver); ok {
+			if resolved, e = multi.ResolveAll(conflict); e != nil {
+				return e
+			}
+		} else {
+			op, err := resolver.Resolve(conflict)
+			if err != nil {
+				return err
+			}
+			resolved = []merger.Operation{op}
+		}
+	}
+	stored, e := p.Get(patchUUID)
+	if e != nil {
+		return e
+	}
+	applied, applyErr := p.applyResolution(stored, conflict, resolved)
+	if len(applied) == 0 {
+		return applyErr
 	}
+	if e := p.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil || bucket.Bucket([]byte(patchUUID)) == nil {
+			return ErrPatchNotFound
+		}
+		patchBucket := bucket.Bucket([]byte(patchUUID))
+		// The conflict may have been resolved concurrently
+		if key, c := p.findConflict(patchBucket, nodePath); c == nil || string(key) != string(conflictKey) {
+			return ErrConflictNotFound
+		}
+		opsBucket := patchBucket.Bucket(opsKey)
+		var reason []byte
+		reasonsBucket := patchBucket.Bucket(reasonsKey)
+		if reasonsBucket != nil {
+			if v := reasonsBucket.Get(conflictKey); v != nil {
+				reason = append([]byte{}, v...)
+			}
+		}
+		for i, op := range applied {
+			data, err := p.codec.Marshal(op)
+			if err != nil {
+				return err
+			}
+			key := conflictKey
+			if i > 0 {
+				seq, _ := opsBucket.NextSequence()
+				key = itob(seq)
+			}
+			if err := opsBucket.Put(key, data); err != nil {
+				return err
+			}
+			// Resolved operations keep the reason of the conflict
+			if reason != nil && i > 0 {
+				if err := reasonsBucket.Put(key, reason); err != nil {
+					return err
+				}
+			}
+		}
+		if resolutionsBucket := patchBucket.Bucket(resolutionsKey); resolutionsBucket != nil {
+			return resolutionsBucket.Delete(conflictKey)
+		}
+		return nil
+	}); e != nil {
+		return e
+	}
+	return applyErr
+}
 
-	return
+// findConflict finds the stored conflict operation on nodePath in patchBucket, and its key.
+func (p *BoltPatchStore) findConflict(patchBucket *bbolt.Bucket, nodePath string) ([]byte, merger.Operation) {
+	opsBucket := patchBucket.Bucket(opsKey)
+	if opsBucket == nil {
+		return nil, nil
+	}
+	oc := opsBucket.Cursor()
+	for k, v := oc.First(); k != nil; k, v = oc.Next() {
+		if operation, err := p.codec.Unmarshal(v); err == nil && operation.Type() == merger.OpConflict && operation.GetRefPath() == nodePath {
+			return append([]byte{}, k...), operation
+		}
+	}
+	return nil, nil
+}
+
+// Delete removes a single patch from the DB. It returns ErrPatchNotFound if it does not exist.
+func (p *BoltPatchStore) Delete(uuid string) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	return p.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil || bucket.Bucket([]byte(uuid)) == nil {
+			return ErrPatchNotFound
+		}
+		if e := unindexPatch(tx, []byte(uuid), bucket.Bucket([]byte(uuid))); e != nil {
+			return e
+		}
+		return bucket.DeleteBucket([]byte(uuid))
+	})
+}
+
+// Clear removes all patches from the DB.
+func (p *BoltPatchStore) Clear() error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	return p.update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{patchBucket, stampsBucket} {
+			if tx.Bucket(name) != nil {
+				if e := tx.DeleteBucket(name); e != nil {
+					return e
+				}
+			}
+		}
+		_, e := tx.CreateBucket(patchBucket)
+		return e
+	})
 }
 
-// Stop closes the DB.
-func (p *PatchStore) Stop() {
+// Stop waits for pending patches to be persisted and closes the DB. Patches stored after Stop are refused.
+func (p *BoltPatchStore) Stop() {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return
+	}
+	p.closed = true
+	p.Unlock()
+	p.senders.Wait()
+	close(p.patches)
+	// Wait for persist goroutine to flush remaining patches
+	p.persistWg.Wait()
 	close(p.done)
+	p.maintenanceWg.Wait()
 	if p.pipeDone != nil {
 		close(p.pipeDone)
 	}
+	p.dbLock.Lock()
 	p.db.Close()
+	p.dbLock.Unlock()
+}
+
+// Compact rewrites the DB file to reclaim space left by deleted patches. It blocks all other
+// accesses to the DB while running.
+func (p *BoltPatchStore) Compact() error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	p.dbLock.Lock()
+	defer p.dbLock.Unlock()
+
+	dbPath := p.db.Path()
+	tmpPath := dbPath + ".compact"
+	dst, err := bbolt.Open(tmpPath, 0644, p.dbOptions)
+	if err != nil {
+		return err
+	}
+	if err := bbolt.Compact(dst, p.db, 65536); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := p.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		p.logger().Error("Cannot replace patch store by compacted version", zap.Error(err))
+		os.Remove(tmpPath)
+	}
+	db, err := bbolt.Open(dbPath, 0644, p.dbOptions)
+	if err != nil {
+		return err
+	}
+	p.db = db
+	return nil
+}
+
+// view runs a read-only transaction on the DB.
+func (p *BoltPatchStore) view(fn func(tx *bbolt.Tx) error) error {
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	return p.db.View(fn)
+}
+
+// update runs a read-write transaction on the DB.
+func (p *BoltPatchStore) update(fn func(tx *bbolt.Tx) error) error {
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	return p.db.Update(fn)
 }
 
 // PublishPatch pushes patch to the persist queue
-func (p *PatchStore) PublishPatch(patch merger.Patch) {
-	p.patches <- patch
+func (p *BoltPatchStore) PublishPatch(patch merger.Patch) {
+	if e := p.Store(patch); e != nil {
+		p.logger().Error("Cannot publish patch", zap.String("patch_uuid", patch.GetUUID()), zap.Error(e))
+	}
 }
 
-func (p *PatchStore) persist(patch merger.Patch) {
-	_, has := patch.HasErrors()
-	// Do not store empty/no-error patch, except if previous had error
-	if patch.Size() == 0 && !has && !p.lastHasErrors {
-		return
+// existsOnEndpoints checks whether a node is found at path on the source or the target.
+func (p *BoltPatchStore) existsOnEndpoints(path string) bool {
+	for _, ep := range []model.Endpoint{p.source, p.target} {
+		if ep == nil {
+			continue
+		}
+		if _, e := ep.LoadNode(context.Background(), path); e == nil {
+			return true
+		}
 	}
+	return false
+}
+
+// LastHadErrors tells whether the last stored patch had errors.
+func (p *BoltPatchStore) LastHadErrors() bool {
+	p.lastErrLock.Lock()
+	defer p.lastErrLock.Unlock()
+	return p.lastHasErrors
+}
+
+func (p *BoltPatchStore) setLastHasErrors(has bool) {
+	p.lastErrLock.Lock()
 	p.lastHasErrors = has
-	p.db.Update(func(tx *bbolt.Tx) error {
+	p.lastErrLock.Unlock()
+}
+
+func (p *BoltPatchStore) persist(patches ...merger.Patch) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	p.persistLock.Lock()
+	defer p.persistLock.Unlock()
+	var toWrite, failures []merger.Patch
+	var chunks []merger.Patch
+	// Number of chunks per patch UUID, zero when not split
+	split := make(map[string]int, len(patches))
+	for _, patch := range patches {
+		cc := SplitPatch(patch, p.maxOperations)
+		if len(cc) > 1 {
+			split[patch.GetUUID()] = len(cc)
+		} else {
+			split[patch.GetUUID()] = 0
+		}
+		chunks = append(chunks, cc...)
+	}
+	lastHasErrors := p.LastHadErrors()
+	for _, patch := range chunks {
+		_, has := patch.HasErrors()
+		// Do not store empty/no-error patch, except if previous had error or if it is labeled
+		if patch.Size() == 0 && !has && !lastHasErrors && PatchLabel(patch) == "" {
+			continue
+		}
+		if has && !lastHasErrors {
+			failures = append(failures, patch)
+		}
+		lastHasErrors = has
+		toWrite = append(toWrite, patch)
+	}
+	p.setLastHasErrors(lastHasErrors)
+	if len(toWrite) == 0 {
+		return nil
+	}
+	var opTypes []string
+	err := p.update(func(tx *bbolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(patchBucket)
 		if err != nil {
 			return err
 		}
-		// Fully replace bucket content
-		bName := []byte(patch.GetUUID())
-		if opsBucket := bucket.Bucket(bName); opsBucket != nil {
-			bucket.DeleteBucket(bName)
+		for id, count := range split {
+			if err := dropStaleChunks(bucket, id, count); err != nil {
+				return err
+			}
 		}
-		patchBucket, err := bucket.CreateBucketIfNotExists(bName)
-		if err != nil {
+		for _, patch := range toWrite {
+			types, err := p.writePatch(bucket, patch)
+			if err != nil {
+				return err
+			}
+			opTypes = append(opTypes, types...)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, patch := range toWrite {
+			p.logger().Error("Cannot store patch", zap.String("patch_uuid", patch.GetUUID()), zap.Error(err))
+		}
+		return err
+	}
+	for _, patch := range toWrite {
+		p.metrics.patchesStored.Inc()
+		if _, has := patch.HasErrors(); has {
+			p.metrics.patchesErrors.Inc()
+		}
+	}
+	for _, t := range opTypes {
+		p.metrics.operations.WithLabelValues(t).Inc()
+	}
+	if p.OnCommit != nil {
+		p.OnCommit(len(toWrite))
+	}
+	if p.OnPatchStored != nil {
+		for _, patch := range toWrite {
+			p.OnPatchStored(patch)
+		}
+	}
+	if p.OnError != nil {
+		for _, patch := range failures {
+			p.OnError(patch)
+		}
+	}
+	if p.events != nil {
+		for _, patch := range toWrite {
+			p.publishStored(patch)
+		}
+	}
+	if _, err := p.Prune(); err != nil {
+		p.logger().Error("Cannot prune patch store", zap.Error(err))
+	}
+	return nil
+}
+
+// collectBatch gathers the patches queued within the batch window following first, up to the batch size.
+func (p *BoltPatchStore) collectBatch(first merger.Patch) []merger.Patch {
+	batch := []merger.Patch{first}
+	if p.batchWindow <= 0 {
+		return batch
+	}
+	timer := time.NewTimer(p.batchWindow)
+	defer timer.Stop()
+	for len(batch) < p.batchSize {
+		select {
+		case next, ok := <-p.patches:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, next)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// dropStaleChunks removes what a previous store of the batch UUID left behind and the new write does not
+// replace: chunks from index count on, and the unsplit patch bucket if the batch is now split into count chunks.
+func dropStaleChunks(bucket *bbolt.Bucket, batch string, count int) error {
+	var stale [][]byte
+	if count > 0 {
+		stale = append(stale, []byte(batch))
+	}
+	for i := count; bucket.Bucket([]byte(ChunkUUID(batch, i))) != nil; i++ {
+		stale = append(stale, []byte(ChunkUUID(batch, i)))
+	}
+	for _, name := range stale {
+		b := bucket.Bucket(name)
+		if b == nil {
+			continue
+		}
+		if err := unindexPatch(bucket.Tx(), name, b); err != nil {
 			return err
 		}
-		mTime, _ := patch.GetStamp().MarshalJSON()
-		patchBucket.Put(timeKey, mTime)
-		if errs, ok := patch.HasErrors(); ok && len(errs) > 0 {
-			patchBucket.Put(patchErrKey, []byte(errs[0].Error()))
+		if err := bucket.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePatch fully replaces the bucket of patch inside the patches bucket and returns the types of
+// the written operations.
+func (p *BoltPatchStore) writePatch(bucket *bbolt.Bucket, patch merger.Patch) (opTypes []string, err error) {
+	bName := []byte(patch.GetUUID())
+	if opsBucket := bucket.Bucket(bName); opsBucket != nil {
+		if err := unindexPatch(bucket.Tx(), bName, opsBucket); err != nil {
+			return nil, err
 		}
-		patchBucket.Put(patchSourceKey, []byte(patch.Source().GetEndpointInfo().URI))
-		opsBucket, _ := patchBucket.CreateBucket(opsKey)
-		patch.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
-			if data, err := json.Marshal(operation); err == nil {
-				id, _ := opsBucket.NextSequence()
-				opsBucket.Put(itob(id), data)
+		bucket.DeleteBucket(bName)
+	}
+	patchBucket, err := bucket.CreateBucketIfNotExists(bName)
+	if err != nil {
+		return nil, err
+	}
+	stamp := patch.GetStamp()
+	if stamp.IsZero() {
+		stamp = p.clock.Now()
+	}
+	mTime, _ := stamp.MarshalJSON()
+	patchBucket.Put(timeKey, mTime)
+	if err := indexPatch(bucket.Tx(), bName, stamp); err != nil {
+		return nil, err
+	}
+	if d := PatchDuration(patch); d > 0 {
+		patchBucket.Put(durationKey, itob(uint64(d)))
+	}
+	if label := PatchLabel(patch); label != "" {
+		patchBucket.Put(labelKey, []byte(label))
+	}
+	if b, ok := patch.(*BatchedPatch); ok {
+		patchBucket.Put(batchKey, []byte(b.batch))
+		patchBucket.Put(chunkKey, itob(uint64(b.index)))
+	}
+	patchBucket.Put(patchSourceKey, []byte(patch.Source().GetEndpointInfo().URI))
+	inverted := "false"
+	if model.Endpoint(patch.Source()) != p.source {
+		inverted = "true"
+	}
+	patchBucket.Put(invertedKey, []byte(inverted))
+	opsBucket, _ := patchBucket.CreateBucket(opsKey)
+	var excludedErrors int
+	var operations []merger.Operation
+	WalkOperationsSorted(patch, []merger.OperationType{}, func(operation merger.Operation) {
+		if p.excludedFromHistory(operation.GetRefPath()) {
+			if status := operation.GetStatus(); status != nil && status.IsError() {
+				excludedErrors++
 			}
-		})
-		return nil
+			return
+		}
+		operations = append(operations, operation)
 	})
+	reasonsBucket, _ := patchBucket.CreateBucket(reasonsKey)
+	// Redundant operations on the same node are only stored as their net effect, with the reason of the original
+	origins := make(map[merger.Operation]merger.Operation)
+	for _, op := range normalizeOperations(operations, func(original, replacement merger.Operation) {
+		origins[replacement] = original
+	}) {
+		if data, err := p.codec.Marshal(op); err == nil {
+			id, _ := opsBucket.NextSequence()
+			opsBucket.Put(itob(id), data)
+			// Reasons are computed before the patch is applied, see ExplainPatch
+			explained := op
+			if original, ok := origins[op]; ok {
+				explained = original
+			}
+			if r, ok := OperationReasonOf(patch, explained); ok {
+				if reason, e := json.Marshal(r); e == nil {
+					reasonsBucket.Put(itob(id), p.sealValue(reason))
+				}
+			}
+			if op.Type() == merger.OpConflict {
+				if proposal := p.proposeResolution(op); proposal != nil {
+					if resolutionsBucket, e := patchBucket.CreateBucketIfNotExists(resolutionsKey); e == nil {
+						resolutionsBucket.Put(itob(id), proposal)
+					}
+				}
+			}
+			opTypes = append(opTypes, op.Type().String())
+		} else {
+			p.logger().Error("Cannot marshall operation", zap.String("patch_uuid", patch.GetUUID()), zap.String("operation", op.Type().String()), zap.String("path", op.GetRefPath()), zap.Error(err))
+		}
+	}
+	errs := ListPatchErrors(patch)
+	if len(errs) == 0 && excludedErrors > 0 {
+		// Keep the patch marked as failed without revealing excluded paths
+		errs = append(errs, fmt.Errorf("%d operations excluded from history failed", excludedErrors))
+	}
+	if len(errs) > 0 {
+		patchBucket.Put(patchErrKey, p.sealValue([]byte(errs[0].Error())))
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		if data, e := json.Marshal(msgs); e == nil {
+			patchBucket.Put(patchErrorsKey, p.sealValue(data))
+		}
+	}
+	return opTypes, nil
+}
+
+// excludedFromHistory tells whether operations on path must not be written to the DB.
+func (p *BoltPatchStore) excludedFromHistory(path string) bool {
+	path = strings.Trim(path, "/")
+	for _, prefix := range p.excludes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// asSource returns ep as a PathSyncSource, or nil if it is nil or cannot be used as such.
+func asSource(ep model.Endpoint) model.PathSyncSource {
+	s, _ := ep.(model.PathSyncSource)
+	return s
+}
+
+// asTarget returns ep as a PathSyncTarget, or nil if it is nil or cannot be used as such.
+func asTarget(ep model.Endpoint) model.PathSyncTarget {
+	t, _ := ep.(model.PathSyncTarget)
+	return t
 }
 
 // itob returns an 8-byte big endian representation of v.
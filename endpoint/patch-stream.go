@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"sort"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+)
+
+// stampIndex lists the UUIDs and stamps of all patches, newest first, without rebuilding their operations.
+func (p *BoltPatchStore) stampIndex(ctx context.Context) (stamps stampSorter, e error) {
+	e = p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ps := patchStamp{uuid: string(k)}
+			ps.stamp.UnmarshalJSON(bucket.Bucket(k).Get(timeKey))
+			stamps = append(stamps, ps)
+		}
+		return nil
+	})
+	sort.Stable(stamps)
+	return
+}
+
+// StreamPatches visits patches newest first, rebuilding them one at a time so that only the current one is held
+// in memory. It stops at the first error returned by fn, or when ctx is cancelled, and returns that error.
+// Patches deleted during the visit are skipped. No transaction is held while fn runs, so it may use the store.
+func (p *BoltPatchStore) StreamPatches(ctx context.Context, fn func(merger.Patch) error) error {
+	stamps, e := p.stampIndex(ctx)
+	if e != nil {
+		return e
+	}
+	for _, ps := range stamps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var patch merger.Patch
+		if e := p.view(func(tx *bbolt.Tx) error {
+			if bucket := tx.Bucket(patchBucket); bucket != nil {
+				if patchBucket := bucket.Bucket([]byte(ps.uuid)); patchBucket != nil {
+					patch = p.patchFromBucket([]byte(ps.uuid), patchBucket)
+				}
+			}
+			return nil
+		}); e != nil {
+			return e
+		}
+		if patch == nil {
+			continue
+		}
+		if e := fn(patch); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// PatchSummary gives an overview of the operations of a patch, for previews and notifications.
+type PatchSummary struct {
+	// Counts is the number of operations by type, conflicts included.
+	Counts map[merger.OperationType]int
+	// Bytes is the total size of the files to transfer.
+	Bytes int64
+	// Conflicts is the number of conflict operations.
+	Conflicts int
+	// SkippedBySize is the number of files left out by the size limits of the patch endpoints.
+	SkippedBySize int
+}
+
+// summaryLabels render the counts of operation types in PatchSummary.String, in this order.
+var summaryLabels = []struct {
+	label string
+	types []merger.OperationType
+}{
+	{label: "created", types: []merger.OperationType{merger.OpCreateFile, merger.OpCreateFolder}},
+	{label: "updated", types: []merger.OperationType{merger.OpUpdateFile}},
+	{label: "moved", types: []merger.OperationType{merger.OpMoveFile, merger.OpMoveFolder}},
+	{label: "deleted", types: []merger.OperationType{merger.OpDelete}},
+}
+
+// SummarizePatch walks the operations of patch once and counts them, along with the files skipped by the
+// size limits of its endpoints.
+func SummarizePatch(patch merger.Patch) PatchSummary {
+	s := PatchSummary{Counts: map[merger.OperationType]int{}}
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		s.Counts[op.Type()]++
+		switch op.Type() {
+		case merger.OpCreateFile, merger.OpUpdateFile:
+			if n := op.GetNode(); n != nil {
+				s.Bytes += n.Size
+			}
+		case merger.OpConflict:
+			s.Conflicts++
+		}
+	})
+	skipped := make(map[string]bool)
+	for _, ep := range []model.Endpoint{patch.Source(), patch.Target()} {
+		// Size filters may be wrapped by other endpoints
+		found := findEndpoint(ep, func(e model.Endpoint) bool {
+			_, ok := e.(sizeSkipper)
+			return ok
+		})
+		if sk, ok := found.(sizeSkipper); ok {
+			for _, p := range sk.SkippedBySize() {
+				skipped[p] = true
+			}
+		}
+	}
+	s.SkippedBySize = len(skipped)
+	return s
+}
+
+// Total returns the number of operations.
+func (s PatchSummary) Total() int {
+	total := 0
+	for _, c := range s.Counts {
+		total += c
+	}
+	return total
+}
+
+// String renders the summary as a short sentence like "3 created, 1 deleted, 2 conflicts".
+func (s PatchSummary) String() string {
+	var parts []string
+	for _, l := range summaryLabels {
+		count := 0
+		for _, t := range l.types {
+			count += s.Counts[t]
+		}
+		if count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, l.label))
+		}
+	}
+	if s.Conflicts == 1 {
+		parts = append(parts, "1 conflict")
+	} else if s.Conflicts > 1 {
+		parts = append(parts, fmt.Sprintf("%d conflicts", s.Conflicts))
+	}
+	if s.SkippedBySize == 1 {
+		parts = append(parts, "1 file skipped (size)")
+	} else if s.SkippedBySize > 1 {
+		parts = append(parts, fmt.Sprintf("%d files skipped (size)", s.SkippedBySize))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
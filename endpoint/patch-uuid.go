@@ -0,0 +1,58 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pborman/uuid"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ContentUUID derives a UUID from the endpoints and the operations of patch, ignoring its stamp and errors:
+// two patches applying the same operations between the same endpoints get the same UUID.
+func ContentUUID(patch merger.Patch) string {
+	var lines []string
+	for _, ep := range []interface{}{patch.Source(), patch.Target()} {
+		if e, ok := ep.(model.Endpoint); ok {
+			lines = append(lines, e.GetEndpointInfo().URI)
+		} else {
+			lines = append(lines, "")
+		}
+	}
+	var ops []string
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		line := op.Type().String() + "\x00" + op.GetRefPath()
+		if op.Type() == merger.OpMoveFile || op.Type() == merger.OpMoveFolder {
+			line += "\x00" + op.GetMoveOriginPath()
+		}
+		if n := op.GetNode(); n != nil {
+			line += fmt.Sprintf("\x00%s\x00%s\x00%d\x00%d", n.Type.String(), n.Etag, n.Size, n.MTime)
+		}
+		ops = append(ops, line)
+	})
+	sort.Strings(ops)
+	lines = append(lines, ops...)
+	return uuid.NewSHA1(uuid.NameSpace_OID, []byte(strings.Join(lines, "\n"))).String()
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// TaskCheck is the result of the preflight checks of one task.
+type TaskCheck struct {
+	Task   *config.Task
+	Errors []error
+}
+
+// OK tells if the task passed all checks.
+func (c *TaskCheck) OK() bool {
+	return len(c.Errors) == 0
+}
+
+// Name identifies the task in reports: its label, else its endpoints with credentials redacted.
+func (c *TaskCheck) Name() string {
+	if c.Task.Label != "" {
+		return c.Task.Label
+	}
+	return config.RedactURI(c.Task.LeftURI) + " <=> " + config.RedactURI(c.Task.RightURI)
+}
+
+// Preflight validates the task definition, builds both its endpoints and probes them with CheckConnection,
+// without syncing anything. Endpoints are only probed if the definition is valid.
+func Preflight(ctx context.Context, task *config.Task) *TaskCheck {
+	check := &TaskCheck{Task: task}
+	if e := task.Validate(); e != nil {
+		check.Errors = append(check.Errors, e)
+		return check
+	}
+	if _, e := ResolverFromName(task.ConflictStrategy); e != nil {
+		check.Errors = append(check.Errors, e)
+	}
+	if _, e := ParseSizePolicy(task.OversizePolicy); e != nil {
+		check.Errors = append(check.Errors, e)
+	}
+	var endpoints []model.Endpoint
+	for _, uris := range [][2]string{{task.LeftURI, task.RightURI}, {task.RightURI, task.LeftURI}} {
+		ep, e := EndpointFromURI(uris[0], uris[1])
+		if e != nil {
+			check.Errors = append(check.Errors, fmt.Errorf("cannot build endpoint %s: %v", config.RedactURI(uris[0]), e))
+			continue
+		}
+		endpoints = append(endpoints, ep)
+	}
+	check.Errors = append(check.Errors, CheckEndpoints(ctx, endpoints...)...)
+	return check
+}
+
+// PreflightReport holds the checks of several tasks.
+type PreflightReport []*TaskCheck
+
+// NewPreflightReport checks all tasks, in order.
+func NewPreflightReport(ctx context.Context, tasks []*config.Task) (report PreflightReport) {
+	for _, t := range tasks {
+		report = append(report, Preflight(ctx, t))
+	}
+	return
+}
+
+// Failures counts the tasks that did not pass the checks.
+func (r PreflightReport) Failures() (count int) {
+	for _, c := range r {
+		if !c.OK() {
+			count++
+		}
+	}
+	return
+}
+
+// WriteText prints one line per task followed by its errors, if any.
+func (r PreflightReport) WriteText(w io.Writer) {
+	for _, c := range r {
+		if c.OK() {
+			fmt.Fprintf(w, "OK      %s\n", c.Name())
+			continue
+		}
+		fmt.Fprintf(w, "FAILED  %s\n", c.Name())
+		for _, e := range c.Errors {
+			fmt.Fprintf(w, "  - %s\n", e.Error())
+		}
+	}
+	fmt.Fprintf(w, "%d tasks checked, %d failed\n", len(r), r.Failures())
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-openapi/runtime"
+	"github.com/pkg/errors"
+	"github.com/pydio/minio-go"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// IsUnauthorized tells whether err is a 401 answer, sent by servers when the access token expired: REST API
+// errors of Cells servers, or S3 errors of their gateway.
+func IsUnauthorized(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch e := errors.Cause(err).(type) {
+	case *runtime.APIError:
+		return e.Code == http.StatusUnauthorized
+	case minio.ErrorResponse:
+		return e.StatusCode == http.StatusUnauthorized
+	case *minio.ErrorResponse:
+		return e.StatusCode == http.StatusUnauthorized
+	case interface{ Code() int }:
+		// Typed answers of the REST API client
+		return e.Code() == http.StatusUnauthorized
+	}
+	return false
+}
+
+// RefreshingTarget wraps a PathSyncTarget to renew its credentials when an operation is refused with an
+// IsUnauthorized error, then replay the operation once. Concurrent operations refused at the same time only
+// trigger one refresh. Transfers are replayed while opening their reader or writer, walks and watches are
+// forwarded as is. Optional interfaces other than the content and resumable upload ones are not forwarded, so
+// the Cells endpoint replays its operations itself instead of being wrapped.
+type RefreshingTarget struct {
+	wrapped
+	*refresher
+}
+
+// NewRefreshingTarget wraps target, calling refresh to renew its credentials, e.g. with NewCellsTokenRefresher.
+func NewRefreshingTarget(target model.PathSyncTarget, refresh func(ctx context.Context) error) model.PathSyncTarget {
+	r := &RefreshingTarget{wrapped: wrapped{inner: target}, refresher: &refresher{refresh: refresh}}
+	return expose(r, target).(model.PathSyncTarget)
+}
+
+// refresher renews credentials when an operation is refused with an IsUnauthorized error, then replays it once.
+type refresher struct {
+	refresh func(ctx context.Context) error
+
+	lock sync.Mutex
+	// generation counts the refreshes, so that operations refused with the same credentials share one refresh
+	generation int
+}
+
+// LoadNode retries the underlying LoadNode after a refresh.
+func (r *RefreshingTarget) LoadNode(ctx context.Context, path string, extendedStats ...bool) (node *tree.Node, err error) {
+	err = r.retry(ctx, func() (e error) {
+		node, e = r.wrapped.LoadNode(ctx, path, extendedStats...)
+		return
+	})
+	return
+}
+
+// CreateNode retries the underlying CreateNode after a refresh.
+func (r *RefreshingTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.CreateNode(ctx, node, updateIfExists)
+	})
+}
+
+// DeleteNode retries the underlying DeleteNode after a refresh.
+func (r *RefreshingTarget) DeleteNode(ctx context.Context, path string) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.DeleteNode(ctx, path)
+	})
+}
+
+// MoveNode retries the underlying MoveNode after a refresh.
+func (r *RefreshingTarget) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.MoveNode(ctx, oldPath, newPath)
+	})
+}
+
+// GetReaderOn retries opening the underlying reader after a refresh.
+func (r *RefreshingTarget) GetReaderOn(p string) (out io.ReadCloser, err error) {
+	err = r.retry(context.Background(), func() (e error) {
+		out, e = r.wrapped.GetReaderOn(p)
+		return
+	})
+	return
+}
+
+// GetWriterOn retries opening the underlying writer after a refresh.
+func (r *RefreshingTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = r.retry(cancel, func() (e error) {
+		out, writeDone, writeErr, e = r.wrapped.GetWriterOn(cancel, p, targetSize)
+		return
+	})
+	return
+}
+
+// GetWriterAt retries opening the underlying resumed writer after a refresh.
+func (r *RefreshingTarget) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = r.retry(ctx, func() (e error) {
+		out, writeDone, writeErr, e = r.wrapped.GetWriterAt(ctx, p, targetSize, offset)
+		return
+	})
+	return
+}
+
+// CommittedOffset retries the underlying CommittedOffset after a refresh.
+func (r *RefreshingTarget) CommittedOffset(ctx context.Context, p string) (offset int64, err error) {
+	err = r.retry(ctx, func() (e error) {
+		offset, e = r.wrapped.CommittedOffset(ctx, p)
+		return
+	})
+	return
+}
+
+func (r *refresher) retry(ctx context.Context, fn func() error) error {
+	r.lock.Lock()
+	generation := r.generation
+	r.lock.Unlock()
+	err := fn()
+	if !IsUnauthorized(err) {
+		return err
+	}
+	r.lock.Lock()
+	if r.generation == generation {
+		// No other operation refreshed the credentials since this one started
+		if e := r.refresh(ctx); e != nil {
+			r.lock.Unlock()
+			return err
+		}
+		r.generation++
+	}
+	r.lock.Unlock()
+	return fn()
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/etcd-io/bbolt"
+
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// transfersBucket stores the committed offsets of interrupted uploads, by path.
+var transfersBucket = []byte("transfers")
+
+// RangeSyncTarget is a DataSyncTarget able to resume an interrupted upload, like S3 multipart or Cells
+// chunked uploads.
+type RangeSyncTarget interface {
+	model.DataSyncTarget
+	// GetWriterAt returns a writer continuing the upload of path after its first offset bytes.
+	GetWriterAt(ctx context.Context, path string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error)
+	// CommittedOffset returns the number of bytes of the pending upload of path that are safely stored.
+	CommittedOffset(ctx context.Context, path string) (int64, error)
+}
+
+// TransferOffsets records how far interrupted uploads went. Offsets are bound to the ETag of the uploaded
+// content, so that a modified file is uploaded again from the start.
+type TransferOffsets interface {
+	TransferOffset(path, etag string) int64
+	SetTransferOffset(path, etag string, offset int64) error
+	ClearTransferOffset(path string) error
+}
+
+// transferState is the stored value of a TransferOffsets entry.
+type transferState struct {
+	Etag   string `json:"etag"`
+	Offset int64  `json:"offset"`
+}
+
+// resumeTransfer uploads the content of op to target, starting from the offset recorded by a previous attempt
+// if any. On failure, the offset committed by the target is recorded for the next attempt.
+func (pp *ParallelProcessor) resumeTransfer(ctx context.Context, source model.DataSyncSource, target RangeSyncTarget, op merger.Operation) error {
+	path, etag, size := op.GetRefPath(), op.GetNode().GetEtag(), op.GetNode().GetSize()
+	offset := pp.Offsets.TransferOffset(path, etag)
+	if offset > 0 {
+		// The target may have dropped part or all of the pending upload in between
+		if committed, e := target.CommittedOffset(ctx, path); e != nil {
+			offset = 0
+		} else if committed < offset {
+			offset = committed
+		}
+	}
+	err := copyContent(ctx, source, path, offset, func() (io.WriteCloser, chan bool, chan error, error) {
+		return target.GetWriterAt(ctx, path, size, offset)
+	}, pp.OnTransferred)
+	if err == nil {
+		pp.Offsets.ClearTransferOffset(path)
+		return nil
+	}
+	if committed, e := target.CommittedOffset(ctx, path); e == nil && committed > 0 {
+		pp.Offsets.SetTransferOffset(path, etag, committed)
+	}
+	return err
+}
+
+// TransferOffset implements TransferOffsets.
+func (p *BoltPatchStore) TransferOffset(path, etag string) (offset int64) {
+	p.view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(transfersBucket)
+		if bucket == nil {
+			return nil
+		}
+		var state transferState
+		if e := json.Unmarshal(bucket.Get([]byte(path)), &state); e == nil && state.Etag == etag {
+			offset = state.Offset
+		}
+		return nil
+	})
+	return
+}
+
+// SetTransferOffset implements TransferOffsets.
+func (p *BoltPatchStore) SetTransferOffset(path, etag string, offset int64) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	data, _ := json.Marshal(transferState{Etag: etag, Offset: offset})
+	return p.update(func(tx *bbolt.Tx) error {
+		bucket, e := tx.CreateBucketIfNotExists(transfersBucket)
+		if e != nil {
+			return e
+		}
+		return bucket.Put([]byte(path), data)
+	})
+}
+
+// ClearTransferOffset implements TransferOffsets.
+func (p *BoltPatchStore) ClearTransferOffset(path string) error {
+	if p.readOnly {
+		return ErrReadOnlyStore
+	}
+	return p.update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(transfersBucket); bucket != nil {
+			return bucket.Delete([]byte(path))
+		}
+		return nil
+	})
+}
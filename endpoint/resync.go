@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/pydio/cells/common/log"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ResyncResult describes what Resync did.
+type ResyncResult struct {
+	// Patches are the applied patches. Resync produces a single patch, which also holds the conflicts: in
+	// bidirectional mode, it merges the creations on both sides.
+	Patches []merger.Patch
+	// Created lists the paths created on the side that missed them.
+	Created []string
+	// Conflicts lists the files found on both sides with different contents.
+	Conflicts []string
+}
+
+// Resync compares left and right from scratch, without relying on snapshots, and reconciles them without
+// deleting anything: nodes missing on one side are created there, as allowed by direction, and files whose
+// contents differ are not overwritten but enqueued as conflicts, to be resolved from the patch store. The
+// processor applies the creations and defaults to a serial ParallelProcessor if nil.
+func Resync(ctx context.Context, left, right model.PathSyncSource, direction model.DirectionType, processor PatchProcessor) (*ResyncResult, error) {
+	leftTarget, ok := left.(model.PathSyncTarget)
+	if !ok && direction != model.DirectionRight {
+		return nil, fmt.Errorf("left endpoint cannot be written")
+	}
+	rightTarget, ok := right.(model.PathSyncTarget)
+	if !ok && direction != model.DirectionLeft {
+		return nil, fmt.Errorf("right endpoint cannot be written")
+	}
+	report, e := Verify(ctx, left, right)
+	if e != nil {
+		return nil, e
+	}
+	if processor == nil {
+		processor = NewParallelProcessor(1)
+	}
+
+	result := &ResyncResult{}
+	var toRight, toLeft merger.Patch
+	if direction != model.DirectionLeft {
+		toRight = merger.NewPatch(left, rightTarget, merger.PatchOptions{})
+	}
+	if direction != model.DirectionRight {
+		toLeft = merger.NewPatch(right, leftTarget, merger.PatchOptions{})
+	}
+	var conflicts []merger.Operation
+	seen := make(map[string]bool)
+	for _, d := range report.Differences {
+		switch d.Kind {
+		case DiffLeftOnly:
+			if toRight != nil {
+				result.Created = append(result.Created, enqueueTree(ctx, left, toRight, d.Path, seen)...)
+			}
+		case DiffRightOnly:
+			if toLeft != nil {
+				result.Created = append(result.Created, enqueueTree(ctx, right, toLeft, d.Path, seen)...)
+			}
+		case DiffSize, DiffHash:
+			l, le := left.LoadNode(ctx, d.Path)
+			r, re := right.LoadNode(ctx, d.Path)
+			if le != nil || re != nil {
+				continue
+			}
+			leftOp := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: d.Path}, l)
+			rightOp := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: d.Path}, r)
+			conflicts = append(conflicts, merger.NewConflictOperation(l, merger.ConflictFileContent, leftOp, rightOp))
+			result.Conflicts = append(result.Conflicts, d.Path)
+		}
+	}
+
+	var patch merger.Patch
+	switch {
+	case toRight != nil && toLeft != nil:
+		bi, e := merger.ComputeBidirectionalPatch(ctx, toRight, toLeft)
+		if e != nil {
+			return nil, e
+		}
+		patch = bi
+	case toRight != nil:
+		patch = toRight
+	default:
+		patch = toLeft
+	}
+	explained := ExplainPatch(ctx, patch)
+	patch = explained
+	cmd := model.NewCommand()
+	defer cmd.Stop()
+	if SummarizePatch(patch).Total() > 0 {
+		processor.Process(patch, cmd)
+	}
+	// Conflicts are only recorded, after processing
+	for _, c := range conflicts {
+		patch.Enqueue(c)
+		if r, ok := ExplainOperation(ctx, c); ok {
+			explained.reasons[c] = r
+		}
+	}
+	if SummarizePatch(patch).Total() > 0 {
+		result.Patches = append(result.Patches, patch)
+	}
+	log.Logger(ctx).Info("Resynced endpoints from scratch",
+		zap.String("left", report.Left),
+		zap.String("right", report.Right),
+		zap.Int("differences", len(report.Differences)),
+		zap.Int("created", len(result.Created)),
+		zap.Strings("conflicts", result.Conflicts))
+	return result, nil
+}
+
+// enqueueTree adds to patch the creation of the node at p on source and of all its children, and returns the
+// enqueued paths. Paths already seen are skipped.
+func enqueueTree(ctx context.Context, source model.PathSyncSource, patch merger.Patch, p string, seen map[string]bool) (created []string) {
+	enqueue := func(p string, node *tree.Node) {
+		p = "/" + strings.TrimLeft(p, "/")
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		n := node.Clone()
+		n.Path = p
+		opType := merger.OpCreateFile
+		if !n.IsLeaf() {
+			opType = merger.OpCreateFolder
+		}
+		patch.Enqueue(merger.NewOperation(opType, model.EventInfo{Path: p}, n))
+		created = append(created, p)
+	}
+	node, e := source.LoadNode(ctx, p)
+	if e != nil {
+		return
+	}
+	enqueue(p, node)
+	if !node.IsLeaf() {
+		source.Walk(func(cp string, child *tree.Node, err error) {
+			if err == nil && child != nil {
+				enqueue(cp, child)
+			}
+		}, p, true)
+	}
+	return
+}
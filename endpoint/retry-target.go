@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// RetryOptions configures the retries of a RetryTarget.
+type RetryOptions struct {
+	// MaxRetries is the number of retries after a first failure, 3 if zero.
+	MaxRetries int
+	// InitialDelay is the wait before the first retry, doubled at each attempt. 500ms if zero.
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between two attempts, 30s if zero.
+	MaxDelay time.Duration
+	// IsTransient classifies errors that are worth retrying, IsTransient if nil.
+	IsTransient func(err error) bool
+}
+
+// IsTransient tells whether err looks like a temporary failure: network timeouts, temporary errors,
+// server-side 5xx errors or throttling responses.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return true
+	}
+	if ne, ok := cause.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+		return true
+	}
+	if te, ok := cause.(interface{ Temporary() bool }); ok && te.Temporary() {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"timeout", "connection reset", "connection refused", "slowdown", "too many requests", "service unavailable", "bad gateway", "internal server error"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryTarget wraps a PathSyncTarget to retry node operations failing with a transient error, using a
+// jittered exponential backoff. Only the last error is returned once retries are exhausted. Transfers are
+// retried while opening their reader or writer: data already sent cannot be replayed.
+type RetryTarget struct {
+	wrapped
+	options RetryOptions
+}
+
+// NewRetryTarget wraps target with retries, using defaults for zero values of options.
+func NewRetryTarget(target model.PathSyncTarget, options RetryOptions) model.PathSyncTarget {
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 3
+	}
+	if options.InitialDelay == 0 {
+		options.InitialDelay = 500 * time.Millisecond
+	}
+	if options.MaxDelay == 0 {
+		options.MaxDelay = 30 * time.Second
+	}
+	if options.IsTransient == nil {
+		options.IsTransient = IsTransient
+	}
+	r := &RetryTarget{wrapped: wrapped{inner: target}, options: options}
+	return expose(r, target).(model.PathSyncTarget)
+}
+
+// CreateNode retries the underlying CreateNode.
+func (r *RetryTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.CreateNode(ctx, node, updateIfExists)
+	})
+}
+
+// DeleteNode retries the underlying DeleteNode.
+func (r *RetryTarget) DeleteNode(ctx context.Context, path string) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.DeleteNode(ctx, path)
+	})
+}
+
+// MoveNode retries the underlying MoveNode.
+func (r *RetryTarget) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	return r.retry(ctx, func() error {
+		return r.wrapped.MoveNode(ctx, oldPath, newPath)
+	})
+}
+
+// GetReaderOn retries opening the underlying reader.
+func (r *RetryTarget) GetReaderOn(p string) (out io.ReadCloser, err error) {
+	err = r.retry(context.Background(), func() (e error) {
+		out, e = r.wrapped.GetReaderOn(p)
+		return
+	})
+	return
+}
+
+// GetWriterOn retries opening the underlying writer.
+func (r *RetryTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = r.retry(cancel, func() (e error) {
+		out, writeDone, writeErr, e = r.wrapped.GetWriterOn(cancel, p, targetSize)
+		return
+	})
+	return
+}
+
+// GetWriterAt retries opening the underlying resumed writer.
+func (r *RetryTarget) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	err = r.retry(ctx, func() (e error) {
+		out, writeDone, writeErr, e = r.wrapped.GetWriterAt(ctx, p, targetSize, offset)
+		return
+	})
+	return
+}
+
+func (r *RetryTarget) retry(ctx context.Context, fn func() error) error {
+	delay := r.options.InitialDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || attempt >= r.options.MaxRetries || !r.options.IsTransient(err) {
+			return err
+		}
+		// Add up to 50% of jitter so that concurrent operations do not retry all at once
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > r.options.MaxDelay {
+			delay = r.options.MaxDelay
+		}
+	}
+}
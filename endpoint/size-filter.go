@@ -0,0 +1,168 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// SizePolicy defines how a file that went out of the size limits after being synced is handled.
+type SizePolicy string
+
+const (
+	// SizeKeepTarget stops updating the file but keeps the copy previously synced on the other side.
+	SizeKeepTarget SizePolicy = "keep"
+	// SizeDeleteTarget removes the copy previously synced on the other side.
+	SizeDeleteTarget SizePolicy = "delete"
+)
+
+// ParseSizePolicy checks a policy name. An empty name defaults to SizeKeepTarget.
+func ParseSizePolicy(name string) (SizePolicy, error) {
+	switch p := SizePolicy(name); p {
+	case "":
+		return SizeKeepTarget, nil
+	case SizeKeepTarget, SizeDeleteTarget:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported size policy %s, please use one of keep, delete", name)
+}
+
+// SizeLimits restricts the size of the synced files. Folders are never filtered.
+type SizeLimits struct {
+	// Min skips files smaller than this number of bytes.
+	Min int64
+	// Max skips files bigger than this number of bytes. Zero means no limit.
+	Max int64
+	// Policy applies to files that went out of the limits after being synced.
+	Policy SizePolicy
+}
+
+// Allows tells whether node is within the limits.
+func (l SizeLimits) Allows(node *tree.Node) bool {
+	if !node.IsLeaf() {
+		return true
+	}
+	return node.GetSize() >= l.Min && (l.Max <= 0 || node.GetSize() <= l.Max)
+}
+
+// SizeFilteredEndpoint wraps an endpoint to hide the files out of some SizeLimits from its listings, so that they
+// are never part of a diff and thus never enqueued into a patch. With the SizeKeepTarget policy, a file already
+// synced to other within the limits is exposed with the node found on other, so that the diff sees no change.
+// The content and resumable upload interfaces of the wrapped endpoint are forwarded.
+type SizeFilteredEndpoint struct {
+	wrapped
+	other  model.PathSyncSource
+	limits SizeLimits
+
+	sync.Mutex
+	skipped map[string]bool
+}
+
+// sizeSkipper is implemented by endpoints reporting the files they skipped because of their size.
+type sizeSkipper interface {
+	SkippedBySize() []string
+}
+
+// NewSizeFilteredEndpoint wraps ep. Other is the endpoint ep is synced with, it may be nil if the policy is
+// SizeDeleteTarget.
+func NewSizeFilteredEndpoint(ep model.Endpoint, other model.PathSyncSource, limits SizeLimits) (model.Endpoint, error) {
+	if _, ok := ep.(syncEndpoint); !ok {
+		return nil, fmt.Errorf("endpoint cannot be used as both source and target")
+	}
+	policy, err := ParseSizePolicy(string(limits.Policy))
+	if err != nil {
+		return nil, err
+	}
+	if policy == SizeKeepTarget && other == nil {
+		return nil, fmt.Errorf("size policy %s requires the other endpoint", policy)
+	}
+	limits.Policy = policy
+	s := &SizeFilteredEndpoint{wrapped: wrapped{inner: ep}, other: other, limits: limits, skipped: make(map[string]bool)}
+	return expose(s, ep), nil
+}
+
+// filter returns the node exposed for node found at p, if any.
+func (s *SizeFilteredEndpoint) filter(ctx context.Context, p string, node *tree.Node) (*tree.Node, bool) {
+	if s.limits.Allows(node) {
+		return node, true
+	}
+	s.Lock()
+	s.skipped["/"+strings.TrimLeft(p, "/")] = true
+	s.Unlock()
+	if s.limits.Policy == SizeKeepTarget {
+		if synced, e := s.other.LoadNode(ctx, p); e == nil && synced != nil && synced.IsLeaf() && s.limits.Allows(synced) {
+			n := synced.Clone()
+			n.Path = node.Path
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Walk wraps the underlying Walk and skips the files out of the limits. A full walk resets the skipped files.
+func (s *SizeFilteredEndpoint) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	if recursive && strings.Trim(root, "/") == "" {
+		s.Lock()
+		s.skipped = make(map[string]bool)
+		s.Unlock()
+	}
+	ctx := context.Background()
+	return s.wrapped.Walk(func(p string, node *tree.Node, err error) {
+		if err == nil && node != nil {
+			var ok bool
+			if node, ok = s.filter(ctx, p, node); !ok {
+				return
+			}
+		}
+		walknFc(p, node, err)
+	}, root, recursive)
+}
+
+// LoadNode hides the files out of the limits.
+func (s *SizeFilteredEndpoint) LoadNode(ctx context.Context, p string, extendedStats ...bool) (*tree.Node, error) {
+	node, err := s.wrapped.LoadNode(ctx, p, extendedStats...)
+	if err != nil {
+		return nil, err
+	}
+	if exposed, ok := s.filter(ctx, p, node); ok {
+		return exposed, nil
+	}
+	return nil, &os.PathError{Op: "load", Path: p, Err: os.ErrNotExist}
+}
+
+// SkippedBySize lists the files skipped since the last full walk.
+func (s *SizeFilteredEndpoint) SkippedBySize() []string {
+	s.Lock()
+	defer s.Unlock()
+	var paths []string
+	for p := range s.skipped {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
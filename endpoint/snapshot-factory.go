@@ -80,13 +80,15 @@ func (f *SnapshotFactory) Close(ctx context.Context) error {
 	return nil
 }
 
-// Reset clears all snapshots (left and right)
+// Reset clears all snapshots (left and right). They are recreated empty on next Load.
 func (f *SnapshotFactory) Reset(ctx context.Context) error {
-
+	f.Lock()
+	defer f.Unlock()
 	for _, name := range []string{"left", "right"} {
 		if s, ok := f.snaps[name]; ok {
 			log.Logger(ctx).Info("Closing and clearing snapshot " + name)
 			s.(*snapshot.BoltSnapshot).Close()
+			delete(f.snaps, name)
 			if e := os.Remove(filepath.Join(f.configPath, "snapshot-"+name)); e != nil {
 				return e
 			}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pydio/cells/common/sync/endpoints/snapshot"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// SnapshotSource wraps a PathSyncSource and keeps a snapshot of its tree in a BoltDB, so that
+// after a restart only the changes since the last capture have to be computed.
+type SnapshotSource struct {
+	model.PathSyncSource
+	sync.Mutex
+
+	snap      *snapshot.BoltSnapshot
+	lastDelta merger.Patch
+}
+
+// NewSnapshotSource opens or creates a snapshot of the underlying source inside folderPath.
+// The folder should be dedicated to this source, as the snapshot file name is fixed.
+func NewSnapshotSource(folderPath string, underlying model.PathSyncSource) (model.PathSyncSource, error) {
+	snap, e := snapshot.NewBoltSnapshot(folderPath, "source")
+	if e != nil {
+		return nil, e
+	}
+	return &SnapshotSource{
+		PathSyncSource: underlying,
+		snap:           snap,
+	}, nil
+}
+
+// Capture computes the changes between the last snapshot and the underlying source, then updates the snapshot.
+// The changes are available via LastDelta.
+func (s *SnapshotSource) Capture(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	snapTarget, ok := model.AsPathSyncTarget(s.snap)
+	if !ok {
+		return fmt.Errorf("snapshot cannot be used as target")
+	}
+	diff := merger.NewTreeDiff(ctx, s.PathSyncSource, s.snap)
+	if e := diff.Compute("/", nil, nil); e != nil {
+		return e
+	}
+	delta := merger.NewPatch(s.PathSyncSource, snapTarget, merger.PatchOptions{MoveDetection: true})
+	diff.ToUnidirectionalPatch(model.DirectionRight, delta)
+	if e := s.snap.Capture(ctx, s.PathSyncSource); e != nil {
+		return e
+	}
+	s.lastDelta = delta
+	return nil
+}
+
+// LastDelta returns the changes detected by the last call to Capture, or nil if Capture was never called.
+func (s *SnapshotSource) LastDelta() merger.Patch {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastDelta
+}
+
+// Snapshot returns the underlying snapshot, usable as a PathSyncSource.
+func (s *SnapshotSource) Snapshot() model.PathSyncSource {
+	return s.snap
+}
+
+// Close closes the snapshot DB.
+func (s *SnapshotSource) Close() {
+	s.snap.Close()
+}
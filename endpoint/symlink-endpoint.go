@@ -0,0 +1,349 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// SymlinkPolicy defines how symbolic links found on a filesystem endpoint are synced.
+type SymlinkPolicy string
+
+const (
+	// SymlinkFollow syncs the file or folder a link points to, as if it was found at the link location.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkSkip ignores links and anything below them.
+	SymlinkSkip SymlinkPolicy = "skip"
+	// SymlinkPreserve syncs the link itself: its target is recorded as node metadata instead of transferring the
+	// content it points to. Only relative targets staying inside the synced folder are preserved, and links are
+	// recreated by ParallelProcessor.
+	SymlinkPreserve SymlinkPolicy = "preserve"
+)
+
+// SymlinkEndpoint wraps a filesystem endpoint rooted at root to apply a SymlinkPolicy. Following links is
+// guarded against loops: a link pointing to one of its own ancestors, or to a folder already followed, is skipped.
+type SymlinkEndpoint struct {
+	syncEndpoint
+	root   string
+	policy SymlinkPolicy
+}
+
+// syncEndpoint is an endpoint that can be used on both sides of a sync.
+type syncEndpoint interface {
+	model.PathSyncSource
+	model.PathSyncTarget
+}
+
+// ParseSymlinkPolicy checks a policy name. An empty name defaults to SymlinkFollow.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(name); p {
+	case "":
+		return SymlinkFollow, nil
+	case SymlinkFollow, SymlinkSkip, SymlinkPreserve:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported symlink policy %s, please use one of follow, skip, preserve", name)
+}
+
+// NewSymlinkEndpoint wraps ep, a filesystem endpoint whose files are stored in the root folder.
+func NewSymlinkEndpoint(ep model.Endpoint, root string, policy SymlinkPolicy) (*SymlinkEndpoint, error) {
+	se, ok := ep.(syncEndpoint)
+	if !ok {
+		return nil, fmt.Errorf("endpoint cannot be used as both source and target")
+	}
+	if _, err := ParseSymlinkPolicy(string(policy)); err != nil {
+		return nil, err
+	}
+	return &SymlinkEndpoint{syncEndpoint: se, root: root, policy: policy}, nil
+}
+
+func (s *SymlinkEndpoint) fullPath(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(strings.TrimLeft(p, "/")))
+}
+
+// isLink tells whether p is a symbolic link.
+func (s *SymlinkEndpoint) isLink(p string) bool {
+	info, err := os.Lstat(s.fullPath(p))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// Walk wraps the underlying Walk and applies the policy to all links found.
+func (s *SymlinkEndpoint) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	var links []string
+	visited := make(map[string]bool)
+	if real, err := filepath.EvalSymlinks(s.root); err == nil {
+		visited[real] = true
+	}
+	err := s.syncEndpoint.Walk(func(p string, node *tree.Node, err error) {
+		p = strings.TrimLeft(p, "/")
+		for _, l := range links {
+			if strings.HasPrefix(p, l+"/") {
+				return
+			}
+		}
+		if !s.isLink(p) {
+			walknFc(p, node, err)
+			return
+		}
+		links = append(links, p)
+	}, root, recursive)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		switch s.policy {
+		case SymlinkPreserve:
+			if node, e := s.linkNode(l); e == nil {
+				walknFc(l, node, nil)
+			} else {
+				walknFc(l, nil, e)
+			}
+		case SymlinkFollow:
+			s.follow(l, visited, walknFc, recursive)
+		}
+	}
+	return nil
+}
+
+// follow walks the real file or folder behind the link at p, exposing it under p.
+func (s *SymlinkEndpoint) follow(p string, visited map[string]bool, walknFc model.WalkNodesFunc, recursive bool) {
+	full := s.fullPath(p)
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		// Broken link or loop between links
+		return
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		node, e := s.followedNode(p, real, info)
+		walknFc(p, node, e)
+		return
+	}
+	if parent, e := filepath.EvalSymlinks(filepath.Dir(full)); visited[real] || e != nil || isAncestor(real, parent) {
+		return
+	}
+	visited[real] = true
+	node, _ := s.followedNode(p, real, info)
+	walknFc(p, node, nil)
+	if recursive {
+		s.walkFollowed(p, real, visited, walknFc)
+	}
+}
+
+// walkFollowed lists the children of a regular folder found below a followed link.
+func (s *SymlinkEndpoint) walkFollowed(p, real string, visited map[string]bool, walknFc model.WalkNodesFunc) {
+	entries, err := ioutil.ReadDir(real)
+	if err != nil {
+		walknFc(p, nil, err)
+		return
+	}
+	for _, entry := range entries {
+		child := path.Join(p, entry.Name())
+		childReal := filepath.Join(real, entry.Name())
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			s.follow(child, visited, walknFc, true)
+		case entry.IsDir():
+			if visited[childReal] {
+				continue
+			}
+			visited[childReal] = true
+			node, _ := s.followedNode(child, childReal, entry)
+			walknFc(child, node, nil)
+			s.walkFollowed(child, childReal, visited, walknFc)
+		default:
+			node, e := s.followedNode(child, childReal, entry)
+			walknFc(child, node, e)
+		}
+	}
+}
+
+// followedNode builds the node exposed at p for the real file or folder behind a link.
+func (s *SymlinkEndpoint) followedNode(p, real string, info os.FileInfo) (*tree.Node, error) {
+	node := &tree.Node{
+		Path:  p,
+		MTime: info.ModTime().Unix(),
+		Mode:  int32(info.Mode().Perm()),
+	}
+	if info.IsDir() {
+		node.Type = tree.NodeType_COLLECTION
+		// Folders behind links cannot store their uuid, derive it from their path
+		node.Uuid = fmt.Sprintf("%x", md5.Sum([]byte(p)))
+		return node, nil
+	}
+	node.Type = tree.NodeType_LEAF
+	node.Size = info.Size()
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	node.Etag = fmt.Sprintf("%x", h.Sum(nil))
+	return node, nil
+}
+
+// SymlinkMeta is the node metadata holding the target of a preserved link, as a slash-separated path relative
+// to the folder of the link.
+const SymlinkMeta = "cells-sync:symlink"
+
+// ErrUnsafeSymlink is returned for preserved links whose target is absolute or outside of the synced folder.
+var ErrUnsafeSymlink = errors.New("symbolic link target is absolute or outside of the synced folder")
+
+// SymlinkTarget returns the link target recorded on node, or an empty string if node is not a preserved link.
+func SymlinkTarget(node *tree.Node) string {
+	if node == nil {
+		return ""
+	}
+	return node.GetStringMeta(SymlinkMeta)
+}
+
+// checkSymlink refuses link targets that are absolute or that escape the synced folder from the link at p.
+func checkSymlink(p, target string) error {
+	if target == "" || filepath.IsAbs(target) || strings.HasPrefix(target, "/") || filepath.VolumeName(target) != "" {
+		return ErrUnsafeSymlink
+	}
+	resolved := path.Join(path.Dir(strings.Trim(p, "/")), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return ErrUnsafeSymlink
+	}
+	return nil
+}
+
+// linkNode builds the leaf exposed for a preserved link, holding no content but the link target as metadata.
+func (s *SymlinkEndpoint) linkNode(p string) (*tree.Node, error) {
+	full := s.fullPath(p)
+	info, err := os.Lstat(full)
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.Readlink(full)
+	if err != nil {
+		return nil, err
+	}
+	target = filepath.ToSlash(target)
+	if err := checkSymlink(p, target); err != nil {
+		return nil, errors.Wrap(err, p)
+	}
+	node := &tree.Node{
+		Path:  p,
+		Type:  tree.NodeType_LEAF,
+		MTime: info.ModTime().Unix(),
+		Etag:  fmt.Sprintf("%x", md5.Sum([]byte(target))),
+	}
+	if err := node.SetMeta(SymlinkMeta, target); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// LoadNode applies the policy if p is a link.
+func (s *SymlinkEndpoint) LoadNode(ctx context.Context, p string, extendedStats ...bool) (*tree.Node, error) {
+	if !s.isLink(p) {
+		return s.syncEndpoint.LoadNode(ctx, p, extendedStats...)
+	}
+	switch s.policy {
+	case SymlinkPreserve:
+		return s.linkNode(p)
+	case SymlinkFollow:
+		real, err := filepath.EvalSymlinks(s.fullPath(p))
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(real)
+		if err != nil {
+			return nil, err
+		}
+		return s.followedNode(p, real, info)
+	}
+	return nil, &os.PathError{Op: "load", Path: p, Err: os.ErrNotExist}
+}
+
+// CreateNode recreates a link for nodes carrying a SymlinkMeta, and forwards other nodes to the wrapped
+// endpoint. Links with an absolute target or a target outside of the synced folder are refused.
+func (s *SymlinkEndpoint) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	target := SymlinkTarget(node)
+	if target == "" {
+		return s.syncEndpoint.CreateNode(ctx, node, updateIfExists)
+	}
+	if s.policy != SymlinkPreserve {
+		return fmt.Errorf("cannot create symbolic link %s, links are only synced with the preserve policy", node.Path)
+	}
+	if err := checkSymlink(node.Path, target); err != nil {
+		return errors.Wrap(err, node.Path)
+	}
+	full := s.fullPath(node.Path)
+	if _, err := os.Lstat(full); err == nil {
+		if !updateIfExists {
+			return &os.PathError{Op: "create", Path: node.Path, Err: os.ErrExist}
+		}
+		if err := os.Remove(full); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(filepath.FromSlash(target), full)
+}
+
+// GetReaderOn forwards to the wrapped endpoint. Preserved links have no content: they are created from the
+// SymlinkMeta of their node.
+func (s *SymlinkEndpoint) GetReaderOn(p string) (out io.ReadCloser, err error) {
+	if s.policy == SymlinkPreserve && s.isLink(p) {
+		return nil, fmt.Errorf("cannot read %s: symbolic links are synced as metadata", p)
+	}
+	ds, ok := s.syncEndpoint.(model.DataSyncSource)
+	if !ok {
+		return nil, fmt.Errorf("endpoint does not support content transfer")
+	}
+	return ds.GetReaderOn(p)
+}
+
+// GetWriterOn forwards to the wrapped endpoint.
+func (s *SymlinkEndpoint) GetWriterOn(cancel context.Context, p string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	dt, ok := s.syncEndpoint.(model.DataSyncTarget)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("endpoint does not support content transfer")
+	}
+	return dt.GetWriterOn(cancel, p, targetSize)
+}
+
+// isAncestor tells whether dir contains p.
+func isAncestor(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
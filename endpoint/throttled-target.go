@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// rateLimiter is a simple token bucket shared by all transfers of a ThrottledTarget.
+// It allows bursts of at most one second worth of bytes.
+type rateLimiter struct {
+	sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (r *rateLimiter) setRate(bytesPerSec int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.rate = bytesPerSec
+	r.tokens = 0
+	r.last = time.Now()
+}
+
+// wait blocks until n bytes can be transferred. A rate <= 0 means unlimited.
+func (r *rateLimiter) wait(n int) {
+	r.Lock()
+	if r.rate <= 0 {
+		r.Unlock()
+		return
+	}
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+	}
+	r.Unlock()
+	if delay > 0 {
+		<-time.After(delay)
+	}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	io.WriteCloser
+	limiter *rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.limiter.wait(len(p))
+	return t.WriteCloser.Write(p)
+}
+
+// ThrottledTarget wraps a PathSyncTarget to limit the bandwidth used by content transfers
+// (reads and writes) on this endpoint.
+type ThrottledTarget struct {
+	model.PathSyncTarget
+	limiter *rateLimiter
+}
+
+// NewThrottledTarget wraps target and caps its transfers to bytesPerSec. A value <= 0 disables throttling.
+func NewThrottledTarget(target model.PathSyncTarget, bytesPerSec int64) model.PathSyncTarget {
+	t := &ThrottledTarget{
+		PathSyncTarget: target,
+		limiter:        &rateLimiter{},
+	}
+	t.limiter.setRate(bytesPerSec)
+	return t
+}
+
+// SetBandwidth changes the cap applied to transfers, including the ones currently running.
+func (t *ThrottledTarget) SetBandwidth(bytesPerSec int64) {
+	t.limiter.setRate(bytesPerSec)
+}
+
+// GetWriterOn wraps the underlying target writer.
+func (t *ThrottledTarget) GetWriterOn(cancel context.Context, path string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	dt, ok := t.PathSyncTarget.(model.DataSyncTarget)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("endpoint does not support content transfer")
+	}
+	out, writeDone, writeErr, err = dt.GetWriterOn(cancel, path, targetSize)
+	if err != nil {
+		return
+	}
+	return &throttledWriter{WriteCloser: out, limiter: t.limiter}, writeDone, writeErr, nil
+}
+
+// GetReaderOn wraps the underlying endpoint reader, if it is also a DataSyncSource.
+func (t *ThrottledTarget) GetReaderOn(path string) (out io.ReadCloser, err error) {
+	ds, ok := t.PathSyncTarget.(model.DataSyncSource)
+	if !ok {
+		return nil, fmt.Errorf("endpoint does not support content transfer")
+	}
+	out, err = ds.GetReaderOn(path)
+	if err != nil {
+		return
+	}
+	return &throttledReader{ReadCloser: out, limiter: t.limiter}, nil
+}
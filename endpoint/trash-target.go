@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// DeletionPolicy tells how a TrashTarget applies deletions.
+type DeletionPolicy string
+
+const (
+	// DeleteHard forwards deletions to the target.
+	DeleteHard DeletionPolicy = "hard"
+	// DeleteTrash moves deleted nodes to a dated folder inside the trash folder.
+	DeleteTrash DeletionPolicy = "trash"
+	// DeleteKeep ignores deletions.
+	DeleteKeep DeletionPolicy = "keep"
+)
+
+// trashDateFormat names the trash subfolders grouping nodes deleted on the same day.
+const trashDateFormat = "2006-01-02"
+
+// TrashOptions configures a TrashTarget.
+type TrashOptions struct {
+	// Folder is the path of the trash folder at the root of the target, ".trash" if empty.
+	// It is hidden from the listings, nodes and events of the target, so that it is never synced.
+	Folder string
+	// Retention is the age after which PurgeTrash removes a dated folder. Zero keeps them forever.
+	Retention time.Duration
+	// Now returns the current time, time.Now if nil.
+	Now func() time.Time
+}
+
+// TrashTarget wraps a PathSyncTarget to apply a DeletionPolicy instead of always deleting nodes. The other
+// interfaces of the wrapped endpoint are forwarded.
+type TrashTarget struct {
+	wrapped
+	// raw is the wrapped target, the trash folder included.
+	raw     model.PathSyncTarget
+	policy  DeletionPolicy
+	options TrashOptions
+}
+
+// ParseDeletionPolicy checks a policy name. An empty name defaults to DeleteHard.
+func ParseDeletionPolicy(name string) (DeletionPolicy, error) {
+	switch p := DeletionPolicy(name); p {
+	case "":
+		return DeleteHard, nil
+	case DeleteHard, DeleteTrash, DeleteKeep:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported deletion policy %s, please use one of hard, trash, keep", name)
+}
+
+// NewTrashTarget wraps target with a deletion policy, using defaults for zero values of options.
+func NewTrashTarget(target model.PathSyncTarget, policy DeletionPolicy, options TrashOptions) (model.PathSyncTarget, error) {
+	policy, err := ParseDeletionPolicy(string(policy))
+	if err != nil {
+		return nil, err
+	}
+	if options.Folder == "" {
+		options.Folder = ".trash"
+	}
+	options.Folder = strings.Trim(options.Folder, "/")
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	var inner model.Endpoint = target
+	if src, ok := target.(model.PathSyncSource); ok {
+		inner = NewFilteredSource(src, []string{"/" + options.Folder + "/"})
+	}
+	t := &TrashTarget{wrapped: wrapped{inner: inner}, raw: target, policy: policy, options: options}
+	return expose(t, target).(model.PathSyncTarget), nil
+}
+
+// FindTrashTarget returns the TrashTarget found among the wrappers of ep, or nil.
+func FindTrashTarget(ep model.Endpoint) *TrashTarget {
+	t, _ := findEndpoint(ep, func(e model.Endpoint) bool {
+		_, ok := e.(*TrashTarget)
+		return ok
+	}).(*TrashTarget)
+	return t
+}
+
+// DeleteNode applies the deletion policy.
+func (t *TrashTarget) DeleteNode(ctx context.Context, p string) error {
+	switch t.policy {
+	case DeleteKeep:
+		return nil
+	case DeleteTrash:
+		if t.inTrash(p) {
+			return t.raw.DeleteNode(ctx, p)
+		}
+		return t.moveToTrash(ctx, p)
+	default:
+		return t.raw.DeleteNode(ctx, p)
+	}
+}
+
+// PurgeTrash deletes the dated trash folders older than the retention. The target must also be a
+// PathSyncSource to list them.
+func (t *TrashTarget) PurgeTrash(ctx context.Context) (purged int, err error) {
+	if t.options.Retention == 0 {
+		return 0, nil
+	}
+	src, ok := t.raw.(model.PathSyncSource)
+	if !ok {
+		return 0, fmt.Errorf("cannot list trash folder on this target")
+	}
+	limit := t.options.Now().Add(-t.options.Retention)
+	var expired []string
+	err = src.Walk(func(p string, node *tree.Node, err error) {
+		if err != nil || node == nil || node.IsLeaf() {
+			return
+		}
+		if day, e := time.ParseInLocation(trashDateFormat, path.Base(p), time.Local); e == nil && day.Before(limit) {
+			expired = append(expired, p)
+		}
+	}, withLeadingSlash(t.options.Folder, "/"), false)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range expired {
+		if err := t.raw.DeleteNode(ctx, p); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (t *TrashTarget) inTrash(p string) bool {
+	trimmed := strings.Trim(p, "/")
+	return trimmed == t.options.Folder || strings.HasPrefix(trimmed, t.options.Folder+"/")
+}
+
+// withLeadingSlash formats p like reference, as endpoints use either absolute or relative paths.
+func withLeadingSlash(p, reference string) string {
+	p = strings.TrimLeft(p, "/")
+	if strings.HasPrefix(reference, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+// moveToTrash moves p to Folder/<date>/p, creating missing parent folders. Nodes already in the trash
+// under the same path get a counter suffix.
+func (t *TrashTarget) moveToTrash(ctx context.Context, p string) error {
+	rel := strings.Trim(p, "/")
+	dest := path.Join(t.options.Folder, t.options.Now().Format(trashDateFormat), rel)
+	parent := ""
+	for _, part := range strings.Split(path.Dir(dest), "/") {
+		parent = path.Join(parent, part)
+		folder := withLeadingSlash(parent, p)
+		if _, e := t.raw.LoadNode(ctx, folder); e == nil {
+			continue
+		}
+		if e := t.raw.CreateNode(ctx, &tree.Node{Path: folder, Type: tree.NodeType_COLLECTION}, false); e != nil {
+			return e
+		}
+	}
+	target := withLeadingSlash(dest, p)
+	for i := 2; ; i++ {
+		if _, e := t.raw.LoadNode(ctx, target); e != nil {
+			break
+		}
+		target = withLeadingSlash(fmt.Sprintf("%s (%d)", dest, i), p)
+	}
+	return t.raw.MoveNode(ctx, p, target)
+}
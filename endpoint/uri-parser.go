@@ -27,9 +27,11 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
-	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/minio-go"
+	"github.com/pydio/minio-go/pkg/credentials"
 
 	"github.com/pydio/cells-sync/config"
 
@@ -45,7 +47,8 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 
 	u, e := url.Parse(uri)
 	if e != nil {
-		return nil, e
+		// Parse errors quote the whole URI, including its credentials
+		return nil, fmt.Errorf("cannot parse endpoint URI %s", config.RedactURI(uri))
 	}
 	otherU, _ := url.Parse(otherUri)
 	opts := model.EndpointOptions{}
@@ -64,7 +67,15 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 				path = filepath.Join(path, u.Path[3:])
 			}
 		}
-		return filesystem.NewFSClient(path, opts)
+		fs, err := filesystem.NewFSClient(path, opts)
+		if err != nil || u.Query().Get("symlinks") == "" {
+			return fs, err
+		}
+		policy, err := ParseSymlinkPolicy(u.Query().Get("symlinks"))
+		if err != nil {
+			return nil, err
+		}
+		return NewSymlinkEndpoint(fs, path, policy)
 
 	case "db":
 		return memory.NewMemDB(), nil
@@ -79,81 +90,86 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 		}
 		return cells.NewLocal(strings.TrimLeft(u.Path, "/"), options), nil
 
-	case "http", "https":
-
-		var auth *config.Authority
-		for _, a := range config.Default().Authorities {
-			newU := *u
-			newU.Path = ""
-			if a.Id == newU.String() {
-				auth = a
-				break
-			}
-		}
-		if auth == nil {
-			return nil, fmt.Errorf("cannot find authority")
-		}
-		// Warning, we use the ACCESSS TOKEN as IdToken
-		conf := cells.RemoteConfig{
-			Url:           fmt.Sprintf("%s://%s", u.Scheme, u.Host),
-			IdToken:       auth.AccessToken,
-			RefreshToken:  auth.RefreshToken,
-			ExpiresAt:     auth.ExpiresAt,
-			SkipVerify:    auth.InsecureSkipVerify,
-			CustomHeaders: map[string]string{"User-Agent": "cells-sync/" + common.Version},
-		}
-		options := cells.Options{
-			EndpointOptions: opts,
-		}
-		ep := cells.NewRemote(conf, strings.TrimLeft(u.Path, "/"), options)
-		if !opts.BrowseOnly {
-			watcher := config.Watch()
-			go func() {
-				for change := range watcher {
-					if aC, ok := change.(*config.AuthChange); ok {
-						acUrl, _ := url.Parse(aC.Authority.URI)
-						if acUrl.Scheme == u.Scheme && acUrl.Host == u.Host && aC.Authority.Username == u.User.Username() {
-							if aC.Type == "delete" {
-								return
-							} else {
-								conf.IdToken = aC.Authority.AccessToken
-								conf.RefreshToken = aC.Authority.RefreshToken
-								conf.ExpiresAt = aC.Authority.ExpiresAt
-								ep.RefreshRemoteConfig(conf)
-							}
-						}
-					}
-				}
-			}()
-		}
-		return ep, nil
+	case "http", "https", "cells":
+		return NewCellsEndpoint(u, opts)
 
 	case "s3":
-		fullPath := u.Path
-		parts := strings.Split(fullPath, "/")
-		bucket := parts[1]
-		parts = parts[2:]
-		rootPath := strings.Join(parts, "/")
-		if u.User == nil {
-			return nil, errors.New("please provide API keys and secret in URL")
-		}
-		password, _ := u.User.Password()
-		values := u.Query()
-		normalize := values.Get("normalize") == "true"
-		secure := strings.Contains(u.Hostname(), "amazonaws.com") || values.Get("secure") == "true"
-		client, e := s3.NewClient(context.Background(), u.Host, u.User.Username(), password, bucket, rootPath, secure, opts)
-		if e != nil {
-			return nil, e
-		}
-		if normalize {
-			client.ServerRequiresNormalization = true
-		}
-		return client, nil
+		return NewS3Endpoint(u, opts)
 
 	default:
-		return nil, fmt.Errorf("unsupported scheme " + u.Scheme)
+		return nil, fmt.Errorf("unsupported scheme %s, please use one of fs, db, router, http, https, cells or s3", u.Scheme)
+	}
+
+}
+
+// NewS3Endpoint creates an endpoint on an S3-compatible storage from an URL like
+// s3://API_KEY:API_SECRET@host[:port]/bucket/prefix. API_SECRET can be a keyring:id reference to a secret stored
+// with config.CredentialToKeyring. Query parameters are "secure=true" to use TLS (always on for amazonaws.com)
+// and "normalize=true" for servers requiring unicode normalization of keys. For MinIO and other self-hosted
+// servers, "region=name" signs requests for this region instead of discovering it, and "pathStyle=true" addresses
+// the bucket in the URL path instead of the host name. Directories are synthesized from keys prefixes by the
+// underlying client. Uploads are resumable with multipart uploads, except on servers requiring normalization.
+func NewS3Endpoint(u *url.URL, opts model.EndpointOptions) (model.Endpoint, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] == "" {
+		return nil, errors.New("please provide a bucket name in URL path")
+	}
+	bucket := parts[0]
+	rootPath := strings.Join(parts[1:], "/")
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("please provide API keys and secret in URL")
+	}
+	u, e := config.ResolveURICredentials(u)
+	if e != nil {
+		return nil, e
+	}
+	password, _ := u.User.Password()
+	values := u.Query()
+	secure := strings.Contains(u.Hostname(), "amazonaws.com") || values.Get("secure") == "true"
+	var pathStyle bool
+	if ps := values.Get("pathStyle"); ps != "" {
+		if pathStyle, e = strconv.ParseBool(ps); e != nil {
+			return nil, fmt.Errorf("invalid pathStyle value %s, please use true or false", ps)
+		}
+	}
+	region := values.Get("region")
+	client, e := s3.NewClient(context.Background(), u.Host, u.User.Username(), password, bucket, rootPath, secure, opts)
+	if e != nil {
+		return nil, e
+	}
+	lookup := minio.BucketLookupAuto
+	if pathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	mc, e := minio.NewWithOptions(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(u.User.Username(), password, ""),
+		Secure:       secure,
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if e != nil {
+		return nil, e
 	}
+	core := &minio.Core{Client: mc}
+	if region != "" || pathStyle {
+		client.Oc = core
+	}
+	if values.Get("normalize") == "true" {
+		// Keys are normalized by the client, uploads are not resumed
+		client.ServerRequiresNormalization = true
+		return client, nil
+	}
+	return &s3Endpoint{Client: client, multipartUploads: multipartUploads{
+		core:   func() (*minio.Core, error) { return core, nil },
+		bucket: bucket,
+		root:   rootPath,
+	}}, nil
+}
 
+// s3Endpoint adds the resumable uploads of RangeSyncTarget to the S3 client of the sync library.
+type s3Endpoint struct {
+	*s3.Client
+	multipartUploads
 }
 
 // DefaultDirForURI tries to find a default directory to display to user when they choose a specific endpoint.
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// VerifiedTarget wraps a PathSyncTarget to check, after each content transfer, that the written file
+// reads back with the same checksum as the transferred data. Mismatches are reported as transfer errors,
+// flagging the corresponding operation as failed. The other calls are forwarded to the wrapped target.
+type VerifiedTarget struct {
+	wrapped
+	newHash func() hash.Hash
+}
+
+// NewVerifiedTarget wraps target with a checksum verification using algorithm, either sha256 (default) or md5.
+func NewVerifiedTarget(target model.PathSyncTarget, algorithm string) (model.PathSyncTarget, error) {
+	v := &VerifiedTarget{wrapped: wrapped{inner: target}}
+	switch algorithm {
+	case "", "sha256":
+		v.newHash = sha256.New
+	case "md5":
+		v.newHash = md5.New
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %s, please use one of sha256, md5", algorithm)
+	}
+	if _, ok := target.(model.DataSyncSource); !ok {
+		return nil, fmt.Errorf("endpoint cannot read back its contents for verification")
+	}
+	// Resumed uploads only write the end of files, that cannot be verified: RangeSyncTarget is not exposed
+	if _, ok := target.(model.DataSyncTarget); ok {
+		return dataEndpointView{v}, nil
+	}
+	return dataSourceTargetView{v}, nil
+}
+
+// verifiedWriter hashes all bytes going through it.
+type verifiedWriter struct {
+	io.WriteCloser
+	hasher  hash.Hash
+	onClose func() error
+}
+
+func (w *verifiedWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hasher.Write(p[:n])
+	return n, err
+}
+
+func (w *verifiedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if w.onClose != nil {
+		return w.onClose()
+	}
+	return nil
+}
+
+// GetWriterOn wraps the underlying target writer. Verification runs once the underlying writer reports
+// completion, or on Close if it does not provide completion channels.
+func (v *VerifiedTarget) GetWriterOn(cancel context.Context, path string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	dt, ok := v.inner.(model.DataSyncTarget)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("endpoint does not support content transfer")
+	}
+	w, done, errs, err := dt.GetWriterOn(cancel, path, targetSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vw := &verifiedWriter{WriteCloser: w, hasher: v.newHash()}
+	if done == nil && errs == nil {
+		vw.onClose = func() error {
+			return v.verify(path, vw.hasher.Sum(nil))
+		}
+		return vw, nil, nil, nil
+	}
+	writeDone = make(chan bool, 1)
+	writeErr = make(chan error, 1)
+	go func() {
+		select {
+		case d := <-done:
+			if e := v.verify(path, vw.hasher.Sum(nil)); e != nil {
+				writeErr <- e
+			} else {
+				writeDone <- d
+			}
+		case e := <-errs:
+			writeErr <- e
+		case <-cancel.Done():
+			writeErr <- cancel.Err()
+		}
+	}()
+	return vw, writeDone, writeErr, nil
+}
+
+// verify reads path back from the target and compares its checksum to expected.
+func (v *VerifiedTarget) verify(path string, expected []byte) error {
+	source, ok := v.inner.(model.DataSyncSource)
+	if !ok {
+		return fmt.Errorf("cannot read %s back for verification: target cannot provide contents", path)
+	}
+	reader, err := source.GetReaderOn(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s back for verification: %v", path, err)
+	}
+	defer reader.Close()
+	hasher := v.newHash()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return fmt.Errorf("cannot read %s back for verification: %v", path, err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return fmt.Errorf("checksum mismatch after transferring %s", path)
+	}
+	return nil
+}
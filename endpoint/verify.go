@@ -0,0 +1,176 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// DifferenceKind qualifies a Difference found by Verify.
+type DifferenceKind string
+
+const (
+	// DiffLeftOnly is a node only found on the left endpoint.
+	DiffLeftOnly DifferenceKind = "left-only"
+	// DiffRightOnly is a node only found on the right endpoint.
+	DiffRightOnly DifferenceKind = "right-only"
+	// DiffSize is a file found on both sides with different sizes.
+	DiffSize DifferenceKind = "size"
+	// DiffHash is a file found on both sides with the same size but a different content hash.
+	DiffHash DifferenceKind = "hash"
+	// DiffMTime is a file found on both sides with the same content but a different modification time.
+	DiffMTime DifferenceKind = "mtime"
+)
+
+// Difference describes a node that differs between two endpoints.
+type Difference struct {
+	Path  string         `json:"path"`
+	Kind  DifferenceKind `json:"kind"`
+	Left  *NodeSummary   `json:"left,omitempty"`
+	Right *NodeSummary   `json:"right,omitempty"`
+}
+
+// NodeSummary holds the node fields compared by Verify.
+type NodeSummary struct {
+	Folder bool   `json:"folder,omitempty"`
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+func newNodeSummary(node *tree.Node) *NodeSummary {
+	if node == nil {
+		return nil
+	}
+	return &NodeSummary{
+		Folder: !node.IsLeaf(),
+		Size:   node.GetSize(),
+		MTime:  node.GetMTime(),
+		Hash:   node.GetEtag(),
+	}
+}
+
+// VerifyReport lists the differences found between two endpoints.
+type VerifyReport struct {
+	Left        string       `json:"left"`
+	Right       string       `json:"right"`
+	Differences []Difference `json:"differences"`
+}
+
+// Converged tells whether no difference was found.
+func (r *VerifyReport) Converged() bool {
+	return len(r.Differences) == 0
+}
+
+// WriteText prints the report in a human readable form.
+func (r *VerifyReport) WriteText(w io.Writer) {
+	if r.Converged() {
+		fmt.Fprintf(w, "%s and %s are in sync\n", r.Left, r.Right)
+		return
+	}
+	fmt.Fprintf(w, "%d differences found between %s and %s\n", len(r.Differences), r.Left, r.Right)
+	for _, d := range r.Differences {
+		switch d.Kind {
+		case DiffLeftOnly, DiffRightOnly:
+			fmt.Fprintf(w, "  %-10s %s\n", d.Kind, d.Path)
+		case DiffSize:
+			fmt.Fprintf(w, "  %-10s %s (%d / %d bytes)\n", d.Kind, d.Path, d.Left.Size, d.Right.Size)
+		case DiffMTime:
+			fmt.Fprintf(w, "  %-10s %s (%d / %d)\n", d.Kind, d.Path, d.Left.MTime, d.Right.MTime)
+		default:
+			fmt.Fprintf(w, "  %-10s %s (%s / %s)\n", d.Kind, d.Path, d.Left.Hash, d.Right.Hash)
+		}
+	}
+}
+
+// Verify compares left and right without modifying them. It computes the same tree diff as a sync, reads
+// the patch that would make right identical to left and discards it, then checks the modification times
+// of files that the diff considers equal.
+func Verify(ctx context.Context, left, right model.PathSyncSource) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Left:        left.GetEndpointInfo().URI,
+		Right:       right.GetEndpointInfo().URI,
+		Differences: []Difference{},
+	}
+	diff := merger.NewTreeDiff(ctx, left, right)
+	if e := diff.Compute("/", nil, nil); e != nil {
+		return nil, e
+	}
+	target, ok := right.(model.PathSyncTarget)
+	if !ok {
+		return nil, fmt.Errorf("right endpoint cannot be used for diffing")
+	}
+	patch := merger.NewPatch(left, target, merger.PatchOptions{})
+	if e := diff.ToUnidirectionalPatch(model.DirectionRight, patch); e != nil {
+		return nil, e
+	}
+	differs := make(map[string]bool)
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		p := "/" + strings.TrimLeft(op.GetRefPath(), "/")
+		var d Difference
+		switch op.Type() {
+		case merger.OpCreateFolder, merger.OpCreateFile:
+			d = Difference{Path: p, Kind: DiffLeftOnly, Left: newNodeSummary(op.GetNode())}
+		case merger.OpDelete:
+			d = Difference{Path: p, Kind: DiffRightOnly, Right: newNodeSummary(op.GetNode())}
+		case merger.OpUpdateFile:
+			l, _ := left.LoadNode(ctx, p)
+			r, _ := right.LoadNode(ctx, p)
+			d = Difference{Path: p, Kind: DiffHash, Left: newNodeSummary(l), Right: newNodeSummary(r)}
+			if l != nil && r != nil && l.GetSize() != r.GetSize() {
+				d.Kind = DiffSize
+			}
+		default:
+			return
+		}
+		differs[p] = true
+		report.Differences = append(report.Differences, d)
+	})
+	e := left.Walk(func(p string, node *tree.Node, err error) {
+		p = "/" + strings.TrimLeft(p, "/")
+		if err != nil || !node.IsLeaf() || differs[p] {
+			return
+		}
+		r, er := right.LoadNode(ctx, p)
+		if er != nil || r == nil {
+			return
+		}
+		if r.GetSize() != node.GetSize() {
+			report.Differences = append(report.Differences, Difference{Path: p, Kind: DiffSize, Left: newNodeSummary(node), Right: newNodeSummary(r)})
+		} else if r.GetMTime() != node.GetMTime() {
+			report.Differences = append(report.Differences, Difference{Path: p, Kind: DiffMTime, Left: newNodeSummary(node), Right: newNodeSummary(r)})
+		}
+	}, "/", true)
+	if e != nil {
+		return nil, e
+	}
+	sort.Slice(report.Differences, func(i, j int) bool {
+		return report.Differences[i].Path < report.Differences[j].Path
+	})
+	return report, nil
+}
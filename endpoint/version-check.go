@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// ErrTargetChanged is set on operations skipped because their target node changed since the patch was computed.
+var ErrTargetChanged = errors.New("target node was modified since the patch was computed")
+
+// nodeVersion is the part of a node compared to detect concurrent modifications.
+type nodeVersion struct {
+	exists bool
+	etag   string
+	mTime  int64
+}
+
+func versionOf(node *tree.Node) nodeVersion {
+	if node == nil {
+		return nodeVersion{}
+	}
+	return nodeVersion{exists: true, etag: node.GetEtag(), mTime: node.GetMTime()}
+}
+
+// TargetVersions records the version of the target files touched by a patch, right after it is computed,
+// so that a processor can check they did not change before overwriting or deleting them.
+type TargetVersions struct {
+	versions map[string]nodeVersion
+}
+
+// CaptureTargetVersions loads the current version of the target node of each file creation, update or deletion of patch.
+func CaptureTargetVersions(ctx context.Context, patch merger.Patch) *TargetVersions {
+	v := &TargetVersions{versions: make(map[string]nodeVersion)}
+	patch.WalkOperations([]merger.OperationType{merger.OpCreateFile, merger.OpUpdateFile, merger.OpDelete}, func(op merger.Operation) {
+		node, err := op.Target().LoadNode(ctx, op.GetRefPath())
+		if err != nil {
+			node = nil
+		}
+		if node != nil && !node.IsLeaf() {
+			return
+		}
+		v.versions[op.GetRefPath()] = versionOf(node)
+	})
+	return v
+}
+
+// Changed reloads the target node of op and tells whether it differs from the captured version. Operations whose
+// version was not captured are never reported as changed. The current node is returned, nil if it does not exist.
+func (v *TargetVersions) Changed(ctx context.Context, target model.PathSyncTarget, op merger.Operation) (*tree.Node, bool) {
+	captured, ok := v.versions[op.GetRefPath()]
+	if !ok {
+		return nil, false
+	}
+	current, err := target.LoadNode(ctx, op.GetRefPath())
+	if err != nil {
+		current = nil
+	}
+	return current, versionOf(current) != captured
+}
+
+// versionConflict builds the conflict raised instead of applying op over a modified target node.
+func versionConflict(op merger.Operation, current *tree.Node) merger.Operation {
+	node := op.GetNode()
+	if node == nil {
+		node = current
+	}
+	var remote merger.Operation
+	if current != nil {
+		remote = merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: op.GetRefPath()}, current)
+	} else {
+		remote = merger.NewOperation(merger.OpDelete, model.EventInfo{Path: op.GetRefPath()}, node)
+	}
+	return merger.NewConflictOperation(node, merger.ConflictFileContent, op, remote)
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// newTestConflict builds a content conflict on p, left and right nodes having the given etags and mtimes.
+func newTestConflict(p string, leftEtag string, leftMTime int64, rightEtag string, rightMTime int64) merger.Operation {
+	left := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: leftEtag, MTime: leftMTime})
+	right := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: rightEtag, MTime: rightMTime})
+	return merger.NewConflictOperation(&tree.Node{Path: p, Type: tree.NodeType_LEAF}, merger.ConflictFileContent, left, right)
+}
+
+// directionProcessor records the paths of the operations it is given, depending on the endpoint they are applied to.
+// Operations are marked as failed with fail when it is set.
+type directionProcessor struct {
+	target   model.Endpoint
+	fail     error
+	forward  []string
+	backward []string
+}
+
+func (d *directionProcessor) Process(patch merger.Patch, cmd *model.Command) {
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		if model.Endpoint(patch.Target()) == d.target {
+			d.forward = append(d.forward, op.GetRefPath())
+		} else {
+			d.backward = append(d.backward, op.GetRefPath())
+		}
+		if d.fail != nil {
+			op.Error(d.fail)
+		}
+	})
+}
+
+func TestConflictResolvers(t *testing.T) {
+
+	Convey("Test built-in conflict resolvers", t, func() {
+		conflict := newTestConflict("/folder/file.txt", "left", 10, "right", 20)
+
+		resolver, e := endpoint.ResolverFromName("prefer-source")
+		So(e, ShouldBeNil)
+		op, e := resolver.Resolve(conflict)
+		So(e, ShouldBeNil)
+		So(op.GetNode().Etag, ShouldEqual, "left")
+
+		resolver, _ = endpoint.ResolverFromName("prefer-target")
+		op, e = resolver.Resolve(conflict)
+		So(e, ShouldBeNil)
+		So(op.GetNode().Etag, ShouldEqual, "right")
+
+		resolver, _ = endpoint.ResolverFromName("most-recent")
+		op, e = resolver.Resolve(conflict)
+		So(e, ShouldBeNil)
+		So(op.GetNode().Etag, ShouldEqual, "right")
+		op, e = resolver.Resolve(newTestConflict("/file", "left", 30, "right", 20))
+		So(e, ShouldBeNil)
+		So(op.GetNode().Etag, ShouldEqual, "left")
+
+		resolver, _ = endpoint.ResolverFromName("keep-both")
+		ops, e := resolver.(endpoint.MultiConflictResolver).ResolveAll(conflict)
+		So(e, ShouldBeNil)
+		So(ops, ShouldHaveLength, 2)
+		So(ops[0].GetRefPath(), ShouldEqual, "/folder/file.txt")
+		So(ops[1].Type(), ShouldEqual, merger.OpMoveFile)
+		So(ops[1].GetMoveOriginPath(), ShouldEqual, "/folder/file.txt")
+		So(ops[1].GetRefPath(), ShouldStartWith, "/folder/file (conflicted copy ")
+		So(ops[1].GetNode().Etag, ShouldEqual, "right")
+
+		_, e = endpoint.ResolverFromName("unknown")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test server authoritative mtime resolver", t, func() {
+		resolver, e := endpoint.ResolverFromName("server-mtime")
+		So(e, ShouldBeNil)
+		So(resolver, ShouldResemble, endpoint.AuthoritativeMTimeResolver{Authority: endpoint.ResolveLeft, Tolerance: 2 * time.Second})
+		resolver, e = endpoint.ResolverFromName("server-mtime:10s")
+		So(e, ShouldBeNil)
+		So(resolver.(endpoint.AuthoritativeMTimeResolver).Tolerance, ShouldEqual, 10*time.Second)
+		_, e = endpoint.ResolverFromName("server-mtime:soon")
+		So(e, ShouldNotBeNil)
+		_, e = endpoint.ResolverFromName("server-mtime10s")
+		So(e, ShouldNotBeNil)
+
+		etag := func(r endpoint.ConflictResolver, conflict merger.Operation) string {
+			op, e := r.Resolve(conflict)
+			So(e, ShouldBeNil)
+			return op.GetNode().Etag
+		}
+		r := endpoint.AuthoritativeMTimeResolver{Tolerance: 5 * time.Second}
+		// Clear winner on either side
+		So(etag(r, newTestConflict("/file", "left", 100, "right", 200)), ShouldEqual, "right")
+		So(etag(r, newTestConflict("/file", "left", 200, "right", 100)), ShouldEqual, "left")
+		// Within tolerance, the tiebreak side is kept whichever is newer
+		So(etag(r, newTestConflict("/file", "left", 100, "right", 104)), ShouldEqual, "left")
+		r.Tiebreak = endpoint.ResolveRight
+		So(etag(r, newTestConflict("/file", "left", 104, "right", 100)), ShouldEqual, "right")
+
+		// The right clock is one minute ahead of the authoritative left one
+		r = endpoint.AuthoritativeMTimeResolver{Skew: time.Minute, Tolerance: 5 * time.Second}
+		So(etag(r, newTestConflict("/file", "left", 100, "right", 130)), ShouldEqual, "left")
+		So(etag(r, newTestConflict("/file", "left", 100, "right", 200)), ShouldEqual, "right")
+		So(etag(r, newTestConflict("/file", "left", 100, "right", 163)), ShouldEqual, "left")
+		// The left clock is one minute ahead of the authoritative right one
+		r.Authority = endpoint.ResolveRight
+		So(etag(r, newTestConflict("/file", "left", 130, "right", 100)), ShouldEqual, "right")
+		So(etag(r, newTestConflict("/file", "left", 200, "right", 100)), ShouldEqual, "left")
+
+		_, e = r.Resolve(merger.NewConflictOperation(&tree.Node{Path: "/file"}, merger.ConflictFileContent,
+			merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/file"}, nil),
+			merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/file"}, nil)))
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test PatchStore proposes resolutions of stored conflicts by server mtime", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		processor := &directionProcessor{target: target}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{
+			Resolver:  endpoint.AuthoritativeMTimeResolver{Skew: time.Minute, Tolerance: 5 * time.Second},
+			Processor: processor,
+		})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(newTestConflict("/doc.txt", "left", 100, "right", 130))
+		storeAndWait(store, patch)
+
+		// The conflict is kept as is, with its proposed resolution
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			So(op.Type(), ShouldEqual, merger.OpConflict)
+		})
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldHaveLength, 1)
+		So(conflicts[0].Proposed, ShouldHaveLength, 1)
+		So(conflicts[0].Proposed[0].GetNode().Etag, ShouldEqual, "left")
+		So(processor.forward, ShouldBeEmpty)
+
+		So(store.ResolveConflict(patch.GetUUID(), "/doc.txt", endpoint.ResolveProposed), ShouldBeNil)
+		So(processor.forward, ShouldResemble, []string{"/doc.txt"})
+		So(processor.backward, ShouldBeEmpty)
+		conflicts, e = store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldBeEmpty)
+	})
+
+	Convey("Test PatchStore keeps failed resolutions for retry", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		processor := &directionProcessor{target: target, fail: fmt.Errorf("cannot write")}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{Processor: processor})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(newTestConflict("/doc.txt", "left", 100, "right", 130))
+		storeAndWait(store, patch)
+
+		e := store.ResolveConflict(patch.GetUUID(), "/doc.txt", endpoint.ResolveLeft)
+		So(e, ShouldNotBeNil)
+		So(e.Error(), ShouldContainSubstring, "cannot write")
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldBeEmpty)
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			So(op.Type(), ShouldNotEqual, merger.OpConflict)
+			So(op.GetStatus().IsError(), ShouldBeTrue)
+		})
+
+		processor.fail = nil
+		_, e = store.Retry(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(processor.forward, ShouldResemble, []string{"/doc.txt", "/doc.txt"})
+	})
+
+	Convey("Test PatchStore without resolver proposes nothing", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(newTestConflict("/doc.txt", "left", 100, "right", 130))
+		storeAndWait(store, patch)
+
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldHaveLength, 1)
+		So(conflicts[0].Proposed, ShouldBeEmpty)
+		So(store.ResolveConflict(patch.GetUUID(), "/doc.txt", endpoint.ResolveProposed), ShouldEqual, endpoint.ErrNoProposedResolution)
+	})
+
+	Convey("Test conflict types are serialized by name", t, func() {
+		codec := endpoint.JSONCodec{}
+		for _, cType := range []merger.ConflictType{
+			merger.ConflictNodeType,
+			merger.ConflictFileContent,
+			merger.ConflictFolderUUID,
+			merger.ConflictFileUUID,
+			merger.ConflictMoveSameSource,
+			merger.ConflictMoveSameTarget,
+		} {
+			name := endpoint.ConflictTypeName(cType)
+			parsed, e := endpoint.ParseConflictType(name)
+			So(e, ShouldBeNil)
+			So(parsed, ShouldEqual, cType)
+
+			left := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/file"}, &tree.Node{Path: "/file", Etag: "left"})
+			right := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/file"}, &tree.Node{Path: "/file", Etag: "right"})
+			conflict := merger.NewConflictOperation(&tree.Node{Path: "/file"}, cType, left, right)
+			data, e := codec.Marshal(conflict)
+			So(e, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"ConflictType":"`+name+`"`)
+
+			decoded, e := codec.Unmarshal(data)
+			So(e, ShouldBeNil)
+			decodedType, _, _, e := endpoint.ConflictInfo(decoded)
+			So(e, ShouldBeNil)
+			So(decodedType, ShouldEqual, cType)
+
+			// Legacy integer values are still accepted
+			legacy, _ := json.Marshal(conflict)
+			decoded, e = codec.Unmarshal(legacy)
+			So(e, ShouldBeNil)
+			decodedType, _, _, e = endpoint.ConflictInfo(decoded)
+			So(e, ShouldBeNil)
+			So(decodedType, ShouldEqual, cType)
+		}
+
+		So(endpoint.ConflictTypeName(merger.ConflictType(42)), ShouldEqual, "42")
+		_, e := endpoint.ParseConflictType("unknown")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test conflicted copy naming", t, func() {
+		date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		So(endpoint.ConflictedCopyPath("/a/report.docx", date, nil), ShouldEqual, "/a/report (conflicted copy 2024-05-01).docx")
+		So(endpoint.ConflictedCopyPath("/a/archive.tar.gz", date, nil), ShouldEqual, "/a/archive.tar (conflicted copy 2024-05-01).gz")
+		So(endpoint.ConflictedCopyPath("/a/Makefile", date, nil), ShouldEqual, "/a/Makefile (conflicted copy 2024-05-01)")
+		So(endpoint.ConflictedCopyPath("/.bashrc", date, nil), ShouldEqual, "/.bashrc (conflicted copy 2024-05-01)")
+
+		used := map[string]bool{
+			"/a/report (conflicted copy 2024-05-01).docx":   true,
+			"/a/report (conflicted copy 2024-05-01 2).docx": true,
+		}
+		exists := func(p string) bool { return used[p] }
+		So(endpoint.ConflictedCopyPath("/a/report.docx", date, exists), ShouldEqual, "/a/report (conflicted copy 2024-05-01 3).docx")
+	})
+
+	Convey("Test PatchStore persists keep-both resolution", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		existing := "/doc (conflicted copy 2024-05-01).txt"
+		So(target.CreateNode(context.Background(), &tree.Node{Path: existing, Type: tree.NodeType_LEAF}, false), ShouldBeNil)
+
+		processor := &directionProcessor{target: target}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{
+			Resolver:  endpoint.KeepBothResolver{Now: func() time.Time { return date }},
+			Processor: processor,
+		})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(newTestConflict("/doc.txt", "left", 10, "right", 20))
+		storeAndWait(store, patch)
+
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldHaveLength, 1)
+		var paths []string
+		for _, op := range conflicts[0].Proposed {
+			paths = append(paths, op.GetRefPath())
+		}
+		So(paths, ShouldHaveLength, 2)
+		So(paths, ShouldContain, "/doc.txt")
+		So(paths, ShouldContain, "/doc (conflicted copy 2024-05-01 2).txt")
+
+		// Both operations are applied to the target: the copy is not created from the source contents
+		So(store.ResolveConflict(patch.GetUUID(), "/doc.txt", endpoint.ResolveProposed), ShouldBeNil)
+		So(processor.forward, ShouldHaveLength, 2)
+		So(processor.backward, ShouldBeEmpty)
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		loaded.WalkOperations([]merger.OperationType{merger.OpMoveFile}, func(op merger.Operation) {
+			So(op.GetMoveOriginPath(), ShouldEqual, "/doc.txt")
+			So(op.GetRefPath(), ShouldEqual, "/doc (conflicted copy 2024-05-01 2).txt")
+		})
+	})
+
+}
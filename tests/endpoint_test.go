@@ -0,0 +1,1463 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	"github.com/pkg/errors"
+	"github.com/pydio/minio-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zalando/go-keyring"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+func TestEndpointFromURI(t *testing.T) {
+
+	Convey("Test endpoints dispatch by URI scheme", t, func() {
+		tmp, _ := ioutil.TempDir("", "endpoint")
+		defer os.RemoveAll(tmp)
+
+		ep, err := endpoint.EndpointFromURI("db://", "fs://"+tmp)
+		So(err, ShouldBeNil)
+		_, ok := ep.(*memory.DBEndpoint)
+		So(ok, ShouldBeTrue)
+
+		ep, err = endpoint.EndpointFromURI("fs://"+tmp, "db://")
+		So(err, ShouldBeNil)
+		_, ok = ep.(*filesystem.FSClient)
+		So(ok, ShouldBeTrue)
+
+		_, err = endpoint.EndpointFromURI("s3://host/bucket/path", "db://")
+		So(err, ShouldNotBeNil)
+
+		_, err = endpoint.EndpointFromURI("ftp://host/path", "db://")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unsupported scheme ftp")
+	})
+
+	Convey("Test Cells endpoints from the logged in authorities", t, func() {
+		previous := config.Default()
+		defer config.SetDefault(previous)
+		config.SetDefault(&config.Global{Authorities: []*config.Authority{{
+			Id:           "https://admin@cells.example.com",
+			URI:          "https://cells.example.com",
+			Username:     "admin",
+			AccessToken:  "access",
+			RefreshToken: "refresh",
+			ExpiresAt:    int(time.Now().Add(time.Hour).Unix()),
+		}}})
+		opts := model.EndpointOptions{BrowseOnly: true}
+
+		for _, uri := range []string{"https://admin@cells.example.com/personal-files/folder", "cells://admin@cells.example.com/personal-files"} {
+			u, _ := url.Parse(uri)
+			ep, err := endpoint.NewCellsEndpoint(u, opts)
+			So(err, ShouldBeNil)
+			So(ep, ShouldNotBeNil)
+			// Tokens are refreshed by the endpoint itself, which is not wrapped and keeps all its interfaces
+			_, ok := ep.(endpoint.RangeSyncTarget)
+			So(ok, ShouldBeTrue)
+			_, ok = ep.(*endpoint.RefreshingTarget)
+			So(ok, ShouldBeFalse)
+		}
+
+		u, _ := url.Parse("cells://other@cells.example.com/personal-files")
+		_, err := endpoint.NewCellsEndpoint(u, opts)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "cannot find authority for https://other@cells.example.com")
+		_, err = endpoint.EndpointFromURI("http://admin@cells.example.com/personal-files", "db://", true)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Test ignore patterns on a filtered source", t, func() {
+		ctx := context.Background()
+		mem := memory.NewMemDB()
+		for _, n := range []*tree.Node{
+			{Path: "/docs", Type: tree.NodeType_COLLECTION},
+			{Path: "/docs/a.tmp", Type: tree.NodeType_LEAF},
+			{Path: "/docs/keep.tmp", Type: tree.NodeType_LEAF},
+			{Path: "/docs/readme.md", Type: tree.NodeType_LEAF},
+			{Path: "/node_modules", Type: tree.NodeType_COLLECTION},
+			{Path: "/node_modules/lib.js", Type: tree.NodeType_LEAF},
+			{Path: "/build", Type: tree.NodeType_LEAF},
+			{Path: "/src", Type: tree.NodeType_COLLECTION},
+			{Path: "/src/build", Type: tree.NodeType_COLLECTION},
+			{Path: "/src/build/out.o", Type: tree.NodeType_LEAF},
+			{Path: "/.DS_Store", Type: tree.NodeType_LEAF},
+		} {
+			mem.CreateNode(ctx, n, false)
+		}
+		filtered := endpoint.NewFilteredSource(mem, []string{"# comment", "*.tmp", "!keep.tmp", "node_modules/", "build/", ".DS_Store"})
+		var paths []string
+		filtered.Walk(func(p string, node *tree.Node, err error) {
+			paths = append(paths, "/"+strings.TrimLeft(p, "/"))
+		}, "/", true)
+
+		So(paths, ShouldContain, "/docs/readme.md")
+		So(paths, ShouldContain, "/docs/keep.tmp")
+		So(paths, ShouldNotContain, "/docs/a.tmp")
+		So(paths, ShouldNotContain, "/node_modules")
+		So(paths, ShouldNotContain, "/node_modules/lib.js")
+		So(paths, ShouldNotContain, "/.DS_Store")
+
+		// Directory-only pattern does not match the "build" file
+		So(paths, ShouldContain, "/build")
+		So(paths, ShouldNotContain, "/src/build/out.o")
+
+		matcher := endpoint.NewIgnoreMatcher([]string{"/root-only", "docs/**/*.pdf"})
+		So(matcher.Match("/root-only", false), ShouldBeTrue)
+		So(matcher.Match("/sub/root-only", false), ShouldBeFalse)
+		So(matcher.Match("/docs/a/b/c.pdf", false), ShouldBeTrue)
+		So(matcher.Match("/docs/c.pdf", false), ShouldBeTrue)
+		So(matcher.Match("/other/docs/c.pdf", false), ShouldBeFalse)
+
+		// Ignored nodes are not found either
+		_, err := filtered.LoadNode(ctx, "/docs/a.tmp")
+		So(err, ShouldNotBeNil)
+		node, err := filtered.LoadNode(ctx, "/docs/readme.md")
+		So(err, ShouldBeNil)
+		So(node.Path, ShouldEqual, "/docs/readme.md")
+
+		// Target and content interfaces of the wrapped endpoint are forwarded
+		_, ok := filtered.(model.PathSyncTarget)
+		So(ok, ShouldBeTrue)
+		_, ok = filtered.(model.DataSyncTarget)
+		So(ok, ShouldEqual, isDataTarget(mem))
+		_, ok = endpoint.NewFilteredSource(&sourceOnly{mem}, nil).(model.PathSyncTarget)
+		So(ok, ShouldBeFalse)
+
+		// Events on ignored paths are dropped
+		watched := &watchedSource{DBEndpoint: mem, w: &model.WatchObject{
+			EventInfoChan: make(chan model.EventInfo),
+			ErrorChan:     make(chan error),
+			DoneChan:      make(chan bool),
+		}}
+		w, err := endpoint.NewFilteredSource(watched, []string{"*.tmp"}).Watch("/")
+		So(err, ShouldBeNil)
+		go func() {
+			watched.w.EventInfoChan <- model.EventInfo{Path: "docs/a.tmp"}
+			watched.w.EventInfoChan <- model.EventInfo{Path: "docs/readme.md"}
+			close(watched.w.EventInfoChan)
+		}()
+		var events []string
+		for e := range w.EventInfoChan {
+			events = append(events, e.Path)
+		}
+		So(events, ShouldResemble, []string{"docs/readme.md"})
+	})
+
+	Convey("Test default ignores for system files", t, func() {
+		defaults := endpoint.NewIgnoreMatcher(endpoint.WithDefaultIgnores(nil))
+		for _, p := range []string{"/.DS_Store", "/docs/.DS_Store", "/docs/._report.pdf", "/Thumbs.db", "/photos/desktop.ini", "/docs/~$report.docx", "/docs/.~lock.sheet.ods#"} {
+			So(defaults.Match(p, false), ShouldBeTrue)
+		}
+		So(defaults.Match("/$RECYCLE.BIN/file.txt", false), ShouldBeTrue)
+		So(defaults.Match("/.Trashes", true), ShouldBeTrue)
+		So(defaults.Match("/docs/report.docx", false), ShouldBeFalse)
+		So(defaults.Match("/docs/Thumbs.db.txt", false), ShouldBeFalse)
+
+		Convey("Test defaults combine with user patterns", func() {
+			m := endpoint.NewIgnoreMatcher(endpoint.WithDefaultIgnores([]string{"*.tmp"}))
+			So(m.Match("/docs/a.tmp", false), ShouldBeTrue)
+			So(m.Match("/docs/Thumbs.db", false), ShouldBeTrue)
+		})
+
+		Convey("Test an explicit include overrides the defaults", func() {
+			m := endpoint.NewIgnoreMatcher(endpoint.WithDefaultIgnores([]string{"!desktop.ini"}))
+			So(m.Match("/photos/desktop.ini", false), ShouldBeFalse)
+			So(m.Match("/.DS_Store", false), ShouldBeTrue)
+		})
+
+		Convey("Test defaults are not applied without opting in", func() {
+			m := endpoint.NewIgnoreMatcher([]string{"*.tmp"})
+			So(m.Match("/Thumbs.db", false), ShouldBeFalse)
+		})
+
+		Convey("Test defaults on a filtered source", func() {
+			ctx := context.Background()
+			mem := memory.NewMemDB()
+			for _, n := range []*tree.Node{
+				{Path: "/docs", Type: tree.NodeType_COLLECTION},
+				{Path: "/docs/report.docx", Type: tree.NodeType_LEAF},
+				{Path: "/docs/~$report.docx", Type: tree.NodeType_LEAF},
+				{Path: "/docs/Thumbs.db", Type: tree.NodeType_LEAF},
+				{Path: "/docs/desktop.ini", Type: tree.NodeType_LEAF},
+			} {
+				mem.CreateNode(ctx, n, false)
+			}
+			filtered := endpoint.NewFilteredSource(mem, endpoint.WithDefaultIgnores([]string{"!desktop.ini"}))
+			var paths []string
+			filtered.Walk(func(p string, node *tree.Node, err error) {
+				paths = append(paths, "/"+strings.TrimLeft(p, "/"))
+			}, "/", true)
+			So(paths, ShouldContain, "/docs/report.docx")
+			So(paths, ShouldContain, "/docs/desktop.ini")
+			So(paths, ShouldNotContain, "/docs/~$report.docx")
+			So(paths, ShouldNotContain, "/docs/Thumbs.db")
+		})
+	})
+
+	Convey("Test ignore patterns of a sync keep the endpoints interfaces", t, func() {
+		ctx := context.Background()
+		leftDir, _ := ioutil.TempDir("", "ignores")
+		rightDir, _ := ioutil.TempDir("", "ignores")
+		defer os.RemoveAll(leftDir)
+		defer os.RemoveAll(rightDir)
+		leftFs, _ := filesystem.NewFSClient(leftDir, model.EndpointOptions{})
+		rightFs, _ := filesystem.NewFSClient(rightDir, model.EndpointOptions{})
+		left, right := &checksumSource{FSClient: leftFs}, &checksumSource{FSClient: rightFs}
+
+		// Without .syncignore, defaults go to the task filters and endpoints are not wrapped
+		l, r, globs, err := endpoint.ApplyIgnorePatterns(ctx, left, right, true)
+		So(err, ShouldBeNil)
+		So(l, ShouldEqual, left)
+		So(r, ShouldEqual, right)
+		_, ok := l.(model.ChecksumProvider)
+		So(ok, ShouldBeTrue)
+		So(globs, ShouldContain, "**/.DS_Store")
+		So(globs, ShouldContain, "**/.Trashes/**")
+		_, _, globs, _ = endpoint.ApplyIgnorePatterns(ctx, left, right, false)
+		So(globs, ShouldBeEmpty)
+
+		// A .syncignore filters both sources, with the defaults first so that it can override them
+		So(ioutil.WriteFile(filepath.Join(leftDir, endpoint.SyncIgnoreFile), []byte("*.tmp\n!desktop.ini\n"), 0644), ShouldBeNil)
+		l, r, globs, err = endpoint.ApplyIgnorePatterns(ctx, left, right, true)
+		So(err, ShouldBeNil)
+		So(globs, ShouldBeEmpty)
+		lf, ok := l.(interface{ Ignored(string, bool) bool })
+		So(ok, ShouldBeTrue)
+		So(lf.Ignored("/a.tmp", false), ShouldBeTrue)
+		So(lf.Ignored("/desktop.ini", false), ShouldBeFalse)
+		So(lf.Ignored("/Thumbs.db", false), ShouldBeTrue)
+		rf, ok := r.(interface{ Ignored(string, bool) bool })
+		So(ok, ShouldBeTrue)
+		So(rf.Ignored("/desktop.ini", false), ShouldBeTrue)
+		So(rf.Ignored("/a.tmp", false), ShouldBeFalse)
+	})
+
+	Convey("Test bandwidth throttling", t, func() {
+		tmp, _ := ioutil.TempDir("", "throttle")
+		defer os.RemoveAll(tmp)
+		content := make([]byte, 50*1024)
+		So(ioutil.WriteFile(filepath.Join(tmp, "file"), content, 0644), ShouldBeNil)
+		fs, err := filesystem.NewFSClient(tmp, model.EndpointOptions{})
+		So(err, ShouldBeNil)
+
+		throttled := endpoint.NewThrottledTarget(fs, 100*1024).(*endpoint.ThrottledTarget)
+		start := time.Now()
+		reader, err := throttled.GetReaderOn("file")
+		So(err, ShouldBeNil)
+		read, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		elapsed := time.Since(start)
+		So(read, ShouldHaveLength, len(content))
+		// 50KB at 100KB/s
+		So(elapsed, ShouldBeGreaterThan, 400*time.Millisecond)
+		So(elapsed, ShouldBeLessThan, 1500*time.Millisecond)
+
+		throttled.SetBandwidth(0)
+		start = time.Now()
+		reader, _ = throttled.GetReaderOn("file")
+		ioutil.ReadAll(reader)
+		reader.Close()
+		So(time.Since(start), ShouldBeLessThan, 200*time.Millisecond)
+	})
+
+	Convey("Test VerifiedTarget detects corrupted transfers", t, func() {
+		tmp, _ := ioutil.TempDir("", "endpoint")
+		defer os.RemoveAll(tmp)
+		fs, err := filesystem.NewFSClient(tmp, model.EndpointOptions{})
+		So(err, ShouldBeNil)
+		content := []byte("some content that should not be altered")
+
+		verified, err := endpoint.NewVerifiedTarget(fs, "sha256")
+		So(err, ShouldBeNil)
+		So(writeContent(verified, "valid", content), ShouldBeNil)
+
+		corrupted, err := endpoint.NewVerifiedTarget(&corruptingTarget{FSClient: fs}, "md5")
+		So(err, ShouldBeNil)
+		So(writeContent(corrupted, "corrupted", content), ShouldNotBeNil)
+
+		_, err = endpoint.NewVerifiedTarget(fs, "crc")
+		So(err, ShouldNotBeNil)
+
+		// Wrapped endpoints can still be walked, but resumed uploads cannot be verified
+		mem := endpoint.NewMemoryEndpoint()
+		verified, err = endpoint.NewVerifiedTarget(mem, "")
+		So(err, ShouldBeNil)
+		_, walks := verified.(model.PathSyncSource)
+		So(walks, ShouldBeTrue)
+		_, ranges := verified.(endpoint.RangeSyncTarget)
+		So(ranges, ShouldBeFalse)
+		So(writeContent(verified, "/memory", content), ShouldBeNil)
+		data, _ := mem.Content("/memory")
+		So(data, ShouldResemble, content)
+	})
+
+	Convey("Test RetryTarget retries transient errors", t, func() {
+		db := memory.NewMemDB()
+		flaky := &flakyTarget{DBEndpoint: db, failures: 2, err: fmt.Errorf("503 service unavailable")}
+		retry := endpoint.NewRetryTarget(flaky, endpoint.RetryOptions{InitialDelay: time.Millisecond})
+		So(retry.CreateNode(context.Background(), &tree.Node{Path: "/file", Type: tree.NodeType_LEAF}, false), ShouldBeNil)
+		So(flaky.calls, ShouldEqual, 3)
+		_, e := db.LoadNode(context.Background(), "/file")
+		So(e, ShouldBeNil)
+
+		// Permanent errors are not retried
+		flaky = &flakyTarget{DBEndpoint: db, failures: 2, err: fmt.Errorf("permission denied")}
+		retry = endpoint.NewRetryTarget(flaky, endpoint.RetryOptions{InitialDelay: time.Millisecond})
+		So(retry.CreateNode(context.Background(), &tree.Node{Path: "/other", Type: tree.NodeType_LEAF}, false), ShouldNotBeNil)
+		So(flaky.calls, ShouldEqual, 1)
+
+		// Transient errors reach the caller once retries are exhausted
+		flaky = &flakyTarget{DBEndpoint: db, failures: 10, err: fmt.Errorf("i/o timeout")}
+		retry = endpoint.NewRetryTarget(flaky, endpoint.RetryOptions{InitialDelay: time.Millisecond, MaxRetries: 2})
+		So(retry.DeleteNode(context.Background(), "/file"), ShouldNotBeNil)
+		So(flaky.calls, ShouldEqual, 3)
+
+		// Opening a writer is retried as well
+		flaky = &flakyTarget{DBEndpoint: db, failures: 2, err: fmt.Errorf("connection reset by peer")}
+		retry = endpoint.NewRetryTarget(flaky, endpoint.RetryOptions{InitialDelay: time.Millisecond})
+		So(isDataTarget(retry), ShouldBeTrue)
+		w, _, _, e := retry.(model.DataSyncTarget).GetWriterOn(context.Background(), "/file", 0)
+		So(e, ShouldBeNil)
+		So(w, ShouldNotBeNil)
+		w.Close()
+		So(flaky.calls, ShouldEqual, 3)
+		So(isDataTarget(endpoint.NewRetryTarget(targetOnly{db}, endpoint.RetryOptions{})), ShouldBeFalse)
+
+		So(endpoint.IsTransient(context.DeadlineExceeded), ShouldBeTrue)
+		So(endpoint.IsTransient(nil), ShouldBeFalse)
+	})
+
+	Convey("Test endpoints connection checks", t, func() {
+		ctx := context.Background()
+		tmp, _ := ioutil.TempDir("", "connection")
+		defer os.RemoveAll(tmp)
+		fs, err := filesystem.NewFSClient(tmp, model.EndpointOptions{})
+		So(err, ShouldBeNil)
+		So(endpoint.CheckConnection(ctx, fs), ShouldBeNil)
+
+		db := memory.NewMemDB()
+		So(endpoint.CheckConnection(ctx, &unreachableEndpoint{DBEndpoint: db}), ShouldBeNil)
+
+		down := &unreachableEndpoint{DBEndpoint: db, err: fmt.Errorf("connection refused")}
+		err = endpoint.CheckConnection(ctx, down)
+		So(err, ShouldNotBeNil)
+		unreachable, ok := err.(*endpoint.UnreachableError)
+		So(ok, ShouldBeTrue)
+		So(unreachable.Err, ShouldEqual, down.err)
+
+		errs := endpoint.CheckEndpoints(ctx, fs, down)
+		So(errs, ShouldHaveLength, 1)
+		So(errs[0].Error(), ShouldContainSubstring, "connection refused")
+	})
+
+	Convey("Test deletion policies of a trash target", t, func() {
+		ctx := context.Background()
+		db := memory.NewMemDB()
+		db.CreateNode(ctx, &tree.Node{Path: "/docs", Type: tree.NodeType_COLLECTION}, false)
+		db.CreateNode(ctx, &tree.Node{Path: "/docs/file", Type: tree.NodeType_LEAF, Etag: "etag"}, false)
+		db.CreateNode(ctx, &tree.Node{Path: "/kept", Type: tree.NodeType_LEAF}, false)
+
+		now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.Local)
+		trash, err := endpoint.NewTrashTarget(db, endpoint.DeleteTrash, endpoint.TrashOptions{Retention: 48 * time.Hour, Now: func() time.Time { return now }})
+		So(err, ShouldBeNil)
+		So(trash.DeleteNode(ctx, "/docs/file"), ShouldBeNil)
+		_, err = db.LoadNode(ctx, "/docs/file")
+		So(err, ShouldNotBeNil)
+		trashed, err := db.LoadNode(ctx, "/.trash/2019-10-01/docs/file")
+		So(err, ShouldBeNil)
+		So(trashed.Etag, ShouldEqual, "etag")
+
+		// Expired dated folders are purged
+		// The trash folder is hidden from the sync
+		_, err = trash.(model.PathSyncSource).LoadNode(ctx, "/.trash/2019-10-01/docs/file")
+		So(err, ShouldNotBeNil)
+		var walked []string
+		trash.(model.PathSyncSource).Walk(func(p string, node *tree.Node, err error) {
+			walked = append(walked, "/"+strings.TrimLeft(p, "/"))
+		}, "/", true)
+		So(walked, ShouldNotContain, "/.trash")
+		So(walked, ShouldContain, "/kept")
+
+		purged, err := endpoint.FindTrashTarget(trash).PurgeTrash(ctx)
+		So(err, ShouldBeNil)
+		So(purged, ShouldEqual, 0)
+		now = now.Add(72 * time.Hour)
+		purged, err = endpoint.FindTrashTarget(trash).PurgeTrash(ctx)
+		So(err, ShouldBeNil)
+		So(purged, ShouldEqual, 1)
+		_, err = db.LoadNode(ctx, "/.trash/2019-10-01/docs/file")
+		So(err, ShouldNotBeNil)
+
+		keep, _ := endpoint.NewTrashTarget(db, endpoint.DeleteKeep, endpoint.TrashOptions{})
+		So(keep.DeleteNode(ctx, "/kept"), ShouldBeNil)
+		_, err = db.LoadNode(ctx, "/kept")
+		So(err, ShouldBeNil)
+
+		hard, _ := endpoint.NewTrashTarget(db, endpoint.DeleteHard, endpoint.TrashOptions{})
+		So(hard.DeleteNode(ctx, "/kept"), ShouldBeNil)
+		_, err = db.LoadNode(ctx, "/kept")
+		So(err, ShouldNotBeNil)
+
+		_, err = endpoint.NewTrashTarget(db, "shred", endpoint.TrashOptions{})
+		So(err, ShouldNotBeNil)
+
+		Convey("Test contents are forwarded to the wrapped target", func() {
+			mem := endpoint.NewMemoryEndpoint()
+			wrapped, err := endpoint.NewTrashTarget(mem, endpoint.DeleteTrash, endpoint.TrashOptions{})
+			So(err, ShouldBeNil)
+			So(writeContent(wrapped, "/file", []byte("content")), ShouldBeNil)
+			data, ok := mem.Content("/file")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "content")
+			reader, err := wrapped.(model.DataSyncSource).GetReaderOn("/file")
+			So(err, ShouldBeNil)
+			read, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			So(string(read), ShouldEqual, "content")
+		})
+	})
+
+	Convey("Test audit log of a target", t, func() {
+		ctx := context.Background()
+		tmp, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(tmp)
+		logPath := filepath.Join(tmp, "audit.log")
+		db := memory.NewMemDB()
+		audit := endpoint.NewAuditTarget(db, logPath)
+
+		So(audit.CreateNode(ctx, &tree.Node{Path: "/file", Type: tree.NodeType_LEAF, Size: 12}, false), ShouldBeNil)
+		So(audit.MoveNode(ctx, "/file", "/moved"), ShouldBeNil)
+		So(audit.DeleteNode(ctx, "/moved"), ShouldBeNil)
+		entries, err := endpoint.VerifyAuditLog(logPath)
+		So(err, ShouldBeNil)
+		So(entries, ShouldEqual, 3)
+
+		// A new target continues the chain
+		So(endpoint.NewAuditTarget(db, logPath).CreateNode(ctx, &tree.Node{Path: "/other", Type: tree.NodeType_LEAF}, false), ShouldBeNil)
+		entries, err = endpoint.VerifyAuditLog(logPath)
+		So(err, ShouldBeNil)
+		So(entries, ShouldEqual, 4)
+
+		data, _ := ioutil.ReadFile(logPath)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		var entry endpoint.AuditEntry
+		So(json.Unmarshal([]byte(lines[1]), &entry), ShouldBeNil)
+		So(entry.Op, ShouldEqual, "move")
+		So(entry.From, ShouldEqual, "/file")
+
+		// Tampering with an entry breaks its hash
+		tampered := append([]string{}, lines...)
+		tampered[1] = strings.Replace(tampered[1], `"/moved"`, `"/elsewhere"`, 1)
+		ioutil.WriteFile(logPath, []byte(strings.Join(tampered, "\n")+"\n"), 0600)
+		entries, err = endpoint.VerifyAuditLog(logPath)
+		So(entries, ShouldEqual, 1)
+		chainErr, ok := err.(*endpoint.AuditChainError)
+		So(ok, ShouldBeTrue)
+		So(chainErr.Line, ShouldEqual, 2)
+
+		// Removing an entry breaks the next link
+		removed := append([]string{lines[0]}, lines[2:]...)
+		ioutil.WriteFile(logPath, []byte(strings.Join(removed, "\n")+"\n"), 0600)
+		_, err = endpoint.VerifyAuditLog(logPath)
+		So(err, ShouldNotBeNil)
+		So(err.(*endpoint.AuditChainError).Line, ShouldEqual, 2)
+
+		Convey("Test content transfers are forwarded and logged", func() {
+			contentLog := filepath.Join(tmp, "content.log")
+			mem := endpoint.NewMemoryEndpoint()
+			audited := endpoint.NewAuditTarget(mem, contentLog)
+			So(writeContent(audited, "/doc", []byte("first")), ShouldBeNil)
+			So(writeContent(audited, "/doc", []byte("second version")), ShouldBeNil)
+			data, _ := mem.Content("/doc")
+			So(string(data), ShouldEqual, "second version")
+			_, ok := audited.(model.DataSyncSource)
+			So(ok, ShouldBeTrue)
+
+			entries, err := endpoint.VerifyAuditLog(contentLog)
+			So(err, ShouldBeNil)
+			So(entries, ShouldEqual, 2)
+			logged, _ := ioutil.ReadFile(contentLog)
+			var create, update endpoint.AuditEntry
+			lines := strings.Split(strings.TrimSpace(string(logged)), "\n")
+			So(json.Unmarshal([]byte(lines[0]), &create), ShouldBeNil)
+			So(json.Unmarshal([]byte(lines[1]), &update), ShouldBeNil)
+			So(create.Op, ShouldEqual, "create")
+			So(create.Size, ShouldEqual, 5)
+			So(update.Op, ShouldEqual, "update")
+			So(update.Size, ShouldEqual, 14)
+		})
+	})
+
+	Convey("Test S3 endpoint URL validation", t, func() {
+		u, _ := url.Parse("s3://key:secret@localhost:9000")
+		_, err := endpoint.NewS3Endpoint(u, model.EndpointOptions{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "bucket")
+
+		u, _ = url.Parse("s3://localhost:9000/bucket/prefix")
+		_, err = endpoint.NewS3Endpoint(u, model.EndpointOptions{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "API keys")
+
+		u, _ = url.Parse("s3://key:secret@localhost:9000/bucket?pathStyle=yes-please")
+		_, err = endpoint.NewS3Endpoint(u, model.EndpointOptions{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "pathStyle")
+	})
+
+}
+
+// sourceOnly hides the target and content interfaces of a memory endpoint.
+type sourceOnly struct {
+	model.PathSyncSource
+}
+
+// targetOnly hides the source and content interfaces of a memory endpoint.
+type targetOnly struct {
+	model.PathSyncTarget
+}
+
+// syncOnly hides the content interfaces of a memory endpoint.
+type syncOnly struct {
+	syncEndpoint
+}
+
+type syncEndpoint interface {
+	model.PathSyncSource
+	model.PathSyncTarget
+}
+
+// watchedSource returns a WatchObject fed by the test.
+type watchedSource struct {
+	*memory.DBEndpoint
+	w *model.WatchObject
+}
+
+func (s *watchedSource) Watch(recursivePath string) (*model.WatchObject, error) {
+	return s.w, nil
+}
+
+func isDataTarget(ep model.Endpoint) bool {
+	_, ok := ep.(model.DataSyncTarget)
+	return ok
+}
+
+func TestKeyringCredentials(t *testing.T) {
+
+	Convey("Test endpoint credentials read from the keyring", t, func() {
+		keyring.MockInit()
+		So(config.CredentialToKeyring("s3-backup", "top-secret"), ShouldBeNil)
+
+		u, _ := url.Parse("s3://API_KEY:keyring:s3-backup@storage.example.com/bucket")
+		resolved, err := config.ResolveURICredentials(u)
+		So(err, ShouldBeNil)
+		password, _ := resolved.User.Password()
+		So(password, ShouldEqual, "top-secret")
+		So(resolved.User.Username(), ShouldEqual, "API_KEY")
+		// The original URI still holds the reference only
+		password, _ = u.User.Password()
+		So(password, ShouldEqual, "keyring:s3-backup")
+
+		escaped, _ := url.Parse("s3://API_KEY:" + url.QueryEscape("keyring://s3-backup") + "@storage.example.com/bucket")
+		resolved, err = config.ResolveURICredentials(escaped)
+		So(err, ShouldBeNil)
+		password, _ = resolved.User.Password()
+		So(password, ShouldEqual, "top-secret")
+
+		plain, _ := url.Parse("s3://API_KEY:inline@storage.example.com/bucket")
+		resolved, err = config.ResolveURICredentials(plain)
+		So(err, ShouldBeNil)
+		So(resolved, ShouldEqual, plain)
+
+		_, err = endpoint.EndpointFromURI("s3://API_KEY:keyring:unknown@storage.example.com/bucket", "db://")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown")
+
+		Convey("Test secrets are redacted from displayed URIs", func() {
+			So(config.RedactURI("s3://API_KEY:top-secret@storage.example.com/bucket"), ShouldNotContainSubstring, "top-secret")
+			So(config.RedactURI("s3://API_KEY:keyring:s3-backup@storage.example.com/bucket"), ShouldContainSubstring, "keyring:s3-backup")
+			So(config.RedactURI("fs:///home/user/Cells"), ShouldEqual, "fs:///home/user/Cells")
+
+			_, err := endpoint.EndpointFromURI("s3://API_KEY:top-secret@storage.example.com/%zz", "db://")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "top-secret")
+
+			global := &config.Global{Tasks: []*config.Task{{
+				LeftURI:   "s3://API_KEY:top-secret@storage.example.com/bucket",
+				RightURI:  "fs:///home/user/Cells",
+				Direction: "Bi",
+			}}}
+			items := global.Items()
+			So(items, ShouldHaveLength, 1)
+			So(items[0], ShouldNotContainSubstring, "top-secret")
+			So(items[0], ShouldContainSubstring, "fs:///home/user/Cells")
+		})
+	})
+}
+
+// unreachableEndpoint answers its liveness probe with err, if set.
+type unreachableEndpoint struct {
+	*memory.DBEndpoint
+	err error
+}
+
+func (u *unreachableEndpoint) CheckConnection(ctx context.Context) error {
+	return u.err
+}
+
+// flakyTarget fails the first node operations with err before forwarding them to the memory DB.
+type flakyTarget struct {
+	*memory.DBEndpoint
+	failures int
+	calls    int
+	err      error
+}
+
+func (f *flakyTarget) fail() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	if e := f.fail(); e != nil {
+		return e
+	}
+	return f.DBEndpoint.CreateNode(ctx, node, updateIfExists)
+}
+
+func (f *flakyTarget) DeleteNode(ctx context.Context, path string) error {
+	if e := f.fail(); e != nil {
+		return e
+	}
+	return f.DBEndpoint.DeleteNode(ctx, path)
+}
+
+func (f *flakyTarget) GetWriterOn(cancel context.Context, path string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	if e := f.fail(); e != nil {
+		return nil, nil, nil, e
+	}
+	return discardCloser{ioutil.Discard}, nil, nil, nil
+}
+
+// discardCloser is a writer that drops its input and has nothing to close.
+type discardCloser struct {
+	io.Writer
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+// checksumSource adds a ChecksumProvider to an FSClient.
+type checksumSource struct {
+	*filesystem.FSClient
+}
+
+func (c *checksumSource) ComputeChecksum(node *tree.Node) error {
+	node.Etag = "checksum"
+	return nil
+}
+
+// corruptingTarget alters the first byte of every chunk written to the underlying FSClient.
+type corruptingTarget struct {
+	*filesystem.FSClient
+}
+
+func (c *corruptingTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	w, done, errs, err := c.FSClient.GetWriterOn(cancel, p, targetSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &corruptingWriter{WriteCloser: w}, done, errs, nil
+}
+
+type corruptingWriter struct {
+	io.WriteCloser
+}
+
+func (c *corruptingWriter) Write(p []byte) (int, error) {
+	altered := append([]byte{}, p...)
+	if len(altered) > 0 {
+		altered[0]++
+	}
+	return c.WriteCloser.Write(altered)
+}
+
+// writeContent transfers content to p on target, returning any error reported by the writer or its channels.
+func writeContent(target model.PathSyncTarget, p string, content []byte) error {
+	w, done, errs, err := target.(model.DataSyncTarget).GetWriterOn(context.Background(), p, int64(len(content)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if done == nil && errs == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	Convey("Test verifying two divergent endpoints", t, func() {
+		ctx := context.Background()
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		leaf := func(p, etag string, size, mtime int64) *tree.Node {
+			return &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: etag, Size: size, MTime: mtime}
+		}
+		for _, n := range []*tree.Node{
+			leaf("/same", "a", 1, 10),
+			leaf("/left-only.txt", "b", 1, 10),
+			leaf("/size", "c", 1, 10),
+			leaf("/hash", "d", 3, 10),
+			leaf("/mtime", "e", 1, 10),
+		} {
+			left.CreateNode(ctx, n, false)
+		}
+		for _, n := range []*tree.Node{
+			leaf("/same", "a", 1, 10),
+			leaf("/right-only.txt", "f", 1, 10),
+			leaf("/size", "g", 2, 10),
+			leaf("/hash", "h", 3, 10),
+			leaf("/mtime", "e", 1, 20),
+		} {
+			right.CreateNode(ctx, n, false)
+		}
+
+		report, err := endpoint.Verify(ctx, left, right)
+		So(err, ShouldBeNil)
+		kinds := make(map[string]endpoint.DifferenceKind)
+		for _, d := range report.Differences {
+			kinds[d.Path] = d.Kind
+		}
+		So(kinds, ShouldResemble, map[string]endpoint.DifferenceKind{
+			"/left-only.txt":  endpoint.DiffLeftOnly,
+			"/right-only.txt": endpoint.DiffRightOnly,
+			"/size":           endpoint.DiffSize,
+			"/hash":           endpoint.DiffHash,
+			"/mtime":          endpoint.DiffMTime,
+		})
+		So(report.Converged(), ShouldBeFalse)
+
+		// Nothing was changed on either side
+		_, err = right.LoadNode(ctx, "/left-only.txt")
+		So(err, ShouldNotBeNil)
+		_, err = left.LoadNode(ctx, "/right-only.txt")
+		So(err, ShouldNotBeNil)
+
+		data, err := json.Marshal(report)
+		So(err, ShouldBeNil)
+		var decoded endpoint.VerifyReport
+		So(json.Unmarshal(data, &decoded), ShouldBeNil)
+		So(decoded.Differences, ShouldResemble, report.Differences)
+
+		text := &strings.Builder{}
+		report.WriteText(text)
+		So(text.String(), ShouldContainSubstring, "5 differences found")
+		So(text.String(), ShouldContainSubstring, "/size (1 / 2 bytes)")
+
+		Convey("Test verifying converged endpoints", func() {
+			report, err := endpoint.Verify(ctx, left, left)
+			So(err, ShouldBeNil)
+			So(report.Converged(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestPreflight(t *testing.T) {
+
+	Convey("Test preflight checks of configured tasks", t, func() {
+		ctx := context.Background()
+		tmp, _ := ioutil.TempDir("", "preflight")
+		defer os.RemoveAll(tmp)
+		left, right := filepath.Join(tmp, "left"), filepath.Join(tmp, "right")
+		So(os.Mkdir(left, 0755), ShouldBeNil)
+		So(os.Mkdir(right, 0755), ShouldBeNil)
+		data, _ := json.Marshal(&config.Global{Tasks: []*config.Task{
+			{Label: "valid", LeftURI: "fs://" + left, RightURI: "fs://" + right, Direction: "Bi"},
+			{Label: "unreachable", LeftURI: "fs://" + left, RightURI: "fs://" + filepath.Join(tmp, "missing"), Direction: "Right"},
+			{Label: "malformed", LeftURI: "fs://" + left, Direction: "Up"},
+		}})
+		confFile := filepath.Join(tmp, "config.json")
+		So(ioutil.WriteFile(confFile, data, 0644), ShouldBeNil)
+		conf, err := config.LoadFromPath(confFile)
+		So(err, ShouldBeNil)
+		So(conf.Tasks, ShouldHaveLength, 3)
+
+		report := endpoint.NewPreflightReport(ctx, conf.Tasks)
+		So(report, ShouldHaveLength, 3)
+		So(report[0].OK(), ShouldBeTrue)
+		So(report[1].OK(), ShouldBeFalse)
+		So(report[1].Errors[0].Error(), ShouldContainSubstring, "missing")
+		So(report[2].OK(), ShouldBeFalse)
+		So(report[2].Errors, ShouldHaveLength, 1)
+		So(report[2].Errors[0].Error(), ShouldContainSubstring, "missing right endpoint URI")
+		So(report.Failures(), ShouldEqual, 2)
+
+		text := &strings.Builder{}
+		report.WriteText(text)
+		So(text.String(), ShouldContainSubstring, "OK      valid")
+		So(text.String(), ShouldContainSubstring, "FAILED  unreachable")
+		So(text.String(), ShouldContainSubstring, "3 tasks checked, 2 failed")
+
+		Convey("Test validating task definitions", func() {
+			task := &config.Task{LeftURI: "fs://" + left, RightURI: "fs://" + right, Direction: "Up"}
+			So(task.Validate(), ShouldNotBeNil)
+			task.Direction = "Left"
+			So(task.Validate(), ShouldBeNil)
+			task.MinFileSize, task.MaxFileSize = 10, 5
+			So(task.Validate(), ShouldNotBeNil)
+			task.MaxFileSize = 0
+			task.SyncWindows = []*config.SyncWindow{{Start: "9h", End: "18:00"}}
+			So(task.Validate(), ShouldNotBeNil)
+			task.SyncWindows = nil
+			task.RetryDelay = "soon"
+			So(task.Validate(), ShouldNotBeNil)
+			task.RetryDelay = "2s"
+			So(task.Validate(), ShouldBeNil)
+			task.RetryMax = -1
+			So(task.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+// fakeOAuthServer issues a new access token for each valid refresh token, only the last one being accepted.
+type fakeOAuthServer struct {
+	*httptest.Server
+	sync.Mutex
+	issued  int
+	access  string
+	refresh string
+}
+
+func newFakeOAuthServer() *fakeOAuthServer {
+	f := &fakeOAuthServer{access: "access-0", refresh: "refresh-0"}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != f.refresh {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.issued++
+		f.access, f.refresh = fmt.Sprintf("access-%d", f.issued), fmt.Sprintf("refresh-%d", f.issued)
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": f.access, "refresh_token": f.refresh, "expires_in": 3600})
+	}))
+	return f
+}
+
+func (f *fakeOAuthServer) valid(token string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return token == f.access
+}
+
+// expire invalidates the current access token, as its expiry would.
+func (f *fakeOAuthServer) expire() {
+	f.Lock()
+	defer f.Unlock()
+	f.access = ""
+}
+
+// tokenTarget refuses node creations with a 401 error unless its token is accepted by the server.
+type tokenTarget struct {
+	*memory.DBEndpoint
+	server  *fakeOAuthServer
+	access  string
+	refresh string
+}
+
+func (t *tokenTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	if !t.server.valid(t.access) {
+		return runtime.NewAPIError("createNode", nil, http.StatusUnauthorized)
+	}
+	return t.DBEndpoint.CreateNode(ctx, node, updateIfExists)
+}
+
+// renew asks the server for new tokens with the current refresh token.
+func (t *tokenTarget) renew(ctx context.Context) error {
+	resp, e := http.PostForm(t.server.URL, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {t.refresh}})
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+	var tokens struct {
+		Access  string `json:"access_token"`
+		Refresh string `json:"refresh_token"`
+	}
+	if e := json.NewDecoder(resp.Body).Decode(&tokens); e != nil {
+		return e
+	}
+	t.access, t.refresh = tokens.Access, tokens.Refresh
+	return nil
+}
+
+func TestRefreshingTarget(t *testing.T) {
+
+	Convey("Test refreshing tokens on unauthorized answers", t, func() {
+		ctx := context.Background()
+		server := newFakeOAuthServer()
+		defer server.Close()
+		target := &tokenTarget{DBEndpoint: memory.NewMemDB(), server: server, access: "access-0", refresh: "refresh-0"}
+		var refreshes int
+		refreshing := endpoint.NewRefreshingTarget(target, func(ctx context.Context) error {
+			refreshes++
+			return target.renew(ctx)
+		})
+
+		So(refreshing.CreateNode(ctx, &tree.Node{Path: "/valid", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+		So(refreshes, ShouldEqual, 0)
+
+		server.expire()
+		So(refreshing.CreateNode(ctx, &tree.Node{Path: "/expired", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+		So(refreshes, ShouldEqual, 1)
+		So(target.access, ShouldEqual, "access-1")
+		_, err := target.LoadNode(ctx, "/expired")
+		So(err, ShouldBeNil)
+
+		// The refresh token was revoked: the original error is returned
+		server.expire()
+		target.refresh = "revoked"
+		err = refreshing.CreateNode(ctx, &tree.Node{Path: "/revoked", Type: tree.NodeType_COLLECTION}, false)
+		So(err, ShouldNotBeNil)
+		So(endpoint.IsUnauthorized(err), ShouldBeTrue)
+		So(refreshes, ShouldEqual, 2)
+
+		So(endpoint.IsUnauthorized(errors.Wrap(minio.ErrorResponse{StatusCode: http.StatusUnauthorized}, "upload")), ShouldBeTrue)
+		So(endpoint.IsUnauthorized(runtime.NewAPIError("createNode", nil, http.StatusForbidden)), ShouldBeFalse)
+		So(endpoint.IsUnauthorized(fmt.Errorf("cannot create /file-401.txt")), ShouldBeFalse)
+		So(endpoint.IsUnauthorized(fmt.Errorf("connection refused")), ShouldBeFalse)
+		So(endpoint.IsUnauthorized(nil), ShouldBeFalse)
+
+		// Content interfaces of the wrapped target are forwarded
+		_, ok := refreshing.(model.DataSyncTarget)
+		So(ok, ShouldBeTrue)
+		_, ok = endpoint.NewRefreshingTarget(targetOnly{target}, target.renew).(model.DataSyncTarget)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestEventBus(t *testing.T) {
+
+	Convey("Test sync events are delivered in order for a simulated sync", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		bus := endpoint.NewEventBus()
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{Events: bus, EventsTask: "task"})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		var lock sync.Mutex
+		var received []string
+		// Handlers run on the bus goroutine, so they only record what they receive
+		record := func(e endpoint.SyncEvent, desc string) {
+			lock.Lock()
+			defer lock.Unlock()
+			received = append(received, e.TaskUUID()+": "+desc)
+		}
+		unsubscribe := bus.Subscribe(endpoint.EventHandlers{
+			SyncStarted:      func(e endpoint.SyncStarted) { record(e, "started") },
+			PatchComputed:    func(e endpoint.PatchComputed) { record(e, "computed "+e.Patch.GetUUID()) },
+			PatchApplied:     func(e endpoint.PatchApplied) { record(e, "applied "+e.Patch.GetUUID()) },
+			PatchFailed:      func(e endpoint.PatchFailed) { record(e, "failed "+e.Errors[0].Error()) },
+			ConflictDetected: func(e endpoint.ConflictDetected) { record(e, "conflict "+e.Path) },
+			EndpointUnreachable: func(e endpoint.EndpointUnreachable) {
+				record(e, "unreachable "+e.Err.Err.Error())
+			},
+		})
+		defer unsubscribe()
+
+		// Events published by the job around the ones published by the store
+		clean := newTestPatch(source, target, 0, "/clean")
+		failed := failTestPatch(newTestPatch(source, target, 1, "/failed"), "cannot write")
+		failed.Enqueue(newTestConflict("/conflict", "left", 10, "right", 20))
+		bus.Publish(endpoint.SyncStarted{Task: "task"})
+		bus.Publish(endpoint.PatchComputed{Task: "task", Patch: clean})
+		storeAndWait(store, clean)
+		bus.Publish(endpoint.PatchComputed{Task: "task", Patch: failed})
+		storeAndWait(store, failed)
+		bus.Publish(endpoint.EndpointUnreachable{Task: "task", Err: &endpoint.UnreachableError{URI: "db://", Err: fmt.Errorf("connection refused")}})
+
+		<-time.After(100 * time.Millisecond)
+		lock.Lock()
+		So(received, ShouldResemble, []string{
+			"task: started",
+			"task: computed " + clean.GetUUID(),
+			"task: applied " + clean.GetUUID(),
+			"task: computed " + failed.GetUUID(),
+			"task: conflict /conflict",
+			"task: failed cannot write",
+			"task: unreachable connection refused",
+		})
+		lock.Unlock()
+		So(bus.Dropped(), ShouldEqual, 0)
+	})
+
+	Convey("Test slow subscribers do not block publishers", t, func() {
+		bus := endpoint.NewEventBus()
+		release := make(chan struct{})
+		var fast, slow int32
+		defer bus.Subscribe(endpoint.EventHandlers{SyncStarted: func(endpoint.SyncStarted) {
+			atomic.AddInt32(&fast, 1)
+		}})()
+		unsubscribe := bus.Subscribe(endpoint.EventHandlers{SyncStarted: func(endpoint.SyncStarted) {
+			<-release
+			atomic.AddInt32(&slow, 1)
+		}})
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 1000; i++ {
+				bus.Publish(endpoint.SyncStarted{})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			So("publish blocked", ShouldBeEmpty)
+		}
+		So(bus.Dropped(), ShouldBeGreaterThan, 0)
+		close(release)
+		<-time.After(100 * time.Millisecond)
+		So(atomic.LoadInt32(&fast), ShouldBeGreaterThan, 0)
+		So(uint64(atomic.LoadInt32(&fast)+atomic.LoadInt32(&slow))+bus.Dropped(), ShouldEqual, 2000)
+
+		// Unsubscribed handlers receive nothing more, and a nil bus ignores events
+		unsubscribe()
+		unsubscribe()
+		received := atomic.LoadInt32(&slow)
+		bus.Publish(endpoint.SyncStarted{})
+		var nilBus *endpoint.EventBus
+		nilBus.Publish(endpoint.SyncStarted{})
+		<-time.After(50 * time.Millisecond)
+		So(atomic.LoadInt32(&slow), ShouldEqual, received)
+	})
+}
+
+type countingEndpoint struct {
+	*memory.DBEndpoint
+	walks int32
+}
+
+func (c *countingEndpoint) Walk(walknFc model.WalkNodesFunc, root string, recursive bool) error {
+	atomic.AddInt32(&c.walks, 1)
+	return c.DBEndpoint.Walk(walknFc, root, recursive)
+}
+
+func TestListingCache(t *testing.T) {
+
+	Convey("Test caching folder listings", t, func() {
+		ctx := context.Background()
+		mem := &countingEndpoint{DBEndpoint: memory.NewMemDB()}
+		So(mem.CreateNode(ctx, &tree.Node{Path: "/folder", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+		So(mem.CreateNode(ctx, &tree.Node{Path: "/folder/a", Type: tree.NodeType_LEAF, Etag: "a"}, false), ShouldBeNil)
+		So(mem.CreateNode(ctx, &tree.Node{Path: "/other", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+
+		wrap := func(options endpoint.ListingCacheOptions) *endpoint.ListingCache {
+			ep, err := endpoint.NewListingCache(mem, options)
+			So(err, ShouldBeNil)
+			cache, ok := ep.(*endpoint.ListingCache)
+			So(ok, ShouldBeTrue)
+			return cache
+		}
+		list := func(cache *endpoint.ListingCache, root string) []string {
+			var paths []string
+			So(cache.Walk(func(p string, node *tree.Node, err error) {
+				if err == nil && node != nil {
+					paths = append(paths, "/"+strings.TrimLeft(p, "/"))
+				}
+			}, root, false), ShouldBeNil)
+			return paths
+		}
+
+		Convey("Test a second listing of an unchanged folder hits the cache", func() {
+			cache := wrap(endpoint.ListingCacheOptions{Size: 10})
+			first := list(cache, "/folder")
+			So(first, ShouldContain, "/folder/a")
+			So(list(cache, "/folder"), ShouldResemble, first)
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 1)
+			hits, misses := cache.Stats()
+			So(hits, ShouldEqual, 1)
+			So(misses, ShouldEqual, 1)
+		})
+
+		Convey("Test a write invalidates the listing of its folder only", func() {
+			cache := wrap(endpoint.ListingCacheOptions{Size: 10})
+			list(cache, "/folder")
+			list(cache, "/other")
+			So(cache.CreateNode(ctx, &tree.Node{Path: "/folder/b", Type: tree.NodeType_LEAF, Etag: "b"}, false), ShouldBeNil)
+			So(list(cache, "/folder"), ShouldContain, "/folder/b")
+			list(cache, "/other")
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 3)
+
+			So(cache.MoveNode(ctx, "/folder/b", "/other/b"), ShouldBeNil)
+			So(list(cache, "/folder"), ShouldNotContain, "/folder/b")
+			So(list(cache, "/other"), ShouldContain, "/other/b")
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 5)
+
+			So(cache.DeleteNode(ctx, "/folder"), ShouldBeNil)
+			So(list(cache, "/folder"), ShouldBeEmpty)
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 6)
+		})
+
+		Convey("Test the least recently used listing is evicted", func() {
+			cache := wrap(endpoint.ListingCacheOptions{Size: 1})
+			list(cache, "/folder")
+			list(cache, "/other")
+			list(cache, "/folder")
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 3)
+		})
+
+		Convey("Test listings expire after the TTL", func() {
+			cache := wrap(endpoint.ListingCacheOptions{Size: 10, TTL: 50 * time.Millisecond})
+			list(cache, "/folder")
+			list(cache, "/folder")
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 1)
+			<-time.After(100 * time.Millisecond)
+			list(cache, "/folder")
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 2)
+		})
+
+		Convey("Test recursive walks are never cached", func() {
+			cache := wrap(endpoint.ListingCacheOptions{Size: 10})
+			So(cache.Walk(func(string, *tree.Node, error) {}, "/", true), ShouldBeNil)
+			So(cache.Walk(func(string, *tree.Node, error) {}, "/", true), ShouldBeNil)
+			So(atomic.LoadInt32(&mem.walks), ShouldEqual, 2)
+		})
+
+		Convey("Test a zero size disables the cache", func() {
+			ep, err := endpoint.NewListingCache(mem, endpoint.ListingCacheOptions{})
+			So(err, ShouldBeNil)
+			So(ep, ShouldEqual, mem)
+		})
+	})
+}
+
+func TestResync(t *testing.T) {
+
+	Convey("Test resync from scratch reconciles endpoints without deleting", t, func() {
+		ctx := context.Background()
+		tmp, _ := ioutil.TempDir("", "resync")
+		defer os.RemoveAll(tmp)
+		left, right := endpoint.NewMemoryEndpoint(), endpoint.NewMemoryEndpoint()
+
+		// Snapshots are lost: the previous sync state cannot be used anymore
+		snaps := endpoint.NewSnapshotFactory(tmp, left, right)
+		before, err := snaps.Load(left)
+		So(err, ShouldBeNil)
+		So(snaps.Reset(ctx), ShouldBeNil)
+		after, err := snaps.Load(left)
+		So(err, ShouldBeNil)
+		So(after, ShouldNotEqual, before)
+		defer snaps.Close(ctx)
+
+		So(writeContent(left, "/same", []byte("same")), ShouldBeNil)
+		So(writeContent(right, "/same", []byte("same")), ShouldBeNil)
+		So(writeContent(left, "/left-only", []byte("left")), ShouldBeNil)
+		So(left.CreateNode(ctx, &tree.Node{Path: "/folder", Type: tree.NodeType_COLLECTION, Uuid: "folder"}, false), ShouldBeNil)
+		So(writeContent(left, "/folder/nested", []byte("nested")), ShouldBeNil)
+		So(writeContent(right, "/right-only", []byte("right")), ShouldBeNil)
+		So(writeContent(left, "/doc", []byte("left version")), ShouldBeNil)
+		So(writeContent(right, "/doc", []byte("right version")), ShouldBeNil)
+
+		result, err := endpoint.Resync(ctx, left, right, model.DirectionBi, nil)
+		So(err, ShouldBeNil)
+		So(result.Conflicts, ShouldResemble, []string{"/doc"})
+		So(result.Created, ShouldHaveLength, 4)
+		// Both sides are reconciled by a single patch
+		So(result.Patches, ShouldHaveLength, 1)
+		_, has := result.Patches[0].HasErrors()
+		So(has, ShouldBeFalse)
+		summary := endpoint.SummarizePatch(result.Patches[0])
+		So(summary.Conflicts, ShouldEqual, 1)
+		So(summary.Counts[merger.OpCreateFile], ShouldEqual, 3)
+
+		for _, p := range []string{"/left-only", "/folder/nested", "/right-only"} {
+			l, _ := left.Content(p)
+			r, _ := right.Content(p)
+			So(l, ShouldNotBeEmpty)
+			So(string(r), ShouldEqual, string(l))
+		}
+		data, _ := left.Content("/doc")
+		So(string(data), ShouldEqual, "left version")
+		data, _ = right.Content("/doc")
+		So(string(data), ShouldEqual, "right version")
+
+		report, err := endpoint.Verify(ctx, left, right)
+		So(err, ShouldBeNil)
+		var remaining []string
+		for _, d := range report.Differences {
+			if d.Kind != endpoint.DiffMTime {
+				remaining = append(remaining, d.Path)
+			}
+		}
+		So(remaining, ShouldResemble, []string{"/doc"})
+
+		Convey("Test one-way resync leaves the source untouched", func() {
+			source, target := endpoint.NewMemoryEndpoint(), endpoint.NewMemoryEndpoint()
+			So(writeContent(source, "/a", []byte("a")), ShouldBeNil)
+			So(writeContent(target, "/b", []byte("b")), ShouldBeNil)
+			result, err := endpoint.Resync(ctx, source, target, model.DirectionRight, nil)
+			So(err, ShouldBeNil)
+			So(result.Patches, ShouldHaveLength, 1)
+			So(result.Created, ShouldResemble, []string{"/a"})
+			_, err = source.LoadNode(ctx, "/b")
+			So(err, ShouldNotBeNil)
+			_, ok := target.Content("/b")
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSizeFilteredEndpoint(t *testing.T) {
+
+	Convey("Test size limits on endpoints", t, func() {
+		ctx := context.Background()
+		left, right := endpoint.NewMemoryEndpoint(), endpoint.NewMemoryEndpoint()
+		for p, size := range map[string]int{"/tiny": 1, "/min": 2, "/max": 10, "/big": 11} {
+			So(writeContent(left, p, []byte(strings.Repeat("x", size))), ShouldBeNil)
+		}
+		So(left.CreateNode(ctx, &tree.Node{Path: "/folder", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+		limits := endpoint.SizeLimits{Min: 2, Max: 10}
+		wrap := func(limits endpoint.SizeLimits) (*endpoint.SizeFilteredEndpoint, *endpoint.SizeFilteredEndpoint) {
+			l, err := endpoint.NewSizeFilteredEndpoint(left, right, limits)
+			So(err, ShouldBeNil)
+			r, err := endpoint.NewSizeFilteredEndpoint(right, left, limits)
+			So(err, ShouldBeNil)
+			return l.(*endpoint.SizeFilteredEndpoint), r.(*endpoint.SizeFilteredEndpoint)
+		}
+		wl, wr := wrap(limits)
+
+		report, err := endpoint.Verify(ctx, wl, wr)
+		So(err, ShouldBeNil)
+		var created []string
+		for _, d := range report.Differences {
+			So(d.Kind, ShouldEqual, endpoint.DiffLeftOnly)
+			created = append(created, d.Path)
+		}
+		So(created, ShouldResemble, []string{"/folder", "/max", "/min"})
+		So(wl.SkippedBySize(), ShouldResemble, []string{"/big", "/tiny"})
+		_, err = wl.LoadNode(ctx, "/big")
+		So(err, ShouldNotBeNil)
+
+		patch := merger.NewPatch(wl, wr, merger.PatchOptions{})
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/min"}, &tree.Node{Path: "/min", Type: tree.NodeType_LEAF, Size: 2}))
+		summary := endpoint.SummarizePatch(patch)
+		So(summary.SkippedBySize, ShouldEqual, 2)
+		So(summary.String(), ShouldEqual, "1 created, 2 files skipped (size)")
+
+		// Skipped files are still found below other wrappers
+		cached, err := endpoint.NewListingCache(wl, endpoint.ListingCacheOptions{Size: 10})
+		So(err, ShouldBeNil)
+		_, ok := cached.(endpoint.RangeSyncTarget)
+		So(ok, ShouldBeTrue)
+		wrappedPatch := merger.NewPatch(cached.(model.PathSyncSource), wr, merger.PatchOptions{})
+		So(endpoint.SummarizePatch(wrappedPatch).SkippedBySize, ShouldEqual, 2)
+
+		// Interfaces missing on the wrapped endpoint are not advertised
+		plain, err := endpoint.NewSizeFilteredEndpoint(syncOnly{endpoint.NewMemoryEndpoint()}, right, limits)
+		So(err, ShouldBeNil)
+		_, ok = plain.(model.DataSyncTarget)
+		So(ok, ShouldBeFalse)
+
+		Convey("Test a file growing past the limit keeps its synced copy", func() {
+			So(writeContent(right, "/doc", []byte("small")), ShouldBeNil)
+			So(writeContent(left, "/doc", []byte(strings.Repeat("grown", 4))), ShouldBeNil)
+			report, err := endpoint.Verify(ctx, wl, wr)
+			So(err, ShouldBeNil)
+			for _, d := range report.Differences {
+				So(d.Path, ShouldNotEqual, "/doc")
+			}
+			So(wl.SkippedBySize(), ShouldContain, "/doc")
+			node, err := wl.LoadNode(ctx, "/doc")
+			So(err, ShouldBeNil)
+			So(node.Size, ShouldEqual, 5)
+		})
+
+		Convey("Test a file growing past the limit is removed from the other side with the delete policy", func() {
+			So(writeContent(right, "/doc", []byte("small")), ShouldBeNil)
+			So(writeContent(left, "/doc", []byte(strings.Repeat("grown", 4))), ShouldBeNil)
+			wl, wr := wrap(endpoint.SizeLimits{Min: 2, Max: 10, Policy: endpoint.SizeDeleteTarget})
+			report, err := endpoint.Verify(ctx, wl, wr)
+			So(err, ShouldBeNil)
+			kinds := make(map[string]endpoint.DifferenceKind)
+			for _, d := range report.Differences {
+				kinds[d.Path] = d.Kind
+			}
+			So(kinds["/doc"], ShouldEqual, endpoint.DiffRightOnly)
+		})
+
+		_, err = endpoint.NewSizeFilteredEndpoint(left, nil, limits)
+		So(err, ShouldNotBeNil)
+		_, err = endpoint.ParseSizePolicy("shrink")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSymlinkEndpoint(t *testing.T) {
+
+	Convey("Test symlink policies on a filesystem endpoint", t, func() {
+		tmp, _ := ioutil.TempDir("", "symlinks")
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		outside := filepath.Join(tmp, "outside")
+		os.MkdirAll(filepath.Join(root, "folder"), 0755)
+		os.MkdirAll(filepath.Join(outside, "dir"), 0755)
+		ioutil.WriteFile(filepath.Join(root, "plain.txt"), []byte("plain"), 0644)
+		ioutil.WriteFile(filepath.Join(outside, "target.txt"), []byte("target"), 0644)
+		ioutil.WriteFile(filepath.Join(outside, "dir", "inner.txt"), []byte("inner"), 0644)
+		So(os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(root, "file-link")), ShouldBeNil)
+		So(os.Symlink(filepath.Join(outside, "dir"), filepath.Join(root, "dir-link")), ShouldBeNil)
+		// Cyclic link pointing to the sync root
+		So(os.Symlink(root, filepath.Join(root, "folder", "loop")), ShouldBeNil)
+		// Relative links, inside and outside of the sync root
+		So(os.Symlink("plain.txt", filepath.Join(root, "rel-link")), ShouldBeNil)
+		So(os.Symlink("../plain.txt", filepath.Join(root, "folder", "up-link")), ShouldBeNil)
+		So(os.Symlink("../outside/target.txt", filepath.Join(root, "escape-link")), ShouldBeNil)
+
+		walk := func(policy endpoint.SymlinkPolicy) (*endpoint.SymlinkEndpoint, map[string]*tree.Node) {
+			fs, err := filesystem.NewFSClient(root, model.EndpointOptions{})
+			So(err, ShouldBeNil)
+			ep, err := endpoint.NewSymlinkEndpoint(fs, root, policy)
+			So(err, ShouldBeNil)
+			nodes := make(map[string]*tree.Node)
+			So(ep.Walk(func(p string, node *tree.Node, err error) {
+				if err == nil && node != nil {
+					nodes["/"+strings.TrimLeft(p, "/")] = node
+				}
+			}, "/", true), ShouldBeNil)
+			return ep, nodes
+		}
+
+		Convey("Test following links", func() {
+			_, nodes := walk(endpoint.SymlinkFollow)
+			So(nodes, ShouldContainKey, "/plain.txt")
+			So(nodes, ShouldContainKey, "/file-link")
+			So(nodes["/file-link"].IsLeaf(), ShouldBeTrue)
+			So(nodes["/file-link"].Size, ShouldEqual, 6)
+			So(nodes, ShouldContainKey, "/dir-link")
+			So(nodes["/dir-link"].IsLeaf(), ShouldBeFalse)
+			So(nodes, ShouldContainKey, "/dir-link/inner.txt")
+			So(nodes, ShouldNotContainKey, "/folder/loop")
+			So(nodes, ShouldNotContainKey, "/folder/loop/plain.txt")
+		})
+
+		Convey("Test skipping links", func() {
+			_, nodes := walk(endpoint.SymlinkSkip)
+			So(nodes, ShouldContainKey, "/plain.txt")
+			So(nodes, ShouldContainKey, "/folder")
+			So(nodes, ShouldNotContainKey, "/file-link")
+			So(nodes, ShouldNotContainKey, "/dir-link")
+			So(nodes, ShouldNotContainKey, "/dir-link/inner.txt")
+			So(nodes, ShouldNotContainKey, "/folder/loop")
+		})
+
+		Convey("Test preserving links", func() {
+			ctx := context.Background()
+			ep, nodes := walk(endpoint.SymlinkPreserve)
+			So(nodes, ShouldContainKey, "/plain.txt")
+			So(nodes, ShouldContainKey, "/rel-link")
+			So(nodes["/rel-link"].IsLeaf(), ShouldBeTrue)
+			So(endpoint.SymlinkTarget(nodes["/rel-link"]), ShouldEqual, "plain.txt")
+			So(endpoint.SymlinkTarget(nodes["/folder/up-link"]), ShouldEqual, "../plain.txt")
+			So(endpoint.SymlinkTarget(nodes["/plain.txt"]), ShouldBeEmpty)
+			// Absolute links and links escaping the root are refused
+			for _, l := range []string{"/file-link", "/dir-link", "/folder/loop", "/escape-link"} {
+				So(nodes, ShouldNotContainKey, l)
+			}
+			So(nodes, ShouldNotContainKey, "/dir-link/inner.txt")
+			_, err := ep.GetReaderOn("/rel-link")
+			So(err, ShouldNotBeNil)
+
+			// Another endpoint in preserve mode recreates the link from its metadata
+			otherRoot := filepath.Join(tmp, "other")
+			os.MkdirAll(otherRoot, 0755)
+			otherFs, err := filesystem.NewFSClient(otherRoot, model.EndpointOptions{})
+			So(err, ShouldBeNil)
+			other, err := endpoint.NewSymlinkEndpoint(otherFs, otherRoot, endpoint.SymlinkPreserve)
+			So(err, ShouldBeNil)
+			So(other.CreateNode(ctx, nodes["/rel-link"], false), ShouldBeNil)
+			link, err := os.Readlink(filepath.Join(otherRoot, "rel-link"))
+			So(err, ShouldBeNil)
+			So(link, ShouldEqual, "plain.txt")
+
+			for _, target := range []string{filepath.ToSlash(filepath.Join(outside, "dir")), "../outside"} {
+				unsafe := &tree.Node{Path: "/unsafe-link", Type: tree.NodeType_LEAF}
+				So(unsafe.SetMeta(endpoint.SymlinkMeta, target), ShouldBeNil)
+				err = other.CreateNode(ctx, unsafe, false)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, endpoint.ErrUnsafeSymlink.Error())
+				_, err = os.Lstat(filepath.Join(otherRoot, "unsafe-link"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			}
+
+			// Regular contents are written as files
+			So(writeContent(other, "/regular.txt", []byte("regular")), ShouldBeNil)
+			data, err := ioutil.ReadFile(filepath.Join(otherRoot, "regular.txt"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "regular")
+		})
+
+		_, err := endpoint.ParseSymlinkPolicy("copy")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/pydio/cells/common/proto/tree"
 	"github.com/pydio/cells/common/sync/endpoints/filesystem"
 	"github.com/pydio/cells/common/sync/endpoints/index"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
 	"github.com/pydio/cells/common/sync/merger"
 	"github.com/pydio/cells/common/sync/model"
 	"github.com/pydio/cells/common/sync/task"
@@ -112,6 +113,36 @@ func TestMergeWithBigDataStructure(t *testing.T) {
 	})
 }
 
+func TestSnapshotSource(t *testing.T) {
+
+	Convey("Test capturing deltas with a SnapshotSource", t, func() {
+		tmp, _ := ioutil.TempDir("", "snapshot-source")
+		defer os.RemoveAll(tmp)
+		ctx := context.Background()
+		mem := memory.NewMemDB()
+		mem.CreateNode(ctx, &tree.Node{Path: "/folder", Type: tree.NodeType_COLLECTION, Uuid: "folder"}, false)
+		mem.CreateNode(ctx, &tree.Node{Path: "/folder/file1", Type: tree.NodeType_LEAF, Etag: "hash1"}, false)
+
+		source, err := endpoint.NewSnapshotSource(tmp, mem)
+		So(err, ShouldBeNil)
+		snapSource := source.(*endpoint.SnapshotSource)
+		defer snapSource.Close()
+
+		So(snapSource.Capture(ctx), ShouldBeNil)
+		So(snapSource.LastDelta().Size(), ShouldEqual, 2)
+
+		mem.CreateNode(ctx, &tree.Node{Path: "/folder/file2", Type: tree.NodeType_LEAF, Etag: "hash2"}, false)
+		So(snapSource.Capture(ctx), ShouldBeNil)
+		delta := snapSource.LastDelta()
+		So(delta.Size(), ShouldEqual, 1)
+		var paths []string
+		delta.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+			paths = append(paths, operation.GetRefPath())
+		})
+		So(paths, ShouldResemble, []string{"/folder/file2"})
+	})
+}
+
 func run(s *task.Sync) error {
 	var err error
 
@@ -317,3 +348,142 @@ func run(s *task.Sync) error {
 
 // 	return *(*string)(unsafe.Pointer(&b))
 // }
+
+func TestWalkOperationsSorted(t *testing.T) {
+
+	Convey("Test operations are walked in a safe apply order", t, func() {
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		patch := merger.NewPatch(source, target, merger.PatchOptions{})
+		enqueue := func(opType merger.OperationType, p string, nodeType tree.NodeType) {
+			patch.Enqueue(merger.NewOperation(opType, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: nodeType}))
+		}
+		enqueue(merger.OpCreateFile, "/a/b/file", tree.NodeType_LEAF)
+		enqueue(merger.OpCreateFolder, "/a/b", tree.NodeType_COLLECTION)
+		enqueue(merger.OpCreateFolder, "/a", tree.NodeType_COLLECTION)
+		enqueue(merger.OpDelete, "/old", tree.NodeType_COLLECTION)
+		enqueue(merger.OpDelete, "/old/sub/file", tree.NodeType_LEAF)
+		enqueue(merger.OpDelete, "/old/sub", tree.NodeType_COLLECTION)
+
+		var paths []string
+		endpoint.WalkOperationsSorted(patch, []merger.OperationType{}, func(op merger.Operation) {
+			paths = append(paths, op.GetRefPath())
+		})
+		So(paths, ShouldResemble, []string{"/a", "/a/b", "/a/b/file", "/old/sub/file", "/old/sub", "/old"})
+
+		paths = nil
+		endpoint.WalkOperationsSorted(patch, []merger.OperationType{merger.OpDelete}, func(op merger.Operation) {
+			paths = append(paths, op.GetRefPath())
+		})
+		So(paths, ShouldResemble, []string{"/old/sub/file", "/old/sub", "/old"})
+	})
+
+}
+
+func TestNormalizeOperations(t *testing.T) {
+
+	Convey("Test redundant operations are collapsed", t, func() {
+		op := func(opType merger.OperationType, p string, etag string) merger.Operation {
+			nodeType := tree.NodeType_LEAF
+			if opType == merger.OpCreateFolder {
+				nodeType = tree.NodeType_COLLECTION
+			}
+			return merger.NewOperation(opType, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: nodeType, Etag: etag})
+		}
+		describe := func(ops []merger.Operation) (out []string) {
+			for _, o := range ops {
+				out = append(out, o.Type().String()+" "+o.GetRefPath()+" "+o.GetNode().GetEtag())
+			}
+			return
+		}
+
+		// create+update keeps a creation with the final content and its status
+		created := op(merger.OpCreateFile, "/updated", "v1")
+		created.Status(model.NewProcessingStatus("Created /updated"))
+		ops := endpoint.NormalizeOperations([]merger.Operation{
+			created,
+			op(merger.OpUpdateFile, "/updated", "v2"),
+			op(merger.OpUpdateFile, "/updated", "v3"),
+			op(merger.OpUpdateFile, "/existing", "e"),
+			op(merger.OpDelete, "/gone", ""),
+		})
+		So(describe(ops), ShouldResemble, []string{
+			merger.OpCreateFile.String() + " /updated v3",
+			merger.OpUpdateFile.String() + " /existing e",
+			merger.OpDelete.String() + " /gone ",
+		})
+		So(ops[0].GetStatus(), ShouldNotBeNil)
+		So(ops[0].GetStatus(), ShouldEqual, created.GetStatus())
+		So(created.GetNode().GetEtag(), ShouldEqual, "v1")
+
+		// A deletion may replace the node created at the same path: both are kept
+		ops = endpoint.NormalizeOperations([]merger.Operation{
+			op(merger.OpCreateFolder, "/tmp", ""),
+			op(merger.OpCreateFile, "/tmp/file", "f"),
+			op(merger.OpCreateFile, "/replaced", "r"),
+			op(merger.OpDelete, "/replaced", ""),
+			op(merger.OpDelete, "/tmp", ""),
+		})
+		So(ops, ShouldHaveLength, 5)
+
+		// Failed operations and conflicts are kept, along with the operations on the same node
+		failed := op(merger.OpCreateFile, "/failed", "x")
+		failed.Error(fmt.Errorf("cannot create"))
+		conflict := merger.NewConflictOperation(&tree.Node{Path: "/conflict", Type: tree.NodeType_LEAF}, merger.ConflictFileContent,
+			op(merger.OpUpdateFile, "/conflict", "left"), op(merger.OpUpdateFile, "/conflict", "right"))
+		ops = endpoint.NormalizeOperations([]merger.Operation{
+			failed,
+			op(merger.OpUpdateFile, "/failed", "y"),
+			op(merger.OpCreateFile, "/conflict", "c"),
+			op(merger.OpUpdateFile, "/conflict", "u"),
+			conflict,
+		})
+		So(ops, ShouldHaveLength, 5)
+		So(ops[0], ShouldEqual, failed)
+		So(ops[2].GetNode().GetEtag(), ShouldEqual, "c")
+		So(ops[4], ShouldEqual, conflict)
+	})
+
+}
+
+func TestMemoryEndpointSync(t *testing.T) {
+
+	Convey("Test two-way sync between two memory endpoints", t, func() {
+		ctx := context.Background()
+		left := endpoint.NewMemoryEndpoint()
+		right := endpoint.NewMemoryEndpoint()
+		left.CreateNode(ctx, &tree.Node{Path: "/docs", Type: tree.NodeType_COLLECTION, Uuid: "docs"}, false)
+		So(writeContent(left, "/docs/a.txt", []byte("left content")), ShouldBeNil)
+		right.CreateNode(ctx, &tree.Node{Path: "/photos", Type: tree.NodeType_COLLECTION, Uuid: "photos"}, false)
+		So(writeContent(right, "/photos/b.jpg", []byte("right content")), ShouldBeNil)
+
+		So(run(task.NewSync(left, right, model.DirectionBi)), ShouldBeNil)
+
+		for _, ep := range []*endpoint.MemoryEndpoint{left, right} {
+			data, ok := ep.Content("/docs/a.txt")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "left content")
+			data, ok = ep.Content("/photos/b.jpg")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "right content")
+		}
+
+		Convey("Test moves and deletes are propagated with their contents", func() {
+			So(left.MoveNode(ctx, "/docs", "/archive"), ShouldBeNil)
+			So(left.DeleteNode(ctx, "/photos/b.jpg"), ShouldBeNil)
+			_, ok := left.Content("/docs/a.txt")
+			So(ok, ShouldBeFalse)
+
+			So(run(task.NewSync(left, right, model.DirectionRight)), ShouldBeNil)
+
+			data, ok := right.Content("/archive/a.txt")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "left content")
+			_, ok = right.Content("/docs/a.txt")
+			So(ok, ShouldBeFalse)
+			_, ok = right.Content("/photos/b.jpg")
+			So(ok, ShouldBeFalse)
+			_, err := right.LoadNode(ctx, "/archive/a.txt")
+			So(err, ShouldBeNil)
+		})
+	})
+}
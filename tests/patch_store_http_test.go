@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+)
+
+func TestPatchStoreHandler(t *testing.T) {
+
+	Convey("Test PatchStore HTTP API", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		first := newTestPatch(source, target, 0, "/first")
+		second := newTestPatch(source, target, 1, "/second-a", "/second-b")
+		storeAndWait(store, first, second)
+
+		server := httptest.NewServer(endpoint.NewPatchStoreHandler(store))
+		defer server.Close()
+
+		// List
+		resp, e := http.Get(server.URL + "/patches?offset=0&limit=1")
+		So(e, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var list struct {
+			Total   int
+			Patches []endpoint.PatchJSON
+		}
+		So(json.NewDecoder(resp.Body).Decode(&list), ShouldBeNil)
+		resp.Body.Close()
+		So(list.Total, ShouldEqual, 2)
+		So(list.Patches, ShouldHaveLength, 1)
+		So(list.Patches[0].UUID, ShouldEqual, second.GetUUID())
+		So(list.Patches[0].Operations, ShouldHaveLength, 2)
+
+		// Get
+		resp, e = http.Get(server.URL + "/patches/" + first.GetUUID())
+		So(e, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var one endpoint.PatchJSON
+		So(json.NewDecoder(resp.Body).Decode(&one), ShouldBeNil)
+		resp.Body.Close()
+		So(one.UUID, ShouldEqual, first.GetUUID())
+		So(one.Operations, ShouldHaveLength, 1)
+		So(one.Operations[0].Path, ShouldEqual, "/first")
+		So(one.Operations[0].NodeType, ShouldEqual, "file")
+
+		// Operations by path glob
+		resp, e = http.Get(server.URL + "/operations?path=" + url.QueryEscape("/second-*"))
+		So(e, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var ops struct {
+			Operations []endpoint.OperationRefDTO
+		}
+		So(json.NewDecoder(resp.Body).Decode(&ops), ShouldBeNil)
+		resp.Body.Close()
+		So(ops.Operations, ShouldHaveLength, 2)
+		So(ops.Operations[0].PatchUUID, ShouldEqual, second.GetUUID())
+		So(ops.Operations[0].Operation.Path, ShouldStartWith, "/second-")
+
+		resp, e = http.Get(server.URL + "/operations")
+		So(e, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+		// Delete
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"/patches/"+first.GetUUID(), nil)
+		resp, e = http.DefaultClient.Do(req)
+		So(e, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+
+		resp, e = http.Get(server.URL + "/patches/" + first.GetUUID())
+		So(e, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Test PatchStore health API", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source := &unreachableEndpoint{DBEndpoint: memory.NewMemDB()}
+		target := &unreachableEndpoint{DBEndpoint: memory.NewMemDB()}
+		store, err := endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		server := httptest.NewServer(endpoint.NewPatchStoreHandler(store))
+		defer server.Close()
+
+		health := func(path string) (int, endpoint.HealthReport) {
+			resp, e := http.Get(server.URL + path)
+			So(e, ShouldBeNil)
+			defer resp.Body.Close()
+			var report endpoint.HealthReport
+			So(json.NewDecoder(resp.Body).Decode(&report), ShouldBeNil)
+			return resp.StatusCode, report
+		}
+
+		storeAndWait(store, newTestPatch(source.DBEndpoint, target.DBEndpoint, 0, "/file"))
+		code, report := health("/health")
+		So(code, ShouldEqual, http.StatusOK)
+		So(report.Healthy, ShouldBeTrue)
+		So(report.LastSync, ShouldNotBeNil)
+		So(report.LastSync.Equal(testStampBase), ShouldBeTrue)
+		So(report.LastHadErrors, ShouldBeFalse)
+		So(report.Endpoints, ShouldHaveLength, 2)
+		So(report.Endpoints[0].Reachable, ShouldBeTrue)
+
+		// Unreachable endpoint
+		target.err = fmt.Errorf("connection refused")
+		code, report = health("/status")
+		So(code, ShouldEqual, http.StatusServiceUnavailable)
+		So(report.Healthy, ShouldBeFalse)
+		So(report.Endpoints[1].Reachable, ShouldBeFalse)
+		So(report.Endpoints[1].Error, ShouldContainSubstring, "connection refused")
+		target.err = nil
+
+		// Last sync errored
+		storeAndWait(store, failTestPatch(newTestPatch(source.DBEndpoint, target.DBEndpoint, 1, "/other"), "cannot sync"))
+		code, report = health("/health")
+		So(code, ShouldEqual, http.StatusServiceUnavailable)
+		So(report.LastHadErrors, ShouldBeTrue)
+		So(report.Endpoints[1].Reachable, ShouldBeTrue)
+	})
+
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+)
+
+// patchStoreBehaviour runs the same expectations against any PatchStore implementation.
+func patchStoreBehaviour(store endpoint.PatchStore, source, target *memory.DBEndpoint) {
+	p1 := newTestPatch(source, target, 1, "/file-1")
+	p2 := newTestPatch(source, target, 2, "/file-2", "/file-2b")
+	p3 := newTestPatch(source, target, 3, "/file-3")
+	storeAndWait(store, p1, p2, p3, newTestPatch(source, target, 4))
+
+	// Empty patches are skipped, newest first
+	patches, total, e := store.LoadWithTotal(0, 2)
+	So(e, ShouldBeNil)
+	So(total, ShouldEqual, 3)
+	So(patches, ShouldHaveLength, 2)
+	So(patches[0].GetUUID(), ShouldEqual, p3.GetUUID())
+	So(patches[1].GetUUID(), ShouldEqual, p2.GetUUID())
+	patches, e = store.Load(2, -1)
+	So(e, ShouldBeNil)
+	So(patches, ShouldHaveLength, 1)
+	So(patches[0].GetUUID(), ShouldEqual, p1.GetUUID())
+	// A negative limit returns all patches, a zero limit none
+	patches, e = store.Load(0, -1)
+	So(e, ShouldBeNil)
+	So(patches, ShouldHaveLength, 3)
+	patches, total, e = store.LoadWithTotal(0, 0)
+	So(e, ShouldBeNil)
+	So(total, ShouldEqual, 3)
+	So(patches, ShouldBeEmpty)
+	patches, e = store.Load(1, 0)
+	So(e, ShouldBeNil)
+	So(patches, ShouldBeEmpty)
+
+	loaded, e := store.Get(p2.GetUUID())
+	So(e, ShouldBeNil)
+	So(loaded.Size(), ShouldEqual, 2)
+	_, e = store.Get("unknown")
+	So(e, ShouldEqual, endpoint.ErrPatchNotFound)
+
+	So(store.Delete(p2.GetUUID()), ShouldBeNil)
+	So(store.Delete(p2.GetUUID()), ShouldEqual, endpoint.ErrPatchNotFound)
+	patches, e = store.Load(0, 10)
+	So(e, ShouldBeNil)
+	So(patches, ShouldHaveLength, 2)
+
+	So(store.LastHadErrors(), ShouldBeFalse)
+	storeAndWait(store, failTestPatch(newTestPatch(source, target, 6, "/failed"), "failed"))
+	So(store.LastHadErrors(), ShouldBeTrue)
+
+	So(store.Clear(), ShouldBeNil)
+	patches, e = store.Load(0, 10)
+	So(e, ShouldBeNil)
+	So(patches, ShouldBeEmpty)
+
+	store.Stop()
+	So(store.Store(newTestPatch(source, target, 5, "/late")), ShouldEqual, endpoint.ErrStoreClosed)
+}
+
+func TestPatchStoreImplementations(t *testing.T) {
+
+	Convey("Test BoltDB PatchStore behaviour", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		patchStoreBehaviour(store, source, target)
+	})
+
+	Convey("Test memory PatchStore behaviour", t, func() {
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		patchStoreBehaviour(endpoint.NewMemoryPatchStore(), source, target)
+	})
+
+}
@@ -0,0 +1,1910 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+var testStampBase = time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestPatch creates a patch with one create operation per path, stamped at base + i minutes.
+func newTestPatch(source, target *memory.DBEndpoint, i int, paths ...string) merger.Patch {
+	patch := merger.NewPatch(source, target, merger.PatchOptions{})
+	for _, p := range paths {
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_LEAF}))
+	}
+	patch.Stamp(testStampBase.Add(time.Duration(i) * time.Minute))
+	return patch
+}
+
+// failTestPatch sets a patch error while preserving the patch stamp.
+func failTestPatch(patch merger.Patch, msg string) merger.Patch {
+	stamp := patch.GetStamp()
+	patch.SetPatchError(errors.New(msg))
+	patch.Stamp(stamp)
+	return patch
+}
+
+// storeAndWait pushes patches to the store and waits for the persist goroutine to handle them.
+func storeAndWait(store endpoint.PatchStore, patches ...merger.Patch) {
+	for _, p := range patches {
+		store.Store(p)
+	}
+	if f, ok := store.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
+
+// newTestStore opens a patch store with options between two new memory endpoints, in a new temporary folder.
+// cleanup stops the store if it is still running and removes the folder.
+func newTestStore(options endpoint.PatchStoreOptions) (tmp string, source, target *memory.DBEndpoint, store *endpoint.BoltPatchStore, cleanup func()) {
+	tmp, _ = ioutil.TempDir("", "patch-store")
+	source, target = memory.NewMemDB(), memory.NewMemDB()
+	store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, options)
+	So(err, ShouldBeNil)
+	return tmp, source, target, store, func() {
+		if store != nil {
+			store.Stop()
+		}
+		os.RemoveAll(tmp)
+	}
+}
+
+// createProcessor applies operations by creating their node on the patch target.
+type createProcessor struct {
+	processed []string
+}
+
+func (c *createProcessor) Process(patch merger.Patch, cmd *model.Command) {
+	patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+		c.processed = append(c.processed, op.GetRefPath())
+		if e := patch.Target().CreateNode(context.Background(), op.GetNode(), false); e != nil {
+			op.Error(e)
+		}
+	})
+}
+
+// fakeClock is an endpoint.Clock only moving forward when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Add(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestPatchStore(t *testing.T) {
+
+	Convey("Test PatchStore pagination", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for i := 0; i < 25; i++ {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		storeAndWait(store, pp...)
+
+		patches, total, e := store.LoadWithTotal(10, 5)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 25)
+		So(patches, ShouldHaveLength, 5)
+		// Newest first: offset 10 is the 15th stored patch
+		So(patches[0].GetStamp().Equal(testStampBase.Add(14*time.Minute)), ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore with pruning disabled", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxStoredPatches: -1})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for i := 0; i < 150; i++ {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		storeAndWait(store, pp...)
+
+		// Loading twice to make sure no pruning happened in between
+		_, _, e := store.LoadWithTotal(0, 10)
+		So(e, ShouldBeNil)
+		<-time.After(200 * time.Millisecond)
+		_, total, e := store.LoadWithTotal(0, 10)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 150)
+	})
+
+	Convey("Test PatchStore explicit pruning", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxStoredPatches: -1})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for i := 0; i < 105; i++ {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		storeAndWait(store, pp...)
+
+		store.MaxStoredPatches = 100
+		removed, e := store.Prune()
+		So(e, ShouldBeNil)
+		So(removed, ShouldEqual, 5)
+		patches, total, e := store.LoadWithTotal(99, 10)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 100)
+		// Oldest remaining patch is the 6th stored one
+		So(patches[0].GetStamp().Equal(testStampBase.Add(5*time.Minute)), ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore single patch lookup", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		patch := newTestPatch(source, target, 0, "/file-a", "/file-b")
+		storeAndWait(store, patch)
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(loaded.GetUUID(), ShouldEqual, patch.GetUUID())
+		So(loaded.Size(), ShouldEqual, 2)
+		So(loaded.GetStamp().Equal(patch.GetStamp()), ShouldBeTrue)
+
+		_, e = store.Get("unknown-uuid")
+		So(e, ShouldEqual, endpoint.ErrPatchNotFound)
+	})
+
+	Convey("Test PatchStore deletion", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		p1 := newTestPatch(source, target, 1, "/file-1")
+		p2 := newTestPatch(source, target, 2, "/file-2")
+		p3 := newTestPatch(source, target, 3, "/file-3")
+		storeAndWait(store, p1, p2, p3)
+
+		So(store.Delete(p2.GetUUID()), ShouldBeNil)
+		So(store.Delete(p2.GetUUID()), ShouldEqual, endpoint.ErrPatchNotFound)
+		patches, e := store.Load(0, 10)
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 2)
+		So(patches[0].GetUUID(), ShouldEqual, p3.GetUUID())
+		So(patches[1].GetUUID(), ShouldEqual, p1.GetUUID())
+
+		So(store.Clear(), ShouldBeNil)
+		patches, e = store.Load(0, 10)
+		So(e, ShouldBeNil)
+		So(patches, ShouldBeEmpty)
+	})
+
+	Convey("Test PatchStore keeps all patch errors", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		patch := merger.NewPatch(source, target, merger.PatchOptions{})
+		for i := 0; i < 3; i++ {
+			p := fmt.Sprintf("/file-%d", i)
+			op := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_LEAF})
+			op.Error(fmt.Errorf("error on %s", p))
+			patch.Enqueue(op)
+		}
+		storeAndWait(store, patch)
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		errs := endpoint.ListPatchErrors(loaded)
+		So(len(errs), ShouldBeGreaterThanOrEqualTo, 3)
+		var messages []string
+		for _, er := range errs {
+			messages = append(messages, er.Error())
+		}
+		So(messages, ShouldContain, "error on /file-0")
+		So(messages, ShouldContain, "error on /file-1")
+		So(messages, ShouldContain, "error on /file-2")
+	})
+
+	Convey("Test PatchStore keeps operations errors", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		patch := newTestPatch(source, target, 0, "/file-0", "/file-2")
+		failing := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/file-1"}, &tree.Node{Path: "/file-1", Type: tree.NodeType_LEAF})
+		failing.Error(fmt.Errorf("cannot upload"))
+		patch.Enqueue(failing)
+		storeAndWait(store, patch)
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		errored := map[string]string{}
+		loaded.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+			if st := operation.GetStatus(); st != nil && st.IsError() {
+				errored[operation.GetRefPath()] = st.Error().Error()
+			}
+		})
+		So(errored, ShouldHaveLength, 1)
+		So(errored["/file-1"], ShouldEqual, "cannot upload")
+	})
+
+	Convey("Test PatchStore read-only mode", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		// Writer holds the lock: read-only open must fail after the timeout
+		start := time.Now()
+		_, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{ReadOnly: true, OpenTimeout: 300 * time.Millisecond})
+		So(err, ShouldNotBeNil)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+		store.Stop()
+
+		readOnly, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{ReadOnly: true, OpenTimeout: 300 * time.Millisecond})
+		So(err, ShouldBeNil)
+		defer readOnly.Stop()
+		So(readOnly.Store(newTestPatch(source, target, 0, "/file")), ShouldEqual, endpoint.ErrReadOnlyStore)
+	})
+
+	Convey("Test PatchStore error callback", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		var calls int
+		store.OnError = func(patch merger.Patch) {
+			calls++
+		}
+		clean := newTestPatch(source, target, 0, "/clean")
+		failing := failTestPatch(newTestPatch(source, target, 1, "/failing"), "failed")
+		failingAgain := failTestPatch(newTestPatch(source, target, 2, "/failing"), "failed again")
+		storeAndWait(store, clean, failing, failingAgain)
+
+		So(calls, ShouldEqual, 1)
+	})
+
+	Convey("Test PatchStore statistics", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		p1 := newTestPatch(source, target, 1, "/a", "/b")
+		p2 := newTestPatch(source, target, 2, "/c")
+		p2.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/d"}, &tree.Node{Path: "/d", Type: tree.NodeType_LEAF}))
+		failTestPatch(p2, "failed")
+		p3 := newTestPatch(source, target, 3, "/e")
+		storeAndWait(store, p1, p2, p3)
+
+		stats, e := store.Stats()
+		So(e, ShouldBeNil)
+		So(stats.Total, ShouldEqual, 3)
+		So(stats.WithErrors, ShouldEqual, 1)
+		So(stats.Operations[merger.OpCreateFile], ShouldEqual, 4)
+		So(stats.Operations[merger.OpDelete], ShouldEqual, 1)
+		So(stats.Oldest.Equal(p1.GetStamp()), ShouldBeTrue)
+		So(stats.Newest.Equal(p3.GetStamp()), ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore filtering by operation type", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		p1 := newTestPatch(source, target, 1, "/a")
+		p2 := newTestPatch(source, target, 2, "/b")
+		p2.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/c"}, &tree.Node{Path: "/c", Type: tree.NodeType_LEAF}))
+		storeAndWait(store, p1, p2)
+
+		patches, e := store.LoadFiltered(0, 10, []merger.OperationType{merger.OpDelete})
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+		So(patches[0].GetUUID(), ShouldEqual, p2.GetUUID())
+
+		patches, e = store.LoadFiltered(0, 10, []merger.OperationType{merger.OpMoveFile})
+		So(e, ShouldBeNil)
+		So(patches, ShouldBeEmpty)
+
+		patches, e = store.LoadFiltered(0, 10, nil)
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 2)
+	})
+
+	Convey("Test PatchStore time range query", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for d := 0; d < 5; d++ {
+			pp = append(pp, newTestPatch(source, target, d*24*60, fmt.Sprintf("/day-%d", d)))
+		}
+		storeAndWait(store, pp...)
+		day := func(d int) time.Time {
+			return testStampBase.Add(time.Duration(d) * 24 * time.Hour)
+		}
+
+		patches, e := store.LoadBetween(day(1), day(3))
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 3)
+		So(patches[0].GetUUID(), ShouldEqual, pp[3].GetUUID())
+		So(patches[2].GetUUID(), ShouldEqual, pp[1].GetUUID())
+
+		patches, e = store.LoadBetween(time.Time{}, day(1))
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 2)
+
+		patches, e = store.LoadBetween(day(4), time.Time{})
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+	})
+
+	Convey("Test PatchStore refuses patches after Stop", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		store.Stop()
+
+		var err error
+		So(func() {
+			err = store.Store(newTestPatch(source, target, 0, "/late"))
+		}, ShouldNotPanic)
+		So(err, ShouldEqual, endpoint.ErrStoreClosed)
+		So(func() {
+			store.PublishPatch(newTestPatch(source, target, 0, "/late"))
+		}, ShouldNotPanic)
+	})
+
+	Convey("Test PatchStore flushes pending patches on Stop", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		for i := 0; i < 5; i++ {
+			store.Store(newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		store.Stop()
+
+		reopened, err := endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		defer reopened.Stop()
+		_, total, e := reopened.LoadWithTotal(0, 10)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 5)
+	})
+
+	Convey("Test PatchStore load with a cancelled context", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		storeAndWait(store, newTestPatch(source, target, 0, "/a"), newTestPatch(source, target, 1, "/b"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		_, e := store.LoadContext(ctx, 0, 10)
+		So(e, ShouldEqual, context.Canceled)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("Test PatchStore compaction", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxStoredPatches: -1})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for i := 0; i < 100; i++ {
+			var paths []string
+			for j := 0; j < 20; j++ {
+				paths = append(paths, fmt.Sprintf("/folder-%d/file-%d", i, j))
+			}
+			pp = append(pp, newTestPatch(source, target, i, paths...))
+		}
+		storeAndWait(store, pp...)
+		for _, patch := range pp[1:] {
+			So(store.Delete(patch.GetUUID()), ShouldBeNil)
+		}
+		before, _ := os.Stat(filepath.Join(tmp, "patches"))
+
+		So(store.Compact(), ShouldBeNil)
+		after, _ := os.Stat(filepath.Join(tmp, "patches"))
+		So(after.Size(), ShouldBeLessThan, before.Size())
+
+		kept, e := store.Get(pp[0].GetUUID())
+		So(e, ShouldBeNil)
+		So(kept.Size(), ShouldEqual, 20)
+	})
+
+	Convey("Test operation codecs", t, func() {
+		left := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/conflict"}, &tree.Node{Path: "/conflict", Type: tree.NodeType_LEAF, Etag: "left"})
+		right := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/conflict"}, &tree.Node{Path: "/conflict", Type: tree.NodeType_LEAF, Etag: "right"})
+		conflict := merger.NewConflictOperation(&tree.Node{Path: "/conflict", Type: tree.NodeType_LEAF}, merger.ConflictFileContent, left, right)
+		create := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/file"}, &tree.Node{Path: "/file", Type: tree.NodeType_LEAF})
+
+		for _, codec := range []endpoint.OperationCodec{endpoint.JSONCodec{}, endpoint.FlateCodec{}, endpoint.DTOCodec{}} {
+			data, e := codec.Marshal(create)
+			So(e, ShouldBeNil)
+			op, e := codec.Unmarshal(data)
+			So(e, ShouldBeNil)
+			So(op.Type(), ShouldEqual, merger.OpCreateFile)
+			So(op.GetRefPath(), ShouldEqual, "/file")
+
+			data, e = codec.Marshal(conflict)
+			So(e, ShouldBeNil)
+			op, e = codec.Unmarshal(data)
+			So(e, ShouldBeNil)
+			So(op.Type(), ShouldEqual, merger.OpConflict)
+			So(op.GetNode().Path, ShouldEqual, "/conflict")
+		}
+	})
+
+	Convey("Test PatchStore keeps patch direction", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		// Patch going from target to source
+		patch := newTestPatch(target, source, 0, "/file")
+		storeAndWait(store, patch)
+		store.Stop()
+
+		// Reopen with different endpoint instances
+		newSource, newTarget := memory.NewMemDB(), memory.NewMemDB()
+		reopened, err := endpoint.NewPatchStore(tmp, newSource, newTarget)
+		So(err, ShouldBeNil)
+		defer reopened.Stop()
+		loaded, e := reopened.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(loaded.Source() == model.PathSyncSource(newTarget), ShouldBeTrue)
+		So(loaded.Target() == model.PathSyncTarget(newSource), ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore lists pending conflicts", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		patch := newTestPatch(source, target, 0, "/normal")
+		patch.Enqueue(newTestConflict("/conflict-a", "left", 10, "right", 20))
+		patch.Enqueue(newTestConflict("/folder/conflict-b", "left", 10, "right", 20))
+		storeAndWait(store, patch, newTestPatch(source, target, 1, "/other"))
+
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldHaveLength, 2)
+		var paths []string
+		for _, c := range conflicts {
+			So(c.PatchUUID, ShouldEqual, patch.GetUUID())
+			So(c.Type, ShouldEqual, merger.ConflictFileContent)
+			So(c.Left.GetNode().Etag, ShouldEqual, "left")
+			So(c.Right.GetNode().Etag, ShouldEqual, "right")
+			paths = append(paths, c.NodePath)
+		}
+		So(paths, ShouldContain, "/conflict-a")
+		So(paths, ShouldContain, "/folder/conflict-b")
+	})
+
+	Convey("Test PatchStore resolves stored conflicts", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		processor := &directionProcessor{target: target}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{Processor: processor})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(newTestConflict("/left.txt", "left", 10, "right", 20))
+		patch.Enqueue(newTestConflict("/right.txt", "left", 10, "right", 20))
+		patch.Enqueue(newTestConflict("/both.txt", "left", 10, "right", 20))
+		storeAndWait(store, patch)
+
+		So(store.ResolveConflict(patch.GetUUID(), "/unknown", endpoint.ResolveLeft), ShouldEqual, endpoint.ErrConflictNotFound)
+		So(store.ResolveConflict("unknown", "/left.txt", endpoint.ResolveLeft), ShouldEqual, endpoint.ErrPatchNotFound)
+
+		So(store.ResolveConflict(patch.GetUUID(), "/left.txt", endpoint.ResolveLeft), ShouldBeNil)
+		So(store.ResolveConflict(patch.GetUUID(), "/right.txt", endpoint.ResolveRight), ShouldBeNil)
+		So(store.ResolveConflict(patch.GetUUID(), "/both.txt", endpoint.ResolveKeepBoth), ShouldBeNil)
+		So(store.ResolveConflict(patch.GetUUID(), "/both.txt", endpoint.ResolveLeft), ShouldEqual, endpoint.ErrConflictNotFound)
+
+		// The source side is applied to the target, the target side back to the source
+		So(processor.forward, ShouldHaveLength, 4)
+		So(processor.forward, ShouldContain, "/left.txt")
+		So(processor.forward, ShouldContain, "/both.txt")
+		So(processor.backward, ShouldResemble, []string{"/right.txt"})
+
+		conflicts, e := store.PendingConflicts()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldBeEmpty)
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		etags := make(map[string]string)
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			etags[op.GetRefPath()] = op.GetNode().Etag
+		})
+		So(etags, ShouldHaveLength, 4)
+		So(etags["/left.txt"], ShouldEqual, "left")
+		So(etags["/right.txt"], ShouldEqual, "right")
+		So(etags["/both.txt"], ShouldEqual, "left")
+		for p, etag := range etags {
+			if strings.HasPrefix(p, "/both (conflicted copy ") {
+				So(etag, ShouldEqual, "right")
+			}
+		}
+	})
+
+	Convey("Test PatchStore encryption at rest", t, func() {
+		key := []byte("0123456789abcdef0123456789abcdef")
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{EncryptionKey: key})
+		defer cleanup()
+
+		patch := failTestPatch(newTestPatch(source, target, 0, "/secret-path"), "secret error")
+		storeAndWait(store, patch)
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(loaded.Size(), ShouldEqual, 1)
+		errs, has := loaded.HasErrors()
+		So(has, ShouldBeTrue)
+		So(errs[0].Error(), ShouldEqual, "secret error")
+		store.Stop()
+
+		raw, _ := ioutil.ReadFile(filepath.Join(tmp, "patches"))
+		So(strings.Contains(string(raw), "secret-path"), ShouldBeFalse)
+		So(strings.Contains(string(raw), "secret error"), ShouldBeFalse)
+
+		_, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{EncryptionKey: []byte("fedcba9876543210fedcba9876543210")})
+		So(err, ShouldEqual, endpoint.ErrInvalidKey)
+		_, err = endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldEqual, endpoint.ErrEncryptedStore)
+
+		store, err = endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{EncryptionKey: key})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		loaded, e = store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(loaded.Size(), ShouldEqual, 1)
+	})
+
+	Convey("Test PatchStore structured logs", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		patch := newTestPatch(source, target, 0, "/file")
+		storeAndWait(store, patch)
+		store.Stop()
+
+		// Inject an invalid operation
+		db, err := bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(err, ShouldBeNil)
+		So(db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("patches")).Bucket([]byte(patch.GetUUID())).Bucket([]byte("operations")).Put([]byte("invalid"), []byte("not json"))
+		}), ShouldBeNil)
+		db.Close()
+
+		buf := &bytes.Buffer{}
+		logger, err := endpoint.NewStoreLogger("json", zapcore.AddSync(buf))
+		So(err, ShouldBeNil)
+		endpoint.SetStoreLogger(logger)
+		defer endpoint.SetStoreLogger(nil)
+
+		store, err = endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		_, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+
+		var entry map[string]interface{}
+		So(json.Unmarshal(bytes.Split(buf.Bytes(), []byte("\n"))[0], &entry), ShouldBeNil)
+		So(entry["msg"], ShouldEqual, "Cannot unmarshall operation")
+		So(entry["patch_uuid"], ShouldEqual, patch.GetUUID())
+		So(entry["error"], ShouldNotBeEmpty)
+
+		_, err = endpoint.NewStoreLogger("xml", zapcore.AddSync(buf))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Test PatchStore metrics", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		conflicting := newTestPatch(source, target, 2, "/c")
+		conflicting.Enqueue(newTestConflict("/conflict", "left", 10, "right", 20))
+		storeAndWait(store,
+			newTestPatch(source, target, 0, "/a", "/b"),
+			failTestPatch(newTestPatch(source, target, 1, "/failed"), "failed"),
+			conflicting,
+		)
+
+		registry := prometheus.NewRegistry()
+		So(registry.Register(store.Metrics()), ShouldBeNil)
+		families, e := registry.Gather()
+		So(e, ShouldBeNil)
+		values := make(map[string]float64)
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				if m.GetCounter() != nil {
+					values[f.GetName()] += m.GetCounter().GetValue()
+				} else if m.GetGauge() != nil {
+					values[f.GetName()] += m.GetGauge().GetValue()
+				}
+			}
+		}
+		So(values["cells_sync_patches_stored_total"], ShouldEqual, 3)
+		So(values["cells_sync_patches_errors_total"], ShouldEqual, 1)
+		So(values["cells_sync_operations_total"], ShouldEqual, 5)
+		So(values["cells_sync_pending_conflicts"], ShouldEqual, 1)
+		So(values["cells_sync_patch_store_bytes"], ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Test PatchStore batches patches queued within the window", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{BatchWindow: 300 * time.Millisecond})
+		defer cleanup()
+		commits := make(chan int, 10)
+		store.OnCommit = func(patches int) {
+			commits <- patches
+		}
+
+		for i := 0; i < 10; i++ {
+			So(store.Store(newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i))), ShouldBeNil)
+		}
+		select {
+		case n := <-commits:
+			So(n, ShouldEqual, 10)
+		case <-time.After(2 * time.Second):
+			So("no commit", ShouldBeEmpty)
+		}
+		So(commits, ShouldBeEmpty)
+		_, total, e := store.LoadWithTotal(0, 1)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 10)
+	})
+
+	Convey("Test PatchStore migrates legacy files", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+
+		// Write a v1 fixture: no schema version, no direction flag, single error
+		db, err := bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(err, ShouldBeNil)
+		op, _ := json.Marshal(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/legacy"}, &tree.Node{Path: "/legacy", Type: tree.NodeType_LEAF}))
+		So(db.Update(func(tx *bbolt.Tx) error {
+			patches, _ := tx.CreateBucket([]byte("patches"))
+			b, _ := patches.CreateBucket([]byte("legacy-uuid"))
+			stamp, _ := testStampBase.MarshalJSON()
+			b.Put([]byte("stamp"), stamp)
+			b.Put([]byte("patchError"), []byte("legacy error"))
+			b.Put([]byte("source"), []byte(target.GetEndpointInfo().URI))
+			ops, _ := b.CreateBucket([]byte("operations"))
+			return ops.Put([]byte("1"), op)
+		}), ShouldBeNil)
+		db.Close()
+
+		store, err := endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		patch, e := store.Get("legacy-uuid")
+		So(e, ShouldBeNil)
+		So(patch.Size(), ShouldEqual, 1)
+		So(patch.Source(), ShouldEqual, target)
+		errs, has := patch.HasErrors()
+		So(has, ShouldBeTrue)
+		So(errs[0].Error(), ShouldEqual, "legacy error")
+		store.Stop()
+
+		db, err = bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(err, ShouldBeNil)
+		db.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte("patches")).Bucket([]byte("legacy-uuid"))
+			So(string(b.Get([]byte("inverted"))), ShouldEqual, "true")
+			So(b.Get([]byte("patchErrors")), ShouldNotBeNil)
+			So(tx.Bucket([]byte("meta")).Get([]byte("schemaVersion")), ShouldNotBeNil)
+			So(tx.Bucket([]byte("stamps")).Stats().KeyN, ShouldEqual, 1)
+			return nil
+		})
+		// Pretend a newer version wrote the file
+		db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("meta")).Put([]byte("schemaVersion"), []byte{0, 0, 0, 0, 0, 0, 0, 99})
+		})
+		db.Close()
+		_, err = endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldEqual, endpoint.ErrSchemaTooNew)
+	})
+
+	Convey("Test PatchStore sort orders", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		p0 := newTestPatch(source, target, 0, "/a")
+		p1 := failTestPatch(newTestPatch(source, target, 1, "/b"), "failed")
+		p2 := newTestPatch(source, target, 2, "/c")
+		p3 := failTestPatch(newTestPatch(source, target, 3, "/d"), "failed")
+		storeAndWait(store, p0, p1, p2, p3)
+
+		uuids := func(patches []merger.Patch) (ids []string) {
+			for _, p := range patches {
+				ids = append(ids, p.GetUUID())
+			}
+			return
+		}
+		patches, e := store.LoadSorted(0, -1, endpoint.SortNewestFirst)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{p3.GetUUID(), p2.GetUUID(), p1.GetUUID(), p0.GetUUID()})
+		patches, e = store.LoadSorted(0, -1, endpoint.SortOldestFirst)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{p0.GetUUID(), p1.GetUUID(), p2.GetUUID(), p3.GetUUID()})
+		patches, e = store.LoadSorted(0, -1, endpoint.SortErrorsFirst)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{p3.GetUUID(), p1.GetUUID(), p2.GetUUID(), p0.GetUUID()})
+		patches, e = store.LoadSorted(1, 2, endpoint.SortOldestFirst)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{p1.GetUUID(), p2.GetUUID()})
+	})
+
+	Convey("Test PatchStore retries errored operations", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		processor := &createProcessor{}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{Processor: processor})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		patch := newTestPatch(source, target, 0, "/ok")
+		failed := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/failed"}, &tree.Node{Path: "/failed", Type: tree.NodeType_LEAF})
+		failed.Error(fmt.Errorf("network is unreachable"))
+		patch.Enqueue(failed)
+		failTestPatch(patch, "network is unreachable")
+		storeAndWait(store, patch)
+
+		retried, err := store.Retry(patch.GetUUID())
+		So(err, ShouldBeNil)
+		So(processor.processed, ShouldResemble, []string{"/failed"})
+		_, has := retried.HasErrors()
+		So(has, ShouldBeFalse)
+		_, err = target.LoadNode(context.Background(), "/failed")
+		So(err, ShouldBeNil)
+
+		store.Flush()
+		reloaded, err := store.Get(patch.GetUUID())
+		So(err, ShouldBeNil)
+		_, has = reloaded.HasErrors()
+		So(has, ShouldBeFalse)
+		So(reloaded.Size(), ShouldEqual, 2)
+
+		_, err = store.Retry("unknown")
+		So(err, ShouldEqual, endpoint.ErrPatchNotFound)
+
+		withConflict := newTestPatch(source, target, 1)
+		withConflict.Enqueue(newTestConflict("/conflict", "left", 10, "right", 20))
+		failTestPatch(withConflict, "conflicts")
+		storeAndWait(store, withConflict)
+		_, err = store.Retry(withConflict.GetUUID())
+		So(err, ShouldEqual, endpoint.ErrUnresolvedConflicts)
+	})
+
+	Convey("Test dumping a read-only PatchStore as JSON", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		var pp []merger.Patch
+		for i := 0; i < 3; i++ {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i), fmt.Sprintf("/other-%d", i)))
+		}
+		failTestPatch(pp[1], "dump error")
+		storeAndWait(store, pp...)
+		store.Stop()
+		before, _ := ioutil.ReadFile(filepath.Join(tmp, "patches"))
+
+		readOnly, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{ReadOnly: true})
+		So(err, ShouldBeNil)
+		buf := &bytes.Buffer{}
+		So(endpoint.DumpPatches(buf, readOnly, 0, -1), ShouldBeNil)
+		var dumped []endpoint.PatchJSON
+		So(json.Unmarshal(buf.Bytes(), &dumped), ShouldBeNil)
+		So(dumped, ShouldHaveLength, 3)
+		So(dumped[0].UUID, ShouldEqual, pp[2].GetUUID())
+		So(dumped[0].Operations, ShouldHaveLength, 2)
+		So(dumped[0].Operations[0].Type, ShouldEqual, merger.OpCreateFile.String())
+		So(dumped[1].Errors, ShouldResemble, []string{"dump error"})
+
+		buf.Reset()
+		So(endpoint.DumpPatches(buf, readOnly, 1, 1), ShouldBeNil)
+		So(json.Unmarshal(buf.Bytes(), &dumped), ShouldBeNil)
+		So(dumped, ShouldHaveLength, 1)
+		So(dumped[0].UUID, ShouldEqual, pp[1].GetUUID())
+		readOnly.Stop()
+
+		after, _ := ioutil.ReadFile(filepath.Join(tmp, "patches"))
+		So(bytes.Equal(before, after), ShouldBeTrue)
+	})
+
+	Convey("Test importing a dumped PatchStore", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		tmpImport, _ := ioutil.TempDir("", "patch-store-import")
+		defer os.RemoveAll(tmpImport)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		store, err := endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		first := newTestPatch(source, target, 0, "/a", "/b")
+		moves := newTestPatch(source, target, 1)
+		moves.Enqueue(merger.NewOperation(merger.OpMoveFile, model.EventInfo{Path: "/moved"}, &tree.Node{Path: "/b", Type: tree.NodeType_LEAF, Etag: "etag"}))
+		moves.Enqueue(newTestConflict("/conflict", "left", 10, "right", 20))
+		failed := failTestPatch(newTestPatch(source, target, 2, "/c"), "import error")
+		storeAndWait(store, first, moves, failed)
+
+		buf := &bytes.Buffer{}
+		So(endpoint.DumpPatches(buf, store, 0, -1), ShouldBeNil)
+		dump := buf.String()
+
+		imported, err := endpoint.NewPatchStore(tmpImport, source, target)
+		So(err, ShouldBeNil)
+		defer imported.Stop()
+		count, err := imported.Import(strings.NewReader(dump))
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 3)
+
+		original, _ := store.Load(0, -1)
+		restored, _ := imported.Load(0, -1)
+		So(restored, ShouldHaveLength, len(original))
+		for i := range original {
+			So(endpoint.NewPatchJSON(restored[i]), ShouldResemble, endpoint.NewPatchJSON(original[i]))
+		}
+
+		// Invalid inputs are refused as a whole
+		_, err = imported.Import(strings.NewReader(`[{"uuid":"a","stamp":"2019-10-01T12:00:00Z","operations":[]},{"uuid":"a","stamp":"2019-10-01T12:00:00Z","operations":[]}]`))
+		So(err, ShouldNotBeNil)
+		_, err = imported.Import(strings.NewReader(`[{"uuid":"b","operations":[]}]`))
+		So(err, ShouldNotBeNil)
+		_, err = imported.Import(strings.NewReader(`[{"uuid":"c","stamp":"not a date","operations":[]}]`))
+		So(err, ShouldNotBeNil)
+		total, _ := imported.Load(0, -1)
+		So(total, ShouldHaveLength, 3)
+	})
+
+	Convey("Test PatchStore detects corrupted files", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		storeAndWait(store, newTestPatch(source, target, 0, "/file"))
+		store.Stop()
+
+		// Overwrite both meta pages
+		dbPath := filepath.Join(tmp, "patches")
+		f, err := os.OpenFile(dbPath, os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		f.WriteAt(bytes.Repeat([]byte{0xde, 0xad}, 8192), 0)
+		f.Close()
+
+		_, err = endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{OpenTimeout: time.Second})
+		So(err, ShouldEqual, endpoint.ErrCorruptStore)
+		_, err = os.Stat(dbPath + ".corrupt")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		recovered, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{OpenTimeout: time.Second, OnCorruption: endpoint.CorruptionBackup})
+		So(err, ShouldBeNil)
+		defer recovered.Stop()
+		patches, err := recovered.Load(0, 10)
+		So(err, ShouldBeNil)
+		So(patches, ShouldBeEmpty)
+		_, err = os.Stat(dbPath + ".corrupt")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Test PatchStore bulk storage", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		var commits []int
+		store.OnCommit = func(patches int) {
+			commits = append(commits, patches)
+		}
+
+		batch := []merger.Patch{
+			newTestPatch(source, target, 0, "/a"),
+			// Skipped: empty and previous had no errors
+			newTestPatch(source, target, 1),
+			failTestPatch(newTestPatch(source, target, 2), "batch error"),
+			// Kept: empty but previous had errors
+			newTestPatch(source, target, 3),
+		}
+		So(store.StoreBatch(batch), ShouldBeNil)
+		So(commits, ShouldResemble, []int{3})
+
+		patches, err := store.Load(0, 10)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 3)
+		So(patches[0].GetUUID(), ShouldEqual, batch[3].GetUUID())
+		So(patches[1].GetUUID(), ShouldEqual, batch[2].GetUUID())
+		So(patches[2].GetUUID(), ShouldEqual, batch[0].GetUUID())
+
+		// Last patch had no errors: next empty patch is skipped again
+		So(store.StoreBatch([]merger.Patch{newTestPatch(source, target, 4)}), ShouldBeNil)
+		patches, _ = store.Load(0, 10)
+		So(patches, ShouldHaveLength, 3)
+
+		store.Stop()
+		So(store.StoreBatch(batch), ShouldEqual, endpoint.ErrStoreClosed)
+	})
+
+	Convey("Test PatchStore in NoSync mode", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{NoSync: true})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for i := 0; i < 5; i++ {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		storeAndWait(store, pp...)
+		patches, err := store.Load(0, 10)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 5)
+		patch, err := store.Get(pp[2].GetUUID())
+		So(err, ShouldBeNil)
+		So(patch.Size(), ShouldEqual, 1)
+	})
+
+	Convey("Test PatchStore persists patch durations", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		timed := endpoint.WithDuration(newTestPatch(source, target, 0, "/timed"), 4200*time.Millisecond)
+		legacy := newTestPatch(source, target, 1, "/legacy")
+		storeAndWait(store, timed, legacy)
+
+		patch, err := store.Get(timed.GetUUID())
+		So(err, ShouldBeNil)
+		So(endpoint.PatchDuration(patch), ShouldEqual, 4200*time.Millisecond)
+		So(endpoint.NewPatchJSON(patch).DurationMs, ShouldEqual, 4200)
+
+		// Records without duration report zero
+		patch, err = store.Get(legacy.GetUUID())
+		So(err, ShouldBeNil)
+		So(endpoint.PatchDuration(patch), ShouldEqual, 0)
+		So(endpoint.WithDuration(patch, 0), ShouldEqual, patch)
+	})
+
+	Convey("Test PatchStore excludes paths from history", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{ExcludeFromHistory: []string{"/private/"}})
+		defer cleanup()
+
+		patch := newTestPatch(source, target, 0, "/public", "/private", "/private/secret", "/private-not")
+		failed := newTestPatch(source, target, 1)
+		failedOp := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/private/failed"}, &tree.Node{Path: "/private/failed", Type: tree.NodeType_LEAF})
+		failedOp.Error(fmt.Errorf("secret error"))
+		failed.Enqueue(failedOp)
+		storeAndWait(store, patch, failed)
+
+		loaded, err := store.Get(patch.GetUUID())
+		So(err, ShouldBeNil)
+		So(loaded.GetStamp().Equal(patch.GetStamp()), ShouldBeTrue)
+		var paths []string
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			paths = append(paths, op.GetRefPath())
+		})
+		So(paths, ShouldResemble, []string{"/private-not", "/public"})
+
+		loaded, err = store.Get(failed.GetUUID())
+		So(err, ShouldBeNil)
+		So(loaded.Size(), ShouldEqual, 0)
+		_, has := loaded.HasErrors()
+		So(has, ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore splits large patches into chunks", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxOperationsPerPatch: 100})
+		defer cleanup()
+
+		var paths []string
+		for i := 0; i < 250; i++ {
+			paths = append(paths, fmt.Sprintf("/file-%03d", i))
+		}
+		patch := newTestPatch(source, target, 0, paths...)
+		So(store.StoreBatch([]merger.Patch{patch}), ShouldBeNil)
+
+		chunks, err := store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(chunks, ShouldHaveLength, 3)
+		sizes := map[int]int{}
+		for _, chunk := range chunks {
+			So(chunk.GetUUID(), ShouldNotEqual, patch.GetUUID())
+			So(endpoint.PatchBatch(chunk), ShouldEqual, patch.GetUUID())
+			So(chunk.GetStamp().Equal(patch.GetStamp()), ShouldBeTrue)
+			sizes[chunk.Size()]++
+		}
+		So(sizes, ShouldResemble, map[int]int{100: 2, 50: 1})
+
+		grouped, err := store.LoadGrouped(0, -1)
+		So(err, ShouldBeNil)
+		So(grouped, ShouldHaveLength, 1)
+		So(grouped[0].GetUUID(), ShouldEqual, patch.GetUUID())
+		So(grouped[0].Size(), ShouldEqual, 250)
+		for _, chunk := range chunks {
+			So(chunk.GetUUID(), ShouldEqual, endpoint.ChunkUUID(patch.GetUUID(), chunk.(*endpoint.BatchedPatch).ChunkIndex()))
+		}
+
+		// Storing the batch again replaces its chunks
+		shorter := newTestPatch(source, target, 0, paths[:150]...)
+		shorter.SetUUID(patch.GetUUID())
+		So(store.StoreBatch([]merger.Patch{shorter}), ShouldBeNil)
+		chunks, err = store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(chunks, ShouldHaveLength, 2)
+		unsplit := newTestPatch(source, target, 0, paths[:30]...)
+		unsplit.SetUUID(patch.GetUUID())
+		So(store.StoreBatch([]merger.Patch{unsplit}), ShouldBeNil)
+		chunks, err = store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(chunks, ShouldHaveLength, 1)
+		So(chunks[0].GetUUID(), ShouldEqual, patch.GetUUID())
+		So(chunks[0].Size(), ShouldEqual, 30)
+
+		// Small patches are stored as is
+		small := newTestPatch(source, target, 1, "/small")
+		So(store.StoreBatch([]merger.Patch{small}), ShouldBeNil)
+		loaded, err := store.Get(small.GetUUID())
+		So(err, ShouldBeNil)
+		So(endpoint.PatchBatch(loaded), ShouldEqual, "")
+		grouped, err = store.LoadGrouped(0, 1)
+		So(err, ShouldBeNil)
+		So(grouped, ShouldHaveLength, 1)
+		So(grouped[0].GetUUID(), ShouldEqual, small.GetUUID())
+	})
+
+	Convey("Test PatchStore uses the injected clock", t, func() {
+		clock := &fakeClock{now: testStampBase}
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{Clock: clock})
+		defer cleanup()
+
+		unstamped := newTestPatch(source, target, 0, "/unstamped")
+		unstamped.Stamp(time.Time{})
+		clock.Add(time.Hour)
+		So(store.StoreBatch([]merger.Patch{unstamped}), ShouldBeNil)
+		clock.Add(time.Hour)
+
+		loaded, err := store.Get(unstamped.GetUUID())
+		So(err, ShouldBeNil)
+		So(loaded.GetStamp().Equal(testStampBase.Add(time.Hour)), ShouldBeTrue)
+
+		stamped := newTestPatch(source, target, 5, "/stamped")
+		So(store.StoreBatch([]merger.Patch{stamped}), ShouldBeNil)
+		loaded, err = store.Get(stamped.GetUUID())
+		So(err, ShouldBeNil)
+		So(loaded.GetStamp().Equal(testStampBase.Add(5*time.Minute)), ShouldBeTrue)
+	})
+
+	Convey("Test PatchStore prunes patches by age", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		clock := &fakeClock{now: testStampBase.Add(40 * 24 * time.Hour)}
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{
+			MaxPatchAge: 30 * 24 * time.Hour,
+			Clock:       clock,
+		})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+
+		// Patches stamped 0, 5, 15 and 25 days after the base are 40, 35, 25 and 15 days old
+		var patches []merger.Patch
+		for _, days := range []int{0, 5, 15, 25} {
+			patch := newTestPatch(source, target, 0, fmt.Sprintf("/day-%d", days))
+			patch.Stamp(testStampBase.Add(time.Duration(days) * 24 * time.Hour))
+			patches = append(patches, patch)
+		}
+		So(store.StoreBatch(patches), ShouldBeNil)
+		remaining, err := store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(remaining, ShouldHaveLength, 2)
+		So(remaining[0].GetUUID(), ShouldEqual, patches[3].GetUUID())
+		So(remaining[1].GetUUID(), ShouldEqual, patches[2].GetUUID())
+
+		// Time passes: the oldest remaining patch expires
+		clock.Add(10 * 24 * time.Hour)
+		removed, err := store.Prune()
+		So(err, ShouldBeNil)
+		So(removed, ShouldEqual, 1)
+
+		Convey("Test age and count limits are both applied", func() {
+			store.MaxStoredPatches = 2
+			var recent []merger.Patch
+			for i := 0; i < 3; i++ {
+				patch := newTestPatch(source, target, 0, fmt.Sprintf("/recent-%d", i))
+				patch.Stamp(clock.Now().Add(-time.Duration(i) * time.Hour))
+				recent = append(recent, patch)
+			}
+			So(store.StoreBatch(recent), ShouldBeNil)
+			remaining, err := store.Load(0, -1)
+			So(err, ShouldBeNil)
+			So(remaining, ShouldHaveLength, 2)
+			So(remaining[0].GetUUID(), ShouldEqual, recent[0].GetUUID())
+			So(remaining[1].GetUUID(), ShouldEqual, recent[1].GetUUID())
+		})
+	})
+
+	Convey("Test PatchStore stored patch callback", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		var stored []string
+		var failed []bool
+		store.OnPatchStored = func(patch merger.Patch) {
+			_, has := patch.HasErrors()
+			stored = append(stored, patch.GetUUID())
+			failed = append(failed, has)
+		}
+		clean := newTestPatch(source, target, 0, "/clean")
+		failing := failTestPatch(newTestPatch(source, target, 1, "/failing"), "failed")
+		// Empty patches are not stored, so they are not reported
+		empty := newTestPatch(source, target, 2)
+		cleanAgain := newTestPatch(source, target, 3, "/clean-again")
+		storeAndWait(store, clean, failing, cleanAgain, empty)
+
+		So(stored, ShouldResemble, []string{clean.GetUUID(), failing.GetUUID(), cleanAgain.GetUUID()})
+		So(failed, ShouldResemble, []bool{false, true, false})
+	})
+
+	Convey("Test PatchStore pending sends do not hold the store lock", t, func() {
+		sizes := func() (int64, int64, error) { return 1, 1, nil }
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{CompactThreshold: 10, SizeSource: sizes})
+		defer cleanup()
+
+		entered, release := make(chan bool, 1), make(chan bool)
+		store.OnPatchStored = func(patch merger.Patch) {
+			select {
+			case entered <- true:
+			default:
+			}
+			<-release
+		}
+		So(store.Store(newTestPatch(source, target, 0, "/first")), ShouldBeNil)
+		<-entered
+		// This send waits for the callback to return
+		go store.Store(newTestPatch(source, target, 1, "/second"))
+		<-time.After(50 * time.Millisecond)
+
+		maintained := make(chan bool)
+		go func() {
+			store.MaintainOnce()
+			close(maintained)
+		}()
+		select {
+		case <-maintained:
+		case <-time.After(time.Second):
+			So("MaintainOnce blocked by a pending Store", ShouldBeEmpty)
+		}
+		close(release)
+		store.Flush()
+	})
+
+	Convey("Test PatchStore lists nodes failing since the last success", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		failingPatch := func(i int, ok []string, failed map[string]string) merger.Patch {
+			patch := newTestPatch(source, target, i, ok...)
+			for p, msg := range failed {
+				op := merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_LEAF})
+				op.Error(errors.New(msg))
+				patch.Enqueue(op)
+			}
+			return failTestPatch(patch, "some operations failed")
+		}
+		older := failingPatch(0, nil, map[string]string{"/old": "before last success"})
+		success := newTestPatch(source, target, 1, "/ok")
+		p2 := failingPatch(2, nil, map[string]string{"/a": "error a1", "/b": "error b"})
+		p3 := failingPatch(3, nil, map[string]string{"/a": "error a2", "/c": "error c"})
+		p4 := failingPatch(4, []string{"/c"}, map[string]string{"/a": "error a3"})
+		So(store.StoreBatch([]merger.Patch{older, success, p2, p3, p4}), ShouldBeNil)
+
+		failing, err := store.FailingSinceLastSuccess()
+		So(err, ShouldBeNil)
+		So(failing, ShouldHaveLength, 2)
+
+		So(failing[0].Path, ShouldEqual, "/a")
+		So(failing[0].Failures, ShouldEqual, 3)
+		So(failing[0].Since.Equal(p2.GetStamp()), ShouldBeTrue)
+		So(failing[0].Last.Equal(p4.GetStamp()), ShouldBeTrue)
+		So(failing[0].LastError, ShouldEqual, "error a3")
+		So(failing[0].Patches, ShouldResemble, []string{p4.GetUUID(), p3.GetUUID(), p2.GetUUID()})
+
+		// "/c" was applied successfully afterwards, "/old" failed before the last success
+		So(failing[1].Path, ShouldEqual, "/b")
+		So(failing[1].Failures, ShouldEqual, 1)
+		So(failing[1].LastError, ShouldEqual, "error b")
+
+		Convey("Test nothing is reported after a successful patch", func() {
+			So(store.StoreBatch([]merger.Patch{newTestPatch(source, target, 5, "/a", "/b")}), ShouldBeNil)
+			failing, err := store.FailingSinceLastSuccess()
+			So(err, ShouldBeNil)
+			So(failing, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Test PatchStore without endpoints", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+
+		_, err := endpoint.NewPatchStore(tmp, nil, target)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "MetadataOnly")
+		_, err = endpoint.NewPatchStore(tmp, source, nil)
+		So(err, ShouldNotBeNil)
+
+		store, err := endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		patch := failTestPatch(newTestPatch(source, target, 0, "/file"), "failed")
+		So(store.StoreBatch([]merger.Patch{patch}), ShouldBeNil)
+		store.Stop()
+
+		inspect, err := endpoint.NewPatchStoreWithOptions(tmp, nil, nil, endpoint.PatchStoreOptions{MetadataOnly: true})
+		So(err, ShouldBeNil)
+		defer inspect.Stop()
+		patches, err := inspect.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+		So(patches[0].GetUUID(), ShouldEqual, patch.GetUUID())
+		So(patches[0].Source(), ShouldBeNil)
+		So(patches[0].Target(), ShouldBeNil)
+		pj := endpoint.NewPatchJSON(patches[0])
+		So(pj.Operations, ShouldHaveLength, 1)
+		So(pj.Errors, ShouldResemble, []string{"failed"})
+
+		// Metadata-only stores are read-only
+		So(inspect.Store(newTestPatch(source, target, 1, "/other")), ShouldEqual, endpoint.ErrReadOnlyStore)
+	})
+
+	Convey("Test PatchStore automatic compaction", t, func() {
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		clock := &fakeClock{now: testStampBase}
+		fileSize, liveSize := int64(100), int64(80)
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{
+			CompactThreshold:     2,
+			CompactCheckInterval: time.Hour,
+			CompactMinInterval:   time.Hour,
+			Clock:                clock,
+			SizeSource: func() (int64, int64, error) {
+				return fileSize, liveSize, nil
+			},
+		})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		So(store.StoreBatch([]merger.Patch{newTestPatch(source, target, 0, "/before")}), ShouldBeNil)
+
+		compacted, err := store.MaintainOnce()
+		So(err, ShouldBeNil)
+		So(compacted, ShouldBeFalse)
+
+		fileSize = 300
+		compacted, err = store.MaintainOnce()
+		So(err, ShouldBeNil)
+		So(compacted, ShouldBeTrue)
+
+		// Minimum interval between two compactions
+		clock.Add(30 * time.Minute)
+		compacted, err = store.MaintainOnce()
+		So(err, ShouldBeNil)
+		So(compacted, ShouldBeFalse)
+		clock.Add(time.Hour)
+		compacted, err = store.MaintainOnce()
+		So(err, ShouldBeNil)
+		So(compacted, ShouldBeTrue)
+
+		// The store is still usable after compaction
+		So(store.StoreBatch([]merger.Patch{newTestPatch(source, target, 1, "/after")}), ShouldBeNil)
+		patches, err := store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 2)
+
+		Convey("Test automatic compaction is disabled by default", func() {
+			tmp2, _ := ioutil.TempDir("", "patch-store")
+			defer os.RemoveAll(tmp2)
+			disabled, err := endpoint.NewPatchStoreWithOptions(tmp2, source, target, endpoint.PatchStoreOptions{
+				SizeSource: func() (int64, int64, error) {
+					return 1000, 1, nil
+				},
+			})
+			So(err, ShouldBeNil)
+			defer disabled.Stop()
+			compacted, err := disabled.MaintainOnce()
+			So(err, ShouldBeNil)
+			So(compacted, ShouldBeFalse)
+		})
+	})
+
+	Convey("Test patch wire format", t, func() {
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		patch := newTestPatch(source, target, 0, "/created")
+		failed := merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/failed"}, &tree.Node{Path: "/failed", Type: tree.NodeType_LEAF, Uuid: "failed-uuid", Etag: "etag", Size: 12, MTime: 10})
+		failed.Error(fmt.Errorf("cannot update"))
+		patch.Enqueue(failed)
+		patch.Enqueue(merger.NewOperation(merger.OpMoveFolder, model.EventInfo{Path: "/moved"}, &tree.Node{Path: "/origin", Type: tree.NodeType_COLLECTION, Uuid: "folder"}))
+		patch.Enqueue(newTestConflict("/conflict", "left", 10, "right", 20))
+
+		dto := endpoint.NewPatchDTO(patch)
+		So(dto.Version, ShouldEqual, endpoint.DTOVersion)
+		So(dto.Operations, ShouldHaveLength, 4)
+		data, err := json.Marshal(dto)
+		So(err, ShouldBeNil)
+
+		// Keys are the documented ones, whatever the merger internals
+		keysOf := func(v interface{}) []string {
+			var keys []string
+			for k := range v.(map[string]interface{}) {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return keys
+		}
+		var raw map[string]interface{}
+		So(json.Unmarshal(data, &raw), ShouldBeNil)
+		for _, k := range []string{"version", "uuid", "stamp", "errors", "operations"} {
+			So(keysOf(raw), ShouldContain, k)
+		}
+		rawOps := map[string]interface{}{}
+		for _, o := range raw["operations"].([]interface{}) {
+			rawOps[o.(map[string]interface{})["path"].(string)] = o
+		}
+		So(keysOf(rawOps["/failed"]), ShouldResemble, []string{"error", "etag", "mtime", "nodeType", "path", "size", "type", "uuid"})
+		So(keysOf(rawOps["/moved"]), ShouldResemble, []string{"from", "nodeType", "path", "type", "uuid"})
+		rawConflict := rawOps["/conflict"].(map[string]interface{})["conflict"]
+		So(keysOf(rawConflict), ShouldResemble, []string{"left", "right", "type"})
+		So(rawConflict.(map[string]interface{})["type"], ShouldEqual, "file-content")
+
+		// Round trip through the merger types
+		var decoded endpoint.PatchDTO
+		So(json.Unmarshal(data, &decoded), ShouldBeNil)
+		for i, oj := range decoded.Operations {
+			op, err := oj.Operation()
+			So(err, ShouldBeNil)
+			So(endpoint.NewOperationDTO(op), ShouldResemble, dto.Operations[i])
+		}
+
+		Convey("Test DTOCodec reads legacy values", func() {
+			legacy, err := endpoint.JSONCodec{}.Marshal(failed)
+			So(err, ShouldBeNil)
+			op, err := endpoint.DTOCodec{}.Unmarshal(legacy)
+			So(err, ShouldBeNil)
+			So(op.GetRefPath(), ShouldEqual, "/failed")
+			So(op.GetStatus().Error().Error(), ShouldEqual, "cannot update")
+
+			stored, err := endpoint.DTOCodec{}.Marshal(failed)
+			So(err, ShouldBeNil)
+			So(string(stored), ShouldContainSubstring, `"version":1`)
+			_, err = endpoint.DTOCodec{}.Unmarshal([]byte(`{"version":99,"type":"create_file","path":"/future"}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Test patch summary", t, func() {
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		patch := newTestPatch(source, target, 0)
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/a"}, &tree.Node{Path: "/a", Type: tree.NodeType_LEAF, Size: 10}))
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/b"}, &tree.Node{Path: "/b", Type: tree.NodeType_LEAF, Size: 20}))
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFolder, model.EventInfo{Path: "/folder"}, &tree.Node{Path: "/folder", Type: tree.NodeType_COLLECTION}))
+		patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/c"}, &tree.Node{Path: "/c", Type: tree.NodeType_LEAF, Size: 5}))
+		patch.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/d"}, &tree.Node{Path: "/d", Type: tree.NodeType_LEAF, Size: 100}))
+		patch.Enqueue(newTestConflict("/e", "left", 10, "right", 20))
+		patch.Enqueue(newTestConflict("/f", "left", 10, "right", 20))
+
+		summary := endpoint.SummarizePatch(patch)
+		So(summary.Counts[merger.OpCreateFile], ShouldEqual, 2)
+		So(summary.Counts[merger.OpCreateFolder], ShouldEqual, 1)
+		So(summary.Counts[merger.OpUpdateFile], ShouldEqual, 1)
+		So(summary.Counts[merger.OpDelete], ShouldEqual, 1)
+		So(summary.Counts[merger.OpMoveFile], ShouldEqual, 0)
+		So(summary.Conflicts, ShouldEqual, 2)
+		So(summary.Total(), ShouldEqual, 7)
+		So(summary.Bytes, ShouldEqual, 35)
+		So(summary.String(), ShouldEqual, "3 created, 1 updated, 1 deleted, 2 conflicts")
+
+		So(endpoint.SummarizePatch(newTestPatch(source, target, 0)).String(), ShouldEqual, "no changes")
+		So(endpoint.SummarizePatch(newTestPatch(source, target, 0, "/x")).String(), ShouldEqual, "1 created")
+	})
+
+	Convey("Test PatchStore deterministic UUIDs", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{DeterministicUUIDs: true})
+		defer cleanup()
+
+		first := newTestPatch(source, target, 0, "/a", "/b")
+		second := newTestPatch(source, target, 1, "/b", "/a")
+		So(first.GetUUID(), ShouldNotEqual, second.GetUUID())
+		So(endpoint.ContentUUID(first), ShouldEqual, endpoint.ContentUUID(second))
+		storeAndWait(store, first)
+		storeAndWait(store, second)
+
+		patches, err := store.Load(0, -1)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+		So(patches[0].GetUUID(), ShouldEqual, endpoint.ContentUUID(first))
+		So(patches[0].GetStamp().Equal(second.GetStamp()), ShouldBeTrue)
+
+		other := newTestPatch(source, target, 2, "/a", "/c")
+		So(store.StoreBatch([]merger.Patch{other}), ShouldBeNil)
+		patches, _ = store.Load(0, -1)
+		So(patches, ShouldHaveLength, 2)
+	})
+
+	Convey("Test PatchStore streams patches one at a time", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		var pp []merger.Patch
+		for _, i := range []int{3, 0, 4, 1, 2} {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		So(store.StoreBatch(pp), ShouldBeNil)
+
+		var visited []string
+		err := store.StreamPatches(context.Background(), func(patch merger.Patch) error {
+			visited = append(visited, patch.GetStamp().Sub(testStampBase).String())
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(visited, ShouldResemble, []string{"4m0s", "3m0s", "2m0s", "1m0s", "0s"})
+
+		// Early abort
+		stop := fmt.Errorf("enough")
+		visited = nil
+		err = store.StreamPatches(context.Background(), func(patch merger.Patch) error {
+			visited = append(visited, patch.GetUUID())
+			if len(visited) == 2 {
+				return stop
+			}
+			return nil
+		})
+		So(err, ShouldEqual, stop)
+		So(visited, ShouldHaveLength, 2)
+
+		// The store can be used while streaming
+		visited = nil
+		err = store.StreamPatches(context.Background(), func(patch merger.Patch) error {
+			visited = append(visited, patch.GetUUID())
+			if len(visited) == 1 {
+				return store.Delete(pp[1].GetUUID())
+			}
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(visited, ShouldHaveLength, 4)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		So(store.StreamPatches(ctx, func(merger.Patch) error { return nil }), ShouldEqual, context.Canceled)
+	})
+
+	Convey("Test PatchStore stamp index follows stored patches", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxStoredPatches: 6})
+		defer cleanup()
+
+		var pp []merger.Patch
+		for _, i := range []int{4, 0, 9, 2, 7, 5, 1, 8} {
+			pp = append(pp, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+		}
+		// Pruning after each write already removed the two oldest patches
+		storeAndWait(store, pp...)
+		So(store.Delete(pp[0].GetUUID()), ShouldBeNil)
+		// Storing a patch again with a new stamp moves it in the index
+		pp[3].Stamp(testStampBase.Add(20 * time.Minute))
+		storeAndWait(store, pp[3])
+
+		uuids := func(patches []merger.Patch) (ids []string) {
+			for _, p := range patches {
+				ids = append(ids, p.GetUUID())
+			}
+			return
+		}
+		// LoadFiltered does not use the index
+		scanned, e := store.LoadFiltered(0, -1, []merger.OperationType{merger.OpCreateFile})
+		So(e, ShouldBeNil)
+		So(scanned, ShouldHaveLength, 5)
+		So(scanned[0].GetUUID(), ShouldEqual, pp[3].GetUUID())
+		indexed, e := store.Load(0, -1)
+		So(e, ShouldBeNil)
+		So(uuids(indexed), ShouldResemble, uuids(scanned))
+		page, total, e := store.LoadWithTotal(2, 3)
+		So(e, ShouldBeNil)
+		So(total, ShouldEqual, 5)
+		So(uuids(page), ShouldResemble, uuids(scanned[2:5]))
+		oldest, e := store.LoadSorted(0, 2, endpoint.SortOldestFirst)
+		So(e, ShouldBeNil)
+		So(uuids(oldest), ShouldResemble, []string{scanned[4].GetUUID(), scanned[3].GetUUID()})
+		store.Stop()
+
+		db, err := bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		db.View(func(tx *bbolt.Tx) error {
+			patches := tx.Bucket([]byte("patches"))
+			var keys int
+			tx.Bucket([]byte("stamps")).ForEach(func(k, v []byte) error {
+				keys++
+				So(patches.Bucket(k[8:]), ShouldNotBeNil)
+				return nil
+			})
+			So(keys, ShouldEqual, 5)
+			return nil
+		})
+	})
+
+	Convey("Test PatchStore finds operations by path glob", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		older := newTestPatch(source, target, 0, "/docs/report.pdf", "/docs/2019/notes.txt")
+		newer := newTestPatch(source, target, 1, "/docs/2019/q1/summary.pdf", "/other/docs/scan.pdf", "/docs.pdf")
+		storeAndWait(store, older, newer)
+
+		refs, e := store.LoadOperationsMatching("docs/**/*.pdf")
+		So(e, ShouldBeNil)
+		So(refs, ShouldHaveLength, 2)
+		So(refs[0].PatchUUID, ShouldEqual, newer.GetUUID())
+		So(refs[0].Stamp.Equal(newer.GetStamp()), ShouldBeTrue)
+		So(refs[0].Operation.GetRefPath(), ShouldEqual, "/docs/2019/q1/summary.pdf")
+		So(refs[1].PatchUUID, ShouldEqual, older.GetUUID())
+		So(refs[1].Operation.GetRefPath(), ShouldEqual, "/docs/report.pdf")
+
+		// A single star does not cross folders
+		refs, e = store.LoadOperationsMatching("/docs/*")
+		So(e, ShouldBeNil)
+		So(refs, ShouldHaveLength, 1)
+		So(refs[0].Operation.GetRefPath(), ShouldEqual, "/docs/report.pdf")
+
+		refs, e = store.LoadOperationsMatching("**/docs/**")
+		So(e, ShouldBeNil)
+		So(refs, ShouldHaveLength, 4)
+
+		refs, e = store.LoadOperationsMatching("archive/**")
+		So(e, ShouldBeNil)
+		So(refs, ShouldBeEmpty)
+	})
+
+	Convey("Test PatchStore loads patches without operations bucket", t, func() {
+		tmp, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		partial := newTestPatch(source, target, 0, "/partial")
+		complete := newTestPatch(source, target, 1, "/complete")
+		storeAndWait(store, partial, complete)
+		store.Stop()
+
+		// Remove the operations of the first patch, as an interrupted write would
+		db, err := bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(err, ShouldBeNil)
+		So(db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("patches")).Bucket([]byte(partial.GetUUID())).DeleteBucket([]byte("operations"))
+		}), ShouldBeNil)
+		db.Close()
+
+		store, err = endpoint.NewPatchStore(tmp, source, target)
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		var patches []merger.Patch
+		So(func() { patches, err = store.Load(0, -1) }, ShouldNotPanic)
+		So(err, ShouldBeNil)
+		So(patches, ShouldHaveLength, 2)
+		So(patches[0].Size(), ShouldEqual, 1)
+		So(patches[1].GetUUID(), ShouldEqual, partial.GetUUID())
+		So(patches[1].Size(), ShouldEqual, 0)
+	})
+
+	Convey("Test PatchStore lists errored patches only", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		e1 := failTestPatch(newTestPatch(source, target, 1, "/e1"), "first failure")
+		e3 := failTestPatch(newTestPatch(source, target, 3, "/e3"), "second failure")
+		e4 := failTestPatch(newTestPatch(source, target, 4, "/e4"), "third failure")
+		storeAndWait(store, e3, newTestPatch(source, target, 0, "/c0"), e1, newTestPatch(source, target, 2, "/c2"), e4, newTestPatch(source, target, 5, "/c5"))
+
+		uuids := func(patches []merger.Patch) (ids []string) {
+			for _, p := range patches {
+				ids = append(ids, p.GetUUID())
+			}
+			return
+		}
+		patches, e := store.LoadErrored(0, -1)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{e4.GetUUID(), e3.GetUUID(), e1.GetUUID()})
+		for _, p := range patches {
+			_, has := p.HasErrors()
+			So(has, ShouldBeTrue)
+		}
+		patches, e = store.LoadErrored(1, 1)
+		So(e, ShouldBeNil)
+		So(uuids(patches), ShouldResemble, []string{e3.GetUUID()})
+	})
+
+	Convey("Test PatchStore stores the net effect of redundant operations", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		patch := newTestPatch(source, target, 0, "/b")
+		leaf := func(p, etag string) *tree.Node {
+			return &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: etag}
+		}
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/a"}, leaf("/a", "v1")))
+		patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/a"}, leaf("/a", "v2")))
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/transient"}, leaf("/transient", "t")))
+		patch.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/transient"}, leaf("/transient", "")))
+		storeAndWait(store, patch)
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		etags := make(map[string]string)
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			etags[op.Type().String()+" "+op.GetRefPath()] = op.GetNode().GetEtag()
+		})
+		So(etags, ShouldResemble, map[string]string{
+			merger.OpCreateFile.String() + " /a":         "v2",
+			merger.OpCreateFile.String() + " /b":         "",
+			merger.OpCreateFile.String() + " /transient": "t",
+			merger.OpDelete.String() + " /transient":     "",
+		})
+	})
+
+	Convey("Test PatchStore explains why each operation exists", t, func() {
+		ctx := context.Background()
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+		leaf := func(p, etag string, size int64) *tree.Node {
+			return &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: etag, Size: size}
+		}
+		for _, n := range []*tree.Node{leaf("/updated", "v1", 5), leaf("/resized", "", 5), leaf("/deleted", "d", 1), leaf("/same", "s", 1)} {
+			So(target.CreateNode(ctx, n, true), ShouldBeNil)
+		}
+
+		patch := newTestPatch(source, target, 0, "/created")
+		patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/updated"}, leaf("/updated", "v2", 5)))
+		patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/resized"}, leaf("/resized", "", 10)))
+		patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/same"}, leaf("/same", "s", 1)))
+		patch.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: "/deleted"}, leaf("/deleted", "d", 1)))
+		// Reasons are computed before the patch is applied
+		storeAndWait(store, endpoint.WithDuration(endpoint.ExplainPatch(ctx, patch), time.Second))
+
+		loaded, e := store.Get(patch.GetUUID())
+		So(e, ShouldBeNil)
+		So(endpoint.PatchDuration(loaded), ShouldEqual, time.Second)
+		reasons := make(map[string]endpoint.OperationReason)
+		loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			if reason, ok := endpoint.OperationReasonOf(loaded, op); ok {
+				reasons[op.GetRefPath()] = reason
+			}
+		})
+		// Both sides of /same look the same: no reason is made up
+		So(reasons, ShouldHaveLength, 4)
+		for _, r := range reasons {
+			So(r.Endpoint, ShouldEqual, source.GetEndpointInfo().URI)
+		}
+		So(reasons["/created"].Comparison, ShouldEqual, endpoint.ComparisonExistence)
+		So(reasons["/updated"].Comparison, ShouldEqual, endpoint.ComparisonHash)
+		So(reasons["/updated"].String(), ShouldEqual, "updated because source hash differs")
+		So(reasons["/resized"].Comparison, ShouldEqual, endpoint.ComparisonSize)
+		So(reasons["/deleted"].Comparison, ShouldEqual, endpoint.ComparisonExistence)
+		So(reasons["/deleted"].Detail, ShouldContainSubstring, "deleted")
+
+		dto := endpoint.NewPatchDTO(loaded)
+		for _, op := range dto.Operations {
+			if op.Path == "/same" {
+				So(op.Reason, ShouldBeNil)
+				continue
+			}
+			So(op.Reason, ShouldNotBeNil)
+			So(op.Reason.Comparison, ShouldEqual, reasons[op.Path].Comparison)
+		}
+
+		Convey("Test merged creations keep the reason of the original creation", func() {
+			merged := newTestPatch(source, target, 2, "/merged")
+			merged.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: "/merged"}, leaf("/merged", "m2", 3)))
+			storeAndWait(store, endpoint.ExplainPatch(ctx, merged))
+			loaded, e := store.Get(merged.GetUUID())
+			So(e, ShouldBeNil)
+			var ops []merger.Operation
+			loaded.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+				ops = append(ops, op)
+			})
+			So(ops, ShouldHaveLength, 1)
+			So(ops[0].Type(), ShouldEqual, merger.OpCreateFile)
+			So(ops[0].GetNode().Etag, ShouldEqual, "m2")
+			reason, ok := endpoint.OperationReasonOf(loaded, ops[0])
+			So(ok, ShouldBeTrue)
+			So(reason.Comparison, ShouldEqual, endpoint.ComparisonExistence)
+		})
+
+		Convey("Test patches stored without reasons have none", func() {
+			plain := newTestPatch(source, target, 1, "/plain")
+			storeAndWait(store, plain)
+			loaded, e := store.Get(plain.GetUUID())
+			So(e, ShouldBeNil)
+			So(endpoint.NewPatchDTO(loaded).Operations[0].Reason, ShouldBeNil)
+			_, ok := endpoint.OperationReasonOf(patch, merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/created"}, &tree.Node{Path: "/created"}))
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Test PatchStore last error status is safe for concurrent use", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{})
+		defer cleanup()
+
+		done := make(chan bool)
+		wg := &sync.WaitGroup{}
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						store.LastHadErrors()
+					}
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			patch := newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i))
+			if i%2 == 0 {
+				patch = failTestPatch(patch, "failed")
+			}
+			store.Store(patch)
+		}
+		// Stop waits for all queued patches to be written
+		store.Stop()
+		close(done)
+		wg.Wait()
+		So(store.LastHadErrors(), ShouldBeFalse)
+	})
+
+	Convey("Test PatchStore labels patches", t, func() {
+		_, source, target, store, cleanup := newTestStore(endpoint.PatchStoreOptions{MaxOperationsPerPatch: 2})
+		defer cleanup()
+
+		nightly := newTestPatch(source, target, 1, "/nightly")
+		plain := newTestPatch(source, target, 2, "/plain")
+		migration := newTestPatch(source, target, 3, "/a", "/b", "/c")
+		empty := newTestPatch(source, target, 4)
+		So(store.StoreLabeled(nightly, "nightly"), ShouldBeNil)
+		So(store.Store(plain), ShouldBeNil)
+		So(store.StoreLabeled(endpoint.WithDuration(migration, time.Second), "before migration"), ShouldBeNil)
+		So(store.StoreLabeled(empty, "nightly"), ShouldBeNil)
+		store.Flush()
+
+		loaded, e := store.Get(nightly.GetUUID())
+		So(e, ShouldBeNil)
+		So(endpoint.PatchLabel(loaded), ShouldEqual, "nightly")
+		So(endpoint.NewPatchDTO(loaded).Label, ShouldEqual, "nightly")
+		loaded, e = store.Get(plain.GetUUID())
+		So(e, ShouldBeNil)
+		So(endpoint.PatchLabel(loaded), ShouldBeEmpty)
+
+		// The split patch keeps its label and duration once its chunks are merged back
+		patches, e := store.LoadGrouped(0, -1)
+		So(e, ShouldBeNil)
+		labels := make(map[string]string)
+		for _, p := range patches {
+			labels[p.GetUUID()] = endpoint.PatchLabel(p)
+		}
+		So(labels[migration.GetUUID()], ShouldEqual, "before migration")
+		for _, p := range patches {
+			if p.GetUUID() == migration.GetUUID() {
+				So(p.Size(), ShouldEqual, 3)
+				So(endpoint.PatchDuration(p), ShouldEqual, time.Second)
+			}
+		}
+
+		uuids := func(patches []merger.Patch) (ids []string) {
+			for _, p := range patches {
+				ids = append(ids, p.GetUUID())
+			}
+			return
+		}
+		// Empty labeled patches are kept, newest first
+		byLabel, e := store.LoadByLabel("nightly")
+		So(e, ShouldBeNil)
+		So(uuids(byLabel), ShouldResemble, []string{empty.GetUUID(), nightly.GetUUID()})
+		byLabel, e = store.LoadByLabel("unknown")
+		So(e, ShouldBeNil)
+		So(byLabel, ShouldBeEmpty)
+		byLabel, e = store.LoadByLabel("")
+		So(e, ShouldBeNil)
+		So(uuids(byLabel), ShouldResemble, []string{plain.GetUUID()})
+	})
+
+}
+
+func benchmarkPatchStore(b *testing.B, opts endpoint.PatchStoreOptions) {
+	tmp, _ := ioutil.TempDir("", "patch-store")
+	defer os.RemoveAll(tmp)
+	source, target := memory.NewMemDB(), memory.NewMemDB()
+	opts.MaxStoredPatches = -1
+	store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Store(newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+	}
+	// Stop waits for all queued patches to be written
+	store.Stop()
+}
+
+func BenchmarkPatchStoreNoBatch(b *testing.B) {
+	benchmarkPatchStore(b, endpoint.PatchStoreOptions{})
+}
+
+func BenchmarkPatchStoreBatch(b *testing.B) {
+	benchmarkPatchStore(b, endpoint.PatchStoreOptions{BatchWindow: 10 * time.Millisecond})
+}
+
+func BenchmarkPatchStoreNoSync(b *testing.B) {
+	benchmarkPatchStore(b, endpoint.PatchStoreOptions{NoSync: true})
+}
+
+func BenchmarkPatchStoreLoadPage(b *testing.B) {
+	tmp, _ := ioutil.TempDir("", "patch-store")
+	defer os.RemoveAll(tmp)
+	source, target := memory.NewMemDB(), memory.NewMemDB()
+	store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{MaxStoredPatches: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Stop()
+	patches := make([]merger.Patch, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		patches = append(patches, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+	}
+	if err := store.StoreBatch(patches); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Load(1000, 20); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPatchStoreStoreBatch(b *testing.B) {
+	tmp, _ := ioutil.TempDir("", "patch-store")
+	defer os.RemoveAll(tmp)
+	source, target := memory.NewMemDB(), memory.NewMemDB()
+	store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{MaxStoredPatches: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	patches := make([]merger.Patch, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		patches = append(patches, newTestPatch(source, target, i, fmt.Sprintf("/file-%d", i)))
+	}
+	b.ResetTimer()
+	if err := store.StoreBatch(patches); err != nil {
+		b.Fatal(err)
+	}
+	store.Stop()
+}
@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2019. Abstrium SAS <team (at) pydio.com>
+ * This file is part of Pydio Cells.
+ *
+ * Pydio Cells is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Pydio Cells is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Pydio Cells.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * The latest code can be found at <https://pydio.com>.
+ */
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/merger"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+// orderedTarget refuses to create a node whose parent does not exist yet, optionally waits latency on
+// each call and records the maximum number of concurrent calls.
+type orderedTarget struct {
+	*endpoint.MemoryEndpoint
+	latency time.Duration
+
+	sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (o *orderedTarget) enter(p string) error {
+	o.Lock()
+	o.running++
+	if o.running > o.maxRunning {
+		o.maxRunning = o.running
+	}
+	o.Unlock()
+	defer func() {
+		o.Lock()
+		o.running--
+		o.Unlock()
+	}()
+	<-time.After(o.latency)
+	if parent := path.Dir(p); parent != "/" {
+		if _, e := o.LoadNode(context.Background(), parent); e != nil {
+			return fmt.Errorf("parent of %s does not exist", p)
+		}
+	}
+	return nil
+}
+
+func (o *orderedTarget) CreateNode(ctx context.Context, node *tree.Node, updateIfExists bool) error {
+	if e := o.enter(node.Path); e != nil {
+		return e
+	}
+	return o.MemoryEndpoint.CreateNode(ctx, node, updateIfExists)
+}
+
+func (o *orderedTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	if e := o.enter(p); e != nil {
+		return nil, nil, nil, e
+	}
+	return o.MemoryEndpoint.GetWriterOn(cancel, p, targetSize)
+}
+
+// interruptedTarget loses the connection once, after failAfter bytes of an upload, and records the offset and the
+// number of bytes written by each upload attempt.
+type interruptedTarget struct {
+	*endpoint.MemoryEndpoint
+	failAfter int64
+
+	offsets []int64
+	written []int64
+}
+
+// interruptedWriter writes to the wrapped writer until its limit is reached. Once failed, it is not closed so that
+// the upload is neither committed nor cancelled.
+type interruptedWriter struct {
+	io.WriteCloser
+	t       *interruptedTarget
+	attempt int
+	limit   int64
+	failed  bool
+}
+
+func (f *interruptedWriter) Write(p []byte) (int, error) {
+	if f.limit >= 0 && f.t.written[f.attempt]+int64(len(p)) > f.limit {
+		n, _ := f.WriteCloser.Write(p[:f.limit-f.t.written[f.attempt]])
+		f.t.written[f.attempt] += int64(n)
+		f.failed = true
+		return n, fmt.Errorf("connection lost")
+	}
+	n, e := f.WriteCloser.Write(p)
+	f.t.written[f.attempt] += int64(n)
+	return n, e
+}
+
+func (f *interruptedWriter) Close() error {
+	if f.failed {
+		return fmt.Errorf("connection lost")
+	}
+	return f.WriteCloser.Close()
+}
+
+func (f *interruptedTarget) wrap(w io.WriteCloser, offset int64) io.WriteCloser {
+	f.offsets = append(f.offsets, offset)
+	f.written = append(f.written, 0)
+	fw := &interruptedWriter{WriteCloser: w, t: f, attempt: len(f.written) - 1, limit: f.failAfter}
+	f.failAfter = -1
+	return fw
+}
+
+func (f *interruptedTarget) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	w, done, errs, e := f.MemoryEndpoint.GetWriterOn(cancel, p, targetSize)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	return f.wrap(w, 0), done, errs, nil
+}
+
+func (f *interruptedTarget) GetWriterAt(ctx context.Context, p string, targetSize int64, offset int64) (io.WriteCloser, chan bool, chan error, error) {
+	w, done, errs, e := f.MemoryEndpoint.GetWriterAt(ctx, p, targetSize, offset)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	return f.wrap(w, offset), done, errs, nil
+}
+
+// newProcessorPatch creates a source holding nested folders and files, and a patch creating them on target.
+func newProcessorPatch(target model.PathSyncTarget, folders, files int) merger.Patch {
+	ctx := context.Background()
+	source := endpoint.NewMemoryEndpoint()
+	patch := merger.NewPatch(source, target, merger.PatchOptions{})
+	for i := 0; i < folders; i++ {
+		for _, p := range []string{fmt.Sprintf("/folder-%d", i), fmt.Sprintf("/folder-%d/sub", i)} {
+			node := &tree.Node{Path: p, Type: tree.NodeType_COLLECTION, Uuid: p}
+			source.CreateNode(ctx, node, false)
+			patch.Enqueue(merger.NewOperation(merger.OpCreateFolder, model.EventInfo{Path: p}, node))
+			for j := 0; j < files; j++ {
+				fp := fmt.Sprintf("%s/file-%d", p, j)
+				writeContent(source, fp, []byte("content of "+fp))
+				node, _ := source.LoadNode(ctx, fp)
+				patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: fp}, node))
+			}
+		}
+	}
+	return patch
+}
+
+// listContents returns all nodes of target with the content of its files.
+func listContents(target *endpoint.MemoryEndpoint) map[string]string {
+	contents := make(map[string]string)
+	target.Walk(func(p string, node *tree.Node, err error) {
+		data, _ := target.Content(p)
+		contents["/"+strings.TrimLeft(p, "/")] = string(data)
+	}, "/", true)
+	return contents
+}
+
+func TestParallelProcessor(t *testing.T) {
+
+	Convey("Test parallel application respects ordering constraints", t, func() {
+		target := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint(), latency: 10 * time.Millisecond}
+		patch := newProcessorPatch(target, 4, 5)
+		cmd := model.NewCommand()
+		defer cmd.Stop()
+		endpoint.NewParallelProcessor(8).Process(patch, cmd)
+
+		errs, has := patch.HasErrors()
+		So(errs, ShouldBeEmpty)
+		So(has, ShouldBeFalse)
+		So(target.maxRunning, ShouldBeGreaterThan, 1)
+		So(target.maxRunning, ShouldBeLessThanOrEqualTo, 8)
+		data, ok := target.Content("/folder-2/sub/file-3")
+		So(ok, ShouldBeTrue)
+		So(string(data), ShouldEqual, "content of /folder-2/sub/file-3")
+
+		Convey("Test results match serial application", func() {
+			serial := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint()}
+			serialPatch := newProcessorPatch(serial, 4, 5)
+			endpoint.NewParallelProcessor(1).Process(serialPatch, cmd)
+			So(serial.maxRunning, ShouldEqual, 1)
+			So(listContents(target.MemoryEndpoint), ShouldResemble, listContents(serial.MemoryEndpoint))
+		})
+
+		Convey("Test serial application keeps the reasons explained before applying", func() {
+			serial := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint()}
+			explained := endpoint.ExplainPatch(context.Background(), newProcessorPatch(serial, 1, 1))
+			endpoint.NewParallelProcessor(1).Process(explained, cmd)
+			_, has := explained.HasErrors()
+			So(has, ShouldBeFalse)
+			var reasons int
+			explained.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+				reason, ok := endpoint.OperationReasonOf(explained, op)
+				So(ok, ShouldBeTrue)
+				So(reason.Comparison, ShouldEqual, endpoint.ComparisonExistence)
+				reasons++
+			})
+			So(reasons, ShouldEqual, 4)
+		})
+
+		Convey("Test chained moves are applied in dependency order", func() {
+			chained := func(workers int) *endpoint.MemoryEndpoint {
+				moved := endpoint.NewMemoryEndpoint()
+				for _, p := range []string{"/a", "/b", "/c"} {
+					writeContent(moved, p, []byte("content of "+p))
+				}
+				patch := merger.NewPatch(endpoint.NewMemoryEndpoint(), moved, merger.PatchOptions{})
+				for _, m := range [][2]string{{"/a", "/b"}, {"/b", "/c"}, {"/c", "/d"}} {
+					patch.Enqueue(merger.NewOperation(merger.OpMoveFile, model.EventInfo{Path: m[1]}, &tree.Node{Path: m[0], Type: tree.NodeType_LEAF}))
+				}
+				endpoint.NewParallelProcessor(workers).Process(patch, cmd)
+				_, has := patch.HasErrors()
+				So(has, ShouldBeFalse)
+				return moved
+			}
+			parallel, serial := chained(8), chained(1)
+			So(listContents(parallel), ShouldResemble, listContents(serial))
+			data, _ := parallel.Content("/d")
+			So(string(data), ShouldEqual, "content of /c")
+			data, _ = parallel.Content("/b")
+			So(string(data), ShouldEqual, "content of /a")
+			_, ok := parallel.Content("/a")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Test errors are set on each failed operation", func() {
+			broken := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint()}
+			failing := merger.NewPatch(endpoint.NewMemoryEndpoint(), broken, merger.PatchOptions{})
+			for _, p := range []string{"/missing/a", "/missing/b"} {
+				failing.Enqueue(merger.NewOperation(merger.OpCreateFolder, model.EventInfo{Path: p}, &tree.Node{Path: p, Type: tree.NodeType_COLLECTION}))
+			}
+			failing.Enqueue(merger.NewOperation(merger.OpCreateFolder, model.EventInfo{Path: "/ok"}, &tree.Node{Path: "/ok", Type: tree.NodeType_COLLECTION}))
+			endpoint.NewParallelProcessor(4).Process(failing, cmd)
+
+			var failed []string
+			failing.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+				if status := op.GetStatus(); status != nil && status.IsError() {
+					failed = append(failed, op.GetRefPath())
+				}
+			})
+			sort.Strings(failed)
+			So(failed, ShouldResemble, []string{"/missing/a", "/missing/b"})
+		})
+
+		Convey("Test files are not created without content transfer", func() {
+			source := struct{ model.PathSyncSource }{endpoint.NewMemoryEndpoint()}
+			plain := endpoint.NewMemoryEndpoint()
+			patch := merger.NewPatch(source, plain, merger.PatchOptions{})
+			patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/file"}, &tree.Node{Path: "/file", Type: tree.NodeType_LEAF}))
+			endpoint.NewParallelProcessor(1).Process(patch, cmd)
+			errs, has := patch.HasErrors()
+			So(has, ShouldBeTrue)
+			So(errs[0].Error(), ShouldContainSubstring, "source cannot provide contents")
+			_, e := plain.LoadNode(context.Background(), "/file")
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Test statuses are published and interruptions stop processing", func() {
+			interrupted := model.NewCommand()
+			defer interrupted.Stop()
+			serial := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint()}
+			patch := newProcessorPatch(serial, 1, 4)
+			processor := endpoint.NewParallelProcessor(1)
+			var statuses []model.Status
+			processor.OnStatus = func(status model.Status) {
+				statuses = append(statuses, status)
+				if len(statuses) == 2 {
+					interrupted.Publish(model.Interrupt)
+					<-time.After(50 * time.Millisecond)
+				}
+			}
+			processor.Process(patch, interrupted)
+			So(statuses, ShouldHaveLength, 2)
+			So(statuses[0].Node(), ShouldNotBeNil)
+			So(statuses[1].Progress(), ShouldBeGreaterThan, statuses[0].Progress())
+			var skipped int
+			patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+				if status := op.GetStatus(); status != nil && status.IsError() && status.Error() == endpoint.ErrInterrupted {
+					skipped++
+				}
+			})
+			So(skipped, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Test transferred bytes are reported", func() {
+			counted := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint()}
+			patch := newProcessorPatch(counted, 2, 3)
+			processor := endpoint.NewParallelProcessor(4)
+			var transferred int64
+			processor.OnTransferred = func(bytes int64) {
+				atomic.AddInt64(&transferred, bytes)
+			}
+			processor.Process(patch, cmd)
+			So(transferred, ShouldBeGreaterThan, 0)
+			So(transferred, ShouldEqual, endpoint.SummarizePatch(patch).Bytes)
+		})
+	})
+}
+
+func TestTargetVersions(t *testing.T) {
+
+	Convey("Test concurrent target modifications raise conflicts", t, func() {
+		ctx := context.Background()
+		source, target := endpoint.NewMemoryEndpoint(), endpoint.NewMemoryEndpoint()
+		So(writeContent(source, "/doc", []byte("local edit")), ShouldBeNil)
+		So(writeContent(source, "/other", []byte("other edit")), ShouldBeNil)
+		So(writeContent(target, "/doc", []byte("original")), ShouldBeNil)
+		So(writeContent(target, "/other", []byte("original")), ShouldBeNil)
+
+		patch := merger.NewPatch(source, target, merger.PatchOptions{})
+		for _, p := range []string{"/doc", "/other"} {
+			node, _ := source.LoadNode(ctx, p)
+			patch.Enqueue(merger.NewOperation(merger.OpUpdateFile, model.EventInfo{Path: p}, node))
+		}
+		versions := endpoint.CaptureTargetVersions(ctx, patch)
+
+		// The remote file changes before the patch is applied
+		So(writeContent(target, "/doc", []byte("remote edit")), ShouldBeNil)
+
+		cmd := model.NewCommand()
+		defer cmd.Stop()
+		endpoint.NewParallelProcessor(2).ProcessWithVersions(patch, cmd, versions)
+
+		data, _ := target.Content("/doc")
+		So(string(data), ShouldEqual, "remote edit")
+		data, _ = target.Content("/other")
+		So(string(data), ShouldEqual, "other edit")
+
+		var conflicts []string
+		var failed []string
+		patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+			if op.Type() == merger.OpConflict {
+				conflicts = append(conflicts, op.GetRefPath())
+			} else if status := op.GetStatus(); status != nil && status.IsError() {
+				failed = append(failed, op.GetRefPath())
+				So(status.Error(), ShouldEqual, endpoint.ErrTargetChanged)
+			}
+		})
+		So(conflicts, ShouldResemble, []string{"/doc"})
+		So(failed, ShouldResemble, []string{"/doc"})
+	})
+}
+
+func TestResumableTransfers(t *testing.T) {
+
+	Convey("Test interrupted uploads resume from the committed offset", t, func() {
+		ctx := context.Background()
+		tmp, _ := ioutil.TempDir("", "patch-store")
+		defer os.RemoveAll(tmp)
+		content := strings.Repeat("0123456789", 100)
+		source := endpoint.NewMemoryEndpoint()
+		So(writeContent(source, "/big", []byte(content)), ShouldBeNil)
+		node, _ := source.LoadNode(ctx, "/big")
+		newPatch := func(target model.PathSyncTarget) merger.Patch {
+			patch := merger.NewPatch(source, target, merger.PatchOptions{})
+			patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.EventInfo{Path: "/big"}, node))
+			return patch
+		}
+		cmd := model.NewCommand()
+		defer cmd.Stop()
+
+		target := &interruptedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint(), failAfter: 400}
+		processor := endpoint.NewParallelProcessor(1)
+		store, err := endpoint.NewPatchStoreWithOptions(tmp, source, target, endpoint.PatchStoreOptions{Processor: processor})
+		So(err, ShouldBeNil)
+		defer store.Stop()
+		So(processor.Offsets, ShouldEqual, store)
+
+		first := newPatch(target)
+		processor.Process(first, cmd)
+		_, has := first.HasErrors()
+		So(has, ShouldBeTrue)
+		So(store.TransferOffset("/big", node.Etag), ShouldEqual, 400)
+		So(store.TransferOffset("/big", "other-etag"), ShouldEqual, 0)
+		_, ok := target.Content("/big")
+		So(ok, ShouldBeFalse)
+
+		second := newPatch(target)
+		processor.Process(second, cmd)
+		errs, has := second.HasErrors()
+		So(errs, ShouldBeEmpty)
+		So(has, ShouldBeFalse)
+		So(target.offsets, ShouldResemble, []int64{0, 400})
+		So(target.written, ShouldResemble, []int64{400, 600})
+		data, _ := target.Content("/big")
+		So(string(data), ShouldEqual, content)
+		So(store.TransferOffset("/big", node.Etag), ShouldEqual, 0)
+
+		Convey("Test targets without range writes upload whole files again", func() {
+			flaky := &interruptedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint(), failAfter: 400}
+			plain := struct{ model.DataSyncTarget }{flaky}
+			for i := 0; i < 2; i++ {
+				processor.Process(newPatch(plain), cmd)
+			}
+			So(flaky.offsets, ShouldResemble, []int64{0, 0})
+			So(flaky.written, ShouldResemble, []int64{400, 1000})
+			data, _ := flaky.Content("/big")
+			So(string(data), ShouldEqual, content)
+		})
+
+		Convey("Test wrapped targets resume uploads", func() {
+			interrupted := &interruptedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint(), failAfter: 300}
+			wrapped := endpoint.NewRetryTarget(interrupted, endpoint.RetryOptions{})
+			_, ok := wrapped.(endpoint.RangeSyncTarget)
+			So(ok, ShouldBeTrue)
+			for i := 0; i < 2; i++ {
+				processor.Process(newPatch(wrapped), cmd)
+			}
+			So(interrupted.offsets, ShouldResemble, []int64{0, 300})
+			data, _ := interrupted.Content("/big")
+			So(string(data), ShouldEqual, content)
+
+			_, ok = endpoint.NewRetryTarget(struct{ model.DataSyncTarget }{interrupted}, endpoint.RetryOptions{}).(endpoint.RangeSyncTarget)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func benchmarkParallelProcessor(b *testing.B, workers int) {
+	cmd := model.NewCommand()
+	defer cmd.Stop()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		target := &orderedTarget{MemoryEndpoint: endpoint.NewMemoryEndpoint(), latency: 5 * time.Millisecond}
+		patch := newProcessorPatch(target, 2, 20)
+		b.StartTimer()
+		endpoint.NewParallelProcessor(workers).Process(patch, cmd)
+	}
+}
+
+func BenchmarkParallelProcessorSerial(b *testing.B) {
+	benchmarkParallelProcessor(b, 1)
+}
+
+func BenchmarkParallelProcessorEightWorkers(b *testing.B) {
+	benchmarkParallelProcessor(b, 8)
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells/common/proto/tree"
+	"github.com/pydio/cells/common/sync/endpoints/memory"
+	"github.com/pydio/cells/common/sync/model"
+)
+
+func TestProgressSocket(t *testing.T) {
+
+	Convey("Test progress frames are streamed over WebSocket", t, func() {
+		socket := control.NewProgressSocket()
+		defer socket.Close()
+		server := httptest.NewServer(socket)
+		defer server.Close()
+
+		conn, _, e := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		So(e, ShouldBeNil)
+		defer conn.Close()
+		<-time.After(100 * time.Millisecond)
+
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		patch := newTestPatch(source, target, 0, "/a", "/b")
+		tracker := control.NewProgressTracker("sync-uuid")
+		tracker.Status(model.NewProcessingStatus("Created /a").SetNode(&tree.Node{Path: "/a"}).SetProgress(0.5))
+		tracker.Status(model.NewProcessingStatus("Created /b").SetNode(&tree.Node{Path: "/b"}).SetProgress(1))
+		tracker.Done(patch)
+
+		var frames []control.ProgressMessage
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for len(frames) < 3 {
+			_, data, er := conn.ReadMessage()
+			So(er, ShouldBeNil)
+			var msg control.ProgressMessage
+			So(json.Unmarshal(data, &msg), ShouldBeNil)
+			frames = append(frames, msg)
+		}
+		So(frames[0].CurrentFile, ShouldEqual, "/a")
+		So(frames[0].Processed, ShouldEqual, 1)
+		So(frames[0].Total, ShouldEqual, 2)
+		So(frames[1].CurrentFile, ShouldEqual, "/b")
+		So(frames[1].Processed, ShouldEqual, 2)
+		So(frames[2].Done, ShouldBeTrue)
+		So(frames[2].SyncUUID, ShouldEqual, "sync-uuid")
+		So(frames[2].Total, ShouldEqual, 2)
+	})
+
+	Convey("Test disconnected clients do not block publication", t, func() {
+		socket := control.NewProgressSocket()
+		defer socket.Close()
+		server := httptest.NewServer(socket)
+		defer server.Close()
+
+		conn, _, e := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		So(e, ShouldBeNil)
+		conn.Close()
+
+		tracker := control.NewProgressTracker("sync-uuid")
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 500; i++ {
+				tracker.Status(model.NewProcessingStatus("Processing").SetProgress(float32(i) / 500))
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			So("publication blocked", ShouldBeEmpty)
+		}
+	})
+
+	Convey("Test throughput and ETA computation", t, func() {
+		now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+		tracker := control.NewProgressTracker("sync-uuid")
+		tracker.Now = func() time.Time { return now }
+
+		// Content transfers: ETA based on bytes
+		tracker.Start(10, 1000)
+		now = now.Add(time.Second)
+		tracker.Transferred(100)
+		status := tracker.JobStatus()
+		So(status.Throughput, ShouldEqual, 100)
+		So(status.ETA, ShouldEqual, 9*time.Second)
+		now = now.Add(time.Second)
+		tracker.Transferred(300)
+		status = tracker.JobStatus()
+		So(status.Throughput, ShouldEqual, 200)
+		So(status.ETA, ShouldEqual, 3*time.Second)
+
+		// Structural patch: ETA based on operations
+		tracker.Start(10, 0)
+		now = now.Add(2 * time.Second)
+		tracker.Status(model.NewProcessingStatus("Moved /a").SetNode(&tree.Node{Path: "/a"}))
+		status = tracker.JobStatus()
+		So(status.Processed, ShouldEqual, 1)
+		So(status.Throughput, ShouldEqual, 0)
+		So(status.ETA, ShouldEqual, 18*time.Second)
+		So(status.Elapsed, ShouldEqual, 2*time.Second)
+
+		// Done reports the total duration
+		now = now.Add(2200 * time.Millisecond)
+		source, target := memory.NewMemDB(), memory.NewMemDB()
+		So(tracker.Done(newTestPatch(source, target, 0)), ShouldEqual, 4200*time.Millisecond)
+		So(tracker.JobStatus().Elapsed, ShouldEqual, 0)
+	})
+
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+func TestWindowSchedule(t *testing.T) {
+
+	// 2019-06-03 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2019, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	Convey("Test a window crossing midnight on week days", t, func() {
+		s, err := control.NewWindowSchedule([]*config.SyncWindow{
+			{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: "22:00", End: "06:00"},
+		})
+		So(err, ShouldBeNil)
+		s.Location = time.UTC
+
+		So(s.Active(at(3, 21, 59)), ShouldBeFalse)
+		So(s.Active(at(3, 22, 0)), ShouldBeTrue)
+		So(s.Active(at(4, 5, 59)), ShouldBeTrue)
+		So(s.Active(at(4, 6, 0)), ShouldBeFalse)
+		// Tuesday window ends on Wednesday morning, no window starts on Wednesday
+		So(s.Active(at(5, 3, 0)), ShouldBeTrue)
+		So(s.Active(at(5, 23, 0)), ShouldBeFalse)
+
+		So(s.NextChange(at(3, 12, 30)), ShouldResemble, at(3, 22, 0))
+		So(s.NextChange(at(3, 22, 0)), ShouldResemble, at(4, 6, 0))
+		So(s.NextChange(at(5, 6, 0)), ShouldResemble, at(10, 22, 0))
+	})
+
+	Convey("Test schedules without windows or with invalid times", t, func() {
+		s, err := control.NewWindowSchedule(nil)
+		So(err, ShouldBeNil)
+		So(s.Active(at(3, 12, 0)), ShouldBeTrue)
+		So(s.NextChange(at(3, 12, 0)).IsZero(), ShouldBeTrue)
+
+		_, err = control.NewWindowSchedule([]*config.SyncWindow{{Start: "25:00", End: "06:00"}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Test the scheduler notifies tasks at window boundaries", t, func() {
+		// Schedules built from the configuration use the local time
+		local := func(day, hour, min int) time.Time {
+			return time.Date(2019, 6, day, hour, min, 0, 0, time.Local)
+		}
+		lock := &sync.Mutex{}
+		now := local(3, 21, 59)
+		waits := make(chan time.Duration, 10)
+		ticks := make(chan time.Time)
+		task := &config.Task{Uuid: "windows-task", Label: "windows", SyncWindows: []*config.SyncWindow{
+			{Days: []time.Weekday{time.Monday}, Start: "22:00", End: "06:00"},
+		}}
+		messages := control.GetBus().Sub(control.TopicSync_ + task.Uuid)
+		defer control.GetBus().Unsub(messages)
+
+		s := control.NewScheduler([]*config.Task{task})
+		s.Clock = endpoint.ClockFunc(func() time.Time {
+			lock.Lock()
+			defer lock.Unlock()
+			return now
+		})
+		s.After = func(d time.Duration) <-chan time.Time {
+			waits <- d
+			return ticks
+		}
+		go s.Serve()
+		defer s.Stop()
+
+		// Nothing is published before the first boundary, the syncer checks its windows when it starts
+		So(<-waits, ShouldEqual, time.Minute)
+		select {
+		case m := <-messages:
+			So(m, ShouldBeNil)
+		default:
+		}
+
+		lock.Lock()
+		now = local(3, 22, 0)
+		lock.Unlock()
+		ticks <- now
+		select {
+		case m := <-messages:
+			So(m, ShouldEqual, control.MessageSyncWindow)
+		case <-time.After(time.Second):
+			So("no message", ShouldBeEmpty)
+		}
+		So(<-waits, ShouldEqual, 8*time.Hour)
+	})
+
+}